@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	problemMissingObject  = "missing_object"
+	problemOrphanedObject = "orphaned_object"
+)
+
+// operational subcommands run once against the configured table and
+// bucket instead of serving, e.g. ./main -bucket assets reconcile
+var adminCommands = map[string]func(args []string) error{
+	"gc-run":          runGC,
+	"reconcile":       runReconcile,
+	"export-metadata": runExportMetadata,
+	"adopt-orphans":   runAdoptOrphans,
+	"iam-token":       runIAMToken,
+}
+
+// where admin subcommands write their results, as JSON lines
+var adminOutput io.Writer = os.Stdout
+
+// an asset whose record and object disagree
+type reconcileFinding struct {
+	ID      string `json:"id"`
+	Problem string `json:"problem"`
+}
+
+func runAdminCommand(args []string) error {
+	command, ok := adminCommands[args[0]]
+	if !ok {
+		var names []string
+		for name := range adminCommands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown command '%s', must be one of %s", args[0], strings.Join(names, ", "))
+	}
+	return command(args[1:])
+}
+
+func noAdminArgs(name string, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("%s takes no arguments, got %s", name, strings.Join(args, " "))
+	}
+	return nil
+}
+
+// records and objects of other kinds share the table and bucket with
+// assets, and none are named like an asset id
+func isAssetKey(key string) bool {
+	return key != "" && !strings.ContainsAny(key, ":/.")
+}
+
+// calls fn with every asset record in the table, stopping at its first error
+func scanAssets(fn func(item map[string]*dynamodb.AttributeValue) error) error {
+	var failed error
+	err := dbSvc.ScanPages(&dynamodb.ScanInput{TableName: aws.String(tableName)}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			if !isAssetKey(stringAttribute(item, "id")) {
+				continue
+			}
+			if failed = fn(item); failed != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return failed
+}
+
+// the gc-run subcommand, which runs each cleanup sweep once whether or not
+// the server runs it in the background
+func runGC(args []string) error {
+	if err := noAdminArgs("gc-run", args); err != nil {
+		return err
+	}
+	sweeps := []struct {
+		name string
+		run  func() error
+	}{
+		{"reservation reaper", reapReservations},
+		{"expiry sweep", sweepExpired},
+		{"purge sweep", purgeDeleted},
+		{"gc sweep", collectMarked},
+		{"scheduled deletions", runScheduledDeletions},
+		{"multipart sweep", abortStaleMultipartUploads},
+		{"bundle sweep", deleteOldBundles},
+	}
+	var failed error
+	for _, sweep := range sweeps {
+		if err := sweep.run(); err != nil {
+			log.Printf("%s: %s", sweep.name, err.Error())
+			failed = fmt.Errorf("%s failed", sweep.name)
+			continue
+		}
+		log.Printf("%s done", sweep.name)
+	}
+	return failed
+}
+
+// the reconcile subcommand, which lists uploaded assets missing their
+// object and objects with no asset record
+func runReconcile(args []string) error {
+	if err := noAdminArgs("reconcile", args); err != nil {
+		return err
+	}
+	findings, err := findDiscrepancies()
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(adminOutput)
+	for _, finding := range findings {
+		if err := encoder.Encode(finding); err != nil {
+			return err
+		}
+	}
+	log.Printf("found %d discrepancies", len(findings))
+	return nil
+}
+
+func findDiscrepancies() ([]reconcileFinding, error) {
+	started := time.Now()
+	recorded := map[string]bool{}
+	var findings []reconcileFinding
+	err := scanAssets(func(item map[string]*dynamodb.AttributeValue) error {
+		assetID := stringAttribute(item, "id")
+		recorded[assetID] = true
+		if stringAttribute(item, "status") != assetStatusUploaded {
+			return nil
+		}
+		_, err := s3Svc.HeadObject(&s3.HeadObjectInput{
+			Bucket:    aws.String(bucketName),
+			Key:       aws.String(objectKey(assetID, item)),
+			VersionId: optionalString(stringAttribute(item, "s3_version_id")),
+		})
+		if isObjectMissing(err) {
+			findings = append(findings, reconcileFinding{ID: assetID, Problem: problemMissingObject})
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = s3Svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{Bucket: aws.String(bucketName)}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			key := aws.StringValue(object.Key)
+			// objects uploaded since the scan can belong to records it missed
+			if !isAssetKey(key) || recorded[key] || aws.TimeValue(object.LastModified).After(started) {
+				continue
+			}
+			findings = append(findings, reconcileFinding{ID: key, Problem: problemOrphanedObject})
+		}
+		return true
+	})
+	return findings, err
+}
+
+// the export-metadata subcommand, which writes every asset record
+func runExportMetadata(args []string) error {
+	if err := noAdminArgs("export-metadata", args); err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(adminOutput)
+	count := 0
+	err := scanAssets(func(item map[string]*dynamodb.AttributeValue) error {
+		count++
+		return encoder.Encode(describeAsset(item))
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("exported %d assets", count)
+	return nil
+}
+
+// the adopt-orphans subcommand, which records objects that have no asset
+// record as uploaded assets described by their object's headers
+func runAdoptOrphans(args []string) error {
+	fs := flag.NewFlagSet("adopt-orphans", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "List the orphans that would be adopted without recording them.")
+	fs.Parse(args)
+
+	findings, err := findDiscrepancies()
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(adminOutput)
+	adopted := 0
+	for _, finding := range findings {
+		if finding.Problem != problemOrphanedObject {
+			continue
+		}
+		if !*dryRun {
+			if err := adoptOrphan(finding.ID); err != nil {
+				if isConditionFailed(err) {
+					continue
+				}
+				return err
+			}
+		}
+		if err := encoder.Encode(finding); err != nil {
+			return err
+		}
+		adopted++
+	}
+	log.Printf("adopted %d orphans", adopted)
+	return nil
+}
+
+// records an object as an uploaded asset, unless a record turned up since
+// it was found
+func adoptOrphan(assetID string) error {
+	head, err := s3Svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(assetID),
+	})
+	if err != nil {
+		return err
+	}
+	item := assetKey(assetID)
+	item["status"] = &dynamodb.AttributeValue{S: aws.String(assetStatusUploaded)}
+	item["changes_shard"] = &dynamodb.AttributeValue{S: aws.String(changesShard(assetID))}
+	item["created_at"] = updatedAtValue()
+	item["updated_at"] = item["created_at"]
+	item["uploaded_at"] = item["created_at"]
+	if contentType := aws.StringValue(head.ContentType); contentType != "" {
+		item["content_type"] = &dynamodb.AttributeValue{S: aws.String(contentType)}
+	}
+	if cacheControl := aws.StringValue(head.CacheControl); cacheControl != "" {
+		item["cache_control"] = &dynamodb.AttributeValue{S: aws.String(cacheControl)}
+	}
+	if len(head.Metadata) > 0 {
+		// S3 canonicalizes metadata names, which are recorded in lower case
+		metadata := map[string]string{}
+		for k, v := range head.Metadata {
+			metadata[strings.ToLower(k)] = aws.StringValue(v)
+		}
+		item["metadata"] = metadataAttribute(metadata)
+	}
+	if versionID := aws.StringValue(head.VersionId); versionID != "" && versionID != "null" {
+		item["s3_version_id"] = &dynamodb.AttributeValue{S: aws.String(versionID)}
+		item["versions"] = &dynamodb.AttributeValue{SS: aws.StringSlice([]string{versionID})}
+	}
+	for k, v := range encryptionAttributes(assetID) {
+		item[k] = v
+	}
+	_, err = dbSvc.PutItem(&dynamodb.PutItemInput{
+		Item:                item,
+		TableName:           aws.String(tableName),
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	})
+	if err != nil {
+		return err
+	}
+	return recordVersion(assetID, item)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// a table with an uploaded asset, a reservation and records of other kinds
+type mockDBScannedClient struct {
+	mockDBClient
+	put []string
+}
+
+func (m *mockDBScannedClient) ScanPages(input *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool) error {
+	fn(&dynamodb.ScanOutput{Items: []map[string]*dynamodb.AttributeValue{
+		{"id": {S: aws.String("uploadedID")}, "status": {S: aws.String(assetStatusUploaded)}, "content_type": {S: aws.String("image/png")}},
+		{"id": {S: aws.String("missingID")}, "status": {S: aws.String(assetStatusUploaded)}},
+		{"id": {S: aws.String("reservedID")}},
+		{"id": {S: aws.String("alias:someAlias")}},
+	}}, true)
+	return nil
+}
+func (m *mockDBScannedClient) ScanPagesWithContext(ctx aws.Context, input *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool, opts ...request.Option) error {
+	return m.ScanPages(input, fn)
+}
+
+func (m *mockDBScannedClient) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	m.put = append(m.put, *input.Item["id"].S)
+	return &dynamodb.PutItemOutput{}, nil
+}
+func (m *mockDBScannedClient) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	return m.PutItem(input)
+}
+
+// a bucket missing one uploaded asset's object and holding an orphan
+type mockS3ListedClient struct {
+	mockS3Client
+}
+
+func (m *mockS3ListedClient) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	if *input.Key == "missingID" {
+		return nil, awserr.NewRequestFailure(awserr.New("NotFound", "Not Found", nil), http.StatusNotFound, "")
+	}
+	return &s3.HeadObjectOutput{ContentType: aws.String("image/png"), Metadata: map[string]*string{"Owner": aws.String("someone")}}, nil
+}
+func (m *mockS3ListedClient) HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	return m.HeadObject(input)
+}
+
+func (m *mockS3ListedClient) ListObjectsV2Pages(input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	old := time.Now().Add(-time.Hour)
+	fn(&s3.ListObjectsV2Output{Contents: []*s3.Object{
+		{Key: aws.String("uploadedID"), LastModified: &old},
+		{Key: aws.String("orphanID"), LastModified: &old},
+		{Key: aws.String("reservedID.tus-tail"), LastModified: &old},
+		{Key: aws.String("bundles/someJob.zip"), LastModified: &old},
+	}}, true)
+	return nil
+}
+
+func TestReconcile(t *testing.T) {
+	dbSvc = &mockDBScannedClient{}
+	s3Svc = &mockS3ListedClient{}
+	findings, err := findDiscrepancies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []reconcileFinding{{"missingID", problemMissingObject}, {"orphanID", problemOrphanedObject}}
+	if len(findings) != len(want) || findings[0] != want[0] || findings[1] != want[1] {
+		t.Errorf("Incorrect discrepancies: %v", findings)
+	}
+}
+
+func TestAdoptOrphans(t *testing.T) {
+	db := &mockDBScannedClient{}
+	dbSvc = db
+	s3Svc = &mockS3ListedClient{}
+	var out bytes.Buffer
+	adminOutput = &out
+
+	if err := runAdminCommand([]string{"adopt-orphans", "-dry-run"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.put) != 0 {
+		t.Errorf("Dry run recorded orphans: %v", db.put)
+	}
+	if err := runAdminCommand([]string{"adopt-orphans"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.put) != 1 || db.put[0] != "orphanID" {
+		t.Errorf("Orphan not adopted: %v", db.put)
+	}
+	var finding reconcileFinding
+	if err := json.NewDecoder(&out).Decode(&finding); err != nil || finding.ID != "orphanID" {
+		t.Errorf("Orphan not listed: %s", out.String())
+	}
+}
+
+func TestExportMetadata(t *testing.T) {
+	dbSvc = &mockDBScannedClient{}
+	var out bytes.Buffer
+	adminOutput = &out
+	if err := runAdminCommand([]string{"export-metadata"}); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Didn't export each asset record once: %s", out.String())
+	}
+	var asset assetMeta
+	if err := json.Unmarshal([]byte(lines[0]), &asset); err != nil || asset.ID != "uploadedID" || asset.ContentType != "image/png" {
+		t.Errorf("Incorrect export: %s", lines[0])
+	}
+}
+
+func TestUnknownAdminCommand(t *testing.T) {
+	if err := runAdminCommand([]string{"frobnicate"}); err == nil {
+		t.Error("Unknown command accepted")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// aliases are reserved in the assets table under this key prefix, which
+// lets a conditional write keep each one unique
+const aliasKeyPrefix = "alias:"
+
+var aliasPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// the reservation record of an alias
+func aliasKey(alias string) map[string]*dynamodb.AttributeValue {
+	return assetKey(aliasKeyPrefix + alias)
+}
+
+// attaches (POST ?name=) or detaches (DELETE) an asset's alias
+func handleAliasRequest(w http.ResponseWriter, r *http.Request, assetID string) {
+	alias := strings.ToLower(r.URL.Query().Get("name"))
+	if r.Method == http.MethodPost && !aliasPattern.MatchString(alias) {
+		http.Error(w, "Invalid argument for name, must be 1 to 63 letters, digits or dashes.", http.StatusBadRequest)
+		return
+	}
+	item, ok := fetchAsset(w, r, assetID)
+	if !ok {
+		return
+	}
+	previous := stringAttribute(item, "alias")
+	if r.Method == http.MethodDelete && previous == "" {
+		http.Error(w, fmt.Sprintf("Asset id '%s' has no alias.", assetID), http.StatusNotFound)
+		return
+	}
+
+	// the asset update comes first so its failure can be told apart
+	values := lockConditionValues(r)
+	values[":updated"] = updatedAtValue()
+	update := &dynamodb.Update{
+		Key:                       assetKey(assetID),
+		TableName:                 aws.String(tableName),
+		UpdateExpression:          aws.String("SET updated_at = :updated REMOVE alias"),
+		ConditionExpression:       aws.String("attribute_exists(id) AND " + lockCondition),
+		ExpressionAttributeValues: values,
+	}
+	owned := map[string]*dynamodb.AttributeValue{":assetID": {S: aws.String(assetID)}}
+	items := []*dynamodb.TransactWriteItem{{Update: update}}
+	if r.Method == http.MethodPost {
+		values[":alias"] = &dynamodb.AttributeValue{S: aws.String(alias)}
+		update.UpdateExpression = aws.String("SET alias = :alias, updated_at = :updated")
+		items = append(items, &dynamodb.TransactWriteItem{Put: &dynamodb.Put{
+			Item: map[string]*dynamodb.AttributeValue{
+				"id":       {S: aws.String(aliasKeyPrefix + alias)},
+				"asset_id": {S: aws.String(assetID)},
+			},
+			TableName:                 aws.String(tableName),
+			ConditionExpression:       aws.String("attribute_not_exists(id) OR asset_id = :assetID"),
+			ExpressionAttributeValues: owned,
+		}})
+	}
+	if previous != "" && previous != alias {
+		items = append(items, &dynamodb.TransactWriteItem{Delete: &dynamodb.Delete{
+			Key:                       aliasKey(previous),
+			TableName:                 aws.String(tableName),
+			ConditionExpression:       aws.String("attribute_not_exists(id) OR asset_id = :assetID"),
+			ExpressionAttributeValues: owned,
+		}})
+	}
+
+	_, err := dbSvc.TransactWriteItemsWithContext(r.Context(), &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	if err != nil {
+		if cerr, ok := err.(*dynamodb.TransactionCanceledException); ok && len(cerr.CancellationReasons) > 1 {
+			if aws.StringValue(cerr.CancellationReasons[0].Code) == "ConditionalCheckFailed" {
+				http.Error(w, fmt.Sprintf("Asset id '%s' is locked.", assetID), http.StatusLocked)
+				return
+			}
+			if r.Method == http.MethodPost && aws.StringValue(cerr.CancellationReasons[1].Code) == "ConditionalCheckFailed" {
+				http.Error(w, fmt.Sprintf("Alias '%s' is taken.", alias), http.StatusConflict)
+				return
+			}
+		}
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// redirects an alias to a download url for its asset
+func serveAlias(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	alias := strings.ToLower(strings.TrimPrefix(r.URL.Path, "/a/"))
+	result, err := dbSvc.GetItemWithContext(r.Context(), &dynamodb.GetItemInput{
+		Key:       aliasKey(alias),
+		TableName: aws.String(tableName),
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	assetID := stringAttribute(result.Item, "asset_id")
+	if assetID == "" {
+		http.Error(w, fmt.Sprintf("Alias '%s' not found.", alias), http.StatusNotFound)
+		return
+	}
+	handleDownloadRedirect(w, r, assetID)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// an uploaded asset aliased as report, whose alias record points back at it
+type mockDBAliasClient struct {
+	mockDBClient
+	transaction []*dynamodb.TransactWriteItem
+	aliasTaken  bool
+}
+
+func (m *mockDBAliasClient) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	output, _ := m.mockDBClient.GetItem(input)
+	output.Item["alias"] = &dynamodb.AttributeValue{S: aws.String("report")}
+	output.Item["asset_id"] = &dynamodb.AttributeValue{S: aws.String("someID")}
+	return output, nil
+}
+func (m *mockDBAliasClient) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return m.GetItem(input)
+}
+
+func (m *mockDBAliasClient) TransactWriteItems(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+	m.transaction = input.TransactItems
+	if m.aliasTaken {
+		return nil, &dynamodb.TransactionCanceledException{
+			CancellationReasons: []*dynamodb.CancellationReason{
+				{Code: aws.String("None")},
+				{Code: aws.String("ConditionalCheckFailed")},
+			},
+		}
+	}
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
+func (m *mockDBAliasClient) TransactWriteItemsWithContext(ctx aws.Context, input *dynamodb.TransactWriteItemsInput, opts ...request.Option) (*dynamodb.TransactWriteItemsOutput, error) {
+	return m.TransactWriteItems(input)
+}
+
+func TestAliasRequest(t *testing.T) {
+	db := &mockDBAliasClient{}
+	dbSvc = db
+	r := httptest.NewRequest(http.MethodPost, "/asset/someID/alias?name=Quarterly-Report", nil)
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusNoContent {
+		t.Fatalf("Incorrect status setting an alias: %d", w.Result().StatusCode)
+	}
+	// updates the asset, reserves the new alias and frees the old one
+	if len(db.transaction) != 3 || *db.transaction[1].Put.Item["id"].S != "alias:quarterly-report" || *db.transaction[2].Delete.Key["id"].S != "alias:report" {
+		t.Errorf("Incorrect alias transaction: %v", db.transaction)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/asset/someID/alias?name=no/slashes", nil)
+	w = httptest.NewRecorder()
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("Didn't get 400 for an invalid alias: %d", w.Result().StatusCode)
+	}
+}
+func TestAliasRequestTaken(t *testing.T) {
+	dbSvc = &mockDBAliasClient{aliasTaken: true}
+	r := httptest.NewRequest(http.MethodPost, "/asset/someID/alias?name=taken", nil)
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusConflict {
+		t.Errorf("Didn't get 409 for a taken alias: %d", w.Result().StatusCode)
+	}
+}
+func TestServeAlias(t *testing.T) {
+	dbSvc = &mockDBAliasClient{}
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodGet, "/a/report", nil)
+	w := httptest.NewRecorder()
+
+	serveAlias(w, r)
+	if w.Result().StatusCode != http.StatusFound {
+		t.Errorf("Incorrect status following an alias: %d", w.Result().StatusCode)
+	}
+
+	dbSvc = &mockDBMissingKeyClient{}
+	w = httptest.NewRecorder()
+	serveAlias(w, r)
+	if w.Result().StatusCode != http.StatusNotFound {
+		t.Errorf("Didn't get 404 for a missing alias: %d", w.Result().StatusCode)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// how often download counts are written back, on average; zero disables
+// counting
+var downloadStatsInterval = 30 * time.Second
+
+// downloads of an asset since the last flush
+type downloadStats struct {
+	count        int64
+	lastAccessed int64
+}
+
+var downloadStatsMu sync.Mutex
+var pendingDownloadStats = map[string]*downloadStats{}
+
+// counts a download of an asset, to be written with the next flush
+func countDownload(assetID string) {
+	if downloadStatsInterval <= 0 {
+		return
+	}
+	downloadStatsMu.Lock()
+	defer downloadStatsMu.Unlock()
+	stats, ok := pendingDownloadStats[assetID]
+	if !ok {
+		stats = &downloadStats{}
+		pendingDownloadStats[assetID] = stats
+	}
+	stats.count++
+	stats.lastAccessed = time.Now().Unix()
+}
+
+// flushes download counts until stopped, then once more, jittering the
+// interval so that instances don't all write at once
+func watchDownloadStats(stop <-chan struct{}) {
+	for {
+		jitter := time.Duration(rand.Int63n(int64(downloadStatsInterval)))
+		if !pause(stop, downloadStatsInterval/2+jitter) {
+			flushDownloadStats()
+			return
+		}
+		flushDownloadStats()
+	}
+}
+
+// writes every asset's counts since the last flush in one update each,
+// keeping the counts that couldn't be written for next time
+func flushDownloadStats() {
+	downloadStatsMu.Lock()
+	pending := pendingDownloadStats
+	pendingDownloadStats = map[string]*downloadStats{}
+	downloadStatsMu.Unlock()
+
+	for assetID, stats := range pending {
+		_, err := dbSvc.UpdateItem(&dynamodb.UpdateItemInput{
+			Key:                 assetKey(assetID),
+			TableName:           aws.String(tableName),
+			UpdateExpression:    aws.String("ADD download_count :count SET last_accessed = :lastAccessed"),
+			ConditionExpression: aws.String("attribute_exists(id)"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":count":        {N: aws.String(strconv.FormatInt(stats.count, 10))},
+				":lastAccessed": {N: aws.String(strconv.FormatInt(stats.lastAccessed, 10))},
+			},
+		})
+		// deleted assets have nothing left to count
+		if err == nil || isConditionFailed(err) {
+			continue
+		}
+		log.Println(err.Error())
+		downloadStatsMu.Lock()
+		if current, ok := pendingDownloadStats[assetID]; ok {
+			current.count += stats.count
+		} else {
+			pendingDownloadStats[assetID] = stats
+		}
+		downloadStatsMu.Unlock()
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// records the counts written for each asset, failing the first write
+type mockDBStatsClient struct {
+	mockDBClient
+	failed bool
+	counts map[string]string
+}
+
+func (m *mockDBStatsClient) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	if !m.failed {
+		m.failed = true
+		return nil, errors.New("throttled")
+	}
+	m.counts[*input.Key["id"].S] = *input.ExpressionAttributeValues[":count"].N
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+func (m *mockDBStatsClient) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	return m.UpdateItem(input)
+}
+
+func TestFlushDownloadStats(t *testing.T) {
+	db := &mockDBStatsClient{counts: map[string]string{}}
+	dbSvc = db
+	pendingDownloadStats = map[string]*downloadStats{}
+	countDownload("someID")
+	countDownload("someID")
+	countDownload("someID")
+
+	// a failed write is kept and merged into the next flush
+	flushDownloadStats()
+	countDownload("someID")
+	flushDownloadStats()
+	if db.counts["someID"] != "4" {
+		t.Errorf("Incorrect download count written: %q", db.counts["someID"])
+	}
+	if len(pendingDownloadStats) != 0 {
+		t.Errorf("Download counts left after flushing: %v", pendingDownloadStats)
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	apiKeyHeader = "X-API-Key"
+	// how long a key found in the API keys table is trusted before it's
+	// looked up again, so revoking it takes at most this long
+	apiKeysRefresh = time.Minute
+)
+
+// names identify keys in logs
+var apiKeyNamePattern = regexp.MustCompile(`^[A-Za-z0-9._@-]{1,64}$`)
+
+// routes whose urls are credentials themselves, or public, and so are
+// served without a key
+var openRoutePrefixes = []string{"/download/", "/public/", "/a/"}
+
+// key names by the hex SHA-256 of the key, from -api-keys and -api-keys-file
+var staticAPIKeys = map[string]string{}
+
+// the DynamoDB table naming keys by the hex SHA-256 of the key as id, none
+// to only use static keys
+var apiKeysTableName string
+
+var apiKeysCache struct {
+	sync.Mutex
+	names map[string]cachedAPIKey
+}
+
+type cachedAPIKey struct {
+	name   string
+	loaded time.Time
+}
+
+// how a request was authenticated, as handlers see it
+type authDecision struct {
+	// apiKeyMethod, bearerMethod, iamMethod or certificateMethod
+	Method string `json:"method"`
+	// the name of the API key, IAM principal or client certificate identity
+	Key string `json:"key,omitempty"`
+	// the ARN that signed an IAM token, or the client certificate subject or
+	// name its identity was mapped from
+	Principal string `json:"principal,omitempty"`
+	// from a bearer token's sub and the claims -oidc-roles-claim and
+	// -oidc-tenant-claim name
+	Subject string   `json:"subject,omitempty"`
+	Roles   []string `json:"roles,omitempty"`
+	Tenant  string   `json:"tenant,omitempty"`
+	// what the caller may do, with -rbac
+	Role string `json:"role,omitempty"`
+	// the end user a caller allowed by -on-behalf-of-callers acts for
+	OnBehalfOf string `json:"on_behalf_of,omitempty"`
+}
+
+const (
+	apiKeyMethod = "api_key"
+	bearerMethod = "bearer"
+	iamMethod    = "iam"
+)
+
+// the request context key holding a request's authDecision
+type authContextKey struct{}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// adds a named key to the static keys
+func addAPIKey(name, key string) error {
+	if !apiKeyNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid API key name '%s'", name)
+	}
+	if key == "" {
+		return fmt.Errorf("API key '%s' is empty", name)
+	}
+	if _, ok := staticAPIKeys[hashAPIKey(key)]; ok {
+		return fmt.Errorf("API key '%s' is a duplicate", name)
+	}
+	staticAPIKeys[hashAPIKey(key)] = name
+	return nil
+}
+
+// adds keys given as comma separated name=key pairs
+func parseAPIKeys(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("API key '%s' must be given as name=key", parts[0])
+		}
+		if err := addAPIKey(parts[0], parts[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// adds keys from a file of "name key" lines; blank lines and lines starting
+// with # are skipped
+func loadAPIKeysFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: expected a name and a key", path, line)
+		}
+		if err := addAPIKey(fields[0], fields[1]); err != nil {
+			return fmt.Errorf("%s:%d: %s", path, line, err.Error())
+		}
+	}
+	return scanner.Err()
+}
+
+// whether requests need an API key
+func apiKeysEnabled() bool {
+	return len(staticAPIKeys) > 0 || apiKeysTableName != ""
+}
+
+// the name of a key, or empty if it isn't known
+func lookupAPIKey(ctx context.Context, key string) (string, error) {
+	hash := hashAPIKey(key)
+	if name, ok := staticAPIKeys[hash]; ok {
+		return name, nil
+	}
+	if apiKeysTableName == "" {
+		return "", nil
+	}
+	apiKeysCache.Lock()
+	cached, ok := apiKeysCache.names[hash]
+	apiKeysCache.Unlock()
+	if ok && time.Since(cached.loaded) < apiKeysRefresh {
+		return cached.name, nil
+	}
+
+	result, err := dbSvc.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		Key:       assetKey(hash),
+		TableName: aws.String(apiKeysTableName),
+	})
+	if err != nil {
+		return "", err
+	}
+	// unknown keys aren't cached, so they can't fill the cache
+	name := stringAttribute(result.Item, "name")
+	if disabled := result.Item["disabled"]; name == "" || (disabled != nil && aws.BoolValue(disabled.BOOL)) {
+		apiKeysCache.Lock()
+		delete(apiKeysCache.names, hash)
+		apiKeysCache.Unlock()
+		return "", nil
+	}
+	apiKeysCache.Lock()
+	if apiKeysCache.names == nil {
+		apiKeysCache.names = map[string]cachedAPIKey{}
+	}
+	apiKeysCache.names[hash] = cachedAPIKey{name: name, loaded: time.Now()}
+	apiKeysCache.Unlock()
+	return name, nil
+}
+
+// how a request was authenticated, the zero decision if it needed no
+// credentials
+func requestAuth(r *http.Request) authDecision {
+	decision, _ := r.Context().Value(authContextKey{}).(authDecision)
+	return decision
+}
+
+// the name of the key a request was made with, empty if it needed none
+func requestAPIKeyName(r *http.Request) string {
+	return requestAuth(r).Key
+}
+
+// reports how the request itself was authenticated, for checking what a
+// client's credentials map to
+func getAuth(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, requestAuth(r))
+}
+
+// whether requests need an API key, bearer token or IAM token
+func authenticationEnabled() bool {
+	return apiKeysEnabled() || jwtEnabled() || iamEnabled() || clientCertificatesEnabled()
+}
+
+// the 401 answer to a request without credentials, naming those accepted
+func missingCredentials(w http.ResponseWriter) {
+	var accepted []string
+	if apiKeysEnabled() {
+		accepted = append(accepted, apiKeyHeader+" header")
+	}
+	if jwtEnabled() {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		accepted = append(accepted, "bearer token")
+	}
+	if iamEnabled() {
+		accepted = append(accepted, iamTokenHeader+" header")
+	}
+	if clientCertificatesEnabled() {
+		accepted = append(accepted, "client certificate")
+	}
+	http.Error(w, fmt.Sprintf("Missing %s.", strings.Join(accepted, " or ")), http.StatusUnauthorized)
+}
+
+// refuses requests without a known X-API-Key or, with -jwks-url, a valid
+// bearer token or, with -iam-principals, an IAM token of an allowed
+// principal with 401, logging each request made with one by the key's
+// name, the token's subject or the principal's ARN; does nothing when none
+// is configured
+func withAuthentication(next http.Handler) http.Handler {
+	if !authenticationEnabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, prefix := range openRoutePrefixes {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		var decision authDecision
+		// withAudit records the decision, also when it's refused
+		defer func() { noteAuditDecision(r, decision) }()
+		var caller string
+		if token := r.Header.Get(iamTokenHeader); token != "" && iamEnabled() {
+			var err error
+			decision, err = validateIAMToken(token, time.Now())
+			if err == errSTSUnavailable {
+				log.Println("error calling STS to check an IAM token")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid IAM token: %s.", err.Error()), http.StatusUnauthorized)
+				return
+			}
+			caller = "principal=" + decision.Principal
+		} else if token := bearerToken(r); token != "" && jwtEnabled() {
+			var err error
+			decision, err = validateJWT(token, time.Now())
+			if err == errJWKSUnavailable {
+				log.Printf("error fetching %s", jwksURL)
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, fmt.Sprintf("Invalid bearer token: %s.", err.Error()), http.StatusUnauthorized)
+				return
+			}
+			caller = "sub=" + decision.Subject
+		} else if cert := clientCertificate(r); cert != nil && r.Header.Get(apiKeyHeader) == "" {
+			var err error
+			decision, err = validateClientCertificate(cert)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid client certificate: %s.", err.Error()), http.StatusUnauthorized)
+				return
+			}
+			caller = "cert=" + decision.Key
+		} else {
+			key := r.Header.Get(apiKeyHeader)
+			if key == "" {
+				missingCredentials(w)
+				return
+			}
+			name, err := lookupAPIKey(r.Context(), key)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			if name == "" {
+				http.Error(w, "Invalid API key.", http.StatusUnauthorized)
+				return
+			}
+			decision = authDecision{Method: apiKeyMethod, Key: name}
+			caller = "key=" + name
+		}
+		if !applyOnBehalfOf(w, r, &decision) {
+			log.Printf("%s %s %d %s on_behalf_of=%s", r.Method, r.URL.Path, http.StatusForbidden, caller, r.Header.Get(onBehalfOfHeader))
+			return
+		}
+		if decision.OnBehalfOf != "" {
+			caller += " on_behalf_of=" + decision.OnBehalfOf
+		}
+		if rbacEnabled {
+			decision.Role = grantedRole(decision)
+			if !checkRole(w, r, decision) {
+				log.Printf("%s %s %d %s role=%s", r.Method, r.URL.Path, http.StatusForbidden, caller, decision.Role)
+				return
+			}
+		}
+		cw := &captureWriter{ResponseWriter: w}
+		next.ServeHTTP(cw, r.WithContext(context.WithValue(r.Context(), authContextKey{}, decision)))
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+		log.Printf("%s %s %d %s", r.Method, r.URL.Path, cw.status, caller)
+	})
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// an API keys table holding an enabled and a disabled key, counting lookups
+type mockDBAPIKeysClient struct {
+	mockDBClient
+	lookups int
+}
+
+func (m *mockDBAPIKeysClient) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	m.lookups++
+	switch stringAttribute(input.Key, "id") {
+	case hashAPIKey("table-key"):
+		return &dynamodb.GetItemOutput{Item: map[string]*dynamodb.AttributeValue{
+			"id":   input.Key["id"],
+			"name": {S: aws.String("ci")},
+		}}, nil
+	case hashAPIKey("revoked-key"):
+		return &dynamodb.GetItemOutput{Item: map[string]*dynamodb.AttributeValue{
+			"id":       input.Key["id"],
+			"name":     {S: aws.String("old")},
+			"disabled": {BOOL: aws.Bool(true)},
+		}}, nil
+	}
+	return &dynamodb.GetItemOutput{}, nil
+}
+func (m *mockDBAPIKeysClient) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return m.GetItem(input)
+}
+
+func resetAPIKeys() {
+	staticAPIKeys = map[string]string{}
+	apiKeysTableName = ""
+	apiKeysCache.Lock()
+	apiKeysCache.names = nil
+	apiKeysCache.Unlock()
+}
+
+func TestParseAPIKeys(t *testing.T) {
+	defer resetAPIKeys()
+	if err := parseAPIKeys("web=abc, batch=d=ef"); err != nil {
+		t.Fatalf("Got error for valid keys: %s", err)
+	}
+	if staticAPIKeys[hashAPIKey("abc")] != "web" || staticAPIKeys[hashAPIKey("d=ef")] != "batch" {
+		t.Errorf("Incorrect keys parsed: %v", staticAPIKeys)
+	}
+	for _, value := range []string{"nokey", "web=", "bad name=abc", "again=abc"} {
+		if err := parseAPIKeys(value); err == nil {
+			t.Errorf("Got no error for keys %q", value)
+		}
+	}
+
+	f, _ := ioutil.TempFile("", "apikeys")
+	defer os.Remove(f.Name())
+	f.WriteString("# uploaders\nmobile xyz\n\n  desktop   uvw\n")
+	f.Close()
+	if err := loadAPIKeysFile(f.Name()); err != nil {
+		t.Fatalf("Got error loading keys: %s", err)
+	}
+	if staticAPIKeys[hashAPIKey("xyz")] != "mobile" || staticAPIKeys[hashAPIKey("uvw")] != "desktop" {
+		t.Errorf("Incorrect keys loaded: %v", staticAPIKeys)
+	}
+}
+
+func TestWithAuthentication(t *testing.T) {
+	defer resetAPIKeys()
+	var served string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served = requestAPIKeyName(r)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	w := httptest.NewRecorder()
+	withAuthentication(next).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/assets", nil))
+	if w.Result().StatusCode != http.StatusNoContent {
+		t.Fatalf("Request refused with no keys configured: %d", w.Result().StatusCode)
+	}
+
+	parseAPIKeys("web=abc")
+	apiKeysTableName = "api-keys"
+	db := &mockDBAPIKeysClient{}
+	dbSvc = db
+	handler := withAuthentication(next)
+	for _, test := range []struct {
+		path, key, name string
+		status          int
+	}{
+		{"/assets", "abc", "web", http.StatusNoContent},
+		{"/assets", "table-key", "ci", http.StatusNoContent},
+		{"/assets", "", "", http.StatusUnauthorized},
+		{"/assets", "wrong", "", http.StatusUnauthorized},
+		{"/assets", "revoked-key", "", http.StatusUnauthorized},
+		{"/download/token", "", "", http.StatusNoContent},
+		{"/public/someID", "", "", http.StatusNoContent},
+	} {
+		served = ""
+		r := httptest.NewRequest(http.MethodGet, test.path, nil)
+		if test.key != "" {
+			r.Header.Set(apiKeyHeader, test.key)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Result().StatusCode != test.status || served != test.name {
+			t.Errorf("Incorrect response to %s with key %q: %d as %q", test.path, test.key, w.Result().StatusCode, served)
+		}
+	}
+
+	// known table keys are cached
+	lookups := db.lookups
+	r := httptest.NewRequest(http.MethodGet, "/assets", nil)
+	r.Header.Set(apiKeyHeader, "table-key")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if db.lookups != lookups {
+		t.Errorf("Table key looked up again: %d lookups", db.lookups)
+	}
+}
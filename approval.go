@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// records awaiting approval to be deleted are put in this partition of
+	// the sparse approval index
+	approvalShard        = "all"
+	eventDeletionPending = "deletion.pending_approval"
+	maxPendingDeletions  = 1000
+)
+
+var errDeletionQueued = errors.New("asset deletion awaits approval")
+
+// objects at least this many bytes wait for approval to be deleted, 0 for
+// no size threshold
+var approvalSize int64
+
+// assets carrying any of these tags wait for approval to be deleted
+var approvalTags map[string]bool
+
+// the DynamoDB index on approval_shard and deletion_requested_at
+var approvalIndexName string
+
+// url told when a deletion starts waiting for approval, none when empty
+var approvalWebhook string
+
+type pendingDeletion struct {
+	ID          string    `json:"id"`
+	Reason      string    `json:"reason"`
+	RequestedAt time.Time `json:"requested_at"`
+}
+
+type pendingDeletionEvent struct {
+	Event string `json:"event"`
+	pendingDeletion
+}
+
+type pendingDeletionsResponse struct {
+	Pending []pendingDeletion `json:"pending"`
+}
+
+func approvalRequired() bool {
+	return approvalSize > 0 || len(approvalTags) > 0
+}
+
+// parses a comma separated list of tags
+func parseApprovalTags(value string) (map[string]bool, error) {
+	tags := map[string]bool{}
+	for _, tag := range strings.Split(value, ",") {
+		if tag = strings.TrimSpace(tag); tag == "" {
+			continue
+		}
+		if !tagPattern.MatchString(tag) {
+			return nil, fmt.Errorf("invalid approval tag '%s'", tag)
+		}
+		tags[tag] = true
+	}
+	return tags, nil
+}
+
+// why deleting an asset needs approval, empty when it doesn't
+func approvalReason(ctx context.Context, assetID string, item map[string]*dynamodb.AttributeValue) (string, error) {
+	for _, tag := range recordedTags(item) {
+		if approvalTags[tag] {
+			return "tagged " + tag, nil
+		}
+	}
+	if approvalSize <= 0 || stringAttribute(item, "status") != assetStatusUploaded {
+		return "", nil
+	}
+	head, err := s3Svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket:    aws.String(bucketName),
+		Key:       aws.String(objectKey(assetID, item)),
+		VersionId: optionalString(stringAttribute(item, "s3_version_id")),
+	})
+	if isObjectMissing(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if size := aws.Int64Value(head.ContentLength); size >= approvalSize {
+		return fmt.Sprintf("%d bytes", size), nil
+	}
+	return "", nil
+}
+
+// puts an asset's deletion up for approval if condition holds, telling the
+// webhook; asking again for one already waiting changes nothing
+func queueDeletion(ctx context.Context, assetID, reason, condition string, values map[string]*dynamodb.AttributeValue) error {
+	now := time.Now()
+	values[":deleted"] = &dynamodb.AttributeValue{S: aws.String(assetStatusDeleted)}
+	values[":requestedAt"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(now.Unix(), 10))}
+	values[":approvalShard"] = &dynamodb.AttributeValue{S: aws.String(approvalShard)}
+	values[":reason"] = &dynamodb.AttributeValue{S: aws.String(reason)}
+	values[":updated"] = updatedAtValue()
+	result, err := dbSvc.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		Key:       assetKey(assetID),
+		TableName: aws.String(tableName),
+		UpdateExpression: aws.String("SET deletion_requested_at = :requestedAt, approval_shard = :approvalShard, " +
+			"deletion_reason = :reason, updated_at = :updated"),
+		ConditionExpression: aws.String("attribute_exists(id) AND (attribute_not_exists(#status) OR #status <> :deleted) AND " +
+			"attribute_not_exists(deletion_requested_at) AND " + condition),
+		ExpressionAttributeNames:            map[string]*string{"#status": aws.String("status")},
+		ExpressionAttributeValues:           values,
+		ReturnValues:                        aws.String(dynamodb.ReturnValueAllNew),
+		ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValuesOnConditionCheckFailureAllOld),
+	})
+	if isConditionFailed(err) && numberAttribute(conditionFailedItem(err), "deletion_requested_at") > 0 {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := announcePendingDeletion(pendingDeletion{ID: assetID, Reason: reason, RequestedAt: now.Truncate(time.Second)}); err != nil {
+		// the deletion is queued all the same, and listed for operators
+		log.Println(err.Error())
+	}
+	publishEvent(eventDeletionPending, assetID, result.Attributes)
+	return nil
+}
+
+func announcePendingDeletion(pending pendingDeletion) error {
+	log.Printf("deletion of asset %s (%s) awaits approval", pending.ID, pending.Reason)
+	if approvalWebhook == "" {
+		return nil
+	}
+	body, err := json.Marshal(pendingDeletionEvent{Event: eventDeletionPending, pendingDeletion: pending})
+	if err != nil {
+		return err
+	}
+	resp, err := webhookClient.Post(approvalWebhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("approval webhook returned %s for asset %s", resp.Status, pending.ID)
+	}
+	return nil
+}
+
+// answers a delete request with 202 instead when the asset's deletion
+// needs approval, returning false to go ahead and delete it; the request's
+// confirmation token is checked as deleting would
+func deferDeleteRequest(w http.ResponseWriter, r *http.Request, assetID, token string) bool {
+	if !approvalRequired() {
+		return false
+	}
+	item, ok := fetchAsset(w, r, assetID)
+	if !ok {
+		return true
+	}
+	reason, err := approvalReason(r.Context(), assetID, item)
+	if err != nil {
+		writeError(w, err)
+		return true
+	}
+	if reason == "" {
+		return false
+	}
+	values := lockConditionValues(r)
+	values[":false"] = &dynamodb.AttributeValue{BOOL: aws.Bool(false)}
+	err = queueDeletion(r.Context(), assetID, reason, confirmedCondition(unpinnedCondition+" AND "+lockCondition, token, values), values)
+	if err != nil {
+		if isConditionFailed(err) {
+			writeDeleteConflict(w, assetID, token, conditionFailedItem(err))
+			return true
+		}
+		writeError(w, err)
+		return true
+	}
+	if requireDeleteConfirmation {
+		noteTokenAccepted(tokenDeleteConfirmation)
+	}
+	pending := pendingDeletion{ID: assetID, Reason: reason, RequestedAt: time.Now().Truncate(time.Second)}
+	if requestedAt := numberAttribute(item, "deletion_requested_at"); requestedAt > 0 {
+		pending.Reason = stringAttribute(item, "deletion_reason")
+		pending.RequestedAt = time.Unix(requestedAt, 0)
+	}
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, pending)
+	return true
+}
+
+// lists deletions awaiting approval, oldest first
+func listPendingDeletions(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	response := pendingDeletionsResponse{Pending: []pendingDeletion{}}
+	err := dbSvc.QueryPagesWithContext(r.Context(), &dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		IndexName:              aws.String(approvalIndexName),
+		KeyConditionExpression: aws.String("approval_shard = :shard"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":shard": {S: aws.String(approvalShard)},
+		},
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			response.Pending = append(response.Pending, pendingDeletion{
+				ID:          stringAttribute(item, "id"),
+				Reason:      stringAttribute(item, "deletion_reason"),
+				RequestedAt: time.Unix(numberAttribute(item, "deletion_requested_at"), 0).UTC(),
+			})
+		}
+		return len(response.Pending) < maxPendingDeletions
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, response)
+}
+
+// approves (POST /deletions/pending/{id}/approve) or rejects (.../reject)
+// a pending deletion; an approved one is deleted like any other, restorably
+// during the retention window
+func managePendingDeletion(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodPost) {
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/deletions/pending/"), "/")
+	if len(parts) != 2 || parts[0] == "" || (parts[1] != "approve" && parts[1] != "reject") {
+		http.NotFound(w, r)
+		return
+	}
+	assetID, action := parts[0], parts[1]
+
+	values := map[string]*dynamodb.AttributeValue{":false": {BOOL: aws.Bool(false)}}
+	condition := "attribute_exists(deletion_requested_at) AND " + unpinnedCondition
+	var err error
+	switch {
+	case action == "reject":
+		values[":updated"] = updatedAtValue()
+		_, err = dbSvc.UpdateItemWithContext(r.Context(), &dynamodb.UpdateItemInput{
+			Key:                       assetKey(assetID),
+			TableName:                 aws.String(tableName),
+			UpdateExpression:          aws.String("SET updated_at = :updated REMOVE deletion_requested_at, approval_shard, deletion_reason"),
+			ConditionExpression:       aws.String("attribute_exists(deletion_requested_at)"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":updated": values[":updated"]},
+		})
+	case deleteRetention > 0:
+		err = trashAsset(r.Context(), assetID, condition, values)
+	default:
+		err = removeAsset(r.Context(), assetID, condition, values)
+	}
+	if err != nil {
+		if isConditionFailed(err) {
+			if isPinned(conditionFailedItem(err)) {
+				http.Error(w, fmt.Sprintf("Asset id '%s' is pinned.", assetID), http.StatusConflict)
+				return
+			}
+			http.Error(w, fmt.Sprintf("No pending deletion for asset id '%s'.", assetID), http.StatusNotFound)
+			return
+		}
+		writeError(w, err)
+		return
+	}
+	if action == "reject" {
+		log.Printf("deletion of asset %s rejected", assetID)
+	} else {
+		log.Printf("deletion of asset %s approved", assetID)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// an uploaded asset tagged important, with a deletion awaiting approval in
+// the approval index
+type mockDBApprovalClient struct {
+	mockDBClient
+	update *dynamodb.UpdateItemInput
+}
+
+func (m *mockDBApprovalClient) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	output, _ := m.mockDBClient.GetItem(input)
+	output.Item["tags"] = &dynamodb.AttributeValue{SS: aws.StringSlice([]string{"important"})}
+	return output, nil
+}
+func (m *mockDBApprovalClient) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return m.GetItem(input)
+}
+
+func (m *mockDBApprovalClient) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	m.update = input
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+func (m *mockDBApprovalClient) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	return m.UpdateItem(input)
+}
+
+func (m *mockDBApprovalClient) QueryPages(input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool) error {
+	fn(&dynamodb.QueryOutput{Items: []map[string]*dynamodb.AttributeValue{{
+		"id":                    {S: aws.String("someID")},
+		"deletion_reason":       {S: aws.String("tagged important")},
+		"deletion_requested_at": {N: aws.String("1700000000")},
+	}}}, true)
+	return nil
+}
+func (m *mockDBApprovalClient) QueryPagesWithContext(ctx aws.Context, input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool, opts ...request.Option) error {
+	return m.QueryPages(input, fn)
+}
+
+func TestDeleteRequestNeedingApproval(t *testing.T) {
+	defer func() { approvalSize, approvalTags = 0, nil }()
+	db := &mockDBApprovalClient{}
+	dbSvc = db
+	s3Svc = &mockS3Client{}
+
+	// the 12 byte object is big enough to need approval
+	approvalSize = 10
+	r := httptest.NewRequest(http.MethodDelete, "/asset/someID", nil)
+	w := httptest.NewRecorder()
+	manageAsset(w, r)
+	var pending pendingDeletion
+	if w.Result().StatusCode != http.StatusAccepted {
+		t.Fatalf("Incorrect status deleting a large asset: %d", w.Result().StatusCode)
+	}
+	if err := json.NewDecoder(w.Body).Decode(&pending); err != nil || pending.Reason != "12 bytes" {
+		t.Errorf("Incorrect pending deletion: %+v", pending)
+	}
+	if !strings.Contains(aws.StringValue(db.update.UpdateExpression), "approval_shard") {
+		t.Errorf("Deletion not queued: %s", aws.StringValue(db.update.UpdateExpression))
+	}
+
+	approvalSize = 100
+	approvalTags = map[string]bool{"important": true}
+	if err := deleteAsset(context.Background(), "someID"); err != errDeletionQueued {
+		t.Errorf("Tagged asset not queued for approval: %v", err)
+	}
+
+	approvalTags = map[string]bool{"other": true}
+	db.update = nil
+	r = httptest.NewRequest(http.MethodDelete, "/asset/someID", nil)
+	w = httptest.NewRecorder()
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusNoContent || strings.Contains(aws.StringValue(db.update.UpdateExpression), "approval_shard =") {
+		t.Errorf("Small untagged asset not deleted: %d", w.Result().StatusCode)
+	}
+}
+
+func TestDeleteRequestNeedingApprovalConfirmation(t *testing.T) {
+	defer func() { approvalSize, requireDeleteConfirmation = 0, false }()
+	approvalSize = 10
+	requireDeleteConfirmation = true
+	db := &mockDBApprovalClient{}
+	dbSvc = db
+	s3Svc = &mockS3Client{}
+
+	r := httptest.NewRequest(http.MethodDelete, "/asset/someID?confirm=given", nil)
+	w := httptest.NewRecorder()
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusAccepted {
+		t.Fatalf("Incorrect status deleting a large asset: %d", w.Result().StatusCode)
+	}
+	// queued only if the token is the asset's
+	if !strings.Contains(aws.StringValue(db.update.ConditionExpression), "delete_token = :confirm") ||
+		stringAttribute(db.update.ExpressionAttributeValues, ":confirm") != "given" {
+		t.Errorf("Deletion queued without checking the confirmation token: %s", aws.StringValue(db.update.ConditionExpression))
+	}
+
+	dbSvc = &mockDBDeleteConflictClient{item: map[string]*dynamodb.AttributeValue{
+		"id":           {S: aws.String("someID")},
+		"delete_token": {S: aws.String("issued")},
+	}}
+	w = httptest.NewRecorder()
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusForbidden {
+		t.Errorf("Didn't get 403 queueing a deletion with a wrong confirmation token: %d", w.Result().StatusCode)
+	}
+}
+
+func TestPendingDeletions(t *testing.T) {
+	db := &mockDBApprovalClient{}
+	dbSvc = db
+	r := httptest.NewRequest(http.MethodGet, "/deletions/pending", nil)
+	w := httptest.NewRecorder()
+	listPendingDeletions(w, r)
+	var response pendingDeletionsResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil || len(response.Pending) != 1 ||
+		response.Pending[0].ID != "someID" || !response.Pending[0].RequestedAt.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("Incorrect pending deletions: %+v", response)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/deletions/pending/someID/approve", nil)
+	w = httptest.NewRecorder()
+	managePendingDeletion(w, r)
+	if w.Result().StatusCode != http.StatusNoContent || !strings.Contains(aws.StringValue(db.update.ConditionExpression), "attribute_exists(deletion_requested_at)") {
+		t.Errorf("Incorrect approval: %d", w.Result().StatusCode)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/deletions/pending/someID/reject", nil)
+	w = httptest.NewRecorder()
+	managePendingDeletion(w, r)
+	if w.Result().StatusCode != http.StatusNoContent || !strings.Contains(aws.StringValue(db.update.UpdateExpression), "REMOVE deletion_requested_at") {
+		t.Errorf("Incorrect rejection: %d", w.Result().StatusCode)
+	}
+
+	dbSvc = &mockDBConditionalErrorClient{}
+	r = httptest.NewRequest(http.MethodPost, "/deletions/pending/someID/approve", nil)
+	w = httptest.NewRecorder()
+	managePendingDeletion(w, r)
+	if w.Result().StatusCode != http.StatusNotFound {
+		t.Errorf("Incorrect status approving no pending deletion: %d", w.Result().StatusCode)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// largest object S3 copies in one request, which archiving relies on
+	maxArchiveSize    = 5 << 30
+	maxRestoreDays    = 30
+	restoreNone       = "none"
+	restoreInProgress = "in_progress"
+	restoreComplete   = "restored"
+)
+
+// storage classes whose objects must be restored before they can be read
+var archiveStorageClasses = map[string]bool{
+	s3.StorageClassGlacier:     true,
+	s3.StorageClassDeepArchive: true,
+}
+
+var restoreTiers = map[string]bool{
+	s3.TierStandard:  true,
+	s3.TierBulk:      true,
+	s3.TierExpedited: true,
+}
+
+// the x-amz-restore header S3 reports on restored or restoring objects
+var restoreHeaderPattern = regexp.MustCompile(`ongoing-request="(true|false)"(?:, expiry-date="([^"]+)")?`)
+
+// whether an archived object can be read and until when
+type archiveStatus struct {
+	StorageClass  string     `json:"storage_class"`
+	Restore       string     `json:"restore"`
+	RestoredUntil *time.Time `json:"restored_until,omitempty"`
+}
+
+func isArchived(head *s3.HeadObjectOutput) bool {
+	return archiveStorageClasses[aws.StringValue(head.StorageClass)]
+}
+
+// describes the restore state of an object from its head
+func restoreStatus(head *s3.HeadObjectOutput) archiveStatus {
+	status := archiveStatus{StorageClass: aws.StringValue(head.StorageClass), Restore: restoreNone}
+	if status.StorageClass == "" {
+		status.StorageClass = s3.StorageClassStandard
+	}
+	m := restoreHeaderPattern.FindStringSubmatch(aws.StringValue(head.Restore))
+	if m == nil {
+		return status
+	}
+	if m[1] == "true" {
+		status.Restore = restoreInProgress
+		return status
+	}
+	status.Restore = restoreComplete
+	if until, err := http.ParseTime(m[2]); err == nil {
+		status.RestoredUntil = &until
+	}
+	return status
+}
+
+// refuses downloads of an archived object that hasn't been restored,
+// writing 202 with the progress of a restore under way or 409 otherwise,
+// and returning false
+func checkArchived(w http.ResponseWriter, assetID string, head *s3.HeadObjectOutput) bool {
+	if !isArchived(head) {
+		return true
+	}
+	status := restoreStatus(head)
+	switch status.Restore {
+	case restoreComplete:
+		return true
+	case restoreInProgress:
+		w.WriteHeader(http.StatusAccepted)
+		writeJSON(w, status)
+	default:
+		http.Error(w, fmt.Sprintf("Asset id '%s' is archived, restore it with POST /asset/%s/archive/restore first.", assetID, assetID), http.StatusConflict)
+	}
+	return false
+}
+
+// moves an uploaded asset's object to an archive storage class
+func handleArchiveRequest(w http.ResponseWriter, r *http.Request, assetID string) {
+	storageClass := r.URL.Query().Get("storage_class")
+	if storageClass == "" {
+		storageClass = s3.StorageClassGlacier
+	}
+	if !archiveStorageClasses[storageClass] {
+		http.Error(w, fmt.Sprintf("Invalid argument for storage_class, must be %s or %s.", s3.StorageClassGlacier, s3.StorageClassDeepArchive), http.StatusBadRequest)
+		return
+	}
+	item, ok := fetchAsset(w, r, assetID)
+	if !ok {
+		return
+	}
+	if stringAttribute(item, "status") != assetStatusUploaded {
+		writeError(w, notUploaded(assetID))
+		return
+	}
+	versionID := stringAttribute(item, "s3_version_id")
+	head, err := objectHead(r.Context(), objectKey(assetID, item), versionID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if aws.StringValue(head.StorageClass) == storageClass {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if aws.Int64Value(head.ContentLength) > maxArchiveSize {
+		http.Error(w, fmt.Sprintf("Asset id '%s' is too large to archive.", assetID), http.StatusUnprocessableEntity)
+		return
+	}
+
+	// copying an object onto itself is how S3 changes its storage class,
+	// keeping its metadata; in a versioned bucket the copy is a new version
+	source := bucketName + "/" + url.PathEscape(objectKey(assetID, item))
+	if versionID != "" {
+		source += "?versionId=" + url.QueryEscape(versionID)
+	}
+	copied, err := s3Svc.CopyObjectWithContext(r.Context(), &s3.CopyObjectInput{
+		Bucket:                  aws.String(bucketName),
+		Key:                     aws.String(objectKey(assetID, item)),
+		CopySource:              aws.String(source),
+		StorageClass:            aws.String(storageClass),
+		ServerSideEncryption:    encryptionAlgorithm(),
+		SSEKMSKeyId:             optionalString(kmsKeyID),
+		SSEKMSEncryptionContext: encryptionContextHeader(assetID),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidObjectState" {
+			http.Error(w, fmt.Sprintf("Asset id '%s' is archived, restore it before moving it to %s.", assetID, storageClass), http.StatusConflict)
+			return
+		}
+		writeError(w, err)
+		return
+	}
+
+	// the copy is made, so it's recorded even past the request's deadline
+	ctx := context.WithoutCancel(r.Context())
+	values := lockConditionValues(r)
+	values[":storageClass"] = &dynamodb.AttributeValue{S: aws.String(storageClass)}
+	values[":updated"] = updatedAtValue()
+	update := "SET storage_class = :storageClass, updated_at = :updated"
+	newVersionID := aws.StringValue(copied.VersionId)
+	if versionID != "" && newVersionID != "" {
+		values[":versionID"] = &dynamodb.AttributeValue{S: aws.String(newVersionID)}
+		values[":versions"] = &dynamodb.AttributeValue{SS: aws.StringSlice([]string{newVersionID})}
+		update += ", s3_version_id = :versionID ADD versions :versions"
+	}
+	result, err := dbSvc.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		Key:                                 assetKey(assetID),
+		TableName:                           aws.String(tableName),
+		UpdateExpression:                    aws.String(update),
+		ConditionExpression:                 aws.String("attribute_exists(id) AND " + lockCondition),
+		ExpressionAttributeValues:           values,
+		ReturnValues:                        aws.String(dynamodb.ReturnValueAllNew),
+		ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValuesOnConditionCheckFailureAllOld),
+	})
+	if err != nil {
+		if isConditionFailed(err) {
+			if isLockedConflict(err) {
+				http.Error(w, fmt.Sprintf("Asset id '%s' is locked.", assetID), http.StatusLocked)
+				return
+			}
+			writeError(w, notFound(assetID))
+			return
+		}
+		writeError(w, err)
+		return
+	}
+	if versionID != "" && newVersionID != "" {
+		if err := replaceArchivedVersion(ctx, assetID, versionID, result.Attributes); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// records the archived copy of a version in place of the original, which
+// would otherwise go on being stored at the standard rate
+func replaceArchivedVersion(ctx context.Context, assetID, versionID string, item map[string]*dynamodb.AttributeValue) error {
+	if err := recordVersion(assetID, item); err != nil {
+		return err
+	}
+	_, err := s3Svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket:    aws.String(bucketName),
+		Key:       aws.String(objectKey(assetID, item)),
+		VersionId: aws.String(versionID),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = dbSvc.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		Key:       versionKey(assetID, versionID),
+		TableName: aws.String(tableName),
+	})
+	return err
+}
+
+// starts restoring (POST) an archived asset for ?days= (1 by default) or
+// reports how its restore is going (GET)
+func handleArchiveRestoreRequest(w http.ResponseWriter, r *http.Request, assetID string) {
+	item, ok := fetchAsset(w, r, assetID)
+	if !ok {
+		return
+	}
+	versionID := stringAttribute(item, "s3_version_id")
+	if r.Method == http.MethodGet {
+		head, err := objectHead(r.Context(), objectKey(assetID, item), versionID)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, restoreStatus(head))
+		return
+	}
+
+	days := 1
+	if value := r.URL.Query().Get("days"); value != "" {
+		var err error
+		days, err = strconv.Atoi(value)
+		if err != nil || days < 1 || days > maxRestoreDays {
+			http.Error(w, fmt.Sprintf("Invalid argument for days, must be integer from 1 to %d.", maxRestoreDays), http.StatusBadRequest)
+			return
+		}
+	}
+	tier := r.URL.Query().Get("tier")
+	if tier == "" {
+		tier = s3.TierStandard
+	}
+	if !restoreTiers[tier] {
+		http.Error(w, fmt.Sprintf("Invalid argument for tier, must be %s, %s or %s.", s3.TierStandard, s3.TierBulk, s3.TierExpedited), http.StatusBadRequest)
+		return
+	}
+
+	_, err := s3Svc.RestoreObjectWithContext(r.Context(), &s3.RestoreObjectInput{
+		Bucket:    aws.String(bucketName),
+		Key:       aws.String(objectKey(assetID, item)),
+		VersionId: optionalString(versionID),
+		RestoreRequest: &s3.RestoreRequest{
+			Days:                 aws.Int64(int64(days)),
+			GlacierJobParameters: &s3.GlacierJobParameters{Tier: aws.String(tier)},
+		},
+	})
+	if err != nil {
+		aerr, ok := err.(awserr.Error)
+		switch {
+		case ok && aerr.Code() == "InvalidObjectState":
+			http.Error(w, fmt.Sprintf("Asset id '%s' isn't archived.", assetID), http.StatusConflict)
+			return
+		case ok && aerr.Code() == "RestoreAlreadyInProgress":
+		default:
+			writeError(w, err)
+			return
+		}
+	}
+	head, err := objectHead(r.Context(), objectKey(assetID, item), versionID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, restoreStatus(head))
+}
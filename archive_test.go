@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// an object in Glacier, with a restore in the given state
+type mockS3ArchivedClient struct {
+	mockS3Client
+	restore  string
+	copied   *s3.CopyObjectInput
+	restored *s3.RestoreObjectInput
+}
+
+func (m *mockS3ArchivedClient) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	output, _ := m.mockS3Client.HeadObject(input)
+	if m.copied == nil {
+		output.StorageClass = aws.String(s3.StorageClassGlacier)
+	}
+	output.Restore = optionalString(m.restore)
+	return output, nil
+}
+func (m *mockS3ArchivedClient) HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	return m.HeadObject(input)
+}
+
+func (m *mockS3ArchivedClient) CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	m.copied = input
+	return &s3.CopyObjectOutput{}, nil
+}
+func (m *mockS3ArchivedClient) CopyObjectWithContext(ctx aws.Context, input *s3.CopyObjectInput, opts ...request.Option) (*s3.CopyObjectOutput, error) {
+	return m.CopyObject(input)
+}
+
+func (m *mockS3ArchivedClient) RestoreObject(input *s3.RestoreObjectInput) (*s3.RestoreObjectOutput, error) {
+	m.restored = input
+	return &s3.RestoreObjectOutput{}, nil
+}
+func (m *mockS3ArchivedClient) RestoreObjectWithContext(ctx aws.Context, input *s3.RestoreObjectInput, opts ...request.Option) (*s3.RestoreObjectOutput, error) {
+	return m.RestoreObject(input)
+}
+
+func TestRestoreStatus(t *testing.T) {
+	status := restoreStatus(&s3.HeadObjectOutput{
+		StorageClass: aws.String(s3.StorageClassDeepArchive),
+		Restore:      aws.String(`ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"`),
+	})
+	if status.Restore != restoreComplete || status.RestoredUntil == nil || !status.RestoredUntil.Equal(time.Date(2012, 12, 21, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Incorrect status for a restored object: %+v", status)
+	}
+	if status := restoreStatus(&s3.HeadObjectOutput{Restore: aws.String(`ongoing-request="true"`)}); status.Restore != restoreInProgress {
+		t.Errorf("Incorrect status for a restoring object: %+v", status)
+	}
+	if status := restoreStatus(&s3.HeadObjectOutput{}); status.Restore != restoreNone || status.StorageClass != s3.StorageClassStandard {
+		t.Errorf("Incorrect status for a standard object: %+v", status)
+	}
+}
+func TestAssetURLRequestArchived(t *testing.T) {
+	dbSvc = &mockDBClient{}
+	for restore, status := range map[string]int{
+		"":                        http.StatusConflict,
+		`ongoing-request="true"`:  http.StatusAccepted,
+		`ongoing-request="false"`: http.StatusOK,
+	} {
+		s3Svc = &mockS3ArchivedClient{restore: restore}
+		r := httptest.NewRequest(http.MethodGet, "/asset/someID", nil)
+		w := httptest.NewRecorder()
+		manageAsset(w, r)
+		if w.Result().StatusCode != status {
+			t.Errorf("Expected %d for an archived asset with restore %q, got %d", status, restore, w.Result().StatusCode)
+		}
+	}
+}
+func TestArchiveRequest(t *testing.T) {
+	dbSvc = &mockDBClient{}
+	s3 := &mockS3ArchivedClient{}
+	s3Svc = s3
+	r := httptest.NewRequest(http.MethodPost, "/asset/someID/archive?storage_class=DEEP_ARCHIVE", nil)
+	w := httptest.NewRecorder()
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusNoContent {
+		t.Fatalf("Incorrect status archiving: %d", w.Result().StatusCode)
+	}
+	if s3.copied == nil || aws.StringValue(s3.copied.StorageClass) != "DEEP_ARCHIVE" || aws.StringValue(s3.copied.CopySource) != bucketName+"/someID" {
+		t.Errorf("Object not copied to the archive class: %+v", s3.copied)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/asset/someID/archive?storage_class=STANDARD", nil)
+	w = httptest.NewRecorder()
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("Didn't get 400 for a storage class that isn't an archive: %d", w.Result().StatusCode)
+	}
+}
+func TestArchiveRestoreRequest(t *testing.T) {
+	dbSvc = &mockDBClient{}
+	s3 := &mockS3ArchivedClient{restore: `ongoing-request="true"`}
+	s3Svc = s3
+	r := httptest.NewRequest(http.MethodPost, "/asset/someID/archive/restore?days=3&tier=Bulk", nil)
+	w := httptest.NewRecorder()
+	manageAsset(w, r)
+	status := archiveStatus{}
+	json.NewDecoder(w.Result().Body).Decode(&status)
+	if w.Result().StatusCode != http.StatusAccepted || status.Restore != restoreInProgress {
+		t.Errorf("Incorrect response starting a restore: %d %+v", w.Result().StatusCode, status)
+	}
+	if s3.restored == nil || aws.Int64Value(s3.restored.RestoreRequest.Days) != 3 || aws.StringValue(s3.restored.RestoreRequest.GlacierJobParameters.Tier) != "Bulk" {
+		t.Errorf("Incorrect restore requested: %+v", s3.restored)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/asset/someID/archive/restore?days=365", nil)
+	w = httptest.NewRecorder()
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("Didn't get 400 for too many days: %d", w.Result().StatusCode)
+	}
+}
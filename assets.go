@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	defaultAssetsPage = 100
+	// most records fetched at once by ID
+	maxAssetsPage = 100
+	// pending assets have no status attribute, so are listed from the
+	// reservation index instead
+	assetStatusPending = "pending"
+)
+
+// the DynamoDB index on status and created_at
+var statusIndexName string
+
+// a page of assets, with a cursor to pass for the next one while there are
+// more
+type assetsResponse struct {
+	Assets []assetMeta `json:"assets"`
+	Cursor string      `json:"cursor,omitempty"`
+}
+
+// position in a listing, handed to clients as an opaque cursor; listings
+// by status or searches also need the index's sort key to resume
+type assetsCursor struct {
+	ID            string `json:"i"`
+	CreatedAt     int64  `json:"c,omitempty"`
+	UploadExpires int64  `json:"e,omitempty"`
+	Project       string `json:"p,omitempty"`
+}
+
+func encodeAssetsCursor(c assetsCursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeAssetsCursor(s string) (assetsCursor, bool) {
+	var c assetsCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || json.Unmarshal(b, &c) != nil {
+		return c, false
+	}
+	return c, isAssetKey(c.ID)
+}
+
+// parses an RFC 3339 time parameter as unix milliseconds, or def when absent
+func timeParam(r *http.Request, name string, def int64) (int64, bool) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, true
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return 0, false
+	}
+	return t.UnixNano() / int64(time.Millisecond), true
+}
+
+// enumerates assets a page of ?limit= (100 by default) at a time, resuming
+// from ?cursor=; deleted assets are left out unless asked for by ?status=,
+// which can be narrowed to those created_after and created_before a time,
+// or by ?tag= or ?folder=
+func listAssets(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	limit, after, ok := assetsPageParams(w, r)
+	if !ok {
+		return
+	}
+	_, byTag := r.URL.Query()["tag"]
+	_, byStatus := r.URL.Query()["status"]
+	_, byFolder := r.URL.Query()["folder"]
+	if byTag && byStatus {
+		http.Error(w, "Assets can be listed by tag or by status, not both.", http.StatusBadRequest)
+		return
+	}
+	if byFolder && (byTag || byStatus) {
+		http.Error(w, "Assets listed by folder can't also be listed by tag or status.", http.StatusBadRequest)
+		return
+	}
+	if byStatus {
+		listAssetsByStatus(w, r, limit, after)
+		return
+	}
+	if r.URL.Query().Get("created_after") != "" || r.URL.Query().Get("created_before") != "" {
+		http.Error(w, "Listing assets by creation time needs a status.", http.StatusBadRequest)
+		return
+	}
+	if byFolder {
+		prefix, err := normalizeKeyPrefix(r.URL.Query().Get("folder"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid argument for folder: %s.", err.Error()), http.StatusBadRequest)
+			return
+		}
+		listAssetsInFolder(r.Context(), w, prefix, limit, after)
+		return
+	}
+	if byTag {
+		tag := r.URL.Query().Get("tag")
+		if !tagPattern.MatchString(tag) {
+			http.Error(w, "Invalid argument for tag.", http.StatusBadRequest)
+			return
+		}
+		listTaggedAssets(r.Context(), w, tag, limit, after)
+		return
+	}
+
+	response, err := scanAssetsPage(r.Context(), limit, after.ID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, response)
+}
+
+// parses ?limit= and ?cursor=, writing an error and returning false if
+// either is invalid
+func assetsPageParams(w http.ResponseWriter, r *http.Request) (int, assetsCursor, bool) {
+	limit := defaultAssetsPage
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > maxAssetsPage {
+			http.Error(w, "Invalid argument for limit.", http.StatusBadRequest)
+			return 0, assetsCursor{}, false
+		}
+	}
+	var after assetsCursor
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		var ok bool
+		if after, ok = decodeAssetsCursor(cursor); !ok {
+			http.Error(w, "Invalid argument for cursor.", http.StatusBadRequest)
+			return 0, assetsCursor{}, false
+		}
+	}
+	return limit, after, true
+}
+
+// scans the table for up to limit assets after the given ID, in the
+// table's own key order, which doesn't change as assets are updated
+func scanAssetsPage(ctx context.Context, limit int, after string) (assetsResponse, error) {
+	response := assetsResponse{Assets: []assetMeta{}}
+	input := &dynamodb.ScanInput{
+		TableName:      aws.String(tableName),
+		ConsistentRead: aws.Bool(true),
+		Limit:          aws.Int64(int64(limit)),
+	}
+	if after != "" {
+		input.ExclusiveStartKey = assetKey(after)
+	}
+	for {
+		result, err := dbSvc.ScanWithContext(ctx, input)
+		if err != nil {
+			return response, err
+		}
+		// records of other kinds share the table, so pages can come up short
+		for i, item := range result.Items {
+			assetID := stringAttribute(item, "id")
+			if !isAssetKey(assetID) || isDeleted(item) {
+				continue
+			}
+			response.Assets = append(response.Assets, describeAsset(item))
+			if len(response.Assets) == limit {
+				if i < len(result.Items)-1 || len(result.LastEvaluatedKey) > 0 {
+					response.Cursor = encodeAssetsCursor(assetsCursor{ID: assetID})
+				}
+				return response, nil
+			}
+		}
+		if len(result.LastEvaluatedKey) == 0 {
+			return response, nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+// lists the assets with a status created within a window, oldest first from
+// the status index; pending assets come from the reservation index instead,
+// in the order their uploads expire
+func listAssetsByStatus(w http.ResponseWriter, r *http.Request, limit int, after assetsCursor) {
+	status := r.URL.Query().Get("status")
+	switch status {
+	case assetStatusPending, assetStatusUploaded, assetStatusRejected, assetStatusDeleted:
+	default:
+		http.Error(w, "Invalid argument for status, must be pending, uploaded, rejected or deleted.", http.StatusBadRequest)
+		return
+	}
+	createdAfter, ok := timeParam(r, "created_after", -1)
+	if !ok {
+		http.Error(w, "Invalid argument for created_after, must be an RFC 3339 time.", http.StatusBadRequest)
+		return
+	}
+	createdBefore, ok := timeParam(r, "created_before", math.MaxInt64)
+	if !ok {
+		http.Error(w, "Invalid argument for created_before, must be an RFC 3339 time.", http.StatusBadRequest)
+		return
+	}
+	// both bounds are exclusive, and DynamoDB refuses an empty range
+	if createdAfter+1 > createdBefore-1 {
+		writeJSON(w, assetsResponse{Assets: []assetMeta{}})
+		return
+	}
+	values := map[string]*dynamodb.AttributeValue{
+		":after":  {N: aws.String(strconv.FormatInt(createdAfter+1, 10))},
+		":before": {N: aws.String(strconv.FormatInt(createdBefore-1, 10))},
+	}
+	query := &dynamodb.QueryInput{
+		TableName:                 aws.String(tableName),
+		ExpressionAttributeNames:  map[string]*string{"#status": aws.String("status")},
+		ExpressionAttributeValues: values,
+		Limit:                     aws.Int64(int64(limit)),
+	}
+	if status == assetStatusPending {
+		values[":shard"] = &dynamodb.AttributeValue{S: aws.String(reservationShard)}
+		query.IndexName = aws.String(reservationIndexName)
+		query.KeyConditionExpression = aws.String("reservation_shard = :shard")
+		query.FilterExpression = aws.String("attribute_not_exists(#status) AND created_at BETWEEN :after AND :before")
+		if after.ID != "" {
+			query.ExclusiveStartKey = assetKey(after.ID)
+			query.ExclusiveStartKey["reservation_shard"] = values[":shard"]
+			query.ExclusiveStartKey["upload_expires"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(after.UploadExpires, 10))}
+		}
+	} else {
+		values[":status"] = &dynamodb.AttributeValue{S: aws.String(status)}
+		query.IndexName = aws.String(statusIndexName)
+		query.KeyConditionExpression = aws.String("#status = :status AND created_at BETWEEN :after AND :before")
+		if after.ID != "" {
+			query.ExclusiveStartKey = assetKey(after.ID)
+			query.ExclusiveStartKey["status"] = values[":status"]
+			query.ExclusiveStartKey["created_at"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(after.CreatedAt, 10))}
+		}
+	}
+	result, err := dbSvc.QueryWithContext(r.Context(), query)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	response := assetsResponse{Assets: []assetMeta{}}
+	for _, item := range result.Items {
+		response.Assets = append(response.Assets, describeAsset(item))
+	}
+	// a filtered page can end past its last match, or have none at all
+	if last := result.LastEvaluatedKey; len(last) > 0 {
+		response.Cursor = encodeAssetsCursor(assetsCursor{
+			ID:            stringAttribute(last, "id"),
+			CreatedAt:     numberAttribute(last, "created_at"),
+			UploadExpires: numberAttribute(last, "upload_expires"),
+		})
+	}
+	writeJSON(w, response)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// a table scanned two records at a time: assets a, b and c, a deleted
+// asset and a version record
+type mockDBPagedScanClient struct {
+	mockDBClient
+	scans int
+}
+
+var pagedScanItems = []map[string]*dynamodb.AttributeValue{
+	{"id": {S: aws.String("a")}},
+	{"id": {S: aws.String("version:a:v1")}},
+	{"id": {S: aws.String("b")}, "status": {S: aws.String(assetStatusUploaded)}},
+	{"id": {S: aws.String("gone")}, "status": {S: aws.String(assetStatusDeleted)}},
+	{"id": {S: aws.String("c")}},
+}
+
+func (m *mockDBPagedScanClient) Scan(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+	m.scans++
+	start := 0
+	if input.ExclusiveStartKey != nil {
+		for i, item := range pagedScanItems {
+			if *item["id"].S == *input.ExclusiveStartKey["id"].S {
+				start = i + 1
+			}
+		}
+	}
+	end := start + 2
+	output := &dynamodb.ScanOutput{}
+	if end < len(pagedScanItems) {
+		output.LastEvaluatedKey = assetKey(*pagedScanItems[end-1]["id"].S)
+	} else {
+		end = len(pagedScanItems)
+	}
+	output.Items = pagedScanItems[start:end]
+	return output, nil
+}
+func (m *mockDBPagedScanClient) ScanWithContext(ctx aws.Context, input *dynamodb.ScanInput, opts ...request.Option) (*dynamodb.ScanOutput, error) {
+	return m.Scan(input)
+}
+
+func TestListAssets(t *testing.T) {
+	dbSvc = &mockDBPagedScanClient{}
+	var ids []string
+	cursor := ""
+	for pages := 0; pages < 5; pages++ {
+		r := httptest.NewRequest(http.MethodGet, "/assets?limit=2&cursor="+cursor, nil)
+		w := httptest.NewRecorder()
+		listAssets(w, r)
+		if w.Result().StatusCode != http.StatusOK {
+			t.Fatalf("Incorrect status listing assets: %d", w.Result().StatusCode)
+		}
+		var response assetsResponse
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		for _, asset := range response.Assets {
+			ids = append(ids, asset.ID)
+		}
+		if cursor = response.Cursor; cursor == "" {
+			break
+		}
+	}
+	if len(ids) != 3 || ids[0] != "a" || ids[1] != "b" || ids[2] != "c" {
+		t.Errorf("Incorrect assets listed: %v", ids)
+	}
+
+	for _, query := range []string{"limit=0", "limit=101", "cursor=!!", "cursor=" + encodeAssetsCursor(assetsCursor{ID: "version:a:v1"})} {
+		r := httptest.NewRequest(http.MethodGet, "/assets?"+query, nil)
+		w := httptest.NewRecorder()
+		listAssets(w, r)
+		if w.Result().StatusCode != http.StatusBadRequest {
+			t.Errorf("Incorrect status listing with %s: %d", query, w.Result().StatusCode)
+		}
+	}
+}
+
+// records the last query and answers with one uploaded asset, more to come
+type mockDBStatusQueryClient struct {
+	mockDBClient
+	input *dynamodb.QueryInput
+}
+
+func (m *mockDBStatusQueryClient) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	m.input = input
+	return &dynamodb.QueryOutput{
+		Items: []map[string]*dynamodb.AttributeValue{{
+			"id":         {S: aws.String("a")},
+			"status":     {S: aws.String(assetStatusUploaded)},
+			"created_at": {N: aws.String("1000")},
+		}},
+		LastEvaluatedKey: map[string]*dynamodb.AttributeValue{
+			"id":         {S: aws.String("a")},
+			"status":     {S: aws.String(assetStatusUploaded)},
+			"created_at": {N: aws.String("1000")},
+		},
+	}, nil
+}
+func (m *mockDBStatusQueryClient) QueryWithContext(ctx aws.Context, input *dynamodb.QueryInput, opts ...request.Option) (*dynamodb.QueryOutput, error) {
+	return m.Query(input)
+}
+
+func TestListAssetsByStatus(t *testing.T) {
+	mock := &mockDBStatusQueryClient{}
+	dbSvc = mock
+	r := httptest.NewRequest(http.MethodGet, "/assets?status=uploaded&created_after=1970-01-01T00:00:00Z&created_before=1970-01-01T00:00:02Z", nil)
+	w := httptest.NewRecorder()
+	listAssets(w, r)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Incorrect status listing by status: %d", w.Result().StatusCode)
+	}
+	if aws.StringValue(mock.input.IndexName) != statusIndexName ||
+		aws.StringValue(mock.input.ExpressionAttributeValues[":after"].N) != "1" ||
+		aws.StringValue(mock.input.ExpressionAttributeValues[":before"].N) != "1999" {
+		t.Errorf("Incorrect query listing by status: %v", mock.input)
+	}
+	var response assetsResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Assets) != 1 || response.Assets[0].CreatedAt != 1000 || response.Cursor == "" {
+		t.Fatalf("Incorrect assets listed by status: %+v", response)
+	}
+
+	// the next page resumes from the cursor's place in the index
+	r = httptest.NewRequest(http.MethodGet, "/assets?status=uploaded&cursor="+response.Cursor, nil)
+	listAssets(httptest.NewRecorder(), r)
+	if start := mock.input.ExclusiveStartKey; aws.StringValue(start["id"].S) != "a" || aws.StringValue(start["created_at"].N) != "1000" {
+		t.Errorf("Incorrect start key resuming by status: %v", start)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/assets?status=pending", nil)
+	listAssets(httptest.NewRecorder(), r)
+	if aws.StringValue(mock.input.IndexName) != reservationIndexName || mock.input.FilterExpression == nil {
+		t.Errorf("Incorrect query listing pending assets: %v", mock.input)
+	}
+
+	for _, query := range []string{"status=stuck", "status=uploaded&created_after=yesterday", "status=uploaded&tag=a", "created_before=2024-01-01T00:00:00Z"} {
+		r := httptest.NewRequest(http.MethodGet, "/assets?"+query, nil)
+		w := httptest.NewRecorder()
+		listAssets(w, r)
+		if w.Result().StatusCode != http.StatusBadRequest {
+			t.Errorf("Incorrect status listing with %s: %d", query, w.Result().StatusCode)
+		}
+	}
+}
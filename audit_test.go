@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func queryAudit(t *testing.T, query string) (int, auditResponse) {
+	w := httptest.NewRecorder()
+	getAuditLog(w, httptest.NewRequest(http.MethodGet, "/audit"+query, nil))
+	var response auditResponse
+	json.NewDecoder(w.Body).Decode(&response)
+	return w.Code, response
+}
+
+func TestAuditLog(t *testing.T) {
+	defer resetAPIKeys()
+	defer func() { auditLog = nil }()
+	parseAPIKeys("ci=k1")
+	auditLog = &fileAuditSink{path: filepath.Join(t.TempDir(), "audit.log")}
+	handler := withAudit(withAuthentication(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/asset":
+			writeJSON(w, initAssetResponse{ID: "newID"})
+		case r.Method == http.MethodDelete:
+			http.Error(w, "Not found.", http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})))
+	for _, test := range []struct{ method, path, key string }{
+		{http.MethodPost, "/asset", "k1"},
+		{http.MethodGet, "/asset/newID", "k1"},
+		{http.MethodPut, "/asset/newID", "k1"},
+		{http.MethodDelete, "/asset/otherID", "k1"},
+		{http.MethodDelete, "/asset/newID", "wrong"},
+	} {
+		r := httptest.NewRequest(test.method, test.path, nil)
+		r.Header.Set(apiKeyHeader, test.key)
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	flushAudit()
+
+	// refused requests are audited too, without a caller
+	code, response := queryAudit(t, "?asset_id=newID&operation=delete")
+	if code != http.StatusOK || len(response.Entries) != 1 || response.Entries[0].Status != http.StatusUnauthorized || response.Entries[0].Key != "" {
+		t.Fatalf("Refused request not audited: %d %+v", code, response)
+	}
+
+	code, response = queryAudit(t, "?caller=ci")
+	if code != http.StatusOK || len(response.Entries) != 3 || response.Cursor != "" {
+		t.Fatalf("Incorrect audit log: %d %+v", code, response)
+	}
+	for i, want := range []auditEntry{
+		{Operation: "init", AssetID: "newID", Status: http.StatusOK},
+		{Operation: "mark_uploaded", AssetID: "newID", Status: http.StatusNoContent},
+		{Operation: "delete", AssetID: "otherID", Status: http.StatusNotFound},
+	} {
+		got := response.Entries[i]
+		if got.Operation != want.Operation || got.AssetID != want.AssetID || got.Status != want.Status || got.Key != "ci" || got.Auth != apiKeyMethod || got.SourceIP != "192.0.2.1" {
+			t.Errorf("Incorrect audit entry %d: %+v", i, got)
+		}
+	}
+
+	if _, response = queryAudit(t, "?asset_id=newID&limit=1"); len(response.Entries) != 1 || response.Cursor == "" {
+		t.Fatalf("Incorrect first page: %+v", response)
+	}
+	if _, response = queryAudit(t, "?asset_id=newID&limit=1&cursor="+response.Cursor); len(response.Entries) != 1 || response.Entries[0].Operation != "mark_uploaded" {
+		t.Errorf("Incorrect second page: %+v", response)
+	}
+	if _, response = queryAudit(t, "?caller=someone-else"); len(response.Entries) != 0 {
+		t.Errorf("Got entries of another caller: %+v", response)
+	}
+	if code, _ = queryAudit(t, "?since=2026-01-01T00:00:00Z&until=2026-06-01T00:00:00Z"); code != http.StatusBadRequest {
+		t.Errorf("Didn't get 400 for a window over 31 days: %d", code)
+	}
+}
+
+func TestAuditOperation(t *testing.T) {
+	for _, test := range []struct {
+		method, path, operation, assetID string
+	}{
+		{http.MethodPatch, "/asset/someID", "metadata", "someID"},
+		{http.MethodPost, "/asset/someID/complete", "mark_uploaded", "someID"},
+		{http.MethodPost, "/asset/someID/archive/restore", "archive_restore", "someID"},
+		{http.MethodPost, "/asset/upload", "init", ""},
+		{http.MethodPatch, "/tus/someID", "tus", "someID"},
+		{http.MethodPost, "/deletions", "deletions", ""},
+	} {
+		operation, assetID := auditOperation(test.method, test.path)
+		if operation != test.operation || assetID != test.assetID {
+			t.Errorf("Incorrect operation for %s %s: %s %s", test.method, test.path, operation, assetID)
+		}
+	}
+}
+
+// keeps items put and returns those of the day queried
+type mockDBAuditClient struct {
+	mockDBClient
+	items   []map[string]*dynamodb.AttributeValue
+	batches int
+	query   *dynamodb.QueryInput
+}
+
+// leaves the first put of each batch unprocessed, as throttling would
+func (m *mockDBAuditClient) BatchWriteItem(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+	m.batches++
+	output := &dynamodb.BatchWriteItemOutput{UnprocessedItems: map[string][]*dynamodb.WriteRequest{}}
+	for table, requests := range input.RequestItems {
+		if len(requests) > maxAuditWriteBatch {
+			return nil, fmt.Errorf("too many items in one batch: %d", len(requests))
+		}
+		for i, request := range requests {
+			if i == 0 && len(requests) > 1 {
+				output.UnprocessedItems[table] = append(output.UnprocessedItems[table], request)
+				continue
+			}
+			m.items = append(m.items, request.PutRequest.Item)
+		}
+	}
+	return output, nil
+}
+func (m *mockDBAuditClient) BatchWriteItemWithContext(ctx aws.Context, input *dynamodb.BatchWriteItemInput, opts ...request.Option) (*dynamodb.BatchWriteItemOutput, error) {
+	return m.BatchWriteItem(input)
+}
+func (m *mockDBAuditClient) QueryPages(input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool) error {
+	m.query = input
+	page := &dynamodb.QueryOutput{}
+	for _, item := range m.items {
+		if aws.StringValue(item["day"].S) == aws.StringValue(input.ExpressionAttributeValues[":day"].S) {
+			page.Items = append(page.Items, item)
+		}
+	}
+	fn(page, true)
+	return nil
+}
+func (m *mockDBAuditClient) QueryPagesWithContext(ctx aws.Context, input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool, opts ...request.Option) error {
+	return m.QueryPages(input, fn)
+}
+
+func TestDynamoAuditSink(t *testing.T) {
+	mock := &mockDBAuditClient{}
+	dbSvc = mock
+	defer func() { auditLog = nil }()
+	auditLog = &dynamoAuditSink{table: "audit"}
+	recordAudit(auditEntry{Sequence: "1792152000000-000000-00000000", At: 1792152000000, Operation: "delete", AssetID: "someID", Key: "ops"})
+	flushAudit()
+	if len(mock.items) != 1 || aws.StringValue(mock.items[0]["day"].S) != "2026-10-16" {
+		t.Fatalf("Entry not put by day: %+v", mock.items)
+	}
+	// larger flushes go in batches, throttled puts tried again
+	var entries []auditEntry
+	for i := 0; i < 30; i++ {
+		entries = append(entries, auditEntry{Sequence: fmt.Sprintf("1792152000000-%06d-00000000", i), At: 1792152000000, Operation: "delete", Key: "batch"})
+	}
+	mock.batches = 0
+	if err := auditLog.write(entries); err != nil || len(mock.items) != 31 || mock.batches < 2 {
+		t.Fatalf("Entries not put in batches: %v, %d put in %d batches", err, len(mock.items)-1, mock.batches)
+	}
+	mock.items = mock.items[:1]
+
+	_, response := queryAudit(t, "?since=2026-10-16T00:00:00Z&until=2026-10-17T00:00:00Z&caller=ops")
+	if len(response.Entries) != 1 || response.Entries[0].AssetID != "someID" {
+		t.Errorf("Incorrect entries: %+v", response)
+	}
+	if aws.StringValue(mock.query.ExpressionAttributeValues[":caller"].S) != "ops" || mock.query.FilterExpression == nil {
+		t.Errorf("Caller not filtered in DynamoDB: %+v", mock.query)
+	}
+}
+
+type mockLogsClient struct {
+	cloudwatchlogsiface.CloudWatchLogsAPI
+	streams int
+	events  []*cloudwatchlogs.InputLogEvent
+	pattern string
+}
+
+func (m *mockLogsClient) CreateLogStream(*cloudwatchlogs.CreateLogStreamInput) (*cloudwatchlogs.CreateLogStreamOutput, error) {
+	m.streams++
+	return &cloudwatchlogs.CreateLogStreamOutput{}, nil
+}
+func (m *mockLogsClient) PutLogEvents(input *cloudwatchlogs.PutLogEventsInput) (*cloudwatchlogs.PutLogEventsOutput, error) {
+	m.events = append(m.events, input.LogEvents...)
+	return &cloudwatchlogs.PutLogEventsOutput{}, nil
+}
+func (m *mockLogsClient) FilterLogEventsPages(input *cloudwatchlogs.FilterLogEventsInput, fn func(*cloudwatchlogs.FilterLogEventsOutput, bool) bool) error {
+	m.pattern = aws.StringValue(input.FilterPattern)
+	page := &cloudwatchlogs.FilterLogEventsOutput{}
+	for _, event := range m.events {
+		page.Events = append(page.Events, &cloudwatchlogs.FilteredLogEvent{Message: event.Message, Timestamp: event.Timestamp})
+	}
+	fn(page, true)
+	return nil
+}
+
+func (m *mockLogsClient) FilterLogEventsPagesWithContext(ctx aws.Context, input *cloudwatchlogs.FilterLogEventsInput, fn func(*cloudwatchlogs.FilterLogEventsOutput, bool) bool, opts ...request.Option) error {
+	return m.FilterLogEventsPages(input, fn)
+}
+
+func TestCloudWatchAuditSink(t *testing.T) {
+	mock := &mockLogsClient{}
+	logsSvc = mock
+	defer func() { logsSvc, auditLog = nil, nil }()
+	sink, err := newAuditSink("cloudwatch:/asset-uploader/audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditLog = sink
+	recordAudit(auditEntry{Sequence: "1792152000002-000000-00000000", At: 1792152000002, Operation: "delete", AssetID: "someID"})
+	recordAudit(auditEntry{Sequence: "1792152000001-000000-00000000", At: 1792152000001, Operation: "init", AssetID: "someID"})
+	flushAudit()
+	recordAudit(auditEntry{Sequence: "1792152000003-000000-00000000", At: 1792152000003, Operation: "tags", AssetID: "otherID"})
+	flushAudit()
+	// the stream is created once, and events put in time order
+	if mock.streams != 1 || len(mock.events) != 3 || aws.Int64Value(mock.events[0].Timestamp) != 1792152000001 {
+		t.Fatalf("Incorrect events put: %d %+v", mock.streams, mock.events)
+	}
+
+	_, response := queryAudit(t, "?since=2026-10-16T00:00:00Z&until=2026-10-17T00:00:00Z&asset_id=someID")
+	if len(response.Entries) != 2 || response.Entries[0].Operation != "init" {
+		t.Errorf("Incorrect entries: %+v", response)
+	}
+	if mock.pattern != `{ $.asset_id = "someID" }` {
+		t.Errorf("Incorrect filter pattern: %s", mock.pattern)
+	}
+	if _, err := newAuditSink("s3:bucket"); err == nil {
+		t.Errorf("Got no error for an unknown sink")
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+const (
+	jobKindAuditExport = "audit_export"
+	// exports are written under this prefix of the bucket, and kept
+	auditExportKeyPrefix = "audit-exports/"
+)
+
+// the hash the first exported entry is chained to
+var auditChainStart = strings.Repeat("0", 2*sha256.Size)
+
+// an exported audit entry, chained to the one before it so that changing,
+// dropping or reordering any entry changes every hash after it
+type chainedAuditEntry struct {
+	auditEntry
+	PrevHash string `json:"prev_hash"`
+	// hex SHA-256 of prev_hash followed by the entry's own JSON
+	Hash string `json:"hash"`
+}
+
+// describes an export, written next to it
+type auditExportManifest struct {
+	Since   time.Time `json:"since"`
+	Until   time.Time `json:"until"`
+	Entries int       `json:"entries"`
+	Key     string    `json:"key"`
+	// the hash of the last entry, vouching for the whole chain; keep it
+	// apart from the export to check the export against later
+	Digest     string    `json:"digest"`
+	ExportedAt time.Time `json:"exported_at"`
+}
+
+type auditExportResult struct {
+	auditExportManifest
+	DownloadURL string `json:"download_url"`
+}
+
+// chains an entry to the hash of the one before it
+func chainAuditEntry(prev string, entry auditEntry) (chainedAuditEntry, error) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return chainedAuditEntry{}, err
+	}
+	sum := sha256.Sum256(append([]byte(prev), data...))
+	return chainedAuditEntry{auditEntry: entry, PrevHash: prev, Hash: hex.EncodeToString(sum[:])}, nil
+}
+
+// exports the audit entries from since to until as hash chained JSON lines
+// to S3 in a background job, with a manifest holding the chain's digest
+func startAuditExportJob(since, until time.Time) *job {
+	return startJob(jobKindAuditExport, 0, func(j *job) (interface{}, error) {
+		key := auditExportKeyPrefix + j.status.ID + ".jsonl"
+		result := auditExportResult{auditExportManifest: auditExportManifest{Since: since, Until: until, Key: key}}
+
+		// stream the export to S3 as it's written
+		pr, pw := io.Pipe()
+		written := make(chan error, 1)
+		go func() {
+			err := writeAuditExport(j, pw, auditFilter{since: since, until: until}, &result.auditExportManifest)
+			pw.CloseWithError(err)
+			written <- err
+		}()
+		uploader := s3manager.NewUploaderWithClient(s3Svc)
+		_, err := uploader.Upload(&s3manager.UploadInput{
+			Bucket:                  aws.String(bucketName),
+			Key:                     aws.String(key),
+			Body:                    pr,
+			ContentType:             aws.String("application/x-ndjson"),
+			ServerSideEncryption:    encryptionAlgorithm(),
+			SSEKMSKeyId:             optionalString(kmsKeyID),
+			SSEKMSEncryptionContext: encryptionContextHeader(key),
+		})
+		pr.CloseWithError(err)
+		if werr := <-written; werr != nil {
+			return result, werr
+		}
+		if err != nil {
+			return result, err
+		}
+
+		result.ExportedAt = time.Now().UTC().Truncate(time.Second)
+		manifest, err := json.Marshal(result.auditExportManifest)
+		if err != nil {
+			return result, err
+		}
+		manifestKey := strings.TrimSuffix(key, ".jsonl") + ".manifest.json"
+		_, err = uploader.Upload(&s3manager.UploadInput{
+			Bucket:                  aws.String(bucketName),
+			Key:                     aws.String(manifestKey),
+			Body:                    bytes.NewReader(manifest),
+			ContentType:             aws.String("application/json"),
+			ServerSideEncryption:    encryptionAlgorithm(),
+			SSEKMSKeyId:             optionalString(kmsKeyID),
+			SSEKMSEncryptionContext: encryptionContextHeader(manifestKey),
+		})
+		if err != nil {
+			return result, err
+		}
+
+		req, _ := s3Svc.GetObjectRequest(&s3.GetObjectInput{
+			Bucket: aws.String(bucketName),
+			Key:    aws.String(key),
+		})
+		result.DownloadURL, err = req.Presign(bundleURLTimeout)
+		return result, err
+	})
+}
+
+// writes every entry the filter matches, oldest first, a page at a time,
+// recording their count and the chain's digest in the manifest
+func writeAuditExport(j *job, w io.Writer, filter auditFilter, manifest *auditExportManifest) error {
+	encoder := json.NewEncoder(w)
+	prev := auditChainStart
+	for {
+		select {
+		case <-j.canceled():
+			return errJobCanceled
+		default:
+		}
+		entries, err := auditLog.query(context.Background(), filter, maxAuditPage)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			chained, err := chainAuditEntry(prev, entry)
+			if err != nil {
+				return err
+			}
+			if err := encoder.Encode(chained); err != nil {
+				return err
+			}
+			prev = chained.Hash
+			manifest.Entries++
+			j.advance()
+		}
+		if len(entries) < maxAuditPage {
+			break
+		}
+		// the next page starts no earlier than the last entry seen
+		last := entries[len(entries)-1]
+		filter.after = last.Sequence
+		if at := time.Unix(0, last.At*int64(time.Millisecond)); at.After(filter.since) {
+			filter.since = at
+		}
+	}
+	manifest.Digest = prev
+	return nil
+}
+
+// starts exporting the audit log from since to until (RFC 3339, the last
+// day by default, at most 31 days apart) for auditors
+func exportAuditLog(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodPost) {
+		return
+	}
+	if auditLog == nil {
+		http.Error(w, "Audit log is not enabled.", http.StatusNotFound)
+		return
+	}
+	since, until, ok := parseAuditRange(w, r)
+	if !ok {
+		return
+	}
+	acceptJob(w, startAuditExportJob(since, until))
+}
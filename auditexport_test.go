@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// remembers the body of every object put, by key
+type mockS3PutKeysClient struct {
+	mockS3Client
+	mu     sync.Mutex
+	bodies map[string][]byte
+}
+
+func (m *mockS3PutKeysClient) PutObjectRequest(input *s3.PutObjectInput) (*request.Request, *s3.PutObjectOutput) {
+	body, _ := ioutil.ReadAll(input.Body)
+	m.mu.Lock()
+	m.bodies[aws.StringValue(input.Key)] = body
+	m.mu.Unlock()
+	r := request.New(aws.Config{}, metadata.ClientInfo{}, request.Handlers{}, nil, &request.Operation{}, nil, nil)
+	return r, &s3.PutObjectOutput{}
+}
+
+func TestAuditExport(t *testing.T) {
+	defer func() { auditLog = nil }()
+	auditLog = &fileAuditSink{path: filepath.Join(t.TempDir(), "audit.log")}
+	now := time.Now()
+	var entries []auditEntry
+	for i, operation := range []string{"init", "mark_uploaded", "delete"} {
+		at := now.Add(time.Duration(i-3) * time.Minute)
+		entries = append(entries, auditEntry{Sequence: eventSequence(at), At: at.UnixNano() / int64(time.Millisecond), Operation: operation, AssetID: "someID", Status: http.StatusOK})
+	}
+	auditLog.write(entries)
+	s3 := &mockS3PutKeysClient{bodies: map[string][]byte{}}
+	s3Svc = s3
+
+	w := httptest.NewRecorder()
+	exportAuditLog(w, httptest.NewRequest(http.MethodPost, "/audit/export", nil))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Incorrect status starting an audit export: %d", w.Code)
+	}
+	var started jobStatus
+	json.NewDecoder(w.Body).Decode(&started)
+	j := waitForJob(t, started.ID)
+	if j.State != jobStateDone || j.Done != 3 {
+		t.Fatalf("Audit export did not finish: %s with %d exported (%s)", j.State, j.Done, j.Error)
+	}
+
+	key := auditExportKeyPrefix + started.ID + ".jsonl"
+	var manifest auditExportManifest
+	if err := json.Unmarshal(s3.bodies[auditExportKeyPrefix+started.ID+".manifest.json"], &manifest); err != nil || manifest.Entries != 3 || manifest.Key != key {
+		t.Fatalf("Incorrect manifest: %+v %v", manifest, err)
+	}
+	// every line chains onto the one before, ending in the digest
+	prev := auditChainStart
+	scanner := bufio.NewScanner(bytes.NewReader(s3.bodies[key]))
+	for i := 0; scanner.Scan(); i++ {
+		var line chainedAuditEntry
+		json.Unmarshal(scanner.Bytes(), &line)
+		want, _ := chainAuditEntry(prev, entries[i])
+		if line.Operation != entries[i].Operation || line.PrevHash != prev || line.Hash != want.Hash {
+			t.Errorf("Incorrect exported entry %d: %+v", i, line)
+		}
+		prev = line.Hash
+	}
+	if prev != manifest.Digest {
+		t.Errorf("Chain ends in %s, not the digest %s", prev, manifest.Digest)
+	}
+
+	// a changed entry doesn't hash the same
+	changed := entries[0]
+	changed.Status = http.StatusForbidden
+	original, _ := chainAuditEntry(auditChainStart, entries[0])
+	if tampered, _ := chainAuditEntry(auditChainStart, changed); tampered.Hash == original.Hash {
+		t.Error("Changed entry hashes the same")
+	}
+
+	w = httptest.NewRecorder()
+	exportAuditLog(w, httptest.NewRequest(http.MethodPost, "/audit/export?since=2026-01-01T00:00:00Z&until=2026-06-01T00:00:00Z", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Didn't get 400 exporting over 31 days: %d", w.Code)
+	}
+}
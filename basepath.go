@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// the path prefix every route is served under, e.g. /files, empty to serve
+// from the root; generated urls include it
+var basePath string
+
+// normalizes a -base-path value to a leading slash and no trailing one
+func parseBasePath(value string) (string, error) {
+	value = strings.TrimSuffix(value, "/")
+	if value == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(value, "/") || strings.ContainsAny(value, "?#") || strings.Contains(value, "//") {
+		return "", fmt.Errorf("invalid base path '%s'", value)
+	}
+	return value, nil
+}
+
+// serves requests under the base path with it stripped, so routes and
+// handlers see the same paths however the service is mounted; anything
+// else is not found
+func withBasePath(next http.Handler) http.Handler {
+	if basePath == "" {
+		return next
+	}
+	stripped := http.StripPrefix(basePath, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, basePath+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		stripped.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseBasePath(t *testing.T) {
+	for value, expected := range map[string]string{"": "", "/": "", "/files": "/files", "/files/": "/files", "/a/b": "/a/b"} {
+		if path, err := parseBasePath(value); err != nil || path != expected {
+			t.Errorf("Incorrect base path for '%s': '%s' %v", value, path, err)
+		}
+	}
+	for _, value := range []string{"files", "/files?x", "//files"} {
+		if _, err := parseBasePath(value); err == nil {
+			t.Errorf("Base path '%s' should be invalid", value)
+		}
+	}
+}
+
+func TestWithBasePath(t *testing.T) {
+	basePath = "/files"
+	defer func() { basePath = "" }()
+	var seen string
+	handler := withBasePath(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.URL.Path
+		w.Header().Set("Location", serviceURL(r, "/download/x"))
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/files/asset/abc", nil))
+	if w.Result().StatusCode != http.StatusOK || seen != "/asset/abc" {
+		t.Errorf("Incorrect path under base path: %d '%s'", w.Result().StatusCode, seen)
+	}
+	if location := w.Header().Get("Location"); location != "http://example.com/files/download/x" {
+		t.Errorf("Incorrect url generated under base path: %s", location)
+	}
+
+	for _, path := range []string{"/asset/abc", "/filesx/asset", "/files"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Result().StatusCode != http.StatusNotFound {
+			t.Errorf("Incorrect status for %s outside base path: %d", path, w.Result().StatusCode)
+		}
+	}
+}
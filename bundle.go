@@ -0,0 +1,228 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+const (
+	jobKindBundle = "bundle"
+	maxBundleIDs  = 1000
+	// finished archives are written under this prefix of the bucket
+	bundleKeyPrefix = "bundles/"
+	// bundle links last as long as the job that reports them
+	bundleURLTimeout    = jobRetention
+	bundleSweepInterval = time.Hour
+)
+
+// how long after they're started archives are kept before the bundle sweep
+// deletes them, zero to keep them
+var bundleRetention = 24 * time.Hour
+
+type bundleRequest struct {
+	IDs []string
+}
+
+type bundleResult struct {
+	DownloadURL string `json:"download_url"`
+	// assets left out because they're missing, unfinished, expired or
+	// embargoed
+	Skipped []string `json:"skipped"`
+}
+
+// zips assets into a single object in a background job
+func startBundleJob(ids []string) *job {
+	return startJob(jobKindBundle, len(ids), func(j *job) (interface{}, error) {
+		key := bundleKeyPrefix + j.status.ID + ".zip"
+		result := bundleResult{Skipped: []string{}}
+
+		// stream the archive to S3 as it's written
+		pr, pw := io.Pipe()
+		written := make(chan error, 1)
+		go func() {
+			err := writeBundle(j, pw, ids, &result)
+			pw.CloseWithError(err)
+			written <- err
+		}()
+		uploader := s3manager.NewUploaderWithClient(s3Svc)
+		_, err := uploader.Upload(&s3manager.UploadInput{
+			Bucket:                  aws.String(bucketName),
+			Key:                     aws.String(key),
+			Body:                    pr,
+			ContentType:             aws.String("application/zip"),
+			ContentDisposition:      aws.String(dispositionHeader(dispositionAttachment, "bundle.zip")),
+			ServerSideEncryption:    encryptionAlgorithm(),
+			SSEKMSKeyId:             optionalString(kmsKeyID),
+			SSEKMSEncryptionContext: encryptionContextHeader(key),
+		})
+		pr.CloseWithError(err)
+		if werr := <-written; werr != nil {
+			return result, werr
+		}
+		if err != nil {
+			return result, err
+		}
+
+		req, _ := s3Svc.GetObjectRequest(&s3.GetObjectInput{
+			Bucket: aws.String(bucketName),
+			Key:    aws.String(key),
+		})
+		result.DownloadURL, err = req.Presign(bundleURLTimeout)
+		return result, err
+	})
+}
+
+// writes a zip of the downloadable assets among ids, noting the rest as
+// skipped
+func writeBundle(j *job, w io.Writer, ids []string, result *bundleResult) error {
+	zw := zip.NewWriter(w)
+	names := map[string]bool{}
+	for _, id := range ids {
+		select {
+		case <-j.canceled():
+			return errJobCanceled
+		default:
+		}
+		added, err := addToBundle(zw, id, names)
+		if err != nil {
+			return err
+		}
+		if !added {
+			result.Skipped = append(result.Skipped, id)
+		}
+		j.advance()
+	}
+	return zw.Close()
+}
+
+// copies an asset's object into the archive, named after its filename when
+// it has one, returning false if the asset can't be downloaded
+func addToBundle(zw *zip.Writer, assetID string, names map[string]bool) (bool, error) {
+	result, err := dbSvc.GetItem(&dynamodb.GetItemInput{
+		Key:       assetKey(assetID),
+		TableName: aws.String(tableName),
+	})
+	if err != nil {
+		return false, err
+	}
+	item := result.Item
+	if stringAttribute(item, "status") != assetStatusUploaded || isExpired(item) || isEmbargoed(item) {
+		return false, nil
+	}
+
+	name := bundleEntryName(assetID, item, names)
+	object, err := s3Svc.GetObject(&s3.GetObjectInput{
+		Bucket:    aws.String(bucketName),
+		Key:       aws.String(objectKey(assetID, item)),
+		VersionId: optionalString(stringAttribute(item, "s3_version_id")),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidObjectState" {
+		// archived and not restored
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer object.Body.Close()
+	header := &zip.FileHeader{Name: name, Method: zip.Deflate}
+	if object.LastModified != nil {
+		header.Modified = *object.LastModified
+	} else {
+		header.Modified = time.Now()
+	}
+	entry, err := zw.CreateHeader(header)
+	if err != nil {
+		return false, err
+	}
+	_, err = io.Copy(entry, object.Body)
+	return err == nil, err
+}
+
+// names an asset's entry in a bundle after its filename when it has one,
+// told apart by its ID from entries already named so
+func bundleEntryName(assetID string, item map[string]*dynamodb.AttributeValue, names map[string]bool) string {
+	name := stringAttribute(item, "filename")
+	if name == "" || name == "." || name == ".." {
+		name = assetID
+	}
+	if names[name] {
+		name = assetID + "-" + name
+	}
+	names[name] = true
+	return name
+}
+
+// starts bundling assets into a zip download
+func createBundle(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodPost) {
+		return
+	}
+	var reqBody bundleRequest
+	err := json.NewDecoder(r.Body).Decode(&reqBody)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON payload: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	if len(reqBody.IDs) == 0 || len(reqBody.IDs) > maxBundleIDs {
+		http.Error(w, fmt.Sprintf("Invalid value for key IDs, must list 1 to %d ids.", maxBundleIDs), http.StatusBadRequest)
+		return
+	}
+	acceptJob(w, startBundleJob(reqBody.IDs))
+}
+
+// deletes old archives until stopped
+func watchBundles(stop <-chan struct{}) {
+	for {
+		if err := deleteOldBundles(); err != nil {
+			log.Println(err.Error())
+		}
+		if !pause(stop, bundleSweepInterval) {
+			return
+		}
+	}
+}
+
+// deletes every version of the archives started over the bundle retention
+// ago, their download links long expired
+func deleteOldBundles() error {
+	if bundleRetention <= 0 {
+		return nil
+	}
+	cutoff := time.Now().Add(-bundleRetention)
+	var old []*s3.ObjectIdentifier
+	err := s3Svc.ListObjectVersionsPages(&s3.ListObjectVersionsInput{
+		Bucket: aws.String(bucketName),
+		Prefix: aws.String(bundleKeyPrefix),
+	}, func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
+		for _, v := range page.Versions {
+			if aws.TimeValue(v.LastModified).Before(cutoff) {
+				old = append(old, &s3.ObjectIdentifier{Key: v.Key, VersionId: v.VersionId})
+			}
+		}
+		for _, m := range page.DeleteMarkers {
+			if aws.TimeValue(m.LastModified).Before(cutoff) {
+				old = append(old, &s3.ObjectIdentifier{Key: m.Key, VersionId: m.VersionId})
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if len(old) > 0 {
+		log.Printf("deleting %d bundle archive versions from before %s", len(old), cutoff.Format(time.RFC3339))
+	}
+	return deleteObjectIdentifiers(context.Background(), old)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// remembers the body of the last object put
+type mockS3PutRecordingClient struct {
+	mockS3Client
+	body []byte
+}
+
+func (m *mockS3PutRecordingClient) PutObjectRequest(input *s3.PutObjectInput) (*request.Request, *s3.PutObjectOutput) {
+	m.body, _ = ioutil.ReadAll(input.Body)
+	r := request.New(aws.Config{}, metadata.ClientInfo{}, request.Handlers{}, nil, &request.Operation{}, nil, nil)
+	return r, &s3.PutObjectOutput{}
+}
+
+// an uploaded asset named hello.txt, plus one that isn't uploaded
+type mockDBBundleClient struct {
+	mockDBClient
+}
+
+func (m *mockDBBundleClient) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	if *input.Key["id"].S == "unfinished" {
+		return &dynamodb.GetItemOutput{Item: map[string]*dynamodb.AttributeValue{"id": {S: aws.String("unfinished")}}}, nil
+	}
+	output, _ := m.mockDBClient.GetItem(input)
+	output.Item["filename"] = &dynamodb.AttributeValue{S: aws.String("hello.txt")}
+	return output, nil
+}
+func (m *mockDBBundleClient) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return m.GetItem(input)
+}
+
+func TestBundle(t *testing.T) {
+	dbSvc = &mockDBBundleClient{}
+	s3 := &mockS3PutRecordingClient{}
+	s3Svc = s3
+	r := httptest.NewRequest(http.MethodPost, "/bundle", bytes.NewReader([]byte(`{"IDs":["a","b","unfinished"]}`)))
+	w := httptest.NewRecorder()
+
+	createBundle(w, r)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Incorrect status starting a bundle: %d", resp.StatusCode)
+	}
+	jsonResp := jobStatus{}
+	json.NewDecoder(resp.Body).Decode(&jsonResp)
+
+	j := waitForJob(t, jsonResp.ID)
+	if j.State != jobStateDone || j.Done != 3 {
+		t.Fatalf("Bundle did not finish: %s with %d added (%s)", j.State, j.Done, j.Error)
+	}
+	result := j.Result.(map[string]interface{})
+	if skipped := result["skipped"].([]interface{}); len(skipped) != 1 || skipped[0] != "unfinished" {
+		t.Errorf("Incorrect assets skipped: %v", skipped)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(s3.body), int64(len(s3.body)))
+	if err != nil {
+		t.Fatalf("Bundle isn't a zip: %s", err)
+	}
+	if len(zr.File) != 2 || zr.File[0].Name != "hello.txt" || zr.File[1].Name != "b-hello.txt" {
+		t.Fatalf("Incorrect bundle entries: %v", zr.File)
+	}
+	f, _ := zr.File[0].Open()
+	if content, _ := ioutil.ReadAll(f); string(content) != "Hello world!" {
+		t.Errorf("Incorrect bundle entry content: %q", content)
+	}
+}
+func TestBundleBadPayload(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/bundle", bytes.NewReader([]byte(`{"IDs":[]}`)))
+	w := httptest.NewRecorder()
+
+	createBundle(w, r)
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("Didn't get 400 for an empty bundle: %d", w.Result().StatusCode)
+	}
+}
+
+// archives started a week and a minute ago, and a delete marker from a week
+// ago, recording the versions deleted
+type mockS3BundlesClient struct {
+	mockS3VersionsClient
+	prefix string
+}
+
+func (m *mockS3BundlesClient) ListObjectVersionsPages(input *s3.ListObjectVersionsInput, fn func(*s3.ListObjectVersionsOutput, bool) bool) error {
+	m.prefix = aws.StringValue(input.Prefix)
+	weekAgo, minuteAgo := time.Now().Add(-7*24*time.Hour), time.Now().Add(-time.Minute)
+	fn(&s3.ListObjectVersionsOutput{
+		Versions: []*s3.ObjectVersion{
+			{Key: aws.String("bundles/old.zip"), VersionId: aws.String("v1"), LastModified: &weekAgo},
+			{Key: aws.String("bundles/new.zip"), VersionId: aws.String("v1"), LastModified: &minuteAgo},
+		},
+		DeleteMarkers: []*s3.DeleteMarkerEntry{{Key: aws.String("bundles/gone.zip"), VersionId: aws.String("v2"), LastModified: &weekAgo}},
+	}, true)
+	return nil
+}
+func (m *mockS3BundlesClient) ListObjectVersionsPagesWithContext(ctx aws.Context, input *s3.ListObjectVersionsInput, fn func(*s3.ListObjectVersionsOutput, bool) bool, opts ...request.Option) error {
+	return m.ListObjectVersionsPages(input, fn)
+}
+
+func TestDeleteOldBundles(t *testing.T) {
+	s3 := &mockS3BundlesClient{}
+	s3Svc = s3
+	defer func() { s3Svc = &mockS3Client{} }()
+	if err := deleteOldBundles(); err != nil {
+		t.Fatal(err)
+	}
+	if s3.prefix != bundleKeyPrefix || !reflect.DeepEqual(s3.deleted, []string{"bundles/old.zip@v1", "bundles/gone.zip@v2"}) {
+		t.Errorf("Incorrect bundle versions deleted under %s: %v", s3.prefix, s3.deleted)
+	}
+}
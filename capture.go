@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	captureFlushInterval = time.Minute
+	maxCaptureBatch      = 1000
+	// marks ids that were anonymized, so replays know to map them
+	anonymizedIDPrefix = "anon-"
+	// enough of an init response to find the id it created
+	maxCapturedBody = 4096
+)
+
+// bucket prefix request traces are written under, no capture when empty
+var capturePrefix string
+
+// keys the anonymized ids of this process, so an id maps to the same
+// placeholder throughout a capture but can't be recovered from it
+var captureKey = func() []byte {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return b
+}()
+
+// first path segments whose next segment is an id or token
+var capturedIDCollections = map[string]bool{
+	"asset": true, "tus": true, "jobs": true, "download": true, "public": true, "tenants": true,
+}
+
+// query parameters recorded verbatim; the rest are recorded without values
+var capturedParams = map[string]bool{
+	"timeout": true, "disposition": true, "upload": true, "limit": true, "count": true, "start": true,
+	"number": true, "duration": true, "max_downloads": true, "public": true, "kind": true,
+}
+
+// an anonymized record of a request and its outcome
+type requestTrace struct {
+	At         time.Time         `json:"at"`
+	Method     string            `json:"method"`
+	Path       string            `json:"path"`
+	Params     map[string]string `json:"params,omitempty"`
+	Status     int               `json:"status"`
+	DurationMS int64             `json:"duration_ms"`
+	// the anonymized id an init created, for replays to map to its own
+	Created string `json:"created,omitempty"`
+}
+
+var captureMu sync.Mutex
+var capturedTraces []requestTrace
+
+func anonymizeID(id string) string {
+	mac := hmac.New(sha256.New, captureKey)
+	mac.Write([]byte(id))
+	return anonymizedIDPrefix + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// replaces any id in a request path with its anonymized placeholder
+func anonymizePath(path string) string {
+	segments := strings.Split(path, "/")
+	if len(segments) > 2 && capturedIDCollections[segments[1]] && segments[2] != "" {
+		segments[2] = anonymizeID(segments[2])
+	}
+	return strings.Join(segments, "/")
+}
+
+// notes the status and, when asked, the start of the body of a response
+type captureWriter struct {
+	http.ResponseWriter
+	status int
+	body   *bytes.Buffer
+}
+
+func (c *captureWriter) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *captureWriter) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	if c.body != nil && c.body.Len() < maxCapturedBody {
+		c.body.Write(b)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+// records a trace of every request handled by next
+func withCapture(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cw := &captureWriter{ResponseWriter: w}
+		isInit := r.Method == http.MethodPost && r.URL.Path == "/asset"
+		if isInit {
+			cw.body = &bytes.Buffer{}
+		}
+		start := time.Now()
+		next.ServeHTTP(cw, r)
+
+		trace := requestTrace{
+			At:         start.UTC(),
+			Method:     r.Method,
+			Path:       anonymizePath(r.URL.Path),
+			Status:     cw.status,
+			DurationMS: int64(time.Since(start) / time.Millisecond),
+		}
+		if trace.Status == 0 {
+			trace.Status = http.StatusOK
+		}
+		if query := r.URL.Query(); len(query) > 0 {
+			trace.Params = map[string]string{}
+			for name := range query {
+				if capturedParams[name] {
+					trace.Params[name] = query.Get(name)
+				} else {
+					trace.Params[name] = ""
+				}
+			}
+		}
+		if isInit && trace.Status == http.StatusOK {
+			var created initAssetResponse
+			if json.Unmarshal(cw.body.Bytes(), &created) == nil && created.ID != "" {
+				trace.Created = anonymizeID(created.ID)
+			}
+		}
+		captureTrace(trace)
+	})
+}
+
+func captureTrace(trace requestTrace) {
+	captureMu.Lock()
+	capturedTraces = append(capturedTraces, trace)
+	full := len(capturedTraces) >= maxCaptureBatch
+	captureMu.Unlock()
+	if full {
+		go flushCapture()
+	}
+}
+
+// flushes captured traces until stopped, then once more
+func watchCapture(stop <-chan struct{}) {
+	for pause(stop, captureFlushInterval) {
+		flushCapture()
+	}
+	// traces since the last flush would be lost otherwise
+	flushCapture()
+}
+
+// writes the traces captured so far to S3 as one object of JSON lines
+func flushCapture() {
+	captureMu.Lock()
+	traces := capturedTraces
+	capturedTraces = nil
+	captureMu.Unlock()
+	if len(traces) == 0 {
+		return
+	}
+
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, trace := range traces {
+		encoder.Encode(trace)
+	}
+	key := capturePrefix + time.Now().UTC().Format("20060102T150405Z") + "-" + randomString(6) + ".jsonl"
+	_, err := s3Svc.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(bucketName),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body.Bytes()),
+		ContentType: aws.String("application/x-ndjson"),
+	})
+	if err != nil {
+		log.Printf("dropped %d request traces: %s", len(traces), err.Error())
+	}
+}
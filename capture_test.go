@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAnonymizePath(t *testing.T) {
+	anonymized := anonymizePath("/asset/someID/lock")
+	if !strings.HasPrefix(anonymized, "/asset/"+anonymizedIDPrefix) || !strings.HasSuffix(anonymized, "/lock") {
+		t.Errorf("Asset path not anonymized: %s", anonymized)
+	}
+	if anonymizePath("/asset/someID") != strings.TrimSuffix(anonymized, "/lock") {
+		t.Error("Same id anonymized differently")
+	}
+	for _, path := range []string{"/asset", "/assets/changes", "/tus"} {
+		if anonymizePath(path) != path {
+			t.Errorf("Path without an id changed: %s", anonymizePath(path))
+		}
+	}
+}
+func TestWithCapture(t *testing.T) {
+	capturedTraces = nil
+	handler := withCapture(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, initAssetResponse{ID: "newID"})
+	}))
+	r := httptest.NewRequest(http.MethodPost, "/asset?timeout=60&filename=secret.pdf", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	if len(capturedTraces) != 1 {
+		t.Fatalf("Incorrect number of traces captured: %d", len(capturedTraces))
+	}
+	trace := capturedTraces[0]
+	if trace.Status != http.StatusOK || trace.Created != anonymizeID("newID") {
+		t.Errorf("Incorrect trace captured: %+v", trace)
+	}
+	if trace.Params["timeout"] != "60" || trace.Params["filename"] != "" {
+		t.Errorf("Params not anonymized: %v", trace.Params)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	// records are spread over this many partitions of the changes index,
+	// by a hash of their id, so that writes don't all land on one
+	changesShards = 16
+	// the partition every record went to before the index was sharded;
+	// records written then stay there and are still listed
+	legacyChangesShard = "all"
+	defaultChangesPage = 100
+	maxChangesPage     = 1000
+)
+
+// how long a hard deleted asset's tombstone stays in the changes index, by
+// the table's TTL on expires; clients syncing less often miss its deletion
+var tombstoneTTL = 30 * 24 * time.Hour
+
+type assetChange struct {
+	ID        string `json:"id"`
+	Status    string `json:"status"`
+	Locale    string `json:"locale,omitempty"`
+	Pinned    bool   `json:"pinned,omitempty"`
+	UpdatedAt int64  `json:"updated_at"`
+}
+
+type changesResponse struct {
+	Changes []assetChange `json:"changes"`
+	Cursor  string        `json:"cursor"`
+}
+
+// position in one partition of the changes index
+type changesPosition struct {
+	ID        string `json:"i"`
+	UpdatedAt int64  `json:"u"`
+}
+
+// positions in the changes index, handed to clients as an opaque cursor
+type changesCursor struct {
+	// where partitions without a position of their own start; cursors from
+	// before the index was sharded only have this, in the legacy partition
+	changesPosition
+	Shards map[string]changesPosition `json:"s,omitempty"`
+}
+
+// the partition of the changes index an asset's record goes in
+func changesShard(assetID string) string {
+	h := fnv.New32a()
+	h.Write([]byte(assetID))
+	return strconv.Itoa(int(h.Sum32() % changesShards))
+}
+
+// every partition of the changes index, the legacy one included
+func changesShardNames() []string {
+	shards := []string{legacyChangesShard}
+	for i := 0; i < changesShards; i++ {
+		shards = append(shards, strconv.Itoa(i))
+	}
+	return shards
+}
+
+// where listing a partition resumes, and whether that's just past a record
+// rather than merely from a time
+func (c changesCursor) position(shard string) (changesPosition, bool) {
+	if pos, ok := c.Shards[shard]; ok {
+		return pos, true
+	}
+	if shard == legacyChangesShard && c.ID != "" {
+		return c.changesPosition, true
+	}
+	return changesPosition{UpdatedAt: c.UpdatedAt}, false
+}
+
+// the current time as an updated_at attribute, in unix milliseconds
+func updatedAtValue() *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{
+		N: aws.String(strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)),
+	}
+}
+
+// the record an asset deleted outright is replaced with, listed as deleted
+// by the changes index until it expires
+func tombstoneItem(assetID string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"id":            {S: aws.String(assetID)},
+		"status":        {S: aws.String(assetStatusDeleted)},
+		"tombstone":     {BOOL: aws.Bool(true)},
+		"changes_shard": {S: aws.String(changesShard(assetID))},
+		"updated_at":    updatedAtValue(),
+		"expires":       {N: aws.String(strconv.FormatInt(time.Now().Add(tombstoneTTL).Unix(), 10))},
+	}
+}
+
+func isTombstone(item map[string]*dynamodb.AttributeValue) bool {
+	v, ok := item["tombstone"]
+	return ok && aws.BoolValue(v.BOOL)
+}
+
+func encodeChangesCursor(c changesCursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeChangesCursor(s string) (changesCursor, error) {
+	var c changesCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(b, &c)
+	return c, err
+}
+
+// one partition's page of the changes index
+type changesShardPage struct {
+	shard string
+	items []map[string]*dynamodb.AttributeValue
+	// where the page stopped reading, if there's more
+	last map[string]*dynamodb.AttributeValue
+}
+
+// returns assets changed since the given cursor, oldest first, along with
+// a cursor to pass on the next call
+func listChanges(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	limit := defaultChangesPage
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > maxChangesPage {
+			http.Error(w, "Invalid argument for limit.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var cursor changesCursor
+	if since := r.URL.Query().Get("since"); since != "" {
+		var err error
+		cursor, err = decodeChangesCursor(since)
+		if err != nil {
+			http.Error(w, "Invalid argument for since.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// a locale filter matches the tag itself and anything more specific,
+	// so en also matches en-GB
+	var filter *string
+	filterValues := map[string]*dynamodb.AttributeValue{}
+	if value := r.URL.Query().Get("locale"); value != "" {
+		locale, err := normalizeLocale(value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid argument for locale: %s.", err.Error()), http.StatusBadRequest)
+			return
+		}
+		filter = aws.String("locale = :locale OR begins_with(locale, :localePrefix)")
+		filterValues[":locale"] = &dynamodb.AttributeValue{S: aws.String(locale)}
+		filterValues[":localePrefix"] = &dynamodb.AttributeValue{S: aws.String(locale + "-")}
+	}
+
+	// read a page from every partition at once, then merge them
+	shards := changesShardNames()
+	pages := make([]changesShardPage, len(shards))
+	group, ctx := errgroup.WithContext(r.Context())
+	for i, shard := range shards {
+		i, shard := i, shard
+		group.Go(func() error {
+			pos, exact := cursor.position(shard)
+			updatedAt := strconv.FormatInt(pos.UpdatedAt, 10)
+			query := &dynamodb.QueryInput{
+				TableName:              aws.String(tableName),
+				IndexName:              aws.String(changesIndexName),
+				KeyConditionExpression: aws.String("changes_shard = :shard AND updated_at >= :since"),
+				FilterExpression:       filter,
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":shard": {S: aws.String(shard)},
+					":since": {N: aws.String(updatedAt)},
+				},
+				Limit: aws.Int64(int64(limit)),
+			}
+			for k, v := range filterValues {
+				query.ExpressionAttributeValues[k] = v
+			}
+			if exact {
+				query.ExclusiveStartKey = map[string]*dynamodb.AttributeValue{
+					"id":            {S: aws.String(pos.ID)},
+					"changes_shard": {S: aws.String(shard)},
+					"updated_at":    {N: aws.String(updatedAt)},
+				}
+			}
+			result, err := dbSvc.QueryWithContext(ctx, query)
+			if err != nil {
+				return err
+			}
+			pages[i] = changesShardPage{shard: shard, items: result.Items, last: result.LastEvaluatedKey}
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// a partition with more to read could still hold changes from after
+	// where its page stopped, so nothing later than that is listed yet
+	cutoff := int64(math.MaxInt64)
+	for _, page := range pages {
+		if page.last != nil && numberAttribute(page.last, "updated_at") < cutoff {
+			cutoff = numberAttribute(page.last, "updated_at")
+		}
+	}
+	type shardChange struct {
+		assetChange
+		shard string
+	}
+	var merged []shardChange
+	for _, page := range pages {
+		for _, item := range page.items {
+			change := shardChange{shard: page.shard}
+			change.ID = stringAttribute(item, "id")
+			change.Status = stringAttribute(item, "status")
+			change.Locale = stringAttribute(item, "locale")
+			change.Pinned = isPinned(item)
+			change.UpdatedAt = numberAttribute(item, "updated_at")
+			if change.UpdatedAt <= cutoff {
+				merged = append(merged, change)
+			}
+		}
+	}
+	// stable, so changes at the same time keep their order in a partition
+	sort.SliceStable(merged, func(a, b int) bool { return merged[a].UpdatedAt < merged[b].UpdatedAt })
+	if len(merged) > limit {
+		merged = merged[:limit]
+	}
+
+	next := changesCursor{changesPosition: changesPosition{UpdatedAt: cursor.UpdatedAt}, Shards: map[string]changesPosition{}}
+	for _, shard := range shards {
+		if pos, exact := cursor.position(shard); exact {
+			next.Shards[shard] = pos
+		}
+	}
+	resp := changesResponse{Changes: []assetChange{}}
+	listed := map[string]int{}
+	for _, change := range merged {
+		resp.Changes = append(resp.Changes, change.assetChange)
+		next.Shards[change.shard] = changesPosition{ID: change.ID, UpdatedAt: change.UpdatedAt}
+		listed[change.shard]++
+	}
+	// a partition whose matches were all listed moves on to where its page
+	// stopped, since a filtered page can end past its last match
+	for _, page := range pages {
+		if page.last != nil && listed[page.shard] == len(page.items) {
+			next.Shards[page.shard] = changesPosition{ID: stringAttribute(page.last, "id"), UpdatedAt: numberAttribute(page.last, "updated_at")}
+		}
+	}
+	resp.Cursor = encodeChangesCursor(next)
+
+	writeJSON(w, resp)
+}
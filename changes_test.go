@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// a changes index holding items, read back a partition at a time in
+// updated_at order as DynamoDB would
+type mockDBChangesClient struct {
+	mockDBClient
+	items []map[string]*dynamodb.AttributeValue
+}
+
+func (m *mockDBChangesClient) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	values := input.ExpressionAttributeValues
+	start := stringAttribute(input.ExclusiveStartKey, "id")
+	output := &dynamodb.QueryOutput{}
+	for _, item := range m.items {
+		if stringAttribute(item, "changes_shard") != stringAttribute(values, ":shard") || numberAttribute(item, "updated_at") < numberAttribute(values, ":since") {
+			continue
+		}
+		if start != "" {
+			if stringAttribute(item, "id") == start {
+				start = ""
+			}
+			continue
+		}
+		output.Items = append(output.Items, item)
+		if int64(len(output.Items)) == aws.Int64Value(input.Limit) {
+			output.LastEvaluatedKey = item
+			break
+		}
+	}
+	return output, nil
+}
+func (m *mockDBChangesClient) QueryWithContext(ctx aws.Context, input *dynamodb.QueryInput, opts ...request.Option) (*dynamodb.QueryOutput, error) {
+	return m.Query(input)
+}
+
+func changeItem(assetID, shard string, updatedAt int64) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"id":            {S: aws.String(assetID)},
+		"status":        {S: aws.String(assetStatusUploaded)},
+		"changes_shard": {S: aws.String(shard)},
+		"updated_at":    {N: aws.String(strconv.FormatInt(updatedAt, 10))},
+	}
+}
+
+func TestListChanges(t *testing.T) {
+	db := &mockDBChangesClient{items: []map[string]*dynamodb.AttributeValue{
+		changeItem("old", legacyChangesShard, 1000),
+	}}
+	ids := []string{"old"}
+	for i, assetID := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		db.items = append(db.items, changeItem(assetID, changesShard(assetID), int64(2000+i)))
+		ids = append(ids, assetID)
+	}
+	dbSvc = db
+
+	// pages through every partition's changes, oldest first
+	listAll := func(since string) []string {
+		var listed []string
+		for i := 0; i < 20; i++ {
+			r := httptest.NewRequest(http.MethodGet, "/assets/changes?limit=3&since="+since, nil)
+			w := httptest.NewRecorder()
+			listChanges(w, r)
+			if w.Result().StatusCode != http.StatusOK {
+				t.Fatalf("Incorrect status while listing changes: %d", w.Result().StatusCode)
+			}
+			jsonResp := changesResponse{}
+			json.NewDecoder(w.Result().Body).Decode(&jsonResp)
+			if len(jsonResp.Changes) == 0 {
+				break
+			}
+			for _, change := range jsonResp.Changes {
+				listed = append(listed, change.ID)
+			}
+			since = jsonResp.Cursor
+		}
+		return listed
+	}
+	if listed := listAll(""); !reflect.DeepEqual(listed, ids) {
+		t.Errorf("Changes not listed once each in order: %v", listed)
+	}
+	// cursors from before the index was sharded carry on in every partition
+	legacy := encodeChangesCursor(changesCursor{changesPosition: changesPosition{ID: "old", UpdatedAt: 1000}})
+	if listed := listAll(legacy); !reflect.DeepEqual(listed, ids[1:]) {
+		t.Errorf("Changes not listed after a legacy cursor: %v", listed)
+	}
+}
+func TestListChangesBadCursor(t *testing.T) {
+	dbSvc = &mockDBClient{}
+	r := httptest.NewRequest(http.MethodGet, "/assets/changes?since=!!!", nil)
+	w := httptest.NewRecorder()
+
+	listChanges(w, r)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Didn't get 400 with a malformed cursor: %d", resp.StatusCode)
+	}
+}
+
+// remembers the queries made and reports more pages past them
+type mockDBQueryRecordingClient struct {
+	mockDBClient
+	mu     sync.Mutex
+	inputs []*dynamodb.QueryInput
+}
+
+func (m *mockDBQueryRecordingClient) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	m.mu.Lock()
+	m.inputs = append(m.inputs, input)
+	m.mu.Unlock()
+	return &dynamodb.QueryOutput{
+		LastEvaluatedKey: map[string]*dynamodb.AttributeValue{
+			"id":         {S: aws.String("laterID")},
+			"updated_at": {N: aws.String("1600000000000")},
+		},
+	}, nil
+}
+func (m *mockDBQueryRecordingClient) QueryWithContext(ctx aws.Context, input *dynamodb.QueryInput, opts ...request.Option) (*dynamodb.QueryOutput, error) {
+	return m.Query(input)
+}
+
+func TestListChangesByLocale(t *testing.T) {
+	db := &mockDBQueryRecordingClient{}
+	dbSvc = db
+	r := httptest.NewRequest(http.MethodGet, "/assets/changes?locale=EN", nil)
+	w := httptest.NewRecorder()
+
+	listChanges(w, r)
+	if len(db.inputs) != changesShards+1 {
+		t.Errorf("Not every partition queried: %d queries", len(db.inputs))
+	}
+	for _, input := range db.inputs {
+		if input.FilterExpression == nil || *input.ExpressionAttributeValues[":locale"].S != "en" {
+			t.Errorf("Query isn't filtered by the normalized locale: %v", input)
+		}
+	}
+	jsonResp := changesResponse{}
+	json.NewDecoder(w.Result().Body).Decode(&jsonResp)
+	cursor, _ := decodeChangesCursor(jsonResp.Cursor)
+	for _, shard := range changesShardNames() {
+		if pos, exact := cursor.position(shard); len(jsonResp.Changes) != 0 || !exact || pos.ID != "laterID" {
+			t.Errorf("Cursor doesn't move past a page without matches in partition %s: %v", shard, pos)
+		}
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/assets/changes?locale=en_US", nil)
+	w = httptest.NewRecorder()
+	listChanges(w, r)
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("Didn't get 400 for a malformed locale: %d", w.Result().StatusCode)
+	}
+}
+
+// keeps the record put in place of an asset, and lists it as a change
+type mockDBTombstoneClient struct {
+	mockDBClient
+	put *dynamodb.PutItemInput
+}
+
+func (m *mockDBTombstoneClient) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	m.put = input
+	output, _ := m.mockDBClient.GetItem(nil)
+	return &dynamodb.PutItemOutput{Attributes: output.Item}, nil
+}
+func (m *mockDBTombstoneClient) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	return m.PutItem(input)
+}
+func (m *mockDBTombstoneClient) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	if stringAttribute(input.ExpressionAttributeValues, ":shard") != stringAttribute(m.put.Item, "changes_shard") {
+		return &dynamodb.QueryOutput{}, nil
+	}
+	return &dynamodb.QueryOutput{Items: []map[string]*dynamodb.AttributeValue{m.put.Item}}, nil
+}
+func (m *mockDBTombstoneClient) QueryWithContext(ctx aws.Context, input *dynamodb.QueryInput, opts ...request.Option) (*dynamodb.QueryOutput, error) {
+	return m.Query(input)
+}
+
+func TestListChangesTombstone(t *testing.T) {
+	db := &mockDBTombstoneClient{}
+	dbSvc = db
+	s3Svc = &mockS3Client{}
+	defer func() { deleteRetention = 7 * 24 * time.Hour }()
+	deleteRetention = 0
+	if err := deleteAsset(context.Background(), "someID"); err != nil {
+		t.Fatal(err)
+	}
+	if db.put == nil || !isTombstone(db.put.Item) || !strings.Contains(aws.StringValue(db.put.ConditionExpression), "attribute_not_exists(tombstone)") {
+		t.Fatalf("Asset not replaced with a tombstone: %v", db.put)
+	}
+	if expires := numberAttribute(db.put.Item, "expires"); expires < time.Now().Add(tombstoneTTL-time.Minute).Unix() {
+		t.Errorf("Tombstone expires too soon: %d", expires)
+	}
+
+	w := httptest.NewRecorder()
+	listChanges(w, httptest.NewRequest(http.MethodGet, "/assets/changes", nil))
+	jsonResp := changesResponse{}
+	json.NewDecoder(w.Result().Body).Decode(&jsonResp)
+	if len(jsonResp.Changes) != 1 || jsonResp.Changes[0].ID != "someID" || jsonResp.Changes[0].Status != assetStatusDeleted || jsonResp.Changes[0].UpdatedAt == 0 {
+		t.Errorf("Deletion not listed as a change: %+v", jsonResp.Changes)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// digests a client expects an uploaded object to have
+type checksums struct {
+	md5    []byte
+	sha256 []byte
+}
+
+func (c checksums) empty() bool {
+	return c.md5 == nil && c.sha256 == nil
+}
+
+// record attributes holding the digests, hex encoded
+func (c checksums) attributes() map[string]*dynamodb.AttributeValue {
+	attributes := map[string]*dynamodb.AttributeValue{}
+	if c.md5 != nil {
+		attributes["md5"] = &dynamodb.AttributeValue{S: aws.String(hex.EncodeToString(c.md5))}
+	}
+	if c.sha256 != nil {
+		attributes["sha256"] = &dynamodb.AttributeValue{S: aws.String(hex.EncodeToString(c.sha256))}
+	}
+	return attributes
+}
+
+// decodes a digest given in either hex or base64
+func decodeDigest(name, value string, size int) ([]byte, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if b, err := hex.DecodeString(value); err == nil && len(b) == size {
+		return b, nil
+	}
+	if b, err := base64.StdEncoding.DecodeString(value); err == nil && len(b) == size {
+		return b, nil
+	}
+	return nil, fmt.Errorf("%s must be a hex or base64 encoded %d byte digest", name, size)
+}
+
+// parses the optional digests sent when marking an asset uploaded
+func parseChecksums(md5Value, sha256Value string) (checksums, error) {
+	var c checksums
+	var err error
+	if c.md5, err = decodeDigest("MD5", md5Value, md5.Size); err != nil {
+		return c, err
+	}
+	c.sha256, err = decodeDigest("SHA256", sha256Value, sha256.Size)
+	return c, err
+}
+
+// hashes everything read through it
+type digester struct {
+	md5    hash.Hash
+	sha256 hash.Hash
+}
+
+func newDigester() *digester {
+	return &digester{md5: md5.New(), sha256: sha256.New()}
+}
+
+func (d *digester) Write(p []byte) (int, error) {
+	d.md5.Write(p)
+	d.sha256.Write(p)
+	return len(p), nil
+}
+
+func (d *digester) sums() checksums {
+	return checksums{md5: d.md5.Sum(nil), sha256: d.sha256.Sum(nil)}
+}
+
+// checks the object stored at key against the expected digests, using what
+// S3 already knows where possible and hashing the object otherwise
+func verifyChecksums(ctx context.Context, key string, expected checksums) (bool, error) {
+	head, err := s3Svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(bucketName),
+		Key:          aws.String(key),
+		ChecksumMode: aws.String(s3.ChecksumModeEnabled),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	// single part uploads without KMS have the MD5 as their ETag, and
+	// uploads sent with a SHA-256 checksum have it recorded
+	md5Known, sha256Known := expected.md5 == nil, expected.sha256 == nil
+	etag := strings.Trim(aws.StringValue(head.ETag), `"`)
+	if !md5Known && !strings.Contains(etag, "-") && aws.StringValue(head.ServerSideEncryption) != s3.ServerSideEncryptionAwsKms {
+		if actual, err := hex.DecodeString(etag); err == nil && len(actual) == md5.Size {
+			if !bytes.Equal(actual, expected.md5) {
+				return false, nil
+			}
+			md5Known = true
+		}
+	}
+	if !sha256Known && head.ChecksumSHA256 != nil && !strings.Contains(*head.ChecksumSHA256, "-") {
+		if actual, err := base64.StdEncoding.DecodeString(*head.ChecksumSHA256); err == nil {
+			if !bytes.Equal(actual, expected.sha256) {
+				return false, nil
+			}
+			sha256Known = true
+		}
+	}
+	if md5Known && sha256Known {
+		return true, nil
+	}
+
+	// fall back to reading the whole object
+	object, err := s3Svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return false, err
+	}
+	defer object.Body.Close()
+	d := newDigester()
+	if _, err := io.Copy(d, object.Body); err != nil {
+		return false, err
+	}
+	actual := d.sums()
+	return (expected.md5 == nil || bytes.Equal(actual.md5, expected.md5)) &&
+		(expected.sha256 == nil || bytes.Equal(actual.sha256, expected.sha256)), nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	helloMD5    = "86fb269d190d2c85f6e0468ceca42a20"
+	helloSHA256 = "c0535e4be2b79ffd93291305436bf889314e4a3faec05ecffcbb7df31ad9e51a"
+)
+
+// reports the MD5 of the mock object content as its ETag
+type mockS3ETagClient struct {
+	mockS3Client
+}
+
+func (m *mockS3ETagClient) HeadObject(*s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	return &s3.HeadObjectOutput{ETag: aws.String(`"` + helloMD5 + `"`)}, nil
+}
+func (m *mockS3ETagClient) HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	return m.HeadObject(input)
+}
+
+func (m *mockS3ETagClient) GetObject(*s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	panic("object should not be read when the ETag is enough")
+}
+func (m *mockS3ETagClient) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	return m.GetObject(input)
+}
+
+func TestParseChecksums(t *testing.T) {
+	c, err := parseChecksums(helloMD5, "wFNeS+K3n/2TKRMFQ2v4iTFOSj+uwF7P/Lt98xrZ5Ro=")
+	if err != nil {
+		t.Fatalf("Got error parsing valid checksums: %s", err)
+	}
+	if c.attributes()["sha256"] == nil || *c.attributes()["sha256"].S != helloSHA256 {
+		t.Errorf("Base64 checksum decoded incorrectly: %v", c.attributes())
+	}
+	if _, err := parseChecksums("abc", ""); err == nil {
+		t.Error("Got no error for a short MD5")
+	}
+}
+func TestVerifyChecksums(t *testing.T) {
+	s3Svc = &mockS3ETagClient{}
+	c, _ := parseChecksums(helloMD5, "")
+	if ok, err := verifyChecksums(context.Background(), "someID", c); !ok || err != nil {
+		t.Errorf("MD5 matching the ETag failed verification: %v", err)
+	}
+
+	s3Svc = &mockS3Client{}
+	c, _ = parseChecksums("", helloSHA256)
+	if ok, err := verifyChecksums(context.Background(), "someID", c); !ok || err != nil {
+		t.Errorf("SHA256 of the content failed verification: %v", err)
+	}
+	c, _ = parseChecksums(helloMD5, helloMD5+helloMD5)
+	if ok, _ := verifyChecksums(context.Background(), "someID", c); ok {
+		t.Error("Wrong SHA256 passed verification")
+	}
+}
+func TestMarkUploadedChecksumMismatch(t *testing.T) {
+	dbSvc = &mockDBClient{}
+	s3Svc = &mockS3Client{}
+	body := `{"Status":"uploaded","SHA256":"` + helloMD5 + helloMD5 + `"}`
+	r := httptest.NewRequest(http.MethodPut, "/asset/foo", bytes.NewReader([]byte(body)))
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("Didn't get 422 for a checksum mismatch: %d", resp.StatusCode)
+	}
+
+	body = `{"Status":"uploaded","SHA256":"` + helloSHA256 + `"}`
+	r = httptest.NewRequest(http.MethodPut, "/asset/foo", bytes.NewReader([]byte(body)))
+	w = httptest.NewRecorder()
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Errorf("Incorrect status for a matching checksum: %d", w.Result().StatusCode)
+	}
+}
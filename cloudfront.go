@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudfront/sign"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// domain of the CloudFront distribution serving downloads, S3 when empty
+var cloudFrontDomain string
+
+var cloudFrontSigner *sign.URLSigner
+
+// sets up signing download urls with a CloudFront key pair or key group
+// public key, given its id and PEM private key file
+func initCloudFront(keyID, keyFile string) error {
+	key, err := sign.LoadPEMPrivKeyFile(keyFile)
+	if err != nil {
+		return err
+	}
+	cloudFrontSigner = sign.NewURLSigner(keyID, key)
+	return nil
+}
+
+// signs a CloudFront url for an object; the response overrides and version
+// are passed as S3 would take them, so the distribution's origin request
+// policy must forward the response-* and versionId query strings
+func presignCloudFront(input *s3.GetObjectInput, timeout time.Duration) (string, error) {
+	query := url.Values{}
+	if input.ResponseCacheControl != nil {
+		query.Set("response-cache-control", *input.ResponseCacheControl)
+	}
+	if input.ResponseContentDisposition != nil {
+		query.Set("response-content-disposition", *input.ResponseContentDisposition)
+	}
+	if input.ResponseContentType != nil {
+		query.Set("response-content-type", *input.ResponseContentType)
+	}
+	if input.VersionId != nil {
+		query.Set("versionId", *input.VersionId)
+	}
+	u := url.URL{
+		Scheme:   "https",
+		Host:     cloudFrontDomain,
+		Path:     "/" + aws.StringValue(input.Key),
+		RawQuery: query.Encode(),
+	}
+	return cloudFrontSigner.Sign(u.String(), time.Now().Add(timeout))
+}
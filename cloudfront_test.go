@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/cloudfront/sign"
+)
+
+func TestAssetURLRequestCloudFront(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cloudFrontDomain = "cdn.example.com"
+	cloudFrontSigner = sign.NewURLSigner("someKeyID", key)
+	defer func() { cloudFrontDomain, cloudFrontSigner = "", nil }()
+	dbSvc = &mockDBClient{}
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodGet, "/asset/someID?filename=report.pdf", nil)
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	var resp assetURLResponse
+	json.NewDecoder(w.Result().Body).Decode(&resp)
+	u, err := url.Parse(resp.DownloadURL)
+	if err != nil || u.Host != "cdn.example.com" || u.Path != "/someID" {
+		t.Fatalf("Download URL isn't on the distribution: %s", resp.DownloadURL)
+	}
+	query := u.Query()
+	if query.Get("Key-Pair-Id") != "someKeyID" || query.Get("Signature") == "" || query.Get("Expires") == "" {
+		t.Errorf("Download URL isn't signed: %s", resp.DownloadURL)
+	}
+	if query.Get("response-content-disposition") != "inline; filename=report.pdf" {
+		t.Errorf("Download URL lost its disposition: %s", resp.DownloadURL)
+	}
+}
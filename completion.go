@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	tokenCompletion = "completion"
+	// the header marking an asset uploaded must carry the token in
+	completionTokenHeader = "X-Completion-Token"
+	// how long past its upload url's expiry a completion token can be
+	// used, for uploads started just before the url expired
+	completionTokenGrace = time.Hour
+)
+
+// whether marking an asset uploaded takes the token issued with its upload
+// url, so only whoever was given the url can complete the upload
+var requireCompletionToken bool
+
+// a new completion token for an upload url lasting timeout, with the
+// attributes recording it on the asset; none when tokens aren't required
+func newCompletionToken(timeout time.Duration) (string, map[string]*dynamodb.AttributeValue) {
+	if !requireCompletionToken {
+		return "", nil
+	}
+	token := secureToken(18)
+	expires := time.Now().Add(timeout + completionTokenGrace).Unix()
+	return token, map[string]*dynamodb.AttributeValue{
+		"completion_token":         {S: aws.String(token)},
+		"completion_token_expires": {N: aws.String(strconv.FormatInt(expires, 10))},
+	}
+}
+
+// the completion token a request carries, answering 403 and returning false
+// if tokens are required and it carries none
+func requestCompletionToken(w http.ResponseWriter, r *http.Request) (string, bool) {
+	token := r.Header.Get(completionTokenHeader)
+	if requireCompletionToken && token == "" {
+		http.Error(w, fmt.Sprintf("Missing %s header.", completionTokenHeader), http.StatusForbidden)
+		return "", false
+	}
+	return token, true
+}
+
+// whether a failed mark uploaded was refused for its completion token,
+// counting an expired one
+func isCompletionTokenRefused(item map[string]*dynamodb.AttributeValue, token string) bool {
+	if token == "" {
+		return false
+	}
+	if stringAttribute(item, "completion_token") != token {
+		return true
+	}
+	if numberAttribute(item, "completion_token_expires") <= tokenCutoff(time.Now()) {
+		noteTokenExpired(tokenCompletion)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// one asset whose completion token is checked and spent as DynamoDB would
+type mockDBCompletionClient struct {
+	mockDBClient
+	item map[string]*dynamodb.AttributeValue
+}
+
+func (m *mockDBCompletionClient) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	m.item = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+func (m *mockDBCompletionClient) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	return m.PutItem(input)
+}
+
+func (m *mockDBCompletionClient) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	values := input.ExpressionAttributeValues
+	if strings.Contains(aws.StringValue(input.ConditionExpression), "completion_token = :completionToken") {
+		if stringAttribute(m.item, "completion_token") != stringAttribute(values, ":completionToken") ||
+			numberAttribute(m.item, "completion_token_expires") <= numberAttribute(values, ":tokenCutoff") {
+			return nil, &dynamodb.ConditionalCheckFailedException{Message_: aws.String("The conditional request failed"), Item: m.item}
+		}
+	}
+	if strings.Contains(aws.StringValue(input.UpdateExpression), "REMOVE reservation_shard, completion_token") {
+		delete(m.item, "completion_token")
+		delete(m.item, "completion_token_expires")
+	}
+	return &dynamodb.UpdateItemOutput{Attributes: m.item}, nil
+}
+func (m *mockDBCompletionClient) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	return m.UpdateItem(input)
+}
+
+func TestCompletionToken(t *testing.T) {
+	requireCompletionToken = true
+	defer func() { requireCompletionToken = false }()
+	db := &mockDBCompletionClient{}
+	dbSvc = db
+	s3Svc = &mockS3Client{}
+
+	w := httptest.NewRecorder()
+	initAsset(w, httptest.NewRequest(http.MethodPost, "/asset", nil))
+	var response initAssetResponse
+	json.NewDecoder(w.Body).Decode(&response)
+	if response.CompletionToken == "" || stringAttribute(db.item, "completion_token") != response.CompletionToken {
+		t.Fatalf("Completion token not issued: %+v", response)
+	}
+
+	markUploaded := func(token string) int {
+		r := httptest.NewRequest(http.MethodPut, "/asset/someID", strings.NewReader(`{"Status":"uploaded"}`))
+		if token != "" {
+			r.Header.Set(completionTokenHeader, token)
+		}
+		w := httptest.NewRecorder()
+		manageAsset(w, r)
+		return w.Result().StatusCode
+	}
+	for name, token := range map[string]string{"no": "", "a wrong": "wrong"} {
+		if status := markUploaded(token); status != http.StatusForbidden {
+			t.Errorf("Didn't get 403 for %s completion token: %d", name, status)
+		}
+	}
+	if status := markUploaded(response.CompletionToken); status != http.StatusOK {
+		t.Fatalf("Couldn't mark uploaded with the completion token: %d", status)
+	}
+	// it's spent on use
+	if status := markUploaded(response.CompletionToken); status != http.StatusForbidden {
+		t.Errorf("Completion token accepted twice: %d", status)
+	}
+
+	token, attributes := newCompletionToken(time.Minute)
+	attributes["completion_token_expires"].N = aws.String(strconv.FormatInt(time.Now().Add(-time.Second).Unix(), 10))
+	db.item = attributes
+	expired := atomic.LoadInt64(&tokenUsage[tokenCompletion].Expired)
+	if status := markUploaded(token); status != http.StatusForbidden || atomic.LoadInt64(&tokenUsage[tokenCompletion].Expired) != expired+1 {
+		t.Errorf("Expired completion token not refused: %d", status)
+	}
+}
+
+// an asset reserved with a completion token, found by lookups
+type mockDBCompletionReservedClient struct {
+	mockDBCompletionClient
+}
+
+func (m *mockDBCompletionReservedClient) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: m.item}, nil
+}
+func (m *mockDBCompletionReservedClient) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return m.GetItem(input)
+}
+
+func TestContentUploadCompletionToken(t *testing.T) {
+	requireCompletionToken = true
+	defer func() { requireCompletionToken = false }()
+	token, item := newCompletionToken(time.Minute)
+	item["id"] = &dynamodb.AttributeValue{S: aws.String("someID")}
+	dbSvc = &mockDBCompletionReservedClient{mockDBCompletionClient{item: item}}
+	s3Svc = &mockS3Client{}
+
+	upload := func(token string) int {
+		r := httptest.NewRequest(http.MethodPost, "/asset/someID/content", strings.NewReader("Hello world!"))
+		if token != "" {
+			r.Header.Set(completionTokenHeader, token)
+		}
+		w := httptest.NewRecorder()
+		manageAsset(w, r)
+		return w.Result().StatusCode
+	}
+	for name, token := range map[string]string{"no": "", "a wrong": "wrong"} {
+		if status := upload(token); status != http.StatusForbidden {
+			t.Errorf("Didn't get 403 for a proxied upload with %s completion token: %d", name, status)
+		}
+	}
+	if status := upload(token); status != http.StatusNoContent {
+		t.Errorf("Proxied upload with the completion token refused: %d", status)
+	}
+}
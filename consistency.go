@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// response header carrying the token of a write, also accepted on reads
+// instead of ?consistency_token=
+const consistencyTokenHeader = "Consistency-Token"
+
+// a write that a read must observe, handed to clients as an opaque token
+type consistencyToken struct {
+	AssetID   string `json:"i"`
+	Region    string `json:"r"`
+	UpdatedAt int64  `json:"u"`
+}
+
+func encodeConsistencyToken(t consistencyToken) string {
+	b, _ := json.Marshal(t)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeConsistencyToken(s string) (consistencyToken, error) {
+	var t consistencyToken
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return t, err
+	}
+	err = json.Unmarshal(b, &t)
+	return t, err
+}
+
+// hands out the token of a write to an asset record, given the record as
+// written
+func setConsistencyToken(w http.ResponseWriter, assetID string, item map[string]*dynamodb.AttributeValue) {
+	w.Header().Set(consistencyTokenHeader, encodeConsistencyToken(consistencyToken{
+		AssetID:   assetID,
+		Region:    awsRegion,
+		UpdatedAt: numberAttribute(item, "updated_at"),
+	}))
+}
+
+// fetches an asset record like fetchAsset, but when the request carries a
+// consistency token only once the record reflects that write, answering
+// 503 until a write made in another region has replicated
+func fetchAssetAfter(w http.ResponseWriter, r *http.Request, assetID string) (map[string]*dynamodb.AttributeValue, bool) {
+	value := r.URL.Query().Get("consistency_token")
+	if value == "" {
+		value = r.Header.Get(consistencyTokenHeader)
+	}
+	if value == "" {
+		return fetchAsset(w, r, assetID)
+	}
+	token, err := decodeConsistencyToken(value)
+	if err != nil || token.AssetID != assetID {
+		http.Error(w, fmt.Sprintf("Invalid consistency token for asset id '%s'.", assetID), http.StatusBadRequest)
+		return nil, false
+	}
+
+	result, err := dbSvc.GetItemWithContext(r.Context(), &dynamodb.GetItemInput{
+		Key:            assetKey(assetID),
+		TableName:      aws.String(tableName),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		writeError(w, err)
+		return nil, false
+	}
+	item := result.Item
+	if len(item) == 0 || numberAttribute(item, "updated_at") < token.UpdatedAt {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, fmt.Sprintf("Asset id '%s' hasn't caught up with its write in %s yet, retry shortly.", assetID, token.Region), http.StatusServiceUnavailable)
+		return nil, false
+	}
+	if isDeleted(item) {
+		writeError(w, notFound(assetID))
+		return nil, false
+	}
+	return item, true
+}
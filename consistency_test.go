@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// an uploaded asset last written at a known time
+type mockDBWrittenClient struct {
+	mockDBClient
+}
+
+func (m *mockDBWrittenClient) GetItem(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	output, _ := m.mockDBClient.GetItem(nil)
+	output.Item["updated_at"] = &dynamodb.AttributeValue{N: aws.String("1500000000000")}
+	return output, nil
+}
+func (m *mockDBWrittenClient) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return m.GetItem(input)
+}
+
+func (m *mockDBWrittenClient) UpdateItem(*dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	output, _ := m.GetItem(nil)
+	return &dynamodb.UpdateItemOutput{Attributes: output.Item}, nil
+}
+func (m *mockDBWrittenClient) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	return m.UpdateItem(input)
+}
+
+func TestMarkUploadedConsistencyToken(t *testing.T) {
+	dbSvc = &mockDBWrittenClient{}
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodPut, "/asset/someID", bytes.NewReader([]byte(`{"Status":"uploaded"}`)))
+	w := httptest.NewRecorder()
+	manageAsset(w, r)
+
+	var response markUploadedResponse
+	json.NewDecoder(w.Body).Decode(&response)
+	if response.ConsistencyToken == "" || response.ConsistencyToken != w.Header().Get(consistencyTokenHeader) {
+		t.Fatalf("No consistency token returned: %+v", response)
+	}
+	token, err := decodeConsistencyToken(response.ConsistencyToken)
+	if err != nil || token.AssetID != "someID" || token.UpdatedAt != 1500000000000 {
+		t.Errorf("Incorrect consistency token: %+v", token)
+	}
+}
+
+func TestAssetURLRequestConsistencyToken(t *testing.T) {
+	dbSvc = &mockDBWrittenClient{}
+	s3Svc = &mockS3Client{}
+	for token, status := range map[string]int{
+		encodeConsistencyToken(consistencyToken{AssetID: "someID", UpdatedAt: 1500000000000}): http.StatusOK,
+		encodeConsistencyToken(consistencyToken{AssetID: "someID", UpdatedAt: 1600000000000}): http.StatusServiceUnavailable,
+		encodeConsistencyToken(consistencyToken{AssetID: "otherID", UpdatedAt: 1}):            http.StatusBadRequest,
+		"garbage": http.StatusBadRequest,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/asset/someID?consistency_token="+token, nil)
+		w := httptest.NewRecorder()
+		manageAsset(w, r)
+		if w.Result().StatusCode != status {
+			t.Errorf("Incorrect status for token %s: %d", token, w.Result().StatusCode)
+		}
+	}
+}
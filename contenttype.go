@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+)
+
+// media type patterns uploads may declare, empty to allow anything
+var allowedContentTypes []string
+
+// parses a comma separated list of media type patterns
+func parseContentTypePatterns(value string) []string {
+	var patterns []string
+	for _, pattern := range strings.Split(value, ",") {
+		if pattern = strings.ToLower(strings.TrimSpace(pattern)); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// checks a declared content type against the allowlist; when one is
+// configured, uploads must declare a type
+func validateContentType(contentType string) error {
+	if contentType == "" {
+		if len(allowedContentTypes) > 0 {
+			return fmt.Errorf("content_type is required")
+		}
+		return nil
+	}
+	if _, _, err := mime.ParseMediaType(contentType); err != nil {
+		return fmt.Errorf("content_type '%s' is malformed", contentType)
+	}
+	if len(allowedContentTypes) == 0 {
+		return nil
+	}
+	mediaType := mediaTypeOf(contentType)
+	for _, pattern := range allowedContentTypes {
+		if matchesMediaPattern(pattern, mediaType) {
+			return nil
+		}
+	}
+	return fmt.Errorf("content_type '%s' is not allowed", mediaType)
+}
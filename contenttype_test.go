@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestValidateContentType(t *testing.T) {
+	defer func(types []string) { allowedContentTypes = types }(allowedContentTypes)
+	allowedContentTypes = nil
+	if err := validateContentType(""); err != nil {
+		t.Errorf("Got error for an undeclared type without an allowlist: %s", err)
+	}
+
+	allowedContentTypes = parseContentTypePatterns("image/*, application/pdf")
+	for _, contentType := range []string{"image/png", "application/pdf", "IMAGE/JPEG; q=1"} {
+		if err := validateContentType(contentType); err != nil {
+			t.Errorf("Got error for allowed type %s: %s", contentType, err)
+		}
+	}
+	for _, contentType := range []string{"", "application/x-msdownload", "not a type"} {
+		if err := validateContentType(contentType); err == nil {
+			t.Errorf("Got no error for disallowed type '%s'", contentType)
+		}
+	}
+}
+func TestInitAssetDisallowedContentType(t *testing.T) {
+	defer func(types []string) { allowedContentTypes = types }(allowedContentTypes)
+	allowedContentTypes = []string{"image/*"}
+	dbSvc = &mockDBClient{}
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodPost, "/asset?content_type=application/x-msdownload", nil)
+	w := httptest.NewRecorder()
+
+	initAsset(w, r)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Didn't get 400 for a disallowed content type: %d", resp.StatusCode)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/asset?content_type=image/png", nil)
+	w = httptest.NewRecorder()
+	initAsset(w, r)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Errorf("Incorrect status for an allowed content type: %d", w.Result().StatusCode)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// an absolute RFC 3339 time by which the caller needs an answer
+	deadlineHeader = "X-Request-Deadline"
+	// a relative budget in gRPC's format, e.g. 250m for 250 milliseconds
+	grpcTimeoutHeader   = "Grpc-Timeout"
+	errDeadlineExceeded = "deadline_exceeded"
+)
+
+var grpcTimeoutUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+type deadlineError struct {
+	Error    string    `json:"error"`
+	Message  string    `json:"message"`
+	Deadline time.Time `json:"deadline"`
+}
+
+// the deadline a request carries, the zero time if none
+func requestDeadline(r *http.Request) (time.Time, error) {
+	if value := r.Header.Get(deadlineHeader); value != "" {
+		deadline, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return deadline, fmt.Errorf("%s must be an RFC 3339 time", deadlineHeader)
+		}
+		return deadline, nil
+	}
+	if value := r.Header.Get(grpcTimeoutHeader); value != "" {
+		timeout, err := parseGRPCTimeout(value)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Now().Add(timeout), nil
+	}
+	return time.Time{}, nil
+}
+
+// parses up to 8 digits followed by a unit, as gRPC sends timeouts
+func parseGRPCTimeout(value string) (time.Duration, error) {
+	err := fmt.Errorf("%s must be up to 8 digits and a unit of H, M, S, m, u or n", grpcTimeoutHeader)
+	if len(value) < 2 || len(value) > 9 {
+		return 0, err
+	}
+	unit, ok := grpcTimeoutUnits[value[len(value)-1]]
+	if !ok {
+		return 0, err
+	}
+	n, perr := strconv.ParseUint(value[:len(value)-1], 10, 64)
+	if perr != nil {
+		return 0, err
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// bounds requests carrying a deadline by it: their context is canceled
+// then, and a handler that hasn't begun answering by then is answered 504
+// in its place, dropping whatever it writes after; handlers make their AWS
+// calls with the context, so none is sent past the deadline, until the
+// first write has gone through, after which the rest of it is finished
+// regardless so that it isn't left half done
+func withDeadlines(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadline, err := requestDeadline(r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid header: %s.", err.Error()), http.StatusBadRequest)
+			return
+		}
+		if deadline.IsZero() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithDeadline(r.Context(), deadline)
+		defer cancel()
+
+		dw := &deadlineWriter{w: w, ctx: ctx, header: http.Header{}}
+		done := make(chan struct{})
+		panicked := make(chan interface{}, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+				}
+			}()
+			next.ServeHTTP(dw, r.WithContext(ctx))
+			close(done)
+		}()
+		finished := false
+		select {
+		case p := <-panicked:
+			panic(p)
+		case <-done:
+			finished = true
+		case <-ctx.Done():
+		}
+
+		dw.mu.Lock()
+		if dw.wroteHeader || (finished && ctx.Err() == nil) {
+			// the answer has begun, so it's left to finish or fail on its own
+			dw.mu.Unlock()
+			if !finished {
+				select {
+				case p := <-panicked:
+					panic(p)
+				case <-done:
+				}
+			}
+			return
+		}
+		dw.timedOut = true
+		dw.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusGatewayTimeout)
+		writeJSON(w, deadlineError{
+			Error:    errDeadlineExceeded,
+			Message:  "The request's deadline passed before it could be answered.",
+			Deadline: deadline.UTC(),
+		})
+	})
+}
+
+// a response writer that stops passing writes through once the request's
+// deadline has been answered for it
+type deadlineWriter struct {
+	w           http.ResponseWriter
+	ctx         context.Context
+	header      http.Header
+	mu          sync.Mutex
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (d *deadlineWriter) Header() http.Header {
+	return d.header
+}
+
+func (d *deadlineWriter) WriteHeader(status int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.writeHeaderLocked(status)
+}
+
+// an answer begun once the deadline has passed is dropped for the 504
+func (d *deadlineWriter) writeHeaderLocked(status int) {
+	if d.timedOut || d.wroteHeader {
+		return
+	}
+	if d.ctx.Err() != nil {
+		d.timedOut = true
+		return
+	}
+	d.wroteHeader = true
+	for k, v := range d.header {
+		d.w.Header()[k] = v
+	}
+	d.w.WriteHeader(status)
+}
+
+func (d *deadlineWriter) Write(b []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.writeHeaderLocked(http.StatusOK)
+	if d.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	return d.w.Write(b)
+}
+
+// streams what's written so far, e.g. of a proxied download, once the
+// answer has begun
+func (d *deadlineWriter) Flush() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.writeHeaderLocked(http.StatusOK)
+	if d.timedOut {
+		return
+	}
+	if f, ok := d.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestParseGRPCTimeout(t *testing.T) {
+	for value, expected := range map[string]time.Duration{"250m": 250 * time.Millisecond, "1S": time.Second, "2H": 2 * time.Hour, "99999999n": 99999999} {
+		if timeout, err := parseGRPCTimeout(value); err != nil || timeout != expected {
+			t.Errorf("Incorrect timeout for %s: %v %v", value, timeout, err)
+		}
+	}
+	for _, value := range []string{"", "m", "10", "10x", "-1S", "123456789S"} {
+		if _, err := parseGRPCTimeout(value); err == nil {
+			t.Errorf("Timeout %s should be invalid", value)
+		}
+	}
+}
+
+func TestWithDeadlines(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	slow := withDeadlines(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/asset/someID", nil)
+	r.Header.Set(grpcTimeoutHeader, "20m")
+	w := httptest.NewRecorder()
+	slow.ServeHTTP(w, r)
+	if w.Result().StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("Incorrect status past the deadline: %d", w.Result().StatusCode)
+	}
+	var response deadlineError
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil || response.Error != errDeadlineExceeded {
+		t.Errorf("Incorrect deadline error: %+v %v", response, err)
+	}
+
+	fast := withDeadlines(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Answered", "yes")
+		w.WriteHeader(http.StatusCreated)
+	}))
+	r = httptest.NewRequest(http.MethodGet, "/asset/someID", nil)
+	r.Header.Set(deadlineHeader, time.Now().Add(time.Minute).Format(time.RFC3339))
+	w = httptest.NewRecorder()
+	fast.ServeHTTP(w, r)
+	if w.Result().StatusCode != http.StatusCreated || w.Header().Get("X-Answered") != "yes" {
+		t.Errorf("Incorrect answer within the deadline: %d", w.Result().StatusCode)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/asset/someID", nil)
+	r.Header.Set(deadlineHeader, "soon")
+	w = httptest.NewRecorder()
+	fast.ServeHTTP(w, r)
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("Incorrect status for an invalid deadline: %d", w.Result().StatusCode)
+	}
+}
+
+func TestDeadlineFlush(t *testing.T) {
+	handler := withDeadlines(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("part"))
+		w.(http.Flusher).Flush()
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/download/someToken", nil)
+	r.Header.Set(grpcTimeoutHeader, "1M")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if !w.Flushed || w.Body.String() != "part" {
+		t.Errorf("Flush not passed through: %v %q", w.Flushed, w.Body.String())
+	}
+}
+
+// counts the records it's asked to update
+type mockDBDeadlineClient struct {
+	mockDBClient
+	updates int
+}
+
+func (m *mockDBDeadlineClient) UpdateItem(*dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	m.updates++
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+func (m *mockDBDeadlineClient) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	return m.UpdateItem(input)
+}
+
+func TestDeadlineStopsWrites(t *testing.T) {
+	// the SDK doesn't send a call made with a context past its deadline
+	var sent int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&sent, 1)
+		w.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+	svc := dynamodb.New(session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(ts.URL),
+		Credentials: credentials.NewStaticCredentials("AKID", "SECRET", ""),
+		MaxRetries:  aws.Int(0),
+	})))
+	called := make(chan error, 1)
+	handler := withDeadlines(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		_, err := svc.UpdateItemWithContext(r.Context(), &dynamodb.UpdateItemInput{
+			Key:       assetKey("someID"),
+			TableName: aws.String(tableName),
+		})
+		called <- err
+	}))
+	r := httptest.NewRequest(http.MethodPut, "/asset/someID", nil)
+	r.Header.Set(grpcTimeoutHeader, "10m")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if err := <-called; err == nil || atomic.LoadInt32(&sent) != 0 || w.Code != http.StatusGatewayTimeout {
+		t.Errorf("Update sent past the deadline: %d %v %d", sent, err, w.Code)
+	}
+
+	// nor is an upload marked once its request is past it
+	mock := &mockDBDeadlineClient{}
+	dbSvc = mock
+	s3Svc = &mockS3Client{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r = httptest.NewRequest(http.MethodPut, "/asset/someID", nil).WithContext(ctx)
+	w = httptest.NewRecorder()
+	if markUploaded(w, r, "someID", "someID", "", nil) || mock.updates != 0 || w.Body.Len() != 0 {
+		t.Errorf("Upload marked past the deadline: %d %q", mock.updates, w.Body.String())
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	jobKindDeletion  = "deletion"
+	maxBulkDeleteIDs = 10000
+	// most keys S3 deletes in one request
+	maxDeleteObjectsBatch = 1000
+	// how long a delete confirmation token can be used for
+	deleteConfirmationTimeout = 5 * time.Minute
+)
+
+// whether deleting an asset takes a token from a first, unconfirmed
+// request
+var requireDeleteConfirmation bool
+
+type deleteConfirmation struct {
+	ConfirmationToken string    `json:"confirmation_token"`
+	ExpiresAt         time.Time `json:"expires_at"`
+}
+
+// spaces out calls so background work can't swamp S3 or DynamoDB
+type throttle struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+	// the limit in the rate limit table this throttle's calls also count
+	// against across instances, empty to only space them out locally
+	shared string
+}
+
+func newThrottle(perSecond float64) *throttle {
+	return &throttle{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// blocks until the caller's turn, returning false if canceled first
+func (t *throttle) wait(cancel <-chan struct{}) bool {
+	if !t.waitLocal(cancel) {
+		return false
+	}
+	if t.shared == "" {
+		return true
+	}
+	return t.waitShared(cancel)
+}
+
+// blocks until the caller's turn on this instance
+func (t *throttle) waitLocal(cancel <-chan struct{}) bool {
+	t.mu.Lock()
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	delay := t.next.Sub(now)
+	t.next = t.next.Add(t.interval)
+	t.mu.Unlock()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-cancel:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// shared by every deletion job
+var deleteThrottle = newThrottle(25)
+
+type deletionRequest struct {
+	IDs []string
+}
+
+type deletionResult struct {
+	Failed []string `json:"failed"`
+	Pinned []string `json:"pinned"`
+	Locked []string `json:"locked"`
+	// deletions left waiting for approval
+	PendingApproval []string `json:"pending_approval"`
+}
+
+// deletes an asset, restorably during the retention window, refusing with
+// errAssetPinned if the asset is pinned or errAssetLocked while anyone holds
+// its lock; missing assets are already gone
+func deleteAsset(ctx context.Context, assetID string) error {
+	values := map[string]*dynamodb.AttributeValue{
+		":false": {BOOL: aws.Bool(false)},
+		":now":   {N: aws.String(strconv.FormatInt(time.Now().Unix(), 10))},
+	}
+	// no caller holds a lock here, so only a free or lapsed one will do
+	condition := unpinnedCondition + " AND (attribute_not_exists(lock_token) OR lock_expires < :now)"
+	if approvalRequired() {
+		result, err := dbSvc.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+			Key:            assetKey(assetID),
+			TableName:      aws.String(tableName),
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			return err
+		}
+		if len(result.Item) == 0 || isDeleted(result.Item) {
+			return nil
+		}
+		reason, err := approvalReason(ctx, assetID, result.Item)
+		if err != nil {
+			return err
+		}
+		if reason != "" {
+			err := queueDeletion(ctx, assetID, reason, condition, values)
+			if isConditionFailed(err) {
+				return deleteRefusal(conditionFailedItem(err))
+			}
+			if err != nil {
+				return err
+			}
+			return errDeletionQueued
+		}
+	}
+	if deleteRetention <= 0 {
+		err := removeAsset(ctx, assetID, condition, values)
+		if isConditionFailed(err) {
+			return deleteRefusal(conditionFailedItem(err))
+		}
+		return err
+	}
+	err := trashAsset(ctx, assetID, condition, values)
+	if isConditionFailed(err) {
+		return deleteRefusal(conditionFailedItem(err))
+	}
+	return err
+}
+
+// why a background deletion's condition failed on item: errAssetPinned,
+// errAssetLocked, or nil if it's already gone
+func deleteRefusal(item map[string]*dynamodb.AttributeValue) error {
+	if isPinned(item) {
+		return errAssetPinned
+	}
+	if isLocked(item) {
+		return errAssetLocked
+	}
+	return nil
+}
+
+// removes an asset if condition holds: its record is marked deleted and
+// due for purging first, then its object versions, unfinished parts,
+// version and tag records and alias are removed, and only then is the
+// record replaced with a tombstone, so an asset whose cleanup fails is left
+// for the purge sweep to retry rather than orphaning its objects; a failed
+// condition comes back as the DynamoDB error, carrying the record when
+// there is one
+func removeAsset(ctx context.Context, assetID, condition string, values map[string]*dynamodb.AttributeValue) error {
+	values[":deleted"] = &dynamodb.AttributeValue{S: aws.String(assetStatusDeleted)}
+	values[":removeAt"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(time.Now().Unix(), 10))}
+	values[":purgeShard"] = &dynamodb.AttributeValue{S: aws.String(purgeShard)}
+	values[":updated"] = updatedAtValue()
+	result, err := dbSvc.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		Key:       assetKey(assetID),
+		TableName: aws.String(tableName),
+		UpdateExpression: aws.String("SET #status = :deleted, purge_at = :removeAt, purge_shard = :purgeShard, updated_at = :updated " +
+			"REMOVE delete_token, delete_token_expires, deletion_requested_at, approval_shard, deletion_reason"),
+		ConditionExpression:                 aws.String("attribute_exists(id) AND attribute_not_exists(tombstone) AND " + condition),
+		ExpressionAttributeNames:            map[string]*string{"#status": aws.String("status")},
+		ExpressionAttributeValues:           values,
+		ReturnValues:                        aws.String(dynamodb.ReturnValueAllOld),
+		ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValuesOnConditionCheckFailureAllOld),
+	})
+	if err != nil {
+		return err
+	}
+	item := result.Attributes
+	// the asset is gone, so the rest is cleaned up even past the deadline
+	ctx = context.WithoutCancel(ctx)
+	// purging an asset already deleted isn't news
+	if !isDeleted(item) {
+		publishEvent(eventDeleted, assetID, item)
+		recordAssetEvent(nil, assetID, assetEventDeleted, nil)
+	}
+
+	if uploadID := stringAttribute(item, "upload_id"); uploadID != "" {
+		_, err := s3Svc.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(bucketName),
+			Key:      aws.String(objectKey(assetID, item)),
+			UploadId: aws.String(uploadID),
+		})
+		if aerr, ok := err.(awserr.Error); err != nil && !(ok && aerr.Code() == s3.ErrCodeNoSuchUpload) {
+			return err
+		}
+	}
+	if err := deleteObjectVersions(ctx, objectKey(assetID, item)); err != nil {
+		return err
+	}
+	if err := deleteVersionRecords(ctx, assetID, item); err != nil {
+		return err
+	}
+	if err := deleteTagRecords(ctx, assetID, item); err != nil {
+		return err
+	}
+	if alias := stringAttribute(item, "alias"); alias != "" {
+		_, err := dbSvc.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+			Key:                       aliasKey(alias),
+			TableName:                 aws.String(tableName),
+			ConditionExpression:       aws.String("asset_id = :assetID"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":assetID": {S: aws.String(assetID)}},
+		})
+		if err != nil && !isConditionFailed(err) {
+			return err
+		}
+	}
+	// unless the asset was restored or removed meanwhile, which the
+	// purge time having passed rules out
+	_, err = dbSvc.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		Item:                     tombstoneItem(assetID),
+		TableName:                aws.String(tableName),
+		ConditionExpression:      aws.String("#status = :deleted AND purge_at <= :removeAt AND attribute_not_exists(tombstone)"),
+		ExpressionAttributeNames: map[string]*string{"#status": aws.String("status")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":deleted":  values[":deleted"],
+			":removeAt": values[":removeAt"],
+		},
+	})
+	if isConditionFailed(err) {
+		return nil
+	}
+	return err
+}
+
+// deletes every version of the object at key and its resumable upload
+// tail; unversioned buckets list each object as a single null version
+func deleteObjectVersions(ctx context.Context, key string) error {
+	keys := map[string]bool{key: true, tusTailKey(key): true}
+	var objects []*s3.ObjectIdentifier
+	err := s3Svc.ListObjectVersionsPagesWithContext(ctx, &s3.ListObjectVersionsInput{
+		Bucket: aws.String(bucketName),
+		Prefix: aws.String(key),
+	}, func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
+		for _, v := range page.Versions {
+			if keys[aws.StringValue(v.Key)] {
+				objects = append(objects, &s3.ObjectIdentifier{Key: v.Key, VersionId: v.VersionId})
+			}
+		}
+		for _, m := range page.DeleteMarkers {
+			if keys[aws.StringValue(m.Key)] {
+				objects = append(objects, &s3.ObjectIdentifier{Key: m.Key, VersionId: m.VersionId})
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return deleteObjectIdentifiers(ctx, objects)
+}
+
+// deletes the given object versions in batches as large as S3 takes
+func deleteObjectIdentifiers(ctx context.Context, objects []*s3.ObjectIdentifier) error {
+	for len(objects) > 0 {
+		batch := objects
+		if len(batch) > maxDeleteObjectsBatch {
+			batch = batch[:maxDeleteObjectsBatch]
+		}
+		objects = objects[len(batch):]
+		result, err := s3Svc.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(bucketName),
+			Delete: &s3.Delete{Objects: batch, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return err
+		}
+		if len(result.Errors) > 0 {
+			return fmt.Errorf("deleting %s: %s", aws.StringValue(result.Errors[0].Key), aws.StringValue(result.Errors[0].Message))
+		}
+	}
+	return nil
+}
+
+// deletes assets in a throttled background job
+func startDeletionJob(ids []string) *job {
+	return startJob(jobKindDeletion, len(ids), func(j *job) (interface{}, error) {
+		result := deletionResult{Failed: []string{}, Pinned: []string{}, Locked: []string{}, PendingApproval: []string{}}
+		for _, id := range ids {
+			if !deleteThrottle.wait(j.canceled()) {
+				return result, errJobCanceled
+			}
+			err := deleteAsset(context.Background(), id)
+			if err == errAssetPinned {
+				result.Pinned = append(result.Pinned, id)
+			} else if err == errAssetLocked {
+				result.Locked = append(result.Locked, id)
+			} else if err == errDeletionQueued {
+				result.PendingApproval = append(result.PendingApproval, id)
+			} else if err != nil {
+				log.Println(err.Error())
+				result.Failed = append(result.Failed, id)
+			}
+			j.advance()
+		}
+		return result, nil
+	})
+}
+
+// starts a bulk deletion
+func bulkDelete(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodPost) {
+		return
+	}
+	var reqBody deletionRequest
+	err := json.NewDecoder(r.Body).Decode(&reqBody)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON payload: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	if len(reqBody.IDs) == 0 || len(reqBody.IDs) > maxBulkDeleteIDs {
+		http.Error(w, fmt.Sprintf("Invalid value for key IDs, must list 1 to %d ids.", maxBulkDeleteIDs), http.StatusBadRequest)
+		return
+	}
+	acceptJob(w, startDeletionJob(reqBody.IDs))
+}
+
+// deletes an asset, restorably during the retention window; with
+// confirmation required, a request without ?confirm= only issues the token
+// to confirm with
+func handleDeleteRequest(w http.ResponseWriter, r *http.Request, assetID string) {
+	token := r.URL.Query().Get("confirm")
+	if requireDeleteConfirmation && token == "" {
+		issueDeleteConfirmation(w, r, assetID)
+		return
+	}
+	if deferDeleteRequest(w, r, assetID, token) {
+		return
+	}
+
+	values := lockConditionValues(r)
+	values[":false"] = &dynamodb.AttributeValue{BOOL: aws.Bool(false)}
+	condition := confirmedCondition("attribute_exists(id) AND "+unpinnedCondition+" AND "+lockCondition, token, values)
+	var err error
+	if deleteRetention > 0 {
+		err = trashAsset(r.Context(), assetID, condition, values)
+	} else {
+		err = removeAsset(r.Context(), assetID, condition, values)
+	}
+	if err != nil {
+		if isConditionFailed(err) {
+			writeDeleteConflict(w, assetID, token, conditionFailedItem(err))
+			return
+		}
+		writeError(w, err)
+		return
+	}
+	if requireDeleteConfirmation {
+		noteTokenAccepted(tokenDeleteConfirmation)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adds to a delete request's condition that it carries the asset's
+// confirmation token, when confirmation is required
+func confirmedCondition(condition, token string, values map[string]*dynamodb.AttributeValue) string {
+	if !requireDeleteConfirmation {
+		return condition
+	}
+	values[":confirm"] = &dynamodb.AttributeValue{S: aws.String(token)}
+	values[":tokenCutoff"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(tokenCutoff(time.Now()), 10))}
+	return condition + " AND delete_token = :confirm AND delete_token_expires > :tokenCutoff"
+}
+
+// answers a delete request whose condition failed against the asset's
+// record, as it was found
+func writeDeleteConflict(w http.ResponseWriter, assetID, token string, item map[string]*dynamodb.AttributeValue) {
+	switch {
+	case len(item) == 0 || isDeleted(item):
+		writeError(w, notFound(assetID))
+	case isPinned(item):
+		http.Error(w, fmt.Sprintf("Asset id '%s' is pinned.", assetID), http.StatusConflict)
+	case requireDeleteConfirmation && stringAttribute(item, "delete_token") != token:
+		http.Error(w, "Invalid or expired confirmation token.", http.StatusForbidden)
+	case requireDeleteConfirmation && numberAttribute(item, "delete_token_expires") <= tokenCutoff(time.Now()):
+		noteTokenExpired(tokenDeleteConfirmation)
+		http.Error(w, "Invalid or expired confirmation token.", http.StatusForbidden)
+	default:
+		http.Error(w, fmt.Sprintf("Asset id '%s' is locked.", assetID), http.StatusLocked)
+	}
+}
+
+// records a short-lived token that a second delete request must carry
+func issueDeleteConfirmation(w http.ResponseWriter, r *http.Request, assetID string) {
+	confirmation := deleteConfirmation{
+		ConfirmationToken: secureToken(18),
+		ExpiresAt:         time.Now().Add(deleteConfirmationTimeout).UTC().Truncate(time.Second),
+	}
+	values := lockConditionValues(r)
+	values[":deleteToken"] = &dynamodb.AttributeValue{S: aws.String(confirmation.ConfirmationToken)}
+	values[":expires"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(confirmation.ExpiresAt.Unix(), 10))}
+	_, err := dbSvc.UpdateItemWithContext(r.Context(), &dynamodb.UpdateItemInput{
+		Key:                                 assetKey(assetID),
+		TableName:                           aws.String(tableName),
+		UpdateExpression:                    aws.String("SET delete_token = :deleteToken, delete_token_expires = :expires"),
+		ConditionExpression:                 aws.String("attribute_exists(id) AND " + lockCondition),
+		ExpressionAttributeValues:           values,
+		ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValuesOnConditionCheckFailureAllOld),
+	})
+	if err != nil {
+		if isConditionFailed(err) {
+			if isLockedConflict(err) {
+				http.Error(w, fmt.Sprintf("Asset id '%s' is locked.", assetID), http.StatusLocked)
+				return
+			}
+			writeError(w, notFound(assetID))
+			return
+		}
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusPreconditionRequired)
+	writeJSON(w, confirmation)
+}
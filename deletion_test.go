@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestThrottleCancel(t *testing.T) {
+	th := newThrottle(0.001)
+	cancel := make(chan struct{})
+	if !th.wait(cancel) {
+		t.Error("First wait on a throttle should not block")
+	}
+	close(cancel)
+	if th.wait(cancel) {
+		t.Error("Canceled wait on a throttle should return false")
+	}
+}
+func TestBulkDelete(t *testing.T) {
+	dbSvc = &mockDBClient{}
+	s3Svc = &mockS3Client{}
+	deleteThrottle = newThrottle(1000)
+	r := httptest.NewRequest(http.MethodPost, "/deletions", bytes.NewReader([]byte(`{"IDs":["a","b","c"]}`)))
+	w := httptest.NewRecorder()
+
+	bulkDelete(w, r)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Incorrect status starting bulk delete: %d", resp.StatusCode)
+	}
+	jsonResp := jobStatus{}
+	json.NewDecoder(resp.Body).Decode(&jsonResp)
+
+	j := waitForJob(t, jsonResp.ID)
+	if j.State != jobStateDone || j.Done != 3 {
+		t.Errorf("Bulk delete did not finish: %s with %d deleted", j.State, j.Done)
+	}
+}
+func TestBulkDeleteBadPayload(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/deletions", bytes.NewReader([]byte(`{"IDs":[]}`)))
+	w := httptest.NewRecorder()
+
+	bulkDelete(w, r)
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("Didn't get 400 for an empty bulk delete: %d", w.Result().StatusCode)
+	}
+}
+
+// fails conditional deletes, reporting the given record as it was
+type mockDBDeleteConflictClient struct {
+	mockDBClient
+	item map[string]*dynamodb.AttributeValue
+}
+
+func (m *mockDBDeleteConflictClient) DeleteItem(*dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	return nil, &dynamodb.ConditionalCheckFailedException{Message_: aws.String("The conditional request failed"), Item: m.item}
+}
+func (m *mockDBDeleteConflictClient) DeleteItemWithContext(ctx aws.Context, input *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	return m.DeleteItem(input)
+}
+
+func (m *mockDBDeleteConflictClient) UpdateItem(*dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	return nil, &dynamodb.ConditionalCheckFailedException{Message_: aws.String("The conditional request failed"), Item: m.item}
+}
+func (m *mockDBDeleteConflictClient) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	return m.UpdateItem(input)
+}
+
+// remembers the object versions deleted
+type mockS3VersionsClient struct {
+	mockS3Client
+	deleted []string
+}
+
+func (m *mockS3VersionsClient) ListObjectVersionsPages(input *s3.ListObjectVersionsInput, fn func(*s3.ListObjectVersionsOutput, bool) bool) error {
+	fn(&s3.ListObjectVersionsOutput{
+		Versions: []*s3.ObjectVersion{
+			{Key: aws.String("someID"), VersionId: aws.String("v2")},
+			{Key: aws.String("someID"), VersionId: aws.String("v1")},
+			{Key: aws.String("someIDother"), VersionId: aws.String("v1")},
+		},
+		DeleteMarkers: []*s3.DeleteMarkerEntry{{Key: aws.String("someID.tus-tail"), VersionId: aws.String("v3")}},
+	}, true)
+	return nil
+}
+func (m *mockS3VersionsClient) ListObjectVersionsPagesWithContext(ctx aws.Context, input *s3.ListObjectVersionsInput, fn func(*s3.ListObjectVersionsOutput, bool) bool, opts ...request.Option) error {
+	return m.ListObjectVersionsPages(input, fn)
+}
+
+func (m *mockS3VersionsClient) DeleteObjects(input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	for _, object := range input.Delete.Objects {
+		m.deleted = append(m.deleted, *object.Key+"@"+*object.VersionId)
+	}
+	return &s3.DeleteObjectsOutput{}, nil
+}
+func (m *mockS3VersionsClient) DeleteObjectsWithContext(ctx aws.Context, input *s3.DeleteObjectsInput, opts ...request.Option) (*s3.DeleteObjectsOutput, error) {
+	return m.DeleteObjects(input)
+}
+
+func TestDeleteRequest(t *testing.T) {
+	defer func() { deleteRetention = 7 * 24 * time.Hour }()
+	deleteRetention = 0
+	dbSvc = &mockDBClient{}
+	s3 := &mockS3VersionsClient{}
+	s3Svc = s3
+	r := httptest.NewRequest(http.MethodDelete, "/asset/someID", nil)
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusNoContent {
+		t.Fatalf("Incorrect status deleting an asset: %d", w.Result().StatusCode)
+	}
+	expected := []string{"someID@v2", "someID@v1", "someID.tus-tail@v3"}
+	if !reflect.DeepEqual(s3.deleted, expected) {
+		t.Errorf("Incorrect object versions deleted: %v", s3.deleted)
+	}
+}
+
+// whether an update is the one removeAsset marks a record removed with
+func isRemoval(input *dynamodb.UpdateItemInput) bool {
+	return strings.Contains(aws.StringValue(input.UpdateExpression), "purge_at = :removeAt")
+}
+
+// records the S3 object versions deleted by the time the tombstone is put
+type mockDBTombstoneOrderClient struct {
+	mockDBClient
+	s3         *mockS3VersionsClient
+	removed    bool
+	tombstoned []string
+}
+
+func (m *mockDBTombstoneOrderClient) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	m.removed = m.removed || isRemoval(input)
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+func (m *mockDBTombstoneOrderClient) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	return m.UpdateItem(input)
+}
+
+func (m *mockDBTombstoneOrderClient) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	if isTombstone(input.Item) {
+		m.tombstoned = append([]string{}, m.s3.deleted...)
+	}
+	return &dynamodb.PutItemOutput{}, nil
+}
+func (m *mockDBTombstoneOrderClient) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	return m.PutItem(input)
+}
+
+// fails deleting object versions
+type mockS3VersionsErrorClient struct {
+	mockS3VersionsClient
+}
+
+func (m *mockS3VersionsErrorClient) DeleteObjects(input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	return nil, errors.New("S3 unavailable")
+}
+func (m *mockS3VersionsErrorClient) DeleteObjectsWithContext(ctx aws.Context, input *s3.DeleteObjectsInput, opts ...request.Option) (*s3.DeleteObjectsOutput, error) {
+	return m.DeleteObjects(input)
+}
+
+func TestRemoveAssetOrder(t *testing.T) {
+	versions := &mockS3VersionsClient{}
+	db := &mockDBTombstoneOrderClient{s3: versions}
+	dbSvc, s3Svc = db, versions
+	defer func() { s3Svc = &mockS3Client{} }()
+	if err := removeAsset(context.Background(), "someID", "attribute_exists(id)", map[string]*dynamodb.AttributeValue{}); err != nil {
+		t.Fatal(err)
+	}
+	if !db.removed || len(db.tombstoned) != 3 {
+		t.Errorf("Tombstone not put after the objects were deleted: %v %v", db.removed, db.tombstoned)
+	}
+
+	// the record stays due for the purge sweep to retry
+	db = &mockDBTombstoneOrderClient{s3: versions}
+	dbSvc, s3Svc = db, &mockS3VersionsErrorClient{}
+	if err := removeAsset(context.Background(), "someID", "attribute_exists(id)", map[string]*dynamodb.AttributeValue{}); err == nil {
+		t.Error("Got no error when the objects couldn't be deleted")
+	}
+	if !db.removed || db.tombstoned != nil {
+		t.Errorf("Tombstone put though the objects weren't deleted: %v", db.tombstoned)
+	}
+}
+func TestDeleteRequestConflicts(t *testing.T) {
+	s3Svc = &mockS3Client{}
+	cases := []struct {
+		item   map[string]*dynamodb.AttributeValue
+		status int
+	}{
+		{nil, http.StatusNotFound},
+		{map[string]*dynamodb.AttributeValue{"id": {S: aws.String("someID")}, "pinned": {BOOL: aws.Bool(true)}}, http.StatusConflict},
+		{map[string]*dynamodb.AttributeValue{"id": {S: aws.String("someID")}, "lock_token": {S: aws.String("other")}}, http.StatusLocked},
+		{map[string]*dynamodb.AttributeValue{"id": {S: aws.String("someID")}, "status": {S: aws.String(assetStatusDeleted)}}, http.StatusNotFound},
+	}
+	for _, c := range cases {
+		dbSvc = &mockDBDeleteConflictClient{item: c.item}
+		r := httptest.NewRequest(http.MethodDelete, "/asset/someID", nil)
+		w := httptest.NewRecorder()
+		manageAsset(w, r)
+		if w.Result().StatusCode != c.status {
+			t.Errorf("Expected %d deleting %v, got %d", c.status, c.item, w.Result().StatusCode)
+		}
+	}
+}
+func TestBulkDeleteLocked(t *testing.T) {
+	s3Svc = &mockS3Client{}
+	deleteThrottle = newThrottle(1000)
+	cases := []struct {
+		expires time.Duration
+		locked  bool
+	}{
+		{time.Minute, true},
+		{-time.Minute, false},
+	}
+	for _, c := range cases {
+		dbSvc = &mockDBDeleteConflictClient{item: map[string]*dynamodb.AttributeValue{
+			"id":           {S: aws.String("someID")},
+			"lock_token":   {S: aws.String("other")},
+			"lock_expires": {N: aws.String(strconv.FormatInt(time.Now().Add(c.expires).Unix(), 10))},
+		}}
+		j := waitForJob(t, startDeletionJob([]string{"someID"}).status.ID)
+		result, _ := j.Result.(map[string]interface{})
+		locked, _ := result["locked"].([]interface{})
+		if j.State != jobStateDone || (len(locked) == 1) != c.locked {
+			t.Errorf("Expected locked %t for a lock expiring in %s, got %s with %v", c.locked, c.expires, j.State, j.Result)
+		}
+	}
+}
+func TestDeleteRequestConfirmation(t *testing.T) {
+	defer func() { requireDeleteConfirmation = false }()
+	requireDeleteConfirmation = true
+	dbSvc = &mockDBClient{}
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodDelete, "/asset/someID", nil)
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	resp := w.Result()
+	confirmation := deleteConfirmation{}
+	json.NewDecoder(resp.Body).Decode(&confirmation)
+	if resp.StatusCode != http.StatusPreconditionRequired || confirmation.ConfirmationToken == "" {
+		t.Fatalf("Didn't get a confirmation token: %d %+v", resp.StatusCode, confirmation)
+	}
+
+	dbSvc = &mockDBDeleteConflictClient{item: map[string]*dynamodb.AttributeValue{
+		"id":           {S: aws.String("someID")},
+		"delete_token": {S: aws.String(confirmation.ConfirmationToken)},
+	}}
+	r = httptest.NewRequest(http.MethodDelete, "/asset/someID?confirm=wrong", nil)
+	w = httptest.NewRecorder()
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusForbidden {
+		t.Errorf("Didn't get 403 for a wrong confirmation token: %d", w.Result().StatusCode)
+	}
+}
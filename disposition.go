@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	dispositionInline     = "inline"
+	dispositionAttachment = "attachment"
+	activeContentForce    = "force"
+	activeContentBlock    = "block"
+	safeContentType       = "application/octet-stream"
+	maxFilenameLength     = 255
+)
+
+// content types a browser may execute script from when rendered inline
+var activeContentTypes = map[string]bool{
+	"text/html":                true,
+	"application/xhtml+xml":    true,
+	"image/svg+xml":            true,
+	"text/xml":                 true,
+	"application/xml":          true,
+	"text/javascript":          true,
+	"application/javascript":   true,
+	"application/x-javascript": true,
+	"application/ecmascript":   true,
+}
+
+// whether active content is forced to download as an attachment or refused
+var activeContentPolicy = activeContentForce
+
+// maps a content type pattern (type/subtype, type/* or *) to a disposition
+type dispositionRule struct {
+	pattern     string
+	disposition string
+}
+
+// rules consulted in order when picking a download disposition, anything
+// unmatched is served as an attachment
+var dispositionRules = []dispositionRule{
+	{"image/*", dispositionInline},
+	{"*", dispositionAttachment},
+}
+
+// parses a comma separated list of pattern=disposition pairs
+func parseDispositionRules(value string) ([]dispositionRule, error) {
+	var rules []dispositionRule
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || !validDisposition(parts[1]) {
+			return nil, fmt.Errorf("invalid disposition rule '%s'", pair)
+		}
+		rules = append(rules, dispositionRule{strings.ToLower(parts[0]), parts[1]})
+	}
+	return rules, nil
+}
+
+func validDisposition(disposition string) bool {
+	return disposition == dispositionInline || disposition == dispositionAttachment
+}
+
+// strips parameters from a content type, lowercasing what's left
+func mediaTypeOf(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	}
+	return mediaType
+}
+
+// matches a media type against type/subtype, type/* or * patterns
+func matchesMediaPattern(pattern, mediaType string) bool {
+	return pattern == "*" || pattern == mediaType ||
+		(strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*")))
+}
+
+// reports whether content of this type could run script in a browser
+func isActiveContent(contentType string) bool {
+	return activeContentTypes[mediaTypeOf(contentType)]
+}
+
+// picks the disposition for a content type from the configured rules
+func dispositionFor(contentType string) string {
+	mediaType := mediaTypeOf(contentType)
+	for _, rule := range dispositionRules {
+		if matchesMediaPattern(rule.pattern, mediaType) {
+			return rule.disposition
+		}
+	}
+	return dispositionAttachment
+}
+
+// checks that a filename is reasonable to suggest to browsers
+func validateFilename(name string) error {
+	if len(name) > maxFilenameLength {
+		return fmt.Errorf("filename is too long")
+	}
+	for _, c := range name {
+		if c < ' ' || c == 0x7f || c == '/' || c == '\\' {
+			return fmt.Errorf("filename contains control characters or slashes")
+		}
+	}
+	return nil
+}
+
+// builds a Content-Disposition value, encoding non-ASCII filenames as
+// RFC 2231 requires
+func dispositionHeader(disposition, filename string) string {
+	if filename == "" {
+		return disposition
+	}
+	return mime.FormatMediaType(disposition, map[string]string{"filename": filename})
+}
+
+// looks up what S3 stored about a version of the object at key, the newest
+// when versionID is empty, returning an empty description if there's no
+// such object and a storage error if S3 couldn't say
+func objectHead(ctx context.Context, key, versionID string) (*s3.HeadObjectOutput, error) {
+	head, err := s3Svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket:    aws.String(bucketName),
+		Key:       aws.String(key),
+		VersionId: optionalString(versionID),
+	})
+	if isObjectNotFound(err) {
+		return &s3.HeadObjectOutput{}, nil
+	}
+	if err != nil {
+		return nil, objectStoreError(err)
+	}
+	return head, nil
+}
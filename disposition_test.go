@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestDispositionFor(t *testing.T) {
+	defer func(rules []dispositionRule) { dispositionRules = rules }(dispositionRules)
+	var err error
+	dispositionRules, err = parseDispositionRules("image/*=inline, application/pdf=inline, *=attachment")
+	if err != nil {
+		t.Fatalf("Failed to parse valid rules: %s", err)
+	}
+
+	cases := map[string]string{
+		"image/png":                dispositionInline,
+		"application/pdf":          dispositionInline,
+		"text/html; charset=utf-8": dispositionAttachment,
+		"":                         dispositionAttachment,
+	}
+	for contentType, expected := range cases {
+		if actual := dispositionFor(contentType); actual != expected {
+			t.Errorf("Got disposition %s for %s, expected %s", actual, contentType, expected)
+		}
+	}
+
+	if _, err := parseDispositionRules("image/*=render"); err == nil {
+		t.Error("Got no error for an invalid disposition rule")
+	}
+}
+func TestAssetURLRequestBadDisposition(t *testing.T) {
+	dbSvc = &mockDBClient{}
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodGet, "/asset/someID?disposition=render", nil)
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Didn't get 400 for a bad disposition: %d", resp.StatusCode)
+	}
+}
+
+type mockS3HTMLClient struct {
+	mockS3Client
+}
+
+func (m *mockS3HTMLClient) HeadObject(*s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	return &s3.HeadObjectOutput{ContentType: aws.String("text/html; charset=utf-8")}, nil
+}
+func (m *mockS3HTMLClient) HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	return m.HeadObject(input)
+}
+
+func TestIsActiveContent(t *testing.T) {
+	if !isActiveContent("Image/SVG+XML") || !isActiveContent("text/html; charset=utf-8") {
+		t.Error("Failed to detect active content")
+	}
+	if isActiveContent("image/png") {
+		t.Error("Plain image detected as active content")
+	}
+}
+func TestAssetURLRequestActiveContentBlocked(t *testing.T) {
+	defer func(policy string) { activeContentPolicy = policy }(activeContentPolicy)
+	activeContentPolicy = activeContentBlock
+	dbSvc = &mockDBClient{}
+	s3Svc = &mockS3HTMLClient{}
+	r := httptest.NewRequest(http.MethodGet, "/asset/someID?disposition=inline", nil)
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Didn't get 403 for blocked active content: %d", resp.StatusCode)
+	}
+}
+func TestDispositionHeader(t *testing.T) {
+	cases := map[string]string{
+		"":              "attachment",
+		"report.pdf":    "attachment; filename=report.pdf",
+		"my report.pdf": `attachment; filename="my report.pdf"`,
+		"résumé.pdf":    "attachment; filename*=utf-8''r%C3%A9sum%C3%A9.pdf",
+	}
+	for filename, expected := range cases {
+		if actual := dispositionHeader(dispositionAttachment, filename); actual != expected {
+			t.Errorf("Got disposition %s for %q, expected %s", actual, filename, expected)
+		}
+	}
+	for _, filename := range []string{"../etc/passwd", "a\nb", strings.Repeat("a", 256)} {
+		if err := validateFilename(filename); err == nil {
+			t.Errorf("Got no error for filename %q", filename)
+		}
+	}
+}
+func TestAssetURLRequestBadFilename(t *testing.T) {
+	dbSvc = &mockDBClient{}
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodGet, "/asset/someID?filename=a%2Fb", nil)
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("Didn't get 400 for a filename with a slash: %d", w.Result().StatusCode)
+	}
+}
+func TestDownloadInputOverrides(t *testing.T) {
+	s3Svc = &mockS3Client{}
+	item := map[string]*dynamodb.AttributeValue{"cache_control": {S: aws.String("max-age=60")}}
+	r := httptest.NewRequest(http.MethodGet, "/asset/someID?content_type=text/plain&cache_control=no-store", nil)
+	w := httptest.NewRecorder()
+
+	head, _ := objectHead(context.Background(), "someID", "")
+	input, ok := downloadInput(w, r, "someID", item, head)
+	if !ok {
+		t.Fatalf("Overrides refused: %d", w.Result().StatusCode)
+	}
+	if aws.StringValue(input.ResponseContentType) != "text/plain" || aws.StringValue(input.ResponseCacheControl) != "no-store" {
+		t.Errorf("Overrides not applied: %v", input)
+	}
+	if !strings.HasPrefix(aws.StringValue(input.ResponseContentDisposition), dispositionAttachment) {
+		t.Errorf("Disposition not picked from the overridden type: %s", aws.StringValue(input.ResponseContentDisposition))
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/asset/someID?content_type=text", nil)
+	w = httptest.NewRecorder()
+	if _, ok := downloadInput(w, r, "someID", item, head); ok || w.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("Didn't get 400 for a malformed content_type: %d", w.Result().StatusCode)
+	}
+}
+func TestDownloadInputActiveContentOverride(t *testing.T) {
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodGet, "/asset/someID?content_type=text/html&disposition=inline", nil)
+	w := httptest.NewRecorder()
+
+	head, _ := objectHead(context.Background(), "someID", "")
+	input, ok := downloadInput(w, r, "someID", nil, head)
+	if !ok || aws.StringValue(input.ResponseContentType) != safeContentType {
+		t.Errorf("Active content override wasn't made safe: %v", input)
+	}
+}
+
+// fails every HEAD with err
+type mockS3HeadErrorClient struct {
+	mockS3Client
+	err error
+}
+
+func (m *mockS3HeadErrorClient) HeadObject(*s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	return nil, m.err
+}
+func (m *mockS3HeadErrorClient) HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	return m.HeadObject(input)
+}
+
+func TestObjectHeadErrors(t *testing.T) {
+	dbSvc = &mockDBClient{}
+	cases := []struct {
+		err    error
+		status int
+	}{
+		{awserr.NewRequestFailure(awserr.New("NotFound", "Not Found", nil), http.StatusNotFound, ""), http.StatusOK},
+		{awserr.NewRequestFailure(awserr.New("SlowDown", "Please reduce your request rate.", nil), http.StatusServiceUnavailable, ""), http.StatusServiceUnavailable},
+		{awserr.NewRequestFailure(awserr.New("InternalError", "We encountered an internal error.", nil), http.StatusInternalServerError, ""), http.StatusBadGateway},
+		{awserr.New(request.ErrCodeSerialization, "failed to read response", nil), http.StatusBadGateway},
+	}
+	for _, c := range cases {
+		s3Svc = &mockS3HeadErrorClient{err: c.err}
+		w := httptest.NewRecorder()
+		manageAsset(w, httptest.NewRequest(http.MethodGet, "/asset/someID/progress", nil))
+		if w.Result().StatusCode != c.status {
+			t.Errorf("Expected %d when HEAD fails with %v, got %d", c.status, c.err, w.Result().StatusCode)
+		}
+		if c.status == http.StatusServiceUnavailable && w.Result().Header.Get("Retry-After") == "" {
+			t.Errorf("No Retry-After when S3 is throttled")
+		}
+	}
+}
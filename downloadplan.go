@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+const (
+	defaultPlanParts = 4
+	maxPlanParts     = 100
+)
+
+// a segment of an object, fetched by sending its headers to its url
+type downloadPart struct {
+	URL     string            `json:"url"`
+	Range   string            `json:"range"`
+	Headers map[string]string `json:"headers"`
+}
+
+// how to fetch an object in parallel segments
+type downloadPlan struct {
+	Size    int64          `json:"size"`
+	ETag    string         `json:"etag,omitempty"`
+	Version string         `json:"version,omitempty"`
+	Parts   []downloadPart `json:"parts"`
+}
+
+// splits an asset's object into ?parts= (4 by default) byte ranges of about
+// the same size, each with its own signed url
+func handleDownloadPlanRequest(w http.ResponseWriter, r *http.Request, assetID string) {
+	parts := defaultPlanParts
+	if value := r.URL.Query().Get("parts"); value != "" {
+		var err error
+		parts, err = strconv.Atoi(value)
+		if err != nil || parts < 1 || parts > maxPlanParts {
+			http.Error(w, fmt.Sprintf("Invalid argument for parts, must be integer from 1 to %d.", maxPlanParts), http.StatusBadRequest)
+			return
+		}
+	}
+	target, ok := resolveDownload(w, r, assetID)
+	if !ok {
+		return
+	}
+
+	plan := downloadPlan{
+		Size:    aws.Int64Value(target.response.Size),
+		ETag:    target.response.ETag,
+		Version: target.response.Version,
+		Parts:   []downloadPart{},
+	}
+	if int64(parts) > plan.Size {
+		parts = int(plan.Size)
+	}
+	var partSize int64
+	if parts > 0 {
+		partSize = (plan.Size + int64(parts) - 1) / int64(parts)
+	}
+	for start := int64(0); start < plan.Size; start += partSize {
+		end := start + partSize
+		if end > plan.Size {
+			end = plan.Size
+		}
+		part := downloadPart{
+			Range:   fmt.Sprintf("bytes=%d-%d", start, end-1),
+			Headers: map[string]string{},
+		}
+		part.Headers["Range"] = part.Range
+		if target.input == nil {
+			// public urls take any range
+			part.URL = target.response.DownloadURL
+		} else {
+			input := *target.input
+			input.Range = aws.String(part.Range)
+			// segments of an unversioned object must all come from the same upload
+			if plan.Version == "" && plan.ETag != "" {
+				input.IfMatch = aws.String(plan.ETag)
+				part.Headers["If-Match"] = plan.ETag
+			}
+			var err error
+			part.URL, err = presignDownload(&input, target.timeout)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				log.Println(err.Error())
+				return
+			}
+		}
+		plan.Parts = append(plan.Parts, part)
+	}
+	countDownload(assetID)
+	writeJSON(w, plan)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDownloadPlanRequest(t *testing.T) {
+	dbSvc = &mockDBClient{}
+	s3Svc = &mockS3Client{}
+	for parts, ranges := range map[string][]string{
+		"":   {"bytes=0-2", "bytes=3-5", "bytes=6-8", "bytes=9-11"},
+		"5":  {"bytes=0-2", "bytes=3-5", "bytes=6-8", "bytes=9-11"},
+		"1":  {"bytes=0-11"},
+		"20": {"bytes=0-0", "bytes=1-1", "bytes=2-2", "bytes=3-3", "bytes=4-4", "bytes=5-5", "bytes=6-6", "bytes=7-7", "bytes=8-8", "bytes=9-9", "bytes=10-10", "bytes=11-11"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/asset/someID/download-plan?parts="+parts, nil)
+		w := httptest.NewRecorder()
+		manageAsset(w, r)
+		if w.Result().StatusCode != http.StatusOK {
+			t.Fatalf("Incorrect status for %s parts: %d", parts, w.Result().StatusCode)
+		}
+		var plan downloadPlan
+		if err := json.NewDecoder(w.Body).Decode(&plan); err != nil {
+			t.Fatal(err)
+		}
+		if plan.Size != 12 || len(plan.Parts) != len(ranges) {
+			t.Fatalf("Incorrect plan for %s parts: %+v", parts, plan)
+		}
+		for i, part := range plan.Parts {
+			if part.Range != ranges[i] || part.Headers["Range"] != ranges[i] {
+				t.Errorf("Incorrect part %d for %s parts: %+v", i, parts, part)
+			}
+		}
+	}
+}
+
+func TestDownloadPlanRequestBadParts(t *testing.T) {
+	dbSvc = &mockDBClient{}
+	s3Svc = &mockS3Client{}
+	for _, parts := range []string{"0", "101", "many"} {
+		r := httptest.NewRequest(http.MethodGet, "/asset/someID/download-plan?parts="+parts, nil)
+		w := httptest.NewRecorder()
+		manageAsset(w, r)
+		if w.Result().StatusCode != http.StatusBadRequest {
+			t.Errorf("Didn't get 400 for %s parts: %d", parts, w.Result().StatusCode)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// download tokens share the assets table under this key prefix
+	downloadTokenKeyPrefix = "dltoken:"
+	maxDownloadLimit       = 1000
+)
+
+// parses the optional max_downloads parameter, returning zero when unset
+func parseDownloadLimit(w http.ResponseWriter, r *http.Request) (int, bool) {
+	value := r.URL.Query().Get("max_downloads")
+	if value == "" {
+		return 0, true
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 || limit > maxDownloadLimit {
+		http.Error(w, fmt.Sprintf("Invalid argument for max_downloads, must be integer from 1 to %d.", maxDownloadLimit), http.StatusBadRequest)
+		return 0, false
+	}
+	return limit, true
+}
+
+// records a token allowing limit downloads of an asset's object until
+// timeout passes, returning the service url that serves them
+func createDownloadToken(r *http.Request, assetID string, input *s3.GetObjectInput, limit int, timeout time.Duration) (string, error) {
+	token := secureToken(24)
+	item := map[string]*dynamodb.AttributeValue{
+		"id":        {S: aws.String(downloadTokenKeyPrefix + token)},
+		"asset_id":  {S: input.Key},
+		"asset":     {S: aws.String(assetID)},
+		"remaining": {N: aws.String(strconv.Itoa(limit))},
+		"expires":   {N: aws.String(strconv.FormatInt(time.Now().Add(timeout).Unix(), 10))},
+	}
+	for name, value := range map[string]*string{
+		"response_cache_control":       input.ResponseCacheControl,
+		"response_content_disposition": input.ResponseContentDisposition,
+		"response_content_type":        input.ResponseContentType,
+		"s3_version_id":                input.VersionId,
+	} {
+		if value != nil {
+			item[name] = &dynamodb.AttributeValue{S: value}
+		}
+	}
+	_, err := dbSvc.PutItemWithContext(r.Context(), &dynamodb.PutItemInput{
+		Item:      item,
+		TableName: aws.String(tableName),
+	})
+	if err != nil {
+		return "", err
+	}
+	return serviceURL(r, "/download/"+token), nil
+}
+
+// the absolute url of a route on this service, as the client reached it
+func serviceURL(r *http.Request, path string) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + basePath + path
+}
+
+// serves a limited-use download link, counting it against its token
+func serveDownload(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	token := strings.TrimPrefix(r.URL.Path, "/download/")
+	now := time.Now()
+	result, err := dbSvc.UpdateItemWithContext(r.Context(), &dynamodb.UpdateItemInput{
+		Key:                 assetKey(downloadTokenKeyPrefix + token),
+		TableName:           aws.String(tableName),
+		UpdateExpression:    aws.String("SET remaining = remaining - :one"),
+		ConditionExpression: aws.String("remaining > :zero AND expires > :cutoff"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":one":    {N: aws.String("1")},
+			":zero":   {N: aws.String("0")},
+			":cutoff": {N: aws.String(strconv.FormatInt(tokenCutoff(now), 10))},
+		},
+		ReturnValues:                        aws.String(dynamodb.ReturnValueAllNew),
+		ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValuesOnConditionCheckFailureAllOld),
+	})
+	if err != nil {
+		if isConditionFailed(err) {
+			// the exception carries the token when it exists but is used up
+			if cerr, ok := err.(*dynamodb.ConditionalCheckFailedException); ok && len(cerr.Item) > 0 {
+				if numberAttribute(cerr.Item, "expires") <= tokenCutoff(now) {
+					noteTokenExpired(tokenDownload)
+				}
+				http.Error(w, "Download link has expired or been used up.", http.StatusGone)
+				return
+			}
+			http.Error(w, "Download link not found.", http.StatusNotFound)
+			return
+		}
+		writeError(w, err)
+		return
+	}
+
+	item := result.Attributes
+	noteTokenUse(tokenDownload, numberAttribute(item, "expires"), now)
+	// tokens made before the event log don't name their asset
+	if assetID := stringAttribute(item, "asset"); assetID != "" {
+		recordAssetEvent(r, assetID, assetEventDownloaded, map[string]string{"via": "download_link"})
+	}
+	streamObject(w, r, &s3.GetObjectInput{
+		Bucket:                     aws.String(bucketName),
+		Key:                        aws.String(stringAttribute(item, "asset_id")),
+		ResponseCacheControl:       optionalString(stringAttribute(item, "response_cache_control")),
+		ResponseContentDisposition: optionalString(stringAttribute(item, "response_content_disposition")),
+		ResponseContentType:        optionalString(stringAttribute(item, "response_content_type")),
+		VersionId:                  optionalString(stringAttribute(item, "s3_version_id")),
+	})
+}
+
+// copies an object to the response with the headers S3 would have sent,
+// or just the byte range asked for
+func streamObject(w http.ResponseWriter, r *http.Request, input *s3.GetObjectInput) {
+	ranged := rangeInput(r, input)
+	object, err := s3Svc.GetObjectWithContext(r.Context(), ranged)
+	if ranged != input {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidRange" {
+			// the size is only a courtesy to the client, so answer without it
+			// if S3 won't say
+			head, err := objectHead(r.Context(), aws.StringValue(input.Key), aws.StringValue(input.VersionId))
+			if err != nil {
+				log.Println(err.Error())
+			} else if head.ContentLength != nil {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", *head.ContentLength))
+			}
+			http.Error(w, fmt.Sprintf("Range '%s' is not satisfiable.", r.Header.Get("Range")), http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		// an object changed since If-Range is sent whole
+		if aerr, ok := err.(awserr.Error); (ok && aerr.Code() == "PreconditionFailed") || (err == nil && !ifRangeDateMatches(r, object)) {
+			if err == nil {
+				object.Body.Close()
+			}
+			object, err = s3Svc.GetObjectWithContext(r.Context(), input)
+		}
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer object.Body.Close()
+	header := w.Header()
+	for name, value := range map[string]*string{
+		"Cache-Control":       object.CacheControl,
+		"Content-Disposition": object.ContentDisposition,
+		"Content-Type":        object.ContentType,
+		"ETag":                object.ETag,
+	} {
+		if value != nil {
+			header.Set(name, *value)
+		}
+	}
+	if object.ContentLength != nil {
+		header.Set("Content-Length", strconv.FormatInt(*object.ContentLength, 10))
+	}
+	if object.LastModified != nil {
+		header.Set("Last-Modified", object.LastModified.UTC().Format(http.TimeFormat))
+	}
+	header.Set("Accept-Ranges", "bytes")
+	if object.ContentRange != nil {
+		header.Set("Content-Range", *object.ContentRange)
+		w.WriteHeader(http.StatusPartialContent)
+	}
+	if _, err := io.Copy(w, object.Body); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// input narrowed to a request's Range, for S3 to cut, or input itself when
+// the whole object is to be sent: S3 cuts one range at a time, so several
+// get the whole object, as does an If-Range with a weak or invalid
+// validator; an If-Range ETag must match for S3 to answer at all, and a
+// date must not have passed
+func rangeInput(r *http.Request, input *s3.GetObjectInput) *s3.GetObjectInput {
+	spec := r.Header.Get("Range")
+	if !strings.HasPrefix(spec, "bytes=") || strings.Contains(spec, ",") {
+		return input
+	}
+	ranged := *input
+	ranged.Range = aws.String(spec)
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" {
+		if strings.HasPrefix(ifRange, `"`) {
+			ranged.IfMatch = aws.String(ifRange)
+		} else if at, err := http.ParseTime(ifRange); err == nil {
+			ranged.IfUnmodifiedSince = aws.Time(at)
+		} else {
+			return input
+		}
+	}
+	return &ranged
+}
+
+// whether an If-Range date is exactly the object's last modification, as
+// it must be for the range to be sent; S3 only checks it hasn't passed
+func ifRangeDateMatches(r *http.Request, object *s3.GetObjectOutput) bool {
+	at, err := http.ParseTime(r.Header.Get("If-Range"))
+	if err != nil {
+		return true
+	}
+	return object.LastModified != nil && object.LastModified.Truncate(time.Second).Equal(at)
+}
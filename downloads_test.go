@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// a download token with uses left
+type mockDBDownloadTokenClient struct {
+	mockDBClient
+}
+
+func (m *mockDBDownloadTokenClient) UpdateItem(*dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	return &dynamodb.UpdateItemOutput{
+		Attributes: map[string]*dynamodb.AttributeValue{
+			"id":                           {S: aws.String(downloadTokenKeyPrefix + "someToken")},
+			"asset_id":                     {S: aws.String("someID")},
+			"remaining":                    {N: aws.String("1")},
+			"response_content_disposition": {S: aws.String("attachment")},
+		},
+	}, nil
+}
+func (m *mockDBDownloadTokenClient) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	return m.UpdateItem(input)
+}
+
+func TestAssetURLRequestLimited(t *testing.T) {
+	db := &mockDBPutRecordingClient{}
+	dbSvc = db
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodGet, "/asset/someID?max_downloads=2", nil)
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	var resp assetURLResponse
+	json.NewDecoder(w.Result().Body).Decode(&resp)
+	if !strings.HasPrefix(resp.DownloadURL, "http://example.com/download/") {
+		t.Errorf("Limited download URL isn't served by the service: %s", resp.DownloadURL)
+	}
+	token := strings.TrimPrefix(resp.DownloadURL, "http://example.com/download/")
+	if stringAttribute(db.item, "id") != downloadTokenKeyPrefix+token || numberAttribute(db.item, "remaining") != 2 {
+		t.Errorf("Incorrect download token recorded: %v", db.item)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/asset/someID?max_downloads=0", nil)
+	w = httptest.NewRecorder()
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("Didn't get 400 for max_downloads=0: %d", w.Result().StatusCode)
+	}
+}
+func TestServeDownload(t *testing.T) {
+	dbSvc = &mockDBDownloadTokenClient{}
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodGet, "/download/someToken", nil)
+	w := httptest.NewRecorder()
+
+	serveDownload(w, r)
+	resp := w.Result()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "Hello world!" {
+		t.Errorf("Incorrect download: %d %s", resp.StatusCode, body)
+	}
+	if resp.Header.Get("Content-Length") != "12" || resp.Header.Get("Content-Type") != "image/png" {
+		t.Errorf("Download is missing object headers: %v", resp.Header)
+	}
+}
+
+var rangeObjectModified = time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+// cuts byte ranges out of a 12 byte object the way S3 does
+type mockS3RangeClient struct {
+	mockS3Client
+}
+
+func (m *mockS3RangeClient) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	content := "Hello world!"
+	output := &s3.GetObjectOutput{ETag: aws.String(`"etag"`), LastModified: aws.Time(rangeObjectModified)}
+	if input.IfMatch != nil && *input.IfMatch != `"etag"` || input.IfUnmodifiedSince != nil && input.IfUnmodifiedSince.Before(rangeObjectModified) {
+		return nil, awserr.New("PreconditionFailed", "At least one of the pre-conditions you specified did not hold", nil)
+	}
+	if input.Range != nil {
+		var start, end int
+		if n, _ := fmt.Sscanf(*input.Range, "bytes=%d-%d", &start, &end); n == 1 {
+			end = len(content) - 1
+		}
+		if start >= len(content) {
+			return nil, awserr.New("InvalidRange", "The requested range is not satisfiable", nil)
+		}
+		output.ContentRange = aws.String(fmt.Sprintf("bytes %d-%d/%d", start, end, len(content)))
+		content = content[start : end+1]
+	}
+	output.Body = ioutil.NopCloser(strings.NewReader(content))
+	output.ContentLength = aws.Int64(int64(len(content)))
+	return output, nil
+}
+func (m *mockS3RangeClient) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	return m.GetObject(input)
+}
+
+func TestServeDownloadRange(t *testing.T) {
+	dbSvc = &mockDBDownloadTokenClient{}
+	s3Svc = &mockS3RangeClient{}
+	for _, test := range []struct {
+		rangeSpec, ifRange string
+		status             int
+		body, contentRange string
+	}{
+		{"bytes=0-4", "", http.StatusPartialContent, "Hello", "bytes 0-4/12"},
+		{"bytes=6-", `"etag"`, http.StatusPartialContent, "world!", "bytes 6-11/12"},
+		{"bytes=6-", rangeObjectModified.Format(http.TimeFormat), http.StatusPartialContent, "world!", "bytes 6-11/12"},
+		// the object changed since, or isn't the one named
+		{"bytes=0-4", `"other"`, http.StatusOK, "Hello world!", ""},
+		{"bytes=0-4", `W/"etag"`, http.StatusOK, "Hello world!", ""},
+		{"bytes=0-4", rangeObjectModified.Add(-time.Hour).Format(http.TimeFormat), http.StatusOK, "Hello world!", ""},
+		{"bytes=0-4", rangeObjectModified.Add(time.Hour).Format(http.TimeFormat), http.StatusOK, "Hello world!", ""},
+		{"bytes=0-1,4-5", "", http.StatusOK, "Hello world!", ""},
+		{"bytes=20-", "", http.StatusRequestedRangeNotSatisfiable, "", "bytes */12"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/download/someToken", nil)
+		r.Header.Set("Range", test.rangeSpec)
+		if test.ifRange != "" {
+			r.Header.Set("If-Range", test.ifRange)
+		}
+		w := httptest.NewRecorder()
+		serveDownload(w, r)
+		resp := w.Result()
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != test.status || resp.Header.Get("Content-Range") != test.contentRange {
+			t.Errorf("Incorrect answer to %s (If-Range %s): %d %s", test.rangeSpec, test.ifRange, resp.StatusCode, resp.Header.Get("Content-Range"))
+		}
+		if test.body != "" && (string(body) != test.body || resp.Header.Get("Accept-Ranges") != "bytes") {
+			t.Errorf("Incorrect body for %s: %q %v", test.rangeSpec, body, resp.Header)
+		}
+	}
+}
+
+func TestServeDownloadUsedUp(t *testing.T) {
+	s3Svc = &mockS3Client{}
+	cases := map[int]dynamodbiface.DynamoDBAPI{
+		http.StatusGone:     &mockDBLockedClient{},
+		http.StatusNotFound: &mockDBConditionalErrorClient{},
+	}
+	for expected, db := range cases {
+		dbSvc = db
+		r := httptest.NewRequest(http.MethodGet, "/download/someToken", nil)
+		w := httptest.NewRecorder()
+		serveDownload(w, r)
+		if w.Result().StatusCode != expected {
+			t.Errorf("Got %d, expected %d", w.Result().StatusCode, expected)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// the DynamoDB index on sha256
+var checksumIndexName string
+
+// what marking an asset uploaded reports back
+type markUploadedResponse struct {
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+	// pass to GET /asset/{id} to be sure of seeing this upload
+	ConsistencyToken string `json:"consistency_token,omitempty"`
+}
+
+// finds another uploaded asset with the same SHA256 as the one just
+// uploaded and records it as duplicate_of, returning its id; this is only
+// a hint, so lookup failures are logged rather than returned
+func recordDuplicate(assetID string, attributes map[string]*dynamodb.AttributeValue) string {
+	sum := stringAttribute(attributes, "sha256")
+	if sum == "" {
+		return ""
+	}
+	var duplicateOf string
+	err := dbSvc.QueryPages(&dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		IndexName:              aws.String(checksumIndexName),
+		KeyConditionExpression: aws.String("sha256 = :sha256"),
+		FilterExpression:       aws.String("#status = :uploaded AND id <> :id"),
+		ExpressionAttributeNames: map[string]*string{
+			"#status": aws.String("status"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":sha256":   {S: aws.String(sum)},
+			":uploaded": {S: aws.String(assetStatusUploaded)},
+			":id":       {S: aws.String(assetID)},
+		},
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		if len(page.Items) > 0 {
+			duplicateOf = stringAttribute(page.Items[0], "id")
+		}
+		return duplicateOf == ""
+	})
+	if err != nil {
+		log.Println(err.Error())
+		return ""
+	}
+	if duplicateOf == "" {
+		return ""
+	}
+
+	_, err = dbSvc.UpdateItem(&dynamodb.UpdateItemInput{
+		Key:                       assetKey(assetID),
+		TableName:                 aws.String(tableName),
+		UpdateExpression:          aws.String("SET duplicate_of = :duplicateOf"),
+		ConditionExpression:       aws.String("attribute_exists(id)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":duplicateOf": {S: aws.String(duplicateOf)}},
+	})
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return duplicateOf
+}
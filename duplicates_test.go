@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// an unfinished asset whose content was already uploaded as otherID
+type mockDBDuplicateClient struct {
+	mockDBNotUploadedClient
+	duplicateOf string
+}
+
+func (m *mockDBDuplicateClient) QueryPages(input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool) error {
+	fn(&dynamodb.QueryOutput{Items: []map[string]*dynamodb.AttributeValue{{"id": {S: aws.String("otherID")}}}}, true)
+	return nil
+}
+func (m *mockDBDuplicateClient) QueryPagesWithContext(ctx aws.Context, input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool, opts ...request.Option) error {
+	return m.QueryPages(input, fn)
+}
+
+func (m *mockDBDuplicateClient) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	if v, ok := input.ExpressionAttributeValues[":duplicateOf"]; ok {
+		m.duplicateOf = *v.S
+	}
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+func (m *mockDBDuplicateClient) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	return m.UpdateItem(input)
+}
+
+func TestContentUploadDuplicate(t *testing.T) {
+	db := &mockDBDuplicateClient{}
+	dbSvc = db
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodPost, "/asset/someID/content", bytes.NewReader([]byte("Hello world!")))
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Incorrect status on duplicate proxied upload: %d", resp.StatusCode)
+	}
+	jsonResp := markUploadedResponse{}
+	json.NewDecoder(resp.Body).Decode(&jsonResp)
+	if jsonResp.DuplicateOf != "otherID" {
+		t.Errorf("Incorrect duplicate_of hint: %q", jsonResp.DuplicateOf)
+	}
+	if db.duplicateOf != "otherID" {
+		t.Errorf("Duplicate not recorded on the asset: %q", db.duplicateOf)
+	}
+}
+func TestRecordDuplicateWithoutChecksum(t *testing.T) {
+	dbSvc = &mockDBDuplicateClient{}
+	if duplicateOf := recordDuplicate("someID", nil); duplicateOf != "" {
+		t.Errorf("Got a duplicate without a checksum: %q", duplicateOf)
+	}
+}
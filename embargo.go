@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	// embargoed records are put in this partition of the sparse embargo
+	// index until their publication has been announced
+	embargoShard        = "all"
+	embargoPollInterval = time.Minute
+	eventPublishable    = "asset.publishable"
+)
+
+// the DynamoDB index on embargo_shard and available_at
+var embargoIndexName string
+
+// url told when embargoed assets become publishable, none when empty
+var embargoWebhook string
+
+type embargoEvent struct {
+	Event       string    `json:"event"`
+	ID          string    `json:"id"`
+	AvailableAt time.Time `json:"available_at"`
+}
+
+// parses an RFC 3339 publication time
+func parseAvailableAt(value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, fmt.Errorf("available_at must be an RFC 3339 time")
+	}
+	return t, nil
+}
+
+// record attributes embargoing an asset until the given time
+func embargoAttributes(availableAt time.Time) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"available_at":  {N: aws.String(strconv.FormatInt(availableAt.Unix(), 10))},
+		"embargo_shard": {S: aws.String(embargoShard)},
+	}
+}
+
+func isEmbargoed(item map[string]*dynamodb.AttributeValue) bool {
+	return time.Now().Unix() < numberAttribute(item, "available_at")
+}
+
+// refuses downloads of an asset before its publication time, writing an
+// error and returning false if it's still embargoed
+func checkEmbargo(w http.ResponseWriter, assetID string, item map[string]*dynamodb.AttributeValue) bool {
+	if !isEmbargoed(item) {
+		return true
+	}
+	availableAt := time.Unix(numberAttribute(item, "available_at"), 0).UTC()
+	w.Header().Set("Retry-After", availableAt.Format(http.TimeFormat))
+	http.Error(w, fmt.Sprintf("Asset id '%s' is embargoed until %s.", assetID, availableAt.Format(time.RFC3339)), http.StatusTooEarly)
+	return false
+}
+
+// sets (POST ?available_at=) or lifts (DELETE) an asset's embargo
+func handleEmbargoRequest(w http.ResponseWriter, r *http.Request, assetID string) {
+	values := lockConditionValues(r)
+	values[":updated"] = updatedAtValue()
+	update := "SET updated_at = :updated REMOVE available_at, embargo_shard"
+	if r.Method == http.MethodPost {
+		availableAt, err := parseAvailableAt(r.URL.Query().Get("available_at"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid argument for available_at: %s.", err.Error()), http.StatusBadRequest)
+			return
+		}
+		update = setAttributes("SET updated_at = :updated", values, embargoAttributes(availableAt))
+	}
+	_, err := dbSvc.UpdateItemWithContext(r.Context(), &dynamodb.UpdateItemInput{
+		Key:                                 assetKey(assetID),
+		TableName:                           aws.String(tableName),
+		UpdateExpression:                    aws.String(update),
+		ConditionExpression:                 aws.String("attribute_exists(id) AND " + lockCondition),
+		ExpressionAttributeValues:           values,
+		ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValuesOnConditionCheckFailureAllOld),
+	})
+	if err != nil {
+		if isConditionFailed(err) {
+			if isLockedConflict(err) {
+				http.Error(w, fmt.Sprintf("Asset id '%s' is locked.", assetID), http.StatusLocked)
+				return
+			}
+			writeError(w, notFound(assetID))
+			return
+		}
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// announces embargoes as they end, until stopped
+func watchEmbargoes(stop <-chan struct{}) {
+	for {
+		if err := announceEmbargoes(); err != nil {
+			log.Println(err.Error())
+		}
+		if !pause(stop, embargoPollInterval) {
+			return
+		}
+	}
+}
+
+// tells the webhook about every asset whose embargo has ended, taking it
+// out of the embargo index once announced
+func announceEmbargoes() error {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	var failed error
+	err := dbSvc.QueryPages(&dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		IndexName:              aws.String(embargoIndexName),
+		KeyConditionExpression: aws.String("embargo_shard = :shard AND available_at <= :now"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":shard": {S: aws.String(embargoShard)},
+			":now":   {N: aws.String(now)},
+		},
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			if err := announceEmbargo(item); err != nil {
+				failed = err
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return failed
+}
+
+func announceEmbargo(item map[string]*dynamodb.AttributeValue) error {
+	assetID := stringAttribute(item, "id")
+	availableAt := item["available_at"]
+	body, err := json.Marshal(embargoEvent{
+		Event:       eventPublishable,
+		ID:          assetID,
+		AvailableAt: time.Unix(numberAttribute(item, "available_at"), 0).UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := webhookClient.Post(embargoWebhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("embargo webhook returned %s for asset %s", resp.Status, assetID)
+	}
+	publishEvent(eventPublishable, assetID, item)
+
+	// leave the index unless the embargo was moved in the meantime
+	_, err = dbSvc.UpdateItem(&dynamodb.UpdateItemInput{
+		Key:                       assetKey(assetID),
+		TableName:                 aws.String(tableName),
+		UpdateExpression:          aws.String("REMOVE embargo_shard"),
+		ConditionExpression:       aws.String("available_at = :availableAt"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":availableAt": availableAt},
+	})
+	if isConditionFailed(err) {
+		return nil
+	}
+	return err
+}
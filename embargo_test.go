@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// an uploaded asset embargoed for another hour, whose embargo index
+// reports it as ended
+type mockDBEmbargoClient struct {
+	mockDBClient
+	announced []string
+}
+
+func (m *mockDBEmbargoClient) GetItem(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	output, _ := m.mockDBClient.GetItem(nil)
+	output.Item["available_at"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))}
+	return output, nil
+}
+func (m *mockDBEmbargoClient) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return m.GetItem(input)
+}
+
+func (m *mockDBEmbargoClient) QueryPages(input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool) error {
+	fn(&dynamodb.QueryOutput{Items: []map[string]*dynamodb.AttributeValue{{
+		"id":           {S: aws.String("someID")},
+		"available_at": {N: aws.String("1500000000")},
+	}}}, true)
+	return nil
+}
+func (m *mockDBEmbargoClient) QueryPagesWithContext(ctx aws.Context, input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool, opts ...request.Option) error {
+	return m.QueryPages(input, fn)
+}
+
+func (m *mockDBEmbargoClient) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	m.announced = append(m.announced, *input.Key["id"].S)
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+func (m *mockDBEmbargoClient) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	return m.UpdateItem(input)
+}
+
+func TestAssetURLRequestEmbargoed(t *testing.T) {
+	dbSvc = &mockDBEmbargoClient{}
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodGet, "/asset/someID", nil)
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusTooEarly || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("Didn't get 425 with Retry-After for an embargoed asset: %d %v", resp.StatusCode, resp.Header)
+	}
+}
+func TestEmbargoRequest(t *testing.T) {
+	dbSvc = &mockDBClient{}
+	r := httptest.NewRequest(http.MethodPost, "/asset/someID/embargo?available_at=2030-01-01T09:00:00Z", nil)
+	w := httptest.NewRecorder()
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusNoContent {
+		t.Errorf("Incorrect status setting an embargo: %d", w.Result().StatusCode)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/asset/someID/embargo?available_at=tomorrow", nil)
+	w = httptest.NewRecorder()
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("Didn't get 400 for a malformed available_at: %d", w.Result().StatusCode)
+	}
+}
+func TestAnnounceEmbargoes(t *testing.T) {
+	events := make(chan embargoEvent, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event embargoEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		events <- event
+	}))
+	defer server.Close()
+	embargoWebhook = server.URL
+	defer func() { embargoWebhook = "" }()
+	db := &mockDBEmbargoClient{}
+	dbSvc = db
+
+	if err := announceEmbargoes(); err != nil {
+		t.Fatalf("Got error announcing embargoes: %s", err)
+	}
+	event := <-events
+	if event.Event != eventPublishable || event.ID != "someID" || event.AvailableAt.Unix() != 1500000000 {
+		t.Errorf("Incorrect event sent: %+v", event)
+	}
+	if len(db.announced) != 1 || db.announced[0] != "someID" {
+		t.Errorf("Announced asset wasn't taken out of the index: %v", db.announced)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// KMS key that new uploads are encrypted with, none when empty
+var kmsKeyID string
+
+// the encryption context binding an asset's data key to the asset
+func encryptionContext(assetID string) map[string]string {
+	return map[string]string{"asset_id": assetID}
+}
+
+// the encryption context as S3 expects it in request headers
+func encryptionContextHeader(assetID string) *string {
+	if kmsKeyID == "" {
+		return nil
+	}
+	b, _ := json.Marshal(encryptionContext(assetID))
+	return aws.String(base64.StdEncoding.EncodeToString(b))
+}
+
+// the server side encryption to request for uploads, nil without KMS
+func encryptionAlgorithm() *string {
+	if kmsKeyID == "" {
+		return nil
+	}
+	return aws.String(s3.ServerSideEncryptionAwsKms)
+}
+
+// record attributes noting the key and context an asset's upload is
+// encrypted with, so the assets a key protects can be enumerated
+func encryptionAttributes(assetID string) map[string]*dynamodb.AttributeValue {
+	if kmsKeyID == "" {
+		return nil
+	}
+	context := map[string]*dynamodb.AttributeValue{}
+	for k, v := range encryptionContext(assetID) {
+		context[k] = &dynamodb.AttributeValue{S: aws.String(v)}
+	}
+	return map[string]*dynamodb.AttributeValue{
+		"kms_key_id":         {S: aws.String(kmsKeyID)},
+		"encryption_context": {M: context},
+	}
+}
+
+// the form fields pinning a browser upload to the configured encryption
+func encryptionFields(assetID string) map[string]string {
+	if kmsKeyID == "" {
+		return nil
+	}
+	return map[string]string{
+		"x-amz-server-side-encryption":                s3.ServerSideEncryptionAwsKms,
+		"x-amz-server-side-encryption-aws-kms-key-id": kmsKeyID,
+		"x-amz-server-side-encryption-context":        *encryptionContextHeader(assetID),
+	}
+}
+
+// reports whether an object is encrypted the way its record says; S3
+// reports key ARNs, so a recorded bare key ID matches its ARN
+func encryptionMatches(item map[string]*dynamodb.AttributeValue, head *s3.HeadObjectOutput) bool {
+	recorded := stringAttribute(item, "kms_key_id")
+	if recorded == "" {
+		return true
+	}
+	if aws.StringValue(head.ServerSideEncryption) != s3.ServerSideEncryptionAwsKms {
+		return false
+	}
+	actual := aws.StringValue(head.SSEKMSKeyId)
+	return actual == recorded || strings.HasSuffix(actual, ":key/"+recorded)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// an uploaded asset recorded as encrypted with someKey
+type mockDBEncryptedClient struct {
+	mockDBClient
+}
+
+func (m *mockDBEncryptedClient) GetItem(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	output, _ := m.mockDBClient.GetItem(nil)
+	output.Item["kms_key_id"] = &dynamodb.AttributeValue{S: aws.String("someKey")}
+	return output, nil
+}
+func (m *mockDBEncryptedClient) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return m.GetItem(input)
+}
+
+func TestEncryptionAttributes(t *testing.T) {
+	defer func(key string) { kmsKeyID = key }(kmsKeyID)
+	kmsKeyID = ""
+	if encryptionAttributes("someID") != nil || encryptionContextHeader("someID") != nil {
+		t.Error("Got encryption settings without a KMS key")
+	}
+
+	kmsKeyID = "someKey"
+	attributes := encryptionAttributes("someID")
+	if *attributes["kms_key_id"].S != "someKey" || *attributes["encryption_context"].M["asset_id"].S != "someID" {
+		t.Errorf("Incorrect encryption attributes: %v", attributes)
+	}
+	if context := *encryptionContextHeader("someID"); context != "eyJhc3NldF9pZCI6InNvbWVJRCJ9" {
+		t.Errorf("Incorrect encryption context header: %s", context)
+	}
+}
+func TestEncryptionMatches(t *testing.T) {
+	item, _ := (&mockDBEncryptedClient{}).GetItem(nil)
+	cases := map[string]bool{
+		"someKey": true,
+		"arn:aws:kms:us-east-1:111122223333:key/someKey":  true,
+		"arn:aws:kms:us-east-1:111122223333:key/otherKey": false,
+	}
+	for keyID, expected := range cases {
+		head := &s3.HeadObjectOutput{
+			ServerSideEncryption: aws.String(s3.ServerSideEncryptionAwsKms),
+			SSEKMSKeyId:          aws.String(keyID),
+		}
+		if actual := encryptionMatches(item.Item, head); actual != expected {
+			t.Errorf("Got %t matching key %s, expected %t", actual, keyID, expected)
+		}
+	}
+	if encryptionMatches(item.Item, &s3.HeadObjectOutput{}) {
+		t.Error("Unencrypted object matched a recorded key")
+	}
+}
+func TestAssetURLRequestWrongEncryption(t *testing.T) {
+	dbSvc = &mockDBEncryptedClient{}
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodGet, "/asset/someID", nil)
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusConflict {
+		t.Errorf("Didn't get 409 for an object missing its recorded encryption: %d", w.Result().StatusCode)
+	}
+}
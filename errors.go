@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// what went wrong, for callers to branch on with errors.Is whatever the
+// transport; writeError maps them to responses
+var (
+	ErrNotFound       = errors.New("not found")
+	ErrNotUploaded    = errors.New("upload is not complete")
+	ErrStoreThrottled = errors.New("store is throttled")
+	// S3 asked for fewer requests, or failed to answer
+	ErrStorageThrottled   = errors.New("storage is throttled")
+	ErrStorageUnavailable = errors.New("storage is unavailable")
+)
+
+// DynamoDB error codes for a table or account over its throughput
+var throttledCodes = map[string]bool{
+	dynamodb.ErrCodeProvisionedThroughputExceededException: true,
+	dynamodb.ErrCodeRequestLimitExceeded:                   true,
+	"ThrottlingException":                                  true,
+}
+
+// an error about one asset, wrapping what's wrong with it
+type assetError struct {
+	assetID string
+	err     error
+}
+
+func (e *assetError) Error() string {
+	return fmt.Sprintf("asset id '%s': %s", e.assetID, e.err.Error())
+}
+
+func (e *assetError) Unwrap() error {
+	return e.err
+}
+
+func notFound(assetID string) error {
+	return &assetError{assetID: assetID, err: ErrNotFound}
+}
+
+func notUploaded(assetID string) error {
+	return &assetError{assetID: assetID, err: ErrNotUploaded}
+}
+
+// wraps an error from the database so throttling can be told apart, or
+// returns it as it is
+func storeError(err error) error {
+	if aerr, ok := err.(awserr.Error); ok && throttledCodes[aerr.Code()] {
+		return fmt.Errorf("%w: %s", ErrStoreThrottled, aerr.Error())
+	}
+	return err
+}
+
+// whether an S3 error says the object or version isn't there
+func isObjectNotFound(err error) bool {
+	if rerr, ok := err.(awserr.RequestFailure); ok && rerr.StatusCode() == http.StatusNotFound {
+		return true
+	}
+	aerr, ok := err.(awserr.Error)
+	return ok && (aerr.Code() == "NotFound" || aerr.Code() == "NoSuchKey" || aerr.Code() == "NoSuchVersion")
+}
+
+// wraps an error from S3 so that throttling can be told apart from S3
+// failing to answer
+func objectStoreError(err error) error {
+	if rerr, ok := err.(awserr.RequestFailure); ok && rerr.StatusCode() == http.StatusServiceUnavailable {
+		return fmt.Errorf("%w: %s", ErrStorageThrottled, err.Error())
+	}
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "SlowDown" {
+		return fmt.Errorf("%w: %s", ErrStorageThrottled, err.Error())
+	}
+	return fmt.Errorf("%w: %s", ErrStorageUnavailable, err.Error())
+}
+
+// answers a request that failed with err: 404 and 409 for an asset not
+// found or not uploaded, 503 to retry when the database or S3 is throttled,
+// 502 when S3 fails to answer and 500, logged, for anything else
+func writeError(w http.ResponseWriter, err error) {
+	err = storeError(err)
+	var aerr *assetError
+	switch {
+	case errors.As(err, &aerr) && errors.Is(err, ErrNotFound):
+		http.Error(w, fmt.Sprintf("Asset id '%s' not found.", aerr.assetID), http.StatusNotFound)
+	case errors.As(err, &aerr) && errors.Is(err, ErrNotUploaded):
+		http.Error(w, fmt.Sprintf("Asset id '%s' found but upload is not complete.", aerr.assetID), http.StatusConflict)
+	case errors.Is(err, ErrStoreThrottled):
+		log.Println(err.Error())
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Too many requests to the database, retry shortly.", http.StatusServiceUnavailable)
+	case errors.Is(err, ErrStorageThrottled):
+		log.Println(err.Error())
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Too many requests to storage, retry shortly.", http.StatusServiceUnavailable)
+	case errors.Is(err, ErrStorageUnavailable):
+		log.Println(err.Error())
+		http.Error(w, "Storage is unavailable, retry later.", http.StatusBadGateway)
+	default:
+		log.Println(err.Error())
+		http.Error(w, "Unexpected internal error.", http.StatusInternalServerError)
+	}
+}
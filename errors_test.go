@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+type mockDBThrottledClient struct {
+	mockDBClient
+}
+
+func (m *mockDBThrottledClient) GetItem(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	return nil, awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "The level of configured provisioned throughput for the table was exceeded", nil)
+}
+func (m *mockDBThrottledClient) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return m.GetItem(input)
+}
+
+func TestWriteError(t *testing.T) {
+	for _, test := range []struct {
+		err    error
+		status int
+	}{
+		{notFound("someID"), http.StatusNotFound},
+		{fmt.Errorf("archiving: %w", notFound("someID")), http.StatusNotFound},
+		{notUploaded("someID"), http.StatusConflict},
+		{awserr.New(dynamodb.ErrCodeRequestLimitExceeded, "throughput exceeds the account limit", nil), http.StatusServiceUnavailable},
+		{awserr.New(dynamodb.ErrCodeInternalServerError, "internal error", nil), http.StatusInternalServerError},
+		{errors.New("boom"), http.StatusInternalServerError},
+	} {
+		w := httptest.NewRecorder()
+		writeError(w, test.err)
+		if w.Code != test.status {
+			t.Errorf("Incorrect status for %v: %d", test.err, w.Code)
+		}
+	}
+}
+
+func TestGetAssetErrors(t *testing.T) {
+	dbSvc = &mockDBMissingKeyClient{}
+	if _, err := getAsset(context.Background(), "someID"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Missing asset isn't ErrNotFound: %v", err)
+	}
+
+	dbSvc = &mockDBThrottledClient{}
+	if _, err := getAsset(context.Background(), "someID"); !errors.Is(err, ErrStoreThrottled) {
+		t.Errorf("Throttled read isn't ErrStoreThrottled: %v", err)
+	}
+	w := httptest.NewRecorder()
+	manageAsset(w, httptest.NewRequest(http.MethodGet, "/asset/someID", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Didn't get 503 to retry for a throttled read: %d", w.Code)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// what can happen to an asset, as recorded in its event log
+const (
+	assetEventCreated    = "created"
+	assetEventURLIssued  = "url_issued"
+	assetEventUploaded   = "uploaded"
+	assetEventScanned    = "scanned"
+	assetEventDownloaded = "downloaded"
+	assetEventDeleted    = "deleted"
+
+	defaultEventsPage = 100
+	maxEventsPage     = 1000
+)
+
+// the DynamoDB table logging events by asset_id and sequence, none to not
+// keep a log
+var eventsTableName string
+
+// an entry in an asset's event log, attributed to the API key or bearer
+// token subject of the request that caused it, if any
+type assetEvent struct {
+	Event   string            `json:"event"`
+	At      int64             `json:"at"`
+	Key     string            `json:"key,omitempty"`
+	Subject string            `json:"subject,omitempty"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+type eventsResponse struct {
+	Events []assetEvent `json:"events"`
+	Cursor string       `json:"cursor,omitempty"`
+}
+
+// events recorded by this instance in the same millisecond, so they sort in
+// the order they happened
+var eventsRecorded struct {
+	sync.Mutex
+	millis int64
+	count  int
+}
+
+// sorts events in the order they were recorded: the time in unix
+// milliseconds, a count of events this instance recorded in that
+// millisecond, and random digits telling apart other instances' events
+func eventSequence(at time.Time) string {
+	millis := at.UnixNano() / int64(time.Millisecond)
+	eventsRecorded.Lock()
+	if millis == eventsRecorded.millis {
+		eventsRecorded.count++
+	} else {
+		eventsRecorded.millis, eventsRecorded.count = millis, 0
+	}
+	count := eventsRecorded.count
+	eventsRecorded.Unlock()
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%013d-%06d-%s", millis, count, hex.EncodeToString(b))
+}
+
+// appends an event to an asset's log; r is the request that caused it, nil
+// for what the service does by itself. The action it records has already
+// happened, so failures are only logged
+func recordAssetEvent(r *http.Request, assetID, event string, details map[string]string) {
+	if eventsTableName == "" {
+		return
+	}
+	now := time.Now()
+	item := map[string]*dynamodb.AttributeValue{
+		"asset_id": {S: aws.String(assetID)},
+		"sequence": {S: aws.String(eventSequence(now))},
+		"event":    {S: aws.String(event)},
+		"at":       {N: aws.String(strconv.FormatInt(now.UnixNano()/int64(time.Millisecond), 10))},
+	}
+	if r != nil {
+		if name := requestAPIKeyName(r); name != "" {
+			item["key"] = &dynamodb.AttributeValue{S: aws.String(name)}
+		}
+		if subject := requestSubject(r); subject != "" {
+			item["subject"] = &dynamodb.AttributeValue{S: aws.String(subject)}
+		}
+	}
+	if len(details) > 0 {
+		item["details"] = &dynamodb.AttributeValue{M: map[string]*dynamodb.AttributeValue{}}
+		for k, v := range details {
+			item["details"].M[k] = &dynamodb.AttributeValue{S: aws.String(v)}
+		}
+	}
+	// entries are only ever added, never overwritten
+	_, err := dbSvc.PutItem(&dynamodb.PutItemInput{
+		Item:                item,
+		TableName:           aws.String(eventsTableName),
+		ConditionExpression: aws.String("attribute_not_exists(asset_id)"),
+	})
+	if err != nil {
+		log.Printf("recording %s event for asset %s: %s", event, assetID, err.Error())
+	}
+}
+
+// lists an asset's events oldest first, a page at a time; pass the cursor
+// returned to get the next page, there being no more without one
+func handleEventsRequest(w http.ResponseWriter, r *http.Request, assetID string) {
+	if eventsTableName == "" {
+		http.Error(w, "Event log is not enabled.", http.StatusNotFound)
+		return
+	}
+	limit := defaultEventsPage
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxEventsPage {
+			http.Error(w, fmt.Sprintf("Invalid argument for limit, must be 1 to %d.", maxEventsPage), http.StatusBadRequest)
+			return
+		}
+	}
+	query := &dynamodb.QueryInput{
+		TableName:              aws.String(eventsTableName),
+		KeyConditionExpression: aws.String("asset_id = :id"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":id": {S: aws.String(assetID)},
+		},
+		Limit: aws.Int64(int64(limit)),
+	}
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		sequence, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil || len(sequence) == 0 {
+			http.Error(w, "Invalid argument for cursor.", http.StatusBadRequest)
+			return
+		}
+		query.ExclusiveStartKey = map[string]*dynamodb.AttributeValue{
+			"asset_id": {S: aws.String(assetID)},
+			"sequence": {S: aws.String(string(sequence))},
+		}
+	}
+	result, err := dbSvc.QueryWithContext(r.Context(), query)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := eventsResponse{Events: []assetEvent{}}
+	for _, item := range result.Items {
+		event := assetEvent{
+			Event:   stringAttribute(item, "event"),
+			At:      numberAttribute(item, "at"),
+			Key:     stringAttribute(item, "key"),
+			Subject: stringAttribute(item, "subject"),
+		}
+		if details := item["details"]; details != nil && len(details.M) > 0 {
+			event.Details = map[string]string{}
+			for k, v := range details.M {
+				event.Details[k] = aws.StringValue(v.S)
+			}
+		}
+		response.Events = append(response.Events, event)
+	}
+	if sequence := stringAttribute(result.LastEvaluatedKey, "sequence"); sequence != "" {
+		response.Cursor = base64.RawURLEncoding.EncodeToString([]byte(sequence))
+	}
+	writeJSON(w, response)
+}
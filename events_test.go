@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// an events table in memory, answering queries a page of two at a time
+type mockDBEventsClient struct {
+	mockDBClient
+	events []map[string]*dynamodb.AttributeValue
+	query  *dynamodb.QueryInput
+}
+
+func (m *mockDBEventsClient) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	if aws.StringValue(input.TableName) == eventsTableName {
+		m.events = append(m.events, input.Item)
+	}
+	return &dynamodb.PutItemOutput{}, nil
+}
+func (m *mockDBEventsClient) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	return m.PutItem(input)
+}
+
+func (m *mockDBEventsClient) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	m.query = input
+	start := 0
+	if input.ExclusiveStartKey != nil {
+		for i, event := range m.events {
+			if stringAttribute(event, "sequence") == stringAttribute(input.ExclusiveStartKey, "sequence") {
+				start = i + 1
+			}
+		}
+	}
+	output := &dynamodb.QueryOutput{Items: m.events[start:]}
+	if len(output.Items) > 2 {
+		output.Items = output.Items[:2]
+		output.LastEvaluatedKey = map[string]*dynamodb.AttributeValue{
+			"asset_id": output.Items[1]["asset_id"],
+			"sequence": output.Items[1]["sequence"],
+		}
+	}
+	return output, nil
+}
+func (m *mockDBEventsClient) QueryWithContext(ctx aws.Context, input *dynamodb.QueryInput, opts ...request.Option) (*dynamodb.QueryOutput, error) {
+	return m.Query(input)
+}
+
+func TestAssetEvents(t *testing.T) {
+	eventsTableName = "events"
+	defer func() { eventsTableName = "" }()
+	db := &mockDBEventsClient{}
+	dbSvc, s3Svc = db, &mockS3Client{}
+
+	r := httptest.NewRequest(http.MethodPost, "/asset?filename=report.pdf", nil)
+	r = r.WithContext(context.WithValue(r.Context(), authContextKey{}, authDecision{Method: apiKeyMethod, Key: "web"}))
+	w := httptest.NewRecorder()
+	initAsset(w, r)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Incorrect status on asset init: %d", w.Result().StatusCode)
+	}
+	var response initAssetResponse
+	json.NewDecoder(w.Body).Decode(&response)
+	recordAssetEvent(nil, response.ID, assetEventScanned, map[string]string{"result": "accepted"})
+	if len(db.events) != 3 || stringAttribute(db.events[0], "event") != assetEventCreated ||
+		stringAttribute(db.events[1], "event") != assetEventURLIssued || stringAttribute(db.events[0], "key") != "web" ||
+		stringAttribute(db.events[0], "asset_id") != response.ID {
+		t.Fatalf("Incorrect events recorded on init: %v", db.events)
+	}
+	if stringAttribute(db.events[0], "sequence") >= stringAttribute(db.events[2], "sequence") {
+		t.Errorf("Event sequences don't sort in order: %v", db.events)
+	}
+
+	var page eventsResponse
+	r = httptest.NewRequest(http.MethodGet, "/asset/"+response.ID+"/events", nil)
+	w = httptest.NewRecorder()
+	manageAsset(w, r)
+	json.NewDecoder(w.Body).Decode(&page)
+	if w.Result().StatusCode != http.StatusOK || len(page.Events) != 2 || page.Cursor == "" ||
+		page.Events[0].Event != assetEventCreated || page.Events[0].Key != "web" || page.Events[1].Details["url"] != "upload" {
+		t.Fatalf("Incorrect first page of events: %d %+v", w.Result().StatusCode, page)
+	}
+	if aws.StringValue(db.query.KeyConditionExpression) != "asset_id = :id" || stringAttribute(db.query.ExpressionAttributeValues, ":id") != response.ID {
+		t.Errorf("Events not queried by asset: %+v", db.query)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/asset/"+response.ID+"/events?cursor="+page.Cursor, nil)
+	w = httptest.NewRecorder()
+	manageAsset(w, r)
+	page = eventsResponse{}
+	json.NewDecoder(w.Body).Decode(&page)
+	if len(page.Events) != 1 || page.Cursor != "" || page.Events[0].Event != assetEventScanned || page.Events[0].Details["result"] != "accepted" {
+		t.Errorf("Incorrect last page of events: %+v", page)
+	}
+
+	for _, query := range []string{"?limit=0", "?limit=1001", "?cursor=%21"} {
+		r = httptest.NewRequest(http.MethodGet, "/asset/someID/events"+query, nil)
+		w = httptest.NewRecorder()
+		manageAsset(w, r)
+		if w.Result().StatusCode != http.StatusBadRequest {
+			t.Errorf("Didn't get 400 for events %q: %d", query, w.Result().StatusCode)
+		}
+	}
+}
+
+func TestAssetEventsDisabled(t *testing.T) {
+	db := &mockDBEventsClient{}
+	dbSvc = db
+	recordAssetEvent(nil, "someID", assetEventDeleted, nil)
+	if len(db.events) != 0 {
+		t.Errorf("Event recorded without an events table: %v", db.events)
+	}
+	w := httptest.NewRecorder()
+	manageAsset(w, httptest.NewRequest(http.MethodGet, "/asset/someID/events", strings.NewReader("")))
+	if w.Result().StatusCode != http.StatusNotFound {
+		t.Errorf("Incorrect status listing events without an events table: %d", w.Result().StatusCode)
+	}
+}
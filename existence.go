@@ -0,0 +1,285 @@
+package main
+
+import (
+	"hash/fnv"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	// how often records changed since the last look are added to the filter,
+	// and how far back each look reaches to cover clock skew between servers
+	existenceSyncInterval = time.Second
+	existenceSyncOverlap  = 5 * time.Second
+	// wait before retrying a failed rebuild, syncing the old filter meanwhile
+	existenceRetryInterval = time.Minute
+	// room for assets created before the next rebuild
+	existenceHeadroom = 1.5
+	minExistenceIDs   = 1024
+)
+
+// how often the filter of asset IDs is rebuilt from a full scan, 0 disables
+// it and every read goes to DynamoDB
+var existenceRebuildInterval time.Duration
+
+// false positive rate the filter is sized for when rebuilt
+var existenceFalsePositiveRate = 0.01
+
+// a bloom filter of every asset ID in the table, deleted or not
+type existenceFilter struct {
+	bits   []uint64
+	hashes uint64
+	ids    int64
+	built  time.Time
+}
+
+var existenceMu sync.RWMutex
+var existence *existenceFilter
+
+// counts of GETs checked against the filter since startup
+var existenceChecked, existenceRejected, existenceFalsePositives int64
+
+// how the filter is doing
+type existenceStats struct {
+	Enabled                bool      `json:"enabled"`
+	IDs                    int64     `json:"ids"`
+	Bits                   int       `json:"bits"`
+	Hashes                 uint64    `json:"hashes"`
+	BuiltAt                time.Time `json:"built_at"`
+	EstimatedFalsePositive float64   `json:"estimated_false_positive_rate"`
+	Checked                int64     `json:"checked"`
+	Rejected               int64     `json:"rejected"`
+	FalsePositives         int64     `json:"false_positives"`
+	ObservedFalsePositive  float64   `json:"observed_false_positive_rate"`
+}
+
+// a filter sized for n IDs at the configured false positive rate
+func newExistenceFilter(n int) *existenceFilter {
+	capacity := math.Max(float64(n)*existenceHeadroom, minExistenceIDs)
+	bits := math.Ceil(-capacity * math.Log(existenceFalsePositiveRate) / (math.Ln2 * math.Ln2))
+	hashes := math.Max(1, math.Round(bits/capacity*math.Ln2))
+	return &existenceFilter{
+		bits:   make([]uint64, int(bits+63)/64),
+		hashes: uint64(hashes),
+	}
+}
+
+// the filter's bit positions for an ID, by double hashing
+func (f *existenceFilter) positions(assetID string) []uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(assetID))
+	sum := h.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32|1
+	size := uint64(len(f.bits)) * 64
+	positions := make([]uint64, f.hashes)
+	for i := range positions {
+		positions[i] = (h1 + uint64(i)*h2) % size
+	}
+	return positions
+}
+
+func (f *existenceFilter) add(assetID string) {
+	for _, p := range f.positions(assetID) {
+		f.bits[p/64] |= 1 << (p % 64)
+	}
+	f.ids++
+}
+
+func (f *existenceFilter) mayContain(assetID string) bool {
+	for _, p := range f.positions(assetID) {
+		if f.bits[p/64]&(1<<(p%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// the false positive rate expected given how full the filter is
+func (f *existenceFilter) estimatedFalsePositiveRate() float64 {
+	size := float64(len(f.bits) * 64)
+	return math.Pow(1-math.Exp(-float64(f.hashes)*float64(f.ids)/size), float64(f.hashes))
+}
+
+// adds an asset created here, so it's found before the next sync
+func noteAssetExists(assetID string) {
+	existenceMu.Lock()
+	defer existenceMu.Unlock()
+	if existence != nil {
+		existence.add(assetID)
+	}
+}
+
+// answers a GET for an asset ID the filter has never seen with a 404,
+// returning false, and otherwise a writer counting the 404s the database
+// answers instead, which are the filter's false positives; reads waiting on
+// a consistency token always go to the database
+func checkAssetExists(w http.ResponseWriter, r *http.Request, assetID string) (http.ResponseWriter, bool) {
+	if r.Method != http.MethodGet || r.URL.Query().Get("consistency_token") != "" || r.Header.Get(consistencyTokenHeader) != "" {
+		return w, true
+	}
+	existenceMu.RLock()
+	filter := existence
+	found := filter == nil || filter.mayContain(assetID)
+	existenceMu.RUnlock()
+	if filter == nil {
+		return w, true
+	}
+	atomic.AddInt64(&existenceChecked, 1)
+	if !found {
+		atomic.AddInt64(&existenceRejected, 1)
+		writeError(w, notFound(assetID))
+		return w, false
+	}
+	return &existenceWriter{ResponseWriter: w}, true
+}
+
+type existenceWriter struct {
+	http.ResponseWriter
+	counted bool
+}
+
+func (e *existenceWriter) WriteHeader(status int) {
+	if status == http.StatusNotFound && !e.counted {
+		e.counted = true
+		atomic.AddInt64(&existenceFalsePositives, 1)
+	}
+	e.ResponseWriter.WriteHeader(status)
+}
+
+func (e *existenceWriter) Write(b []byte) (int, error) {
+	e.counted = true
+	return e.ResponseWriter.Write(b)
+}
+
+// keeps the filter up to date until stopped, rebuilding it from a full scan
+// every existenceRebuildInterval and adding changed records in between
+func watchExistence(stop <-chan struct{}) {
+	var synced, nextRebuild time.Time
+	for {
+		if time.Now().After(nextRebuild) {
+			started, err := rebuildExistenceFilter()
+			if err != nil {
+				log.Println(err.Error())
+				nextRebuild = time.Now().Add(existenceRetryInterval)
+			} else {
+				synced = started
+				nextRebuild = started.Add(existenceRebuildInterval)
+			}
+		} else if !synced.IsZero() {
+			started, err := syncExistenceFilter(synced)
+			if err != nil {
+				log.Println(err.Error())
+			} else {
+				synced = started
+			}
+		}
+		if !pause(stop, existenceSyncInterval) {
+			return
+		}
+	}
+}
+
+// replaces the filter with one built from a scan of every asset ID,
+// returning when the scan started, since which changes may be missing
+func rebuildExistenceFilter() (time.Time, error) {
+	started := time.Now()
+	var ids []string
+	err := dbSvc.ScanPages(&dynamodb.ScanInput{
+		TableName:            aws.String(tableName),
+		ProjectionExpression: aws.String("id"),
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			if assetID := stringAttribute(item, "id"); isAssetKey(assetID) {
+				ids = append(ids, assetID)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	filter := newExistenceFilter(len(ids))
+	for _, assetID := range ids {
+		filter.add(assetID)
+	}
+	filter.built = started
+
+	// assets created here during the scan are picked up by the next sync
+	existenceMu.Lock()
+	existence = filter
+	existenceMu.Unlock()
+	return started, nil
+}
+
+// adds every asset changed since the given time, returning when the sync
+// started
+func syncExistenceFilter(since time.Time) (time.Time, error) {
+	started := time.Now()
+	from := since.Add(-existenceSyncOverlap).UnixNano() / int64(time.Millisecond)
+	var ids []string
+	for _, shard := range changesShardNames() {
+		err := dbSvc.QueryPages(&dynamodb.QueryInput{
+			TableName:              aws.String(tableName),
+			IndexName:              aws.String(changesIndexName),
+			KeyConditionExpression: aws.String("changes_shard = :shard AND updated_at >= :since"),
+			ProjectionExpression:   aws.String("id"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":shard": {S: aws.String(shard)},
+				":since": {N: aws.String(strconv.FormatInt(from, 10))},
+			},
+		}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+			for _, item := range page.Items {
+				if assetID := stringAttribute(item, "id"); isAssetKey(assetID) {
+					ids = append(ids, assetID)
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+	existenceMu.Lock()
+	defer existenceMu.Unlock()
+	for _, assetID := range ids {
+		if !existence.mayContain(assetID) {
+			existence.add(assetID)
+		}
+	}
+	return started, nil
+}
+
+// reports the filter's size and how often it has spared the database
+func getExistenceStats(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	stats := existenceStats{
+		Checked:        atomic.LoadInt64(&existenceChecked),
+		Rejected:       atomic.LoadInt64(&existenceRejected),
+		FalsePositives: atomic.LoadInt64(&existenceFalsePositives),
+	}
+	existenceMu.RLock()
+	if existence != nil {
+		stats.Enabled = true
+		stats.IDs = existence.ids
+		stats.Bits = len(existence.bits) * 64
+		stats.Hashes = existence.hashes
+		stats.BuiltAt = existence.built
+		stats.EstimatedFalsePositive = existence.estimatedFalsePositiveRate()
+	}
+	existenceMu.RUnlock()
+	// of the IDs that aren't assets, the share that got past the filter
+	if missing := stats.Rejected + stats.FalsePositives; missing > 0 {
+		stats.ObservedFalsePositive = float64(stats.FalsePositives) / float64(missing)
+	}
+	writeJSON(w, stats)
+}
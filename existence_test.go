@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// a changes index holding one asset created since the last rebuild
+type mockDBRecentlyChangedClient struct {
+	mockDBScannedClient
+}
+
+func (m *mockDBRecentlyChangedClient) QueryPages(input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool) error {
+	fn(&dynamodb.QueryOutput{Items: []map[string]*dynamodb.AttributeValue{
+		{"id": {S: aws.String("newID")}},
+	}}, true)
+	return nil
+}
+func (m *mockDBRecentlyChangedClient) QueryPagesWithContext(ctx aws.Context, input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool, opts ...request.Option) error {
+	return m.QueryPages(input, fn)
+}
+
+func TestExistenceFilter(t *testing.T) {
+	filter := newExistenceFilter(1000)
+	for i := 0; i < 1000; i++ {
+		filter.add(fmt.Sprintf("asset%d", i))
+	}
+	for i := 0; i < 1000; i++ {
+		if !filter.mayContain(fmt.Sprintf("asset%d", i)) {
+			t.Fatalf("Filter lost asset%d", i)
+		}
+	}
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if filter.mayContain(fmt.Sprintf("stranger%d", i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 300 {
+		t.Errorf("Too many false positives: %d in 10000", falsePositives)
+	}
+}
+
+func TestExistenceFilterRebuildAndSync(t *testing.T) {
+	dbSvc = &mockDBRecentlyChangedClient{}
+	defer func() { existence = nil }()
+
+	started, err := rebuildExistenceFilter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !existence.mayContain("uploadedID") || !existence.mayContain("reservedID") || existence.ids != 3 {
+		t.Errorf("Filter not built from the scanned assets: %d ids", existence.ids)
+	}
+	if _, err := syncExistenceFilter(started); err != nil {
+		t.Fatal(err)
+	}
+	if !existence.mayContain("newID") {
+		t.Error("Filter missing an asset changed since the rebuild")
+	}
+}
+
+func TestCheckAssetExists(t *testing.T) {
+	existence = newExistenceFilter(0)
+	existence.add("someID")
+	defer func() { existence = nil }()
+
+	// unknown IDs never reach the database
+	dbSvc = &mockDBErrorClient{}
+	r := httptest.NewRequest(http.MethodGet, "/asset/strangerID/meta", nil)
+	w := httptest.NewRecorder()
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusNotFound {
+		t.Errorf("Incorrect status for an unknown asset: %d", w.Result().StatusCode)
+	}
+
+	dbSvc = &mockDBClient{}
+	r = httptest.NewRequest(http.MethodGet, "/asset/someID/meta", nil)
+	w = httptest.NewRecorder()
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Errorf("Incorrect status for a known asset: %d", w.Result().StatusCode)
+	}
+
+	// a hard deleted asset is a false positive until the next rebuild
+	existence.add("goneID")
+	dbSvc = &mockDBMissingKeyClient{}
+	falsePositives := existenceFalsePositives
+	r = httptest.NewRequest(http.MethodGet, "/asset/goneID/meta", nil)
+	w = httptest.NewRecorder()
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusNotFound || existenceFalsePositives != falsePositives+1 {
+		t.Errorf("False positive not counted: %d, %d", w.Result().StatusCode, existenceFalsePositives)
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	// expiring records are put in this partition of the sparse expiry
+	// index until they're swept
+	expiryShard = "all"
+	// DynamoDB TTL removes records this long after they expire, in case
+	// the sweep never got to them
+	expiryGrace = 24 * time.Hour
+)
+
+// the DynamoDB index on expiry_shard and expires_at
+var expiryIndexName string
+
+// how often expired assets are swept, zero to never sweep
+var expirySweepInterval = time.Minute
+
+// the fields PATCH /asset/{id} can change; the rest, such as id and
+// created_at, are refused
+type assetPatch struct {
+	// the download filename, or empty to clear it
+	Filename *string `json:"filename"`
+	// replaces the asset's tags, [] clearing them
+	Tags *[]string `json:"tags"`
+	// an RFC 3339 time, or empty to never expire
+	ExpiresAt *string `json:"expires_at"`
+	// an RFC 3339 time, or empty to cancel a scheduled deletion
+	DeleteAt *string `json:"delete_at"`
+	// replaces the asset's metadata, {} clearing it
+	Metadata *map[string]string `json:"metadata"`
+	// free text and attributes searches find the asset by, empty to clear
+	Description *string `json:"description"`
+	Owner       *string `json:"owner"`
+	Project     *string `json:"project"`
+}
+
+// parses an RFC 3339 expiry time, which must be in the future
+func parseExpiresAt(value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, fmt.Errorf("expires_at must be an RFC 3339 time")
+	}
+	if !t.After(time.Now()) {
+		return t, fmt.Errorf("expires_at must be in the future")
+	}
+	return t, nil
+}
+
+// record attributes expiring an asset at the given time; expires is the
+// table's TTL attribute
+func expiryAttributes(expiresAt time.Time) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"expires_at":   {N: aws.String(strconv.FormatInt(expiresAt.Unix(), 10))},
+		"expiry_shard": {S: aws.String(expiryShard)},
+		"expires":      {N: aws.String(strconv.FormatInt(expiresAt.Add(expiryGrace).Unix(), 10))},
+	}
+}
+
+// pinned assets never expire
+func isExpired(item map[string]*dynamodb.AttributeValue) bool {
+	expiresAt := numberAttribute(item, "expires_at")
+	return expiresAt > 0 && time.Now().Unix() >= expiresAt && !isPinned(item)
+}
+
+// refuses downloads of an expired asset that hasn't been swept yet,
+// writing an error and returning false if it has expired
+func checkExpiry(w http.ResponseWriter, assetID string, item map[string]*dynamodb.AttributeValue) bool {
+	if !isExpired(item) {
+		return true
+	}
+	http.Error(w, fmt.Sprintf("Asset id '%s' has expired.", assetID), http.StatusGone)
+	return false
+}
+
+// changes an asset's settings after init
+func handlePatchRequest(w http.ResponseWriter, r *http.Request, assetID string) {
+	var patch assetPatch
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&patch)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON payload: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	if patch.Filename == nil && patch.Tags == nil && patch.ExpiresAt == nil && patch.DeleteAt == nil && patch.Metadata == nil &&
+		patch.Description == nil && patch.Owner == nil && patch.Project == nil {
+		http.Error(w, "Nothing to update.", http.StatusBadRequest)
+		return
+	}
+
+	attributes := map[string]*dynamodb.AttributeValue{}
+	var removed []string
+	if patch.Filename != nil {
+		if err := validateFilename(*patch.Filename); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid value for key filename: %s.", err.Error()), http.StatusBadRequest)
+			return
+		}
+		if *patch.Filename == "" {
+			removed = append(removed, "filename")
+		} else {
+			attributes["filename"] = &dynamodb.AttributeValue{S: aws.String(*patch.Filename)}
+		}
+	}
+	if patch.Description != nil {
+		if err := validateDescription(*patch.Description); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid value for key description: %s.", err.Error()), http.StatusBadRequest)
+			return
+		}
+		if *patch.Description == "" {
+			removed = append(removed, "description")
+		} else {
+			attributes["description"] = &dynamodb.AttributeValue{S: aws.String(*patch.Description)}
+		}
+	}
+	// with a bearer token, assets can only be given to its subject
+	if patch.Owner != nil && requestSubject(r) != "" && *patch.Owner != requestSubject(r) {
+		http.Error(w, "Invalid value for key owner: owner must be the bearer token's subject.", http.StatusForbidden)
+		return
+	}
+	for name, value := range map[string]*string{"owner": patch.Owner, "project": patch.Project} {
+		if value == nil {
+			continue
+		}
+		if *value == "" {
+			removed = append(removed, clearedSearchAttributes(name)...)
+			continue
+		}
+		if err := validateSearchAttribute(name, *value); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid value for key %s: %s.", name, err.Error()), http.StatusBadRequest)
+			return
+		}
+		for k, v := range searchAttributes(name, *value) {
+			attributes[k] = v
+		}
+	}
+	if patch.ExpiresAt != nil {
+		if *patch.ExpiresAt == "" {
+			removed = append(removed, "expires_at", "expiry_shard", "expires")
+		} else {
+			expiresAt, err := parseExpiresAt(*patch.ExpiresAt)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid value for key expires_at: %s.", err.Error()), http.StatusBadRequest)
+				return
+			}
+			for k, v := range expiryAttributes(expiresAt) {
+				attributes[k] = v
+			}
+			// pinned assets are left for DynamoDB TTL to find when unpinned
+			delete(attributes, "expires")
+		}
+	}
+	if patch.DeleteAt != nil {
+		if *patch.DeleteAt == "" {
+			removed = append(removed, "delete_at", "deletion_shard")
+		} else {
+			deleteAt, err := parseDeleteAt(*patch.DeleteAt)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid value for key delete_at: %s.", err.Error()), http.StatusBadRequest)
+				return
+			}
+			for k, v := range deletionAttributes(deleteAt) {
+				attributes[k] = v
+			}
+		}
+	}
+
+	if patch.Metadata != nil {
+		if err := validateMetadata(*patch.Metadata); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid value for key metadata: %s.", err.Error()), http.StatusBadRequest)
+			return
+		}
+		if len(*patch.Metadata) == 0 {
+			removed = append(removed, "metadata")
+		} else {
+			attributes["metadata"] = metadataAttribute(*patch.Metadata)
+		}
+	}
+
+	var addedTags, removedTags map[string]bool
+	if patch.Tags != nil {
+		if err := validateTags(*patch.Tags); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid value for key tags: %s.", err.Error()), http.StatusBadRequest)
+			return
+		}
+		item, ok := fetchAsset(w, r, assetID)
+		if !ok {
+			return
+		}
+		keep := map[string]bool{}
+		for _, tag := range *patch.Tags {
+			keep[tag] = true
+		}
+		var stale []string
+		for _, tag := range recordedTags(item) {
+			if !keep[tag] {
+				stale = append(stale, tag)
+			}
+		}
+		var count int
+		addedTags, removedTags, count = diffTags(recordedTags(item), *patch.Tags, stale)
+		if count > maxTags {
+			http.Error(w, fmt.Sprintf("Asset id '%s' can have at most %d tags.", assetID, maxTags), http.StatusBadRequest)
+			return
+		}
+	}
+
+	values := lockConditionValues(r)
+	values[":updated"] = updatedAtValue()
+	update := setAttributes("SET updated_at = :updated", values, attributes)
+	if len(removed) > 0 {
+		update += " REMOVE " + strings.Join(removed, ", ")
+	}
+	condition := "attribute_exists(id) AND " + lockCondition
+	// and only take assets owned by no one or its subject already
+	claimed := patch.Owner != nil && requestSubject(r) != ""
+	if claimed {
+		condition += " AND (attribute_not_exists(owner) OR owner = :currentSubject)"
+		values[":currentSubject"] = &dynamodb.AttributeValue{S: aws.String(requestSubject(r))}
+	}
+	var result map[string]*dynamodb.AttributeValue
+	if len(addedTags)+len(removedTags) > 0 {
+		result, err = patchAssetWithTags(r.Context(), assetID, update, condition, values, addedTags, removedTags)
+	} else {
+		var output *dynamodb.UpdateItemOutput
+		output, err = dbSvc.UpdateItemWithContext(r.Context(), &dynamodb.UpdateItemInput{
+			Key:                                 assetKey(assetID),
+			TableName:                           aws.String(tableName),
+			UpdateExpression:                    aws.String(update),
+			ConditionExpression:                 aws.String(condition),
+			ExpressionAttributeValues:           values,
+			ReturnValues:                        aws.String(dynamodb.ReturnValueAllNew),
+			ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValuesOnConditionCheckFailureAllOld),
+		})
+		if err == nil {
+			result = output.Attributes
+		}
+	}
+	if err != nil {
+		if isConditionFailed(err) {
+			if owner := stringAttribute(conditionFailedItem(err), "owner"); claimed && owner != "" && owner != requestSubject(r) {
+				http.Error(w, fmt.Sprintf("Asset id '%s' is owned by someone else.", assetID), http.StatusForbidden)
+				return
+			}
+			if isLockedConflict(err) {
+				http.Error(w, fmt.Sprintf("Asset id '%s' is locked.", assetID), http.StatusLocked)
+				return
+			}
+			writeError(w, notFound(assetID))
+			return
+		}
+		writeError(w, err)
+		return
+	}
+	if patch.ExpiresAt != nil && *patch.ExpiresAt != "" {
+		if err := setExpiryTTL(r.Context(), assetID); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	// only an uploaded asset has an object to copy onto
+	if patch.Metadata != nil && mirrorMetadata && stringAttribute(result, "status") == assetStatusUploaded {
+		if err := mirrorObjectMetadata(r.Context(), assetID, result); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// applies a patch's update together with the writes of the tag records it
+// adds and removes, returning the updated record; a failed condition on the
+// asset comes back as a conditional check failure carrying the record
+func patchAssetWithTags(ctx context.Context, assetID, update, condition string, values map[string]*dynamodb.AttributeValue, added, removed map[string]bool) (map[string]*dynamodb.AttributeValue, error) {
+	clause, records := tagWrites(assetID, added, removed, values)
+	items := append([]*dynamodb.TransactWriteItem{{Update: &dynamodb.Update{
+		Key:                                 assetKey(assetID),
+		TableName:                           aws.String(tableName),
+		UpdateExpression:                    aws.String(update + clause),
+		ConditionExpression:                 aws.String(condition),
+		ExpressionAttributeValues:           values,
+		ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValuesOnConditionCheckFailureAllOld),
+	}}}, records...)
+	_, err := dbSvc.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	if isFirstConditionFailed(err) {
+		item := err.(*dynamodb.TransactionCanceledException).CancellationReasons[0].Item
+		return nil, &dynamodb.ConditionalCheckFailedException{Message_: aws.String("asset condition failed"), Item: item}
+	}
+	if err != nil {
+		return nil, err
+	}
+	// transactions don't return what they wrote
+	output, err := dbSvc.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		Key:            assetKey(assetID),
+		TableName:      aws.String(tableName),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output.Item, nil
+}
+
+// points DynamoDB TTL at an unpinned asset's expiry; pinned assets carry
+// no TTL so that it can't remove them
+func setExpiryTTL(ctx context.Context, assetID string) error {
+	_, err := dbSvc.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		Key:                 assetKey(assetID),
+		TableName:           aws.String(tableName),
+		UpdateExpression:    aws.String("SET expires = expires_at + :grace"),
+		ConditionExpression: aws.String("attribute_exists(expires_at) AND " + unpinnedCondition),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":grace": {N: aws.String(strconv.FormatInt(int64(expiryGrace/time.Second), 10))},
+			":false": {BOOL: aws.Bool(false)},
+		},
+	})
+	if isConditionFailed(err) {
+		return nil
+	}
+	return err
+}
+
+// sweeps expired assets until stopped
+func watchExpiries(stop <-chan struct{}) {
+	for {
+		if err := sweepExpired(); err != nil {
+			log.Println(err.Error())
+		}
+		if !pause(stop, expirySweepInterval) {
+			return
+		}
+	}
+}
+
+// collects every unpinned asset that has expired, with its objects
+func sweepExpired() error {
+	now := time.Now()
+	var failed error
+	err := dbSvc.QueryPages(&dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		IndexName:              aws.String(expiryIndexName),
+		KeyConditionExpression: aws.String("expiry_shard = :shard AND expires_at <= :now"),
+		FilterExpression:       aws.String("attribute_not_exists(gc_at) AND attribute_not_exists(gc_kept) AND " + unpinnedCondition),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":shard": {S: aws.String(expiryShard)},
+			":now":   {N: aws.String(strconv.FormatInt(now.Unix(), 10))},
+			":false": {BOOL: aws.Bool(false)},
+		},
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			// skip assets pinned or given a later expiry since the query
+			err := collectAsset(stringAttribute(item, "id"), gcReasonExpired, now)
+			if err != nil && !isConditionFailed(err) {
+				failed = err
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return failed
+}
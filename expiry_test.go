@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// an uploaded asset that expired an hour ago, reported by the expiry index
+type mockDBExpiredClient struct {
+	mockDBClient
+	deleted []string
+}
+
+func (m *mockDBExpiredClient) GetItem(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	output, _ := m.mockDBClient.GetItem(nil)
+	output.Item["expires_at"] = &dynamodb.AttributeValue{N: aws.String("1500000000")}
+	return output, nil
+}
+func (m *mockDBExpiredClient) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return m.GetItem(input)
+}
+
+func (m *mockDBExpiredClient) QueryPages(input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool) error {
+	fn(&dynamodb.QueryOutput{Items: []map[string]*dynamodb.AttributeValue{{
+		"id":         {S: aws.String("someID")},
+		"expires_at": {N: aws.String("1500000000")},
+	}}}, true)
+	return nil
+}
+func (m *mockDBExpiredClient) QueryPagesWithContext(ctx aws.Context, input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool, opts ...request.Option) error {
+	return m.QueryPages(input, fn)
+}
+
+func (m *mockDBExpiredClient) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	m.deleted = append(m.deleted, *input.Item["id"].S)
+	return &dynamodb.PutItemOutput{}, nil
+}
+func (m *mockDBExpiredClient) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	return m.PutItem(input)
+}
+
+func TestAssetURLRequestExpired(t *testing.T) {
+	dbSvc = &mockDBExpiredClient{}
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodGet, "/asset/someID", nil)
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusGone {
+		t.Errorf("Didn't get 410 for an expired asset: %d", w.Result().StatusCode)
+	}
+}
+func TestPatchExpiry(t *testing.T) {
+	dbSvc = &mockDBClient{}
+	for body, status := range map[string]int{
+		`{"expires_at": "2099-01-01T09:00:00Z"}`: http.StatusNoContent,
+		`{"expires_at": ""}`:                     http.StatusNoContent,
+		`{"expires_at": "2001-01-01T09:00:00Z"}`: http.StatusBadRequest,
+		`{"expires_at": "tomorrow"}`:             http.StatusBadRequest,
+		`{}`:                                     http.StatusBadRequest,
+	} {
+		r := httptest.NewRequest(http.MethodPatch, "/asset/someID", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		manageAsset(w, r)
+		if w.Result().StatusCode != status {
+			t.Errorf("Incorrect status patching %s: %d", body, w.Result().StatusCode)
+		}
+	}
+}
+func TestSweepExpired(t *testing.T) {
+	gcWindow = 0
+	defer func() { gcWindow = 24 * time.Hour }()
+	db := &mockDBExpiredClient{}
+	dbSvc = db
+	s3Svc = &mockS3Client{}
+	if err := sweepExpired(); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.deleted) != 1 || db.deleted[0] != "someID" {
+		t.Errorf("Expired asset wasn't deleted: %v", db.deleted)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+const (
+	formFileField = "file"
+	// form fields other than the file are read into memory
+	maxFormFieldSize = 4096
+)
+
+type formUploadResponse struct {
+	ID          string `json:"id"`
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+	// pass to GET /asset/{id} to be sure of seeing this upload
+	ConsistencyToken string `json:"consistency_token,omitempty"`
+}
+
+// settings an upload form sets with fields ahead of its file
+type formUpload struct {
+	attributes   map[string]*dynamodb.AttributeValue
+	metadata     map[string]string
+	contentType  string
+	cacheControl string
+}
+
+// records a form field ahead of the file: the init options filename,
+// content_type, cache_control, locale, folder, description, owner and
+// project, or x-amz-meta-* metadata as S3 form uploads take it
+func (f *formUpload) setField(name, value string) error {
+	if strings.HasPrefix(name, "x-amz-meta-") && len(name) > len("x-amz-meta-") {
+		f.metadata[strings.TrimPrefix(name, "x-amz-meta-")] = value
+		return validateMetadata(f.metadata)
+	}
+	if value == "" {
+		return nil
+	}
+	switch name {
+	case "filename":
+		if err := validateFilename(value); err != nil {
+			return err
+		}
+		f.attributes["filename"] = &dynamodb.AttributeValue{S: aws.String(value)}
+	case "content_type":
+		f.contentType = value
+	case "cache_control":
+		if err := validateCacheControl(value); err != nil {
+			return err
+		}
+		f.cacheControl = value
+	case "locale":
+		locale, err := normalizeLocale(value)
+		if err != nil {
+			return err
+		}
+		f.attributes["locale"] = &dynamodb.AttributeValue{S: aws.String(locale)}
+	case "folder":
+		prefix, err := normalizeKeyPrefix(value)
+		if err != nil {
+			return err
+		}
+		f.attributes["key_prefix"] = &dynamodb.AttributeValue{S: aws.String(prefix)}
+	case "description":
+		if err := validateDescription(value); err != nil {
+			return err
+		}
+		f.attributes["description"] = &dynamodb.AttributeValue{S: aws.String(value)}
+	case "owner", "project":
+		if err := validateSearchAttribute(name, value); err != nil {
+			return err
+		}
+		for k, v := range searchAttributes(name, value) {
+			f.attributes[k] = v
+		}
+	default:
+		return fmt.Errorf("unknown field")
+	}
+	return nil
+}
+
+// inits an asset, streams the file of a multipart/form-data post to S3 and
+// marks it uploaded in one call, for clients that can only post forms;
+// fields set up the asset as init would and must come before the file
+func uploadForm(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodPost) {
+		return
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "multipart/form-data" {
+		http.Error(w, "Uploads must be posted as multipart/form-data.", http.StatusUnsupportedMediaType)
+		return
+	}
+	if r.ContentLength > maxProxyUploadSize {
+		http.Error(w, "Request body is too large.", http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxProxyUploadSize)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid form: %s.", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	form := formUpload{
+		attributes:   map[string]*dynamodb.AttributeValue{},
+		metadata:     map[string]string{},
+		cacheControl: defaultCacheControl,
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			http.Error(w, fmt.Sprintf("Form has no %s field.", formFileField), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid form: %s.", err.Error()), http.StatusBadRequest)
+			return
+		}
+		if part.FormName() == formFileField {
+			uploadFormFile(w, r, &form, part)
+			return
+		}
+		value, err := ioutil.ReadAll(io.LimitReader(part, maxFormFieldSize+1))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid form: %s.", err.Error()), http.StatusBadRequest)
+			return
+		}
+		if len(value) > maxFormFieldSize {
+			http.Error(w, fmt.Sprintf("Form field %s is too long.", part.FormName()), http.StatusBadRequest)
+			return
+		}
+		if err := form.setField(strings.ToLower(part.FormName()), string(value)); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid form field %s: %s.", part.FormName(), err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+}
+
+// reserves an asset for the form's file part and uploads it
+func uploadFormFile(w http.ResponseWriter, r *http.Request, form *formUpload, file *multipart.Part) {
+	// the name and type of the file posted, unless fields set them
+	if form.attributes["filename"] == nil {
+		if filename := file.FileName(); filename != "" && validateFilename(filename) == nil {
+			form.attributes["filename"] = &dynamodb.AttributeValue{S: aws.String(filename)}
+		}
+	}
+	if form.contentType == "" {
+		form.contentType = file.Header.Get("Content-Type")
+	}
+	owner, err := requestOwner(r, stringAttribute(form.attributes, "owner"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid form field owner: %s.", err.Error()), http.StatusForbidden)
+		return
+	}
+	if owner != "" {
+		for k, v := range searchAttributes("owner", owner) {
+			form.attributes[k] = v
+		}
+	}
+	for k, v := range onBehalfOfAttributes(r) {
+		form.attributes[k] = v
+	}
+	if err := validateContentType(form.contentType); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid form field content_type: %s.", err.Error()), http.StatusBadRequest)
+		return
+	}
+	if form.contentType != "" {
+		form.attributes["content_type"] = &dynamodb.AttributeValue{S: aws.String(form.contentType)}
+	}
+	if form.cacheControl != "" {
+		form.attributes["cache_control"] = &dynamodb.AttributeValue{S: aws.String(form.cacheControl)}
+	}
+	if len(form.metadata) > 0 {
+		form.attributes["metadata"] = metadataAttribute(form.metadata)
+	}
+	// reaped like any other reservation if the upload never finishes
+	for k, v := range reservationAttributes(maxUploadTimeout) {
+		form.attributes[k] = v
+	}
+	// issued and spent within this request, which reserved the asset
+	completionToken, tokenAttributes := newCompletionToken(maxUploadTimeout)
+	for k, v := range tokenAttributes {
+		form.attributes[k] = v
+	}
+	assetID, err := reserveUniqueID(r.Context(), form.attributes)
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	recordAssetEvent(r, assetID, assetEventCreated, nil)
+
+	key := objectKey(assetID, form.attributes)
+	d := newDigester()
+	uploader := s3manager.NewUploaderWithClient(s3Svc)
+	_, err = uploader.UploadWithContext(r.Context(), &s3manager.UploadInput{
+		Bucket:                  aws.String(bucketName),
+		Key:                     aws.String(key),
+		Body:                    io.TeeReader(file, d),
+		ContentType:             optionalString(form.contentType),
+		CacheControl:            optionalString(form.cacheControl),
+		Metadata:                aws.StringMap(form.metadata),
+		ServerSideEncryption:    encryptionAlgorithm(),
+		SSEKMSKeyId:             optionalString(kmsKeyID),
+		SSEKMSEncryptionContext: encryptionContextHeader(assetID),
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	attributes := d.sums().attributes()
+	for k, v := range encryptionAttributes(assetID) {
+		attributes[k] = v
+	}
+	if !markUploaded(w, r, assetID, key, completionToken, attributes) {
+		return
+	}
+	response := formUploadResponse{
+		ID:               assetID,
+		DuplicateOf:      recordDuplicate(assetID, attributes),
+		ConsistencyToken: w.Header().Get(consistencyTokenHeader),
+	}
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, response)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// a form posting fields in order, then hello.txt unless file is false
+func uploadFormBody(file bool, fields ...string) (*bytes.Buffer, string) {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	for i := 0; i+1 < len(fields); i += 2 {
+		mw.WriteField(fields[i], fields[i+1])
+	}
+	if file {
+		part, _ := mw.CreateFormFile(formFileField, "hello.txt")
+		part.Write([]byte("Hello world!"))
+	}
+	mw.Close()
+	return body, mw.FormDataContentType()
+}
+
+func TestUploadForm(t *testing.T) {
+	db := &mockDBPutRecordingClient{}
+	dbSvc, s3Svc = db, &mockS3Client{}
+	body, contentType := uploadFormBody(true, "content_type", "text/plain", "x-amz-meta-source", "legacy", "owner", "finance")
+	r := httptest.NewRequest(http.MethodPost, "/asset/upload", body)
+	r.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+
+	uploadForm(w, r)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Incorrect status on form upload: %d", resp.StatusCode)
+	}
+	var response formUploadResponse
+	json.NewDecoder(resp.Body).Decode(&response)
+	if response.ID == "" || response.ID != stringAttribute(db.item, "id") {
+		t.Errorf("Incorrect asset returned: %+v", response)
+	}
+	if stringAttribute(db.item, "filename") != "hello.txt" || stringAttribute(db.item, "content_type") != "text/plain" ||
+		stringAttribute(db.item, "owner") != "finance" || recordedMetadata(db.item)["source"] != "legacy" {
+		t.Errorf("Form fields not recorded on asset: %v", db.item)
+	}
+}
+
+func TestUploadFormInvalid(t *testing.T) {
+	dbSvc, s3Svc = &mockDBClient{}, &mockS3Client{}
+	for _, test := range []struct {
+		file   bool
+		fields []string
+		status int
+	}{
+		{false, []string{"filename", "report.pdf"}, http.StatusBadRequest},
+		{true, []string{"submit", "Upload"}, http.StatusBadRequest},
+		{true, []string{"locale", "not a locale"}, http.StatusBadRequest},
+		{true, []string{"description", strings.Repeat("x", maxFormFieldSize+1)}, http.StatusBadRequest},
+	} {
+		body, contentType := uploadFormBody(test.file, test.fields...)
+		r := httptest.NewRequest(http.MethodPost, "/asset/upload", body)
+		r.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		uploadForm(w, r)
+		if w.Result().StatusCode != test.status {
+			t.Errorf("Incorrect status on form upload %v: %d", test.fields, w.Result().StatusCode)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/asset/upload", strings.NewReader("Hello world!"))
+	r.Header.Set("Content-Type", "text/plain")
+	w := httptest.NewRecorder()
+	uploadForm(w, r)
+	if w.Result().StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("Didn't get 415 for a body that isn't a form: %d", w.Result().StatusCode)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	// why an asset is being collected
+	gcReasonAbandoned = "abandoned"
+	gcReasonExpired   = "expired"
+	// marked records are put in this partition of the sparse gc index until
+	// they're collected or rescued
+	gcShard          = "all"
+	gcInterval       = time.Minute
+	maxMarkedListing = 1000
+)
+
+// how long the reservation reaper and expiry sweep leave an asset marked
+// before deleting it, zero to delete straight away
+var gcWindow = 24 * time.Hour
+
+// the DynamoDB index on gc_shard and gc_at
+var gcIndexName string
+
+// counts since start
+var gcMarked, gcCollected, gcRescued, gcUndone int64
+
+type markedAsset struct {
+	ID        string    `json:"id"`
+	Reason    string    `json:"reason"`
+	MarkedAt  time.Time `json:"marked_at"`
+	CollectAt time.Time `json:"collect_at"`
+}
+
+type markedAssetsResponse struct {
+	Marked []markedAsset `json:"marked"`
+}
+
+type gcStats struct {
+	WindowSeconds int64 `json:"window_seconds"`
+	// assets marked now, waiting out the window
+	Pending   int64 `json:"pending"`
+	Marked    int64 `json:"marked"`
+	Collected int64 `json:"collected"`
+	Rescued   int64 `json:"rescued"`
+	Undone    int64 `json:"undone"`
+}
+
+// what must still hold of an asset for it to be collected for a reason;
+// assets kept by undoing their collection never are
+func gcCondition(reason string, now time.Time) (string, map[string]*dynamodb.AttributeValue) {
+	values := map[string]*dynamodb.AttributeValue{":false": {BOOL: aws.Bool(false)}}
+	condition := "attribute_not_exists(gc_kept) AND " + unpinnedCondition
+	switch reason {
+	case gcReasonAbandoned:
+		values[":cutoff"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(now.Add(-reservationGrace).Unix(), 10))}
+		condition += " AND attribute_exists(reservation_shard) AND upload_expires <= :cutoff AND attribute_not_exists(purge_at)"
+	case gcReasonExpired:
+		values[":expiredBy"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(now.Unix(), 10))}
+		condition += " AND expires_at <= :expiredBy"
+	}
+	return condition, values
+}
+
+// deletes an asset for a reason once the gc window has passed, marking it
+// until then; a failed condition comes back as the DynamoDB error
+func collectAsset(assetID, reason string, now time.Time) error {
+	condition, values := gcCondition(reason, now)
+	if gcWindow <= 0 {
+		return removeAsset(context.Background(), assetID, condition, values)
+	}
+	values[":reason"] = &dynamodb.AttributeValue{S: aws.String(reason)}
+	values[":gcShard"] = &dynamodb.AttributeValue{S: aws.String(gcShard)}
+	values[":markedAt"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(now.Unix(), 10))}
+	values[":gcAt"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(now.Add(gcWindow).Unix(), 10))}
+	_, err := dbSvc.UpdateItem(&dynamodb.UpdateItemInput{
+		Key:                       assetKey(assetID),
+		TableName:                 aws.String(tableName),
+		UpdateExpression:          aws.String("SET gc_reason = :reason, gc_shard = :gcShard, gc_marked_at = :markedAt, gc_at = :gcAt"),
+		ConditionExpression:       aws.String("attribute_not_exists(gc_at) AND " + condition),
+		ExpressionAttributeValues: values,
+	})
+	if err == nil {
+		atomic.AddInt64(&gcMarked, 1)
+		log.Printf("marked asset %s for collection (%s)", assetID, reason)
+	}
+	return err
+}
+
+// collects marked assets until stopped
+func watchCollections(stop <-chan struct{}) {
+	for {
+		if err := collectMarked(); err != nil {
+			log.Println(err.Error())
+		}
+		if !pause(stop, gcInterval) {
+			return
+		}
+	}
+}
+
+// deletes every asset whose gc window has passed if what it was marked for
+// still holds, unmarking it otherwise
+func collectMarked() error {
+	now := time.Now()
+	var failed error
+	err := dbSvc.QueryPages(&dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		IndexName:              aws.String(gcIndexName),
+		KeyConditionExpression: aws.String("gc_shard = :shard AND gc_at <= :now"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":shard": {S: aws.String(gcShard)},
+			":now":   {N: aws.String(strconv.FormatInt(now.Unix(), 10))},
+		},
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			if err := collectOne(stringAttribute(item, "id"), stringAttribute(item, "gc_reason"), now); err != nil {
+				failed = err
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return failed
+}
+
+func collectOne(assetID, reason string, now time.Time) error {
+	condition, values := gcCondition(reason, now)
+	values[":now"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(now.Unix(), 10))}
+	err := removeAsset(context.Background(), assetID, "gc_at <= :now AND "+condition, values)
+	if err == nil {
+		atomic.AddInt64(&gcCollected, 1)
+		return nil
+	}
+	if !isConditionFailed(err) {
+		return err
+	}
+	// uploaded, pinned, given a later expiry or undone since it was marked
+	_, err = dbSvc.UpdateItem(&dynamodb.UpdateItemInput{
+		Key:                       assetKey(assetID),
+		TableName:                 aws.String(tableName),
+		UpdateExpression:          aws.String("REMOVE gc_reason, gc_shard, gc_marked_at, gc_at"),
+		ConditionExpression:       aws.String("gc_at <= :now"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":now": values[":now"]},
+	})
+	if isConditionFailed(err) {
+		return nil
+	}
+	if err == nil {
+		atomic.AddInt64(&gcRescued, 1)
+		log.Printf("asset %s no longer %s, unmarked", assetID, reason)
+	}
+	return err
+}
+
+// reports the gc window with counts of assets marked now and since start
+func getGCStats(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	stats := gcStats{
+		WindowSeconds: int64(gcWindow / time.Second),
+		Marked:        atomic.LoadInt64(&gcMarked),
+		Collected:     atomic.LoadInt64(&gcCollected),
+		Rescued:       atomic.LoadInt64(&gcRescued),
+		Undone:        atomic.LoadInt64(&gcUndone),
+	}
+	err := dbSvc.QueryPagesWithContext(r.Context(), &dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		IndexName:              aws.String(gcIndexName),
+		KeyConditionExpression: aws.String("gc_shard = :shard"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":shard": {S: aws.String(gcShard)},
+		},
+		Select: aws.String(dynamodb.SelectCount),
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		stats.Pending += aws.Int64Value(page.Count)
+		return true
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, stats)
+}
+
+// lists assets marked for collection, soonest collected first
+func listMarkedAssets(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	response := markedAssetsResponse{Marked: []markedAsset{}}
+	err := dbSvc.QueryPagesWithContext(r.Context(), &dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		IndexName:              aws.String(gcIndexName),
+		KeyConditionExpression: aws.String("gc_shard = :shard"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":shard": {S: aws.String(gcShard)},
+		},
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			response.Marked = append(response.Marked, markedAsset{
+				ID:        stringAttribute(item, "id"),
+				Reason:    stringAttribute(item, "gc_reason"),
+				MarkedAt:  time.Unix(numberAttribute(item, "gc_marked_at"), 0).UTC(),
+				CollectAt: time.Unix(numberAttribute(item, "gc_at"), 0).UTC(),
+			})
+		}
+		return len(response.Marked) < maxMarkedListing
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, response)
+}
+
+// undoes an asset's collection (POST /gc/marked/{id}/undo) while it's
+// marked, keeping it from ever being collected again
+func undoCollection(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodPost) {
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/gc/marked/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "undo" {
+		http.NotFound(w, r)
+		return
+	}
+	assetID := parts[0]
+	_, err := dbSvc.UpdateItemWithContext(r.Context(), &dynamodb.UpdateItemInput{
+		Key:                       assetKey(assetID),
+		TableName:                 aws.String(tableName),
+		UpdateExpression:          aws.String("SET gc_kept = :true REMOVE gc_reason, gc_shard, gc_marked_at, gc_at"),
+		ConditionExpression:       aws.String("attribute_exists(gc_at)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":true": {BOOL: aws.Bool(true)}},
+	})
+	if err != nil {
+		if isConditionFailed(err) {
+			http.Error(w, fmt.Sprintf("Asset id '%s' isn't marked for collection.", assetID), http.StatusNotFound)
+			return
+		}
+		writeError(w, err)
+		return
+	}
+	atomic.AddInt64(&gcUndone, 1)
+	log.Printf("collection of asset %s undone", assetID)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// an asset marked as abandoned whose window has passed, recording the
+// updates and deletions made to it; fail makes every deletion's condition
+// fail, as if it had been uploaded since
+type mockDBMarkedClient struct {
+	mockDBClient
+	fail      bool
+	updates   []string
+	deletions []string
+}
+
+func (m *mockDBMarkedClient) QueryPages(input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool) error {
+	fn(&dynamodb.QueryOutput{
+		Items: []map[string]*dynamodb.AttributeValue{{
+			"id":           {S: aws.String("someID")},
+			"gc_reason":    {S: aws.String(gcReasonAbandoned)},
+			"gc_marked_at": {N: aws.String("1500000000")},
+			"gc_at":        {N: aws.String("1500086400")},
+		}},
+		Count: aws.Int64(1),
+	}, true)
+	return nil
+}
+func (m *mockDBMarkedClient) QueryPagesWithContext(ctx aws.Context, input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool, opts ...request.Option) error {
+	return m.QueryPages(input, fn)
+}
+
+func (m *mockDBMarkedClient) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	if isRemoval(input) {
+		if m.fail {
+			return nil, &dynamodb.ConditionalCheckFailedException{Message_: aws.String("The conditional request failed")}
+		}
+		m.deletions = append(m.deletions, aws.StringValue(input.ConditionExpression))
+		return &dynamodb.UpdateItemOutput{}, nil
+	}
+	m.updates = append(m.updates, aws.StringValue(input.UpdateExpression))
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+func (m *mockDBMarkedClient) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	return m.UpdateItem(input)
+}
+
+func TestReapReservationsMarks(t *testing.T) {
+	db := &mockDBMarkedClient{}
+	dbSvc = db
+	if err := reapReservations(); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.deletions) != 0 || len(db.updates) != 1 || !strings.Contains(db.updates[0], "gc_at = :gcAt") {
+		t.Errorf("Abandoned reservation wasn't marked instead of deleted: %v %v", db.updates, db.deletions)
+	}
+}
+
+func TestCollectMarked(t *testing.T) {
+	db := &mockDBMarkedClient{}
+	dbSvc = db
+	s3Svc = &mockS3Client{}
+	if err := collectMarked(); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.deletions) != 1 || !strings.Contains(db.deletions[0], "gc_at <= :now") ||
+		!strings.Contains(db.deletions[0], "attribute_exists(reservation_shard)") {
+		t.Errorf("Marked asset not deleted on condition it's still abandoned: %v", db.deletions)
+	}
+
+	// uploaded since it was marked
+	db = &mockDBMarkedClient{fail: true}
+	dbSvc = db
+	if err := collectMarked(); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.updates) != 1 || !strings.HasPrefix(db.updates[0], "REMOVE gc_reason") {
+		t.Errorf("Rescued asset wasn't unmarked: %v", db.updates)
+	}
+}
+
+func TestUndoCollection(t *testing.T) {
+	db := &mockDBMarkedClient{}
+	dbSvc = db
+	r := httptest.NewRequest(http.MethodPost, "/gc/marked/someID/undo", nil)
+	w := httptest.NewRecorder()
+
+	undoCollection(w, r)
+	if w.Result().StatusCode != http.StatusNoContent {
+		t.Fatalf("Incorrect status undoing a collection: %d", w.Result().StatusCode)
+	}
+	if len(db.updates) != 1 || !strings.Contains(db.updates[0], "SET gc_kept") {
+		t.Errorf("Asset not kept: %v", db.updates)
+	}
+
+	dbSvc = &mockDBConditionalErrorClient{}
+	w = httptest.NewRecorder()
+	undoCollection(w, httptest.NewRequest(http.MethodPost, "/gc/marked/someID/undo", nil))
+	if w.Result().StatusCode != http.StatusNotFound {
+		t.Errorf("Didn't get 404 undoing an unmarked asset: %d", w.Result().StatusCode)
+	}
+}
+
+func TestGCStatsAndListing(t *testing.T) {
+	dbSvc = &mockDBMarkedClient{}
+	w := httptest.NewRecorder()
+	getGCStats(w, httptest.NewRequest(http.MethodGet, "/gc", nil))
+	var stats gcStats
+	json.NewDecoder(w.Body).Decode(&stats)
+	if stats.Pending != 1 || stats.WindowSeconds != int64(gcWindow/time.Second) {
+		t.Errorf("Incorrect gc stats: %+v", stats)
+	}
+
+	w = httptest.NewRecorder()
+	listMarkedAssets(w, httptest.NewRequest(http.MethodGet, "/gc/marked", nil))
+	var listing markedAssetsResponse
+	json.NewDecoder(w.Body).Decode(&listing)
+	if len(listing.Marked) != 1 || listing.Marked[0].Reason != gcReasonAbandoned ||
+		listing.Marked[0].CollectAt.Sub(listing.Marked[0].MarkedAt) != 24*time.Hour {
+		t.Errorf("Incorrect marked assets: %+v", listing)
+	}
+}
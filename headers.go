@@ -0,0 +1,21 @@
+package main
+
+import "errors"
+
+const maxCacheControlLength = 256
+
+// server-wide Cache-Control applied to uploads that don't specify one
+var defaultCacheControl string
+
+// checks that a Cache-Control value is safe to sign into a request
+func validateCacheControl(value string) error {
+	if len(value) > maxCacheControlLength {
+		return errors.New("cache_control is too long")
+	}
+	for _, c := range value {
+		if c < ' ' || c == 0x7f {
+			return errors.New("cache_control contains control characters")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestValidateCacheControl(t *testing.T) {
+	if err := validateCacheControl("public, max-age=3600"); err != nil {
+		t.Errorf("Got error for a valid cache control: %s", err)
+	}
+	if err := validateCacheControl("max-age=1\r\nX-Evil: 1"); err == nil {
+		t.Error("Got no error for a cache control with control characters")
+	}
+	if err := validateCacheControl(strings.Repeat("a", maxCacheControlLength+1)); err == nil {
+		t.Error("Got no error for an overlong cache control")
+	}
+}
+func TestInitAssetBadCacheControl(t *testing.T) {
+	dbSvc = &mockDBClient{}
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodPost, "/asset?cache_control="+url.QueryEscape("a\nb"), nil)
+	w := httptest.NewRecorder()
+
+	initAsset(w, r)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Didn't get 400 for a bad cache control: %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+const (
+	// the header requests carry an IAM token in: a presigned STS
+	// GetCallerIdentity url, base64url encoded, that the service calls to
+	// learn who signed it
+	iamTokenHeader = "X-IAM-Token"
+	// the header, signed into the token, naming the service it's for, so a
+	// token made for another service can't be replayed here
+	iamAudienceHeader = "X-Asset-Uploader-Audience"
+	tokenIAM          = "iam"
+	// STS accepts presigned urls for at most this long
+	maxIAMTokenLifetime = 15 * time.Minute
+	maxIAMTokenSize     = 4096
+	maxSTSBody          = 1 << 16
+	// identities learned from STS are kept at most this many at a time
+	maxIAMCacheEntries = 10000
+)
+
+// STS endpoints tokens may be presigned for, global or regional
+var stsHostPattern = regexp.MustCompile(`^sts(\.[a-z0-9-]+)?\.amazonaws\.com(\.cn)?$`)
+
+// names of allowed IAM roles and users by ARN, from -iam-principals
+var iamPrincipals = map[string]string{}
+
+// the audience tokens must be signed for
+var iamAudience = "asset-uploader"
+
+var stsClient = &http.Client{Timeout: 10 * time.Second}
+
+// STS couldn't be reached, so tokens can't be checked at all
+var errSTSUnavailable = errors.New("STS is unavailable")
+
+// caller ARNs by the hash of the token STS confirmed them for, kept until
+// the token expires
+var iamCache struct {
+	sync.Mutex
+	callers map[string]cachedIAMCaller
+}
+
+type cachedIAMCaller struct {
+	arn     string
+	expires int64
+}
+
+type getCallerIdentityResponse struct {
+	GetCallerIdentityResponse struct {
+		GetCallerIdentityResult struct {
+			Arn string
+		}
+	}
+}
+
+func iamEnabled() bool {
+	return len(iamPrincipals) > 0
+}
+
+// adds allowed principals given as comma separated name=arn pairs
+func parseIAMPrincipals(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("IAM principal '%s' must be given as name=arn", parts[0])
+		}
+		if !apiKeyNamePattern.MatchString(parts[0]) {
+			return fmt.Errorf("invalid IAM principal name '%s'", parts[0])
+		}
+		arn, err := principalARN(parts[1])
+		if err != nil || arn != parts[1] {
+			return fmt.Errorf("IAM principal '%s' must be a role or user ARN", parts[0])
+		}
+		iamPrincipals[arn] = parts[0]
+	}
+	return nil
+}
+
+// the role or user ARN behind a caller ARN, which for an assumed role
+// drops the session name; role paths aren't part of it, so roles are
+// matched without them
+func principalARN(arn string) (string, error) {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" || parts[4] == "" {
+		return "", fmt.Errorf("invalid ARN '%s'", arn)
+	}
+	resource := parts[5]
+	switch {
+	case parts[2] == "sts" && strings.HasPrefix(resource, "assumed-role/"):
+		segments := strings.Split(resource, "/")
+		if len(segments) != 3 || segments[1] == "" {
+			return "", fmt.Errorf("invalid assumed role ARN '%s'", arn)
+		}
+		return fmt.Sprintf("arn:%s:iam::%s:role/%s", parts[1], parts[4], segments[1]), nil
+	case parts[2] == "iam" && parts[3] == "" && (strings.HasPrefix(resource, "role/") || strings.HasPrefix(resource, "user/")):
+		return arn, nil
+	}
+	return "", fmt.Errorf("ARN '%s' is not of a role or user", arn)
+}
+
+// checks an IAM token by calling the STS url it carries, returning the
+// decision to let its request through as the principal that signed it
+func validateIAMToken(token string, now time.Time) (authDecision, error) {
+	if len(token) > maxIAMTokenSize {
+		return authDecision{}, fmt.Errorf("token is too long")
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return authDecision{}, fmt.Errorf("token is malformed")
+	}
+	u, expires, err := parseIAMTokenURL(string(raw), now)
+	if err != nil {
+		return authDecision{}, err
+	}
+	if !checkTokenExpiry(tokenIAM, expires, now) {
+		return authDecision{}, fmt.Errorf("token is expired")
+	}
+
+	hash := hashAPIKey(token)
+	iamCache.Lock()
+	cached, ok := iamCache.callers[hash]
+	iamCache.Unlock()
+	caller := cached.arn
+	if !ok {
+		if caller, err = getCallerIdentity(u); err != nil {
+			return authDecision{}, err
+		}
+		cacheIAMCaller(hash, caller, expires, now)
+	}
+	principal, err := principalARN(caller)
+	if err != nil {
+		return authDecision{}, err
+	}
+	name, ok := iamPrincipals[principal]
+	if !ok {
+		return authDecision{}, fmt.Errorf("principal '%s' is not allowed", principal)
+	}
+	return authDecision{Method: iamMethod, Key: name, Principal: caller}, nil
+}
+
+// checks a token's url is a presigned STS GetCallerIdentity call signed
+// for this service, returning it with when it expires in unix seconds
+func parseIAMTokenURL(raw string, now time.Time) (*url.URL, int64, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || !stsHostPattern.MatchString(u.Host) || (u.Path != "/" && u.Path != "") || u.User != nil {
+		return nil, 0, fmt.Errorf("token is not for STS")
+	}
+	query := u.Query()
+	for name := range query {
+		if name != "Action" && name != "Version" && !strings.HasPrefix(name, "X-Amz-") {
+			return nil, 0, fmt.Errorf("token has unexpected parameter %s", name)
+		}
+	}
+	if query.Get("Action") != "GetCallerIdentity" || query.Get("Version") != "2011-06-15" || query.Get("X-Amz-Algorithm") != "AWS4-HMAC-SHA256" {
+		return nil, 0, fmt.Errorf("token is not a GetCallerIdentity call")
+	}
+	signed := map[string]bool{}
+	for _, header := range strings.Split(query.Get("X-Amz-SignedHeaders"), ";") {
+		signed[header] = true
+	}
+	if !signed["host"] || !signed[strings.ToLower(iamAudienceHeader)] {
+		return nil, 0, fmt.Errorf("token must sign host and %s", iamAudienceHeader)
+	}
+	date, err := time.Parse("20060102T150405Z", query.Get("X-Amz-Date"))
+	if err != nil {
+		return nil, 0, fmt.Errorf("token has an invalid X-Amz-Date")
+	}
+	lifetime, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+	if err != nil || lifetime <= 0 || time.Duration(lifetime)*time.Second > maxIAMTokenLifetime {
+		return nil, 0, fmt.Errorf("token must expire within %s", maxIAMTokenLifetime)
+	}
+	if date.After(now.Add(clockSkew)) {
+		return nil, 0, fmt.Errorf("token is not valid yet")
+	}
+	return u, date.Unix() + int64(lifetime), nil
+}
+
+// calls a presigned GetCallerIdentity url, returning the caller's ARN
+func getCallerIdentity(u *url.URL) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(iamAudienceHeader, iamAudience)
+	req.Header.Set("Accept", "application/json")
+	resp, err := stsClient.Do(req)
+	if err != nil {
+		return "", errSTSUnavailable
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests:
+		// a bad or expired signature, or one for another audience
+		return "", fmt.Errorf("STS refused the token")
+	case resp.StatusCode != http.StatusOK:
+		return "", errSTSUnavailable
+	}
+	var identity getCallerIdentityResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxSTSBody)).Decode(&identity); err != nil {
+		return "", errSTSUnavailable
+	}
+	arn := identity.GetCallerIdentityResponse.GetCallerIdentityResult.Arn
+	if arn == "" {
+		return "", errSTSUnavailable
+	}
+	return arn, nil
+}
+
+// remembers the caller STS confirmed for a token until it expires,
+// dropping expired entries once the cache fills up
+func cacheIAMCaller(hash, arn string, expires int64, now time.Time) {
+	iamCache.Lock()
+	defer iamCache.Unlock()
+	if iamCache.callers == nil {
+		iamCache.callers = map[string]cachedIAMCaller{}
+	}
+	if len(iamCache.callers) >= maxIAMCacheEntries {
+		for k, cached := range iamCache.callers {
+			if cached.expires <= tokenCutoff(now) {
+				delete(iamCache.callers, k)
+			}
+		}
+		if len(iamCache.callers) >= maxIAMCacheEntries {
+			iamCache.callers = map[string]cachedIAMCaller{}
+		}
+	}
+	iamCache.callers[hash] = cachedIAMCaller{arn: arn, expires: expires}
+}
+
+// prints an IAM token for the credentials the service runs with, for
+// calling another instance with: ./main iam-token
+func runIAMToken(args []string) error {
+	if err := noAdminArgs("iam-token", args); err != nil {
+		return err
+	}
+	token, err := newIAMToken(sts.New(session.New()))
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(adminOutput).Encode(map[string]string{"token": token})
+}
+
+// presigns a GetCallerIdentity call for this service's audience with the
+// credentials svc signs with
+func newIAMToken(svc *sts.STS) (string, error) {
+	req, _ := svc.GetCallerIdentityRequest(&sts.GetCallerIdentityInput{})
+	req.HTTPRequest.Header.Set(iamAudienceHeader, iamAudience)
+	presigned, err := req.Presign(maxIAMTokenLifetime)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(presigned)), nil
+}
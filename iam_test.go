@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// sends every request to a test server, wherever it was addressed
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (t redirectTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.URL.Scheme, r.URL.Host = t.target.Scheme, t.target.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// an STS answering GetCallerIdentity calls for the audience with arn, or
+// with status if set
+func serveSTS(t *testing.T, arn string, status *int, calls *int) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+		if *status != 0 {
+			w.WriteHeader(*status)
+			return
+		}
+		if r.URL.Query().Get("Action") != "GetCallerIdentity" || r.Header.Get(iamAudienceHeader) != iamAudience {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprintf(w, `{"GetCallerIdentityResponse":{"GetCallerIdentityResult":{"Account":"123456789012","Arn":%q}}}`, arn)
+	}))
+	t.Cleanup(server.Close)
+	target, _ := url.Parse(server.URL)
+	client := stsClient
+	stsClient = &http.Client{Transport: redirectTransport{target}}
+	t.Cleanup(func() { stsClient = client })
+}
+
+func resetIAM() {
+	iamPrincipals = map[string]string{}
+	iamCache.Lock()
+	iamCache.callers = nil
+	iamCache.Unlock()
+}
+
+func testIAMToken(t *testing.T) string {
+	svc := sts.New(session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("AKID", "SECRET", ""),
+	})))
+	token, err := newIAMToken(svc)
+	if err != nil {
+		t.Fatalf("Got error presigning token: %s", err)
+	}
+	return token
+}
+
+func TestPrincipalARN(t *testing.T) {
+	for arn, want := range map[string]string{
+		"arn:aws:sts::123456789012:assumed-role/uploader/i-0abc":  "arn:aws:iam::123456789012:role/uploader",
+		"arn:aws-cn:sts::123456789012:assumed-role/uploader/ci":   "arn:aws-cn:iam::123456789012:role/uploader",
+		"arn:aws:iam::123456789012:user/deploy":                   "arn:aws:iam::123456789012:user/deploy",
+		"arn:aws:iam::123456789012:role/uploader":                 "arn:aws:iam::123456789012:role/uploader",
+		"arn:aws:sts::123456789012:federated-user/someone":        "",
+		"arn:aws:s3:::bucket":                                     "",
+		"arn:aws:sts::123456789012:assumed-role/uploader/ci/more": "",
+	} {
+		got, err := principalARN(arn)
+		if got != want || (err == nil) != (want != "") {
+			t.Errorf("Incorrect principal for %s: %s, %v", arn, got, err)
+		}
+	}
+}
+
+func TestIAMToken(t *testing.T) {
+	defer resetIAM()
+	if err := parseIAMPrincipals("ci=arn:aws:iam::123456789012:role/uploader"); err != nil {
+		t.Fatalf("Got error parsing principals: %s", err)
+	}
+	var status, calls int
+	serveSTS(t, "arn:aws:sts::123456789012:assumed-role/uploader/ci-run", &status, &calls)
+
+	handler := withAuthentication(http.HandlerFunc(getAuth))
+	token := testIAMToken(t)
+	get := func(token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+		r.Header.Set(iamTokenHeader, token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	w := get(token)
+	var decision authDecision
+	json.NewDecoder(w.Body).Decode(&decision)
+	if w.Code != http.StatusOK || decision.Method != iamMethod || decision.Key != "ci" || decision.Principal != "arn:aws:sts::123456789012:assumed-role/uploader/ci-run" {
+		t.Fatalf("Incorrect auth decision: %d %+v", w.Code, decision)
+	}
+	// STS is only asked once per token
+	get(token)
+	if calls != 1 {
+		t.Errorf("STS called %d times for one token", calls)
+	}
+
+	// forgotten, so STS is asked again
+	iamCache.Lock()
+	iamCache.callers = nil
+	iamCache.Unlock()
+	status = http.StatusInternalServerError
+	if w := get(token); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Didn't get 503 with STS unavailable: %d", w.Code)
+	}
+	status = http.StatusForbidden
+	if w := get(token); w.Code != http.StatusUnauthorized {
+		t.Errorf("Didn't get 401 for a token STS refused: %d", w.Code)
+	}
+
+	// tokens that aren't GetCallerIdentity calls for this service are
+	// refused before STS is asked
+	calls = 0
+	raw, _ := base64.RawURLEncoding.DecodeString(token)
+	for name, change := range map[string]func(u *url.URL, q url.Values){
+		"another host":      func(u *url.URL, q url.Values) { u.Host = "attacker.example.com" },
+		"another action":    func(u *url.URL, q url.Values) { q.Set("Action", "GetSessionToken") },
+		"unsigned audience": func(u *url.URL, q url.Values) { q.Set("X-Amz-SignedHeaders", "host") },
+		"a long lifetime":   func(u *url.URL, q url.Values) { q.Set("X-Amz-Expires", "3600") },
+		"an expired date": func(u *url.URL, q url.Values) {
+			q.Set("X-Amz-Date", time.Now().Add(-time.Hour).UTC().Format("20060102T150405Z"))
+		},
+	} {
+		u, _ := url.Parse(string(raw))
+		q := u.Query()
+		change(u, q)
+		u.RawQuery = q.Encode()
+		if w := get(base64.RawURLEncoding.EncodeToString([]byte(u.String()))); w.Code != http.StatusUnauthorized {
+			t.Errorf("Didn't get 401 for a token with %s: %d", name, w.Code)
+		}
+	}
+	if calls != 0 {
+		t.Errorf("STS called for invalid tokens")
+	}
+
+	// signed by a role that isn't allowed
+	resetIAM()
+	parseIAMPrincipals("other=arn:aws:iam::123456789012:role/other")
+	status = 0
+	if w := get(token); w.Code != http.StatusUnauthorized {
+		t.Errorf("Didn't get 401 for a principal that isn't allowed: %d", w.Code)
+	}
+}
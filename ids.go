@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	idStrategyConditional = "conditional"
+	idStrategyPool        = "pool"
+	idStrategyTime        = "time"
+	idPoolBlockSize       = 1 << 16
+)
+
+// the table the pool strategy reserves its blocks of IDs in
+var idBlockTableName string
+
+// url-safe base64 alphabet in ASCII order, so encoded IDs sort like their bytes
+var sortableEncoding = base64.NewEncoding("-0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ_abcdefghijklmnopqrstuvwxyz").WithPadding(base64.NoPadding)
+
+// picks candidate IDs for new assets
+type idGenerator interface {
+	// returns a new ID, and whether it is unique by construction so that
+	// it can be stored without a conditional write
+	nextID(ctx context.Context) (id string, unique bool, err error)
+}
+
+// returns the generator for the named strategy
+func newIDGenerator(strategy string) (idGenerator, error) {
+	switch strategy {
+	case idStrategyConditional:
+		return conditionalIDGenerator{}, nil
+	case idStrategyPool:
+		if idBlockTableName == "" {
+			return nil, fmt.Errorf("the pool id strategy needs an id-block-table")
+		}
+		return &poolIDGenerator{}, nil
+	case idStrategyTime:
+		return timeIDGenerator{}, nil
+	}
+	return nil, fmt.Errorf("unknown id strategy '%s'", strategy)
+}
+
+// random IDs checked for collisions by a conditional write on every reservation
+type conditionalIDGenerator struct{}
+
+func (conditionalIDGenerator) nextID(context.Context) (string, bool, error) {
+	return secureToken(12), false, nil
+}
+
+// IDs handed out sequentially from blocks, where only the block itself is
+// reserved with a conditional write; each ends in random bytes so that
+// knowing one doesn't give away the rest of its block
+type poolIDGenerator struct {
+	mu     sync.Mutex
+	prefix []byte
+	next   uint32
+}
+
+func (g *poolIDGenerator) nextID(ctx context.Context) (string, bool, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.prefix == nil || g.next >= idPoolBlockSize {
+		prefix, err := reserveIDBlock(ctx)
+		if err != nil {
+			return "", false, err
+		}
+		g.prefix = prefix
+		g.next = 0
+	}
+	idBytes := make([]byte, 20)
+	copy(idBytes, g.prefix)
+	binary.BigEndian.PutUint32(idBytes[8:], g.next)
+	if _, err := cryptorand.Read(idBytes[12:]); err != nil {
+		return "", false, err
+	}
+	g.next++
+	return base64.RawURLEncoding.EncodeToString(idBytes), true, nil
+}
+
+// claims a random 8 byte prefix for a block of IDs in the id block table
+func reserveIDBlock(ctx context.Context) ([]byte, error) {
+	prefix := make([]byte, 8)
+	if _, err := cryptorand.Read(prefix); err != nil {
+		return nil, err
+	}
+	query := &dynamodb.PutItemInput{
+		Item: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(base64.RawURLEncoding.EncodeToString(prefix)),
+			},
+			"reserved_at": updatedAtValue(),
+		},
+		TableName:           aws.String(idBlockTableName),
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	}
+	_, err := dbSvc.PutItemWithContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return prefix, nil
+}
+
+// IDs that sort by creation time: a millisecond timestamp followed by
+// random bytes, which can still collide within a millisecond, so stored
+// with a conditional write
+type timeIDGenerator struct{}
+
+func (timeIDGenerator) nextID(context.Context) (string, bool, error) {
+	idBytes := make([]byte, 12)
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	binary.BigEndian.PutUint64(idBytes, ms<<16)
+	if _, err := cryptorand.Read(idBytes[6:]); err != nil {
+		return "", false, err
+	}
+	return sortableEncoding.EncodeToString(idBytes), false, nil
+}
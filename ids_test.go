@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestNewIDGenerator(t *testing.T) {
+	defer func() { idBlockTableName = "" }()
+	if _, err := newIDGenerator(idStrategyPool); err == nil {
+		t.Error("Got no error for the pool id strategy without an id block table")
+	}
+	idBlockTableName = "id-blocks"
+	for _, strategy := range []string{idStrategyConditional, idStrategyPool, idStrategyTime} {
+		if _, err := newIDGenerator(strategy); err != nil {
+			t.Errorf("Failed to create %s id generator: %s", strategy, err)
+		}
+	}
+	if _, err := newIDGenerator("foo"); err == nil {
+		t.Error("Got no error for an unknown id strategy")
+	}
+}
+
+// remembers the tables items are put in
+type mockDBPutTablesClient struct {
+	mockDBClient
+	tables []string
+}
+
+func (m *mockDBPutTablesClient) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	m.tables = append(m.tables, aws.StringValue(input.TableName))
+	return &dynamodb.PutItemOutput{}, nil
+}
+func (m *mockDBPutTablesClient) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	return m.PutItem(input)
+}
+
+func TestPoolIDGenerator(t *testing.T) {
+	defer func() { idBlockTableName = "" }()
+	idBlockTableName = "id-blocks"
+	db := &mockDBPutTablesClient{}
+	dbSvc = db
+	g := &poolIDGenerator{}
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		id, unique, err := g.nextID(context.Background())
+		if err != nil || !unique {
+			t.Fatal("Pool generator failed to hand out a unique id")
+		}
+		if seen[id] {
+			t.Errorf("Pool generator repeated id %s", id)
+		}
+		seen[id] = true
+	}
+	// blocks are kept out of the assets table
+	if len(db.tables) != 1 || db.tables[0] != "id-blocks" {
+		t.Errorf("Id block not reserved in its own table: %v", db.tables)
+	}
+	// the ids of a block can't be counted through
+	first, _, _ := g.nextID(context.Background())
+	second, _, _ := g.nextID(context.Background())
+	a, _ := base64.RawURLEncoding.DecodeString(first)
+	b, _ := base64.RawURLEncoding.DecodeString(second)
+	if len(a) != 20 || bytes.Equal(a[12:], b[12:]) {
+		t.Errorf("Pool ids don't end in random bytes: %s %s", first, second)
+	}
+
+	dbSvc = &mockDBErrorClient{}
+	g = &poolIDGenerator{}
+	if _, _, err := g.nextID(context.Background()); err == nil {
+		t.Error("Got no error reserving an id block with a bad DB client")
+	}
+}
+func TestTimeIDGeneratorOrdering(t *testing.T) {
+	g := timeIDGenerator{}
+	first, unique, _ := g.nextID(context.Background())
+	time.Sleep(2 * time.Millisecond)
+	second, _, _ := g.nextID(context.Background())
+	if first >= second {
+		t.Errorf("Time ordered ids out of order: %s >= %s", first, second)
+	}
+	// ids made in the same millisecond can collide
+	if unique {
+		t.Error("Time ids stored without a conditional write")
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+const (
+	jobStateRunning  = "running"
+	jobStateDone     = "done"
+	jobStateFailed   = "failed"
+	jobStateCanceled = "canceled"
+	// finished jobs stay queryable for this long
+	jobRetention = time.Hour
+	// a running job not saved for this many save intervals ran on an
+	// instance that stopped
+	jobStaleIntervals = 3
+)
+
+// the DynamoDB table, keyed on id with TTL on expires, keeping the status
+// of jobs so any instance can report and cancel them, also after the one
+// running them restarts; none to keep jobs in memory only
+var jobsTableName string
+
+// how often running jobs are saved to the jobs table, picking up
+// cancellations asked of other instances
+var jobSaveInterval = 5 * time.Second
+
+// returned by job functions that stopped because they were canceled
+var errJobCanceled = errors.New("job canceled")
+
+// the externally visible state of a job
+type jobStatus struct {
+	ID       string      `json:"id"`
+	Kind     string      `json:"kind"`
+	State    string      `json:"state"`
+	Total    int         `json:"total"`
+	Done     int         `json:"done"`
+	Result   interface{} `json:"result,omitempty"`
+	Error    string      `json:"error,omitempty"`
+	Started  time.Time   `json:"started"`
+	Finished *time.Time  `json:"finished,omitempty"`
+}
+
+// a long running operation tracked in the background
+type job struct {
+	mu     sync.Mutex
+	status jobStatus
+	cancel chan struct{}
+	// closed once the job has finished and saved its status
+	done chan struct{}
+	// canceled because the instance is shutting down
+	interrupted bool
+	// the jobs table the job is saved to, if any
+	table string
+	// held while saving, so an older status is never saved over a newer one
+	saving sync.Mutex
+}
+
+// the work done by a job, returning its result once finished; it should
+// report progress with advance and stop when canceled is closed
+type jobFunc func(j *job) (interface{}, error)
+
+var jobsMu sync.Mutex
+var jobs = map[string]*job{}
+
+// runs fn in the background as a job of the given kind, expected to
+// process total items
+func startJob(kind string, total int, fn jobFunc) *job {
+	j := &job{
+		status: jobStatus{
+			ID:      secureToken(12),
+			Kind:    kind,
+			State:   jobStateRunning,
+			Total:   total,
+			Started: time.Now().UTC(),
+		},
+		cancel: make(chan struct{}),
+		done:   make(chan struct{}),
+		table:  jobsTableName,
+	}
+
+	jobsMu.Lock()
+	for id, old := range jobs {
+		old.mu.Lock()
+		if old.status.Finished != nil && time.Since(*old.status.Finished) > jobRetention {
+			delete(jobs, id)
+		}
+		old.mu.Unlock()
+	}
+	jobs[j.status.ID] = j
+	jobsMu.Unlock()
+
+	j.save()
+	if j.table != "" {
+		go j.watch(jobSaveInterval)
+	}
+	go func() {
+		defer close(j.done)
+		result, err := fn(j)
+		finished := time.Now().UTC()
+		j.mu.Lock()
+		j.status.Result = result
+		j.status.Finished = &finished
+		switch {
+		case err == errJobCanceled:
+			j.status.State = jobStateCanceled
+			if j.interrupted {
+				j.status.Error = "stopped by shutdown"
+			}
+		case err != nil:
+			log.Printf("%s job %s failed: %s", kind, j.status.ID, err.Error())
+			j.status.State = jobStateFailed
+			j.status.Error = err.Error()
+		default:
+			j.status.State = jobStateDone
+		}
+		j.mu.Unlock()
+		j.save()
+	}()
+	return j
+}
+
+// saves a running job's progress every interval until it finishes
+func (j *job) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-j.done:
+			return
+		case <-ticker.C:
+			j.save()
+		}
+	}
+}
+
+// writes the job's status to the jobs table, stopping the job if it's been
+// canceled through another instance
+func (j *job) save() {
+	if j.table == "" {
+		return
+	}
+	j.saving.Lock()
+	defer j.saving.Unlock()
+	status := j.snapshot()
+	item, err := dynamodbattribute.MarshalMap(status)
+	if err != nil {
+		log.Printf("saving %s job %s: %s", status.Kind, status.ID, err.Error())
+		return
+	}
+	delete(item, "id")
+	now := time.Now()
+	item["instance"] = &dynamodb.AttributeValue{S: aws.String(instanceID)}
+	item["saved_at"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(now.UnixNano()/int64(time.Millisecond), 10))}
+	item["expires"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(now.Add(jobRetention).Unix(), 10))}
+	// attributes are set by placeholder, as some names are reserved words
+	var sets []string
+	names := map[string]*string{}
+	values := map[string]*dynamodb.AttributeValue{}
+	for name, value := range item {
+		placeholder := strconv.Itoa(len(sets))
+		sets = append(sets, "#a"+placeholder+" = :a"+placeholder)
+		names["#a"+placeholder] = aws.String(name)
+		values[":a"+placeholder] = value
+	}
+	result, err := dbSvc.UpdateItem(&dynamodb.UpdateItemInput{
+		Key:                       assetKey(status.ID),
+		TableName:                 aws.String(j.table),
+		UpdateExpression:          aws.String("SET " + strings.Join(sets, ", ")),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		ReturnValues:              aws.String(dynamodb.ReturnValueAllNew),
+	})
+	if err != nil {
+		log.Printf("saving %s job %s: %s", status.Kind, status.ID, err.Error())
+		return
+	}
+	if v, ok := result.Attributes["cancel_requested"]; ok && aws.BoolValue(v.BOOL) {
+		j.stop()
+	}
+}
+
+// records that another item has been processed
+func (j *job) advance() {
+	j.mu.Lock()
+	j.status.Done++
+	j.mu.Unlock()
+}
+
+// closed when the job is asked to stop
+func (j *job) canceled() <-chan struct{} {
+	return j.cancel
+}
+
+func (j *job) stop() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.status.State != jobStateRunning {
+		return
+	}
+	select {
+	case <-j.cancel:
+	default:
+		close(j.cancel)
+	}
+}
+
+// cancels every running job and waits for each to save where it got to, so
+// it's reported stopped rather than left running with the instance gone
+func drainJobs(ctx context.Context) error {
+	jobsMu.Lock()
+	running := []*job{}
+	for _, j := range jobs {
+		if j.snapshot().State == jobStateRunning {
+			running = append(running, j)
+		}
+	}
+	jobsMu.Unlock()
+	for _, j := range running {
+		j.mu.Lock()
+		j.interrupted = true
+		j.mu.Unlock()
+		j.stop()
+	}
+	for _, j := range running {
+		select {
+		case <-j.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func findJob(jobID string) (*job, bool) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	j, ok := jobs[jobID]
+	return j, ok
+}
+
+// a copy of the job's current status
+func (j *job) snapshot() jobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+// a job's status as saved in the jobs table; a running job that hasn't been
+// saved for a while is reported failed, its instance having stopped
+func storedJobStatus(item map[string]*dynamodb.AttributeValue) (jobStatus, error) {
+	var status jobStatus
+	if err := dynamodbattribute.UnmarshalMap(item, &status); err != nil {
+		return status, err
+	}
+	savedAt := time.Unix(0, numberAttribute(item, "saved_at")*int64(time.Millisecond))
+	if status.State == jobStateRunning && time.Since(savedAt) > jobStaleIntervals*jobSaveInterval {
+		status.State = jobStateFailed
+		status.Error = "instance running the job stopped"
+	}
+	return status, nil
+}
+
+// the status of a job run by any instance, from the jobs table
+func loadJob(ctx context.Context, jobID string) (jobStatus, bool, error) {
+	result, err := dbSvc.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		Key:            assetKey(jobID),
+		TableName:      aws.String(jobsTableName),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || len(result.Item) == 0 {
+		return jobStatus{}, false, err
+	}
+	status, err := storedJobStatus(result.Item)
+	return status, err == nil, err
+}
+
+// the jobs of every instance in the jobs table, of the given kind if any
+func scanJobs(ctx context.Context, kind string) ([]jobStatus, error) {
+	input := &dynamodb.ScanInput{TableName: aws.String(jobsTableName)}
+	if kind != "" {
+		input.FilterExpression = aws.String("#kind = :kind")
+		input.ExpressionAttributeNames = map[string]*string{"#kind": aws.String("kind")}
+		input.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{":kind": {S: aws.String(kind)}}
+	}
+	var list []jobStatus
+	var unmarshalErr error
+	err := dbSvc.ScanPagesWithContext(ctx, input, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			var status jobStatus
+			if status, unmarshalErr = storedJobStatus(item); unmarshalErr != nil {
+				return false
+			}
+			list = append(list, status)
+		}
+		return true
+	})
+	if err == nil {
+		err = unmarshalErr
+	}
+	return list, err
+}
+
+// asks whichever instance runs a job to cancel it, at its next save
+func requestJobCancel(ctx context.Context, jobID string) error {
+	_, err := dbSvc.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		Key:                      assetKey(jobID),
+		TableName:                aws.String(jobsTableName),
+		UpdateExpression:         aws.String("SET cancel_requested = :true"),
+		ConditionExpression:      aws.String("#state = :running"),
+		ExpressionAttributeNames: map[string]*string{"#state": aws.String("state")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":true":    {BOOL: aws.Bool(true)},
+			":running": {S: aws.String(jobStateRunning)},
+		},
+	})
+	// already finished, or not found
+	if isConditionFailed(err) {
+		return nil
+	}
+	return err
+}
+
+// marks a response as having started a job
+func acceptJob(w http.ResponseWriter, j *job) {
+	w.Header().Set("Location", basePath+"/jobs/"+j.status.ID)
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, j.snapshot())
+}
+
+// lists jobs, newest first, optionally filtered by kind
+func listJobs(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	kind := r.URL.Query().Get("kind")
+	byID := map[string]jobStatus{}
+	if jobsTableName != "" {
+		stored, err := scanJobs(r.Context(), kind)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		for _, status := range stored {
+			byID[status.ID] = status
+		}
+	}
+	// this instance's own jobs are the most up to date
+	jobsMu.Lock()
+	for _, j := range jobs {
+		if status := j.snapshot(); kind == "" || status.Kind == kind {
+			byID[status.ID] = status
+		}
+	}
+	jobsMu.Unlock()
+	list := []jobStatus{}
+	for _, status := range byID {
+		list = append(list, status)
+	}
+	sort.Slice(list, func(a, b int) bool { return list[a].Started.After(list[b].Started) })
+	writeJSON(w, list)
+}
+
+// reports the status of, or cancels, a job
+func manageJob(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet, http.MethodDelete) {
+		return
+	}
+	jobID := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	if j, ok := findJob(jobID); ok {
+		if r.Method == http.MethodDelete {
+			j.stop()
+		}
+		writeJSON(w, j.snapshot())
+		return
+	}
+	// run by another instance, or before a restart
+	if jobsTableName == "" {
+		http.Error(w, fmt.Sprintf("Job '%s' not found.", jobID), http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		if err := requestJobCancel(r.Context(), jobID); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	status, found, err := loadJob(r.Context(), jobID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !found {
+		http.Error(w, fmt.Sprintf("Job '%s' not found.", jobID), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, status)
+}
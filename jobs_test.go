@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// polls a job through the jobs endpoint until it stops running
+func waitForJob(t *testing.T, jobID string) jobStatus {
+	j := jobStatus{}
+	for i := 0; i < 100; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/jobs/"+jobID, nil)
+		w := httptest.NewRecorder()
+		manageJob(w, r)
+		if w.Result().StatusCode != http.StatusOK {
+			t.Fatalf("Incorrect status fetching job: %d", w.Result().StatusCode)
+		}
+		json.NewDecoder(w.Result().Body).Decode(&j)
+		if j.State != jobStateRunning {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return j
+}
+
+func TestJobFailure(t *testing.T) {
+	started := startJob("test", 1, func(j *job) (interface{}, error) {
+		return nil, errors.New("foo")
+	})
+	j := waitForJob(t, started.status.ID)
+	if j.State != jobStateFailed || j.Error != "foo" {
+		t.Errorf("Job did not fail: %s %s", j.State, j.Error)
+	}
+}
+func TestJobCancel(t *testing.T) {
+	started := startJob("test", 1, func(j *job) (interface{}, error) {
+		<-j.canceled()
+		return nil, errJobCanceled
+	})
+	r := httptest.NewRequest(http.MethodDelete, "/jobs/"+started.status.ID, nil)
+	w := httptest.NewRecorder()
+	manageJob(w, r)
+
+	j := waitForJob(t, started.status.ID)
+	if j.State != jobStateCanceled {
+		t.Errorf("Job was not canceled: %s", j.State)
+	}
+}
+func TestJobNotFound(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/jobs/nonexistant", nil)
+	w := httptest.NewRecorder()
+	manageJob(w, r)
+	if w.Result().StatusCode != http.StatusNotFound {
+		t.Errorf("Didn't get 404 for a missing job: %d", w.Result().StatusCode)
+	}
+}
+func TestListJobs(t *testing.T) {
+	startJob("listed", 0, func(j *job) (interface{}, error) { return nil, nil })
+	r := httptest.NewRequest(http.MethodGet, "/jobs?kind=listed", nil)
+	w := httptest.NewRecorder()
+	listJobs(w, r)
+
+	list := []jobStatus{}
+	json.NewDecoder(w.Result().Body).Decode(&list)
+	if len(list) != 1 || list[0].Kind != "listed" {
+		t.Errorf("Unexpected jobs listed: %v", list)
+	}
+}
+
+// a jobs table, shared by every instance
+type mockDBJobsClient struct {
+	mockDBClient
+	mu    sync.Mutex
+	items map[string]map[string]*dynamodb.AttributeValue
+}
+
+func (m *mockDBJobsClient) copy(item map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	if item == nil {
+		return nil
+	}
+	copied := map[string]*dynamodb.AttributeValue{}
+	for name, value := range item {
+		copied[name] = value
+	}
+	return copied
+}
+
+func (m *mockDBJobsClient) set(jobID, name string, value *dynamodb.AttributeValue) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.items[jobID][name] = value
+}
+
+func (m *mockDBJobsClient) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	jobID := stringAttribute(input.Key, "id")
+	item, ok := m.items[jobID]
+	if !ok {
+		item = map[string]*dynamodb.AttributeValue{"id": input.Key["id"]}
+	}
+	values := input.ExpressionAttributeValues
+	if _, canceling := values[":true"]; canceling {
+		if stringAttribute(item, "state") != jobStateRunning {
+			return nil, &dynamodb.ConditionalCheckFailedException{Message_: aws.String("The conditional request failed")}
+		}
+		item["cancel_requested"] = values[":true"]
+		return &dynamodb.UpdateItemOutput{}, nil
+	}
+	for placeholder, name := range input.ExpressionAttributeNames {
+		item[aws.StringValue(name)] = values[":"+strings.TrimPrefix(placeholder, "#")]
+	}
+	m.items[jobID] = item
+	return &dynamodb.UpdateItemOutput{Attributes: m.copy(item)}, nil
+}
+func (m *mockDBJobsClient) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	return m.UpdateItem(input)
+}
+
+func (m *mockDBJobsClient) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return &dynamodb.GetItemOutput{Item: m.copy(m.items[stringAttribute(input.Key, "id")])}, nil
+}
+func (m *mockDBJobsClient) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return m.GetItem(input)
+}
+
+func (m *mockDBJobsClient) ScanPages(input *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	page := &dynamodb.ScanOutput{}
+	for _, item := range m.items {
+		if input.FilterExpression == nil || stringAttribute(item, "kind") == stringAttribute(input.ExpressionAttributeValues, ":kind") {
+			page.Items = append(page.Items, m.copy(item))
+		}
+	}
+	fn(page, true)
+	return nil
+}
+func (m *mockDBJobsClient) ScanPagesWithContext(ctx aws.Context, input *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool, opts ...request.Option) error {
+	return m.ScanPages(input, fn)
+}
+
+// takes a job out of this instance, as if another one ran it
+func forgetJob(jobID string) {
+	jobsMu.Lock()
+	delete(jobs, jobID)
+	jobsMu.Unlock()
+}
+
+func TestJobsTable(t *testing.T) {
+	db := &mockDBJobsClient{items: map[string]map[string]*dynamodb.AttributeValue{}}
+	dbSvc = db
+	jobsTableName, jobSaveInterval = "jobs", 10*time.Millisecond
+	defer func() { jobsTableName, jobSaveInterval = "", 5*time.Second }()
+	started := startJob("shared", 2, func(j *job) (interface{}, error) {
+		j.advance()
+		<-j.canceled()
+		return nil, errJobCanceled
+	})
+	forgetJob(started.status.ID)
+
+	// another instance reports and cancels it through the table
+	r := httptest.NewRequest(http.MethodGet, "/jobs/"+started.status.ID, nil)
+	w := httptest.NewRecorder()
+	manageJob(w, r)
+	var status jobStatus
+	json.NewDecoder(w.Body).Decode(&status)
+	if w.Code != http.StatusOK || status.State != jobStateRunning || status.Kind != "shared" {
+		t.Fatalf("Incorrect status of a job on another instance: %d %+v", w.Code, status)
+	}
+	manageJob(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, "/jobs/"+started.status.ID, nil))
+	select {
+	case <-started.done:
+	case <-time.After(time.Second):
+		t.Fatal("Job not canceled through the table")
+	}
+	if status = waitForJob(t, started.status.ID); status.State != jobStateCanceled || status.Done != 1 {
+		t.Errorf("Canceled job not saved: %+v", status)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/jobs?kind=shared", nil)
+	w = httptest.NewRecorder()
+	listJobs(w, r)
+	list := []jobStatus{}
+	json.NewDecoder(w.Body).Decode(&list)
+	if len(list) != 1 || list[0].ID != started.status.ID {
+		t.Errorf("Job on another instance not listed: %+v", list)
+	}
+
+	// the instance running it stopped without saving where it got to
+	db.set(started.status.ID, "state", &dynamodb.AttributeValue{S: aws.String(jobStateRunning)})
+	db.set(started.status.ID, "saved_at", &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(time.Now().Add(-time.Minute).UnixNano()/int64(time.Millisecond), 10))})
+	if status = waitForJob(t, started.status.ID); status.State != jobStateFailed {
+		t.Errorf("Job of a stopped instance not failed: %+v", status)
+	}
+}
+
+func TestDrainJobs(t *testing.T) {
+	db := &mockDBJobsClient{items: map[string]map[string]*dynamodb.AttributeValue{}}
+	dbSvc = db
+	jobsTableName = "jobs"
+	defer func() { jobsTableName = "" }()
+	started := startJob("draining", 1, func(j *job) (interface{}, error) {
+		<-j.canceled()
+		return nil, errJobCanceled
+	})
+	if err := drainJobs(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	forgetJob(started.status.ID)
+	if status := waitForJob(t, started.status.ID); status.State != jobStateCanceled || status.Error != "stopped by shutdown" {
+		t.Errorf("Job not stopped and saved on shutdown: %+v", status)
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// how long keys fetched from the JWKS url are used before fetching them
+	// again, and how soon an unknown key ID can prompt an early fetch
+	jwksRefresh    = time.Hour
+	jwksMinRefetch = time.Minute
+	// how long requests needing a fresh key wait on the provider
+	jwksFetchTimeout   = 5 * time.Second
+	maxJWKSBody        = 1 << 20
+	tokenJWT           = "jwt"
+	bearerPrefix       = "Bearer "
+	maxBearerTokenSize = 8192
+)
+
+// where the identity provider publishes its signing keys, empty to not
+// accept bearer tokens
+var jwksURL string
+
+// the iss and aud bearer tokens must carry, unchecked if empty
+var jwtIssuer, jwtAudience string
+
+var jwksClient = &http.Client{Timeout: jwksFetchTimeout}
+
+// signing keys couldn't be fetched, so tokens can't be checked at all
+var errJWKSUnavailable = errors.New("signing keys are unavailable")
+
+var jwksCache struct {
+	sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// fetches of the JWKS in flight, made outside jwksCache's lock
+var jwksFetches singleflight.Group
+
+// hashes and key types by the alg a token is signed with
+var jwtAlgorithms = map[string]struct {
+	hash crypto.Hash
+	kty  string
+}{
+	"RS256": {crypto.SHA256, "RSA"},
+	"RS384": {crypto.SHA384, "RSA"},
+	"RS512": {crypto.SHA512, "RSA"},
+	"ES256": {crypto.SHA256, "EC"},
+	"ES384": {crypto.SHA384, "EC"},
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Issuer    string          `json:"iss"`
+	Subject   string          `json:"sub"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *int64          `json:"exp"`
+	NotBefore *int64          `json:"nbf"`
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func jwtEnabled() bool {
+	return jwksURL != ""
+}
+
+// the bearer token a request carries, if any
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) < len(bearerPrefix) || !strings.EqualFold(header[:len(bearerPrefix)], bearerPrefix) {
+		return ""
+	}
+	return strings.TrimSpace(header[len(bearerPrefix):])
+}
+
+// the subject of the bearer token a request was made with, or the end user
+// it was made on behalf of, empty if neither
+func requestSubject(r *http.Request) string {
+	decision := requestAuth(r)
+	if decision.OnBehalfOf != "" {
+		return decision.OnBehalfOf
+	}
+	return decision.Subject
+}
+
+// the owner an asset created or changed by a request gets: the subject of
+// its bearer token, which an owner asked for must match, or else the owner
+// asked for
+func requestOwner(r *http.Request, owner string) (string, error) {
+	subject := requestSubject(r)
+	if subject == "" {
+		return owner, nil
+	}
+	if owner != "" && owner != subject {
+		return "", fmt.Errorf("owner must be the bearer token's subject")
+	}
+	return subject, nil
+}
+
+// checks a bearer token's signature and claims, returning the decision to
+// let its request through as its subject
+func validateJWT(token string, now time.Time) (authDecision, error) {
+	if len(token) > maxBearerTokenSize {
+		return authDecision{}, fmt.Errorf("token is too long")
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return authDecision{}, fmt.Errorf("token is malformed")
+	}
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return authDecision{}, err
+	}
+	algorithm, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return authDecision{}, fmt.Errorf("token alg '%s' isn't accepted", header.Alg)
+	}
+	key, err := jwksKey(header.Kid)
+	if err != nil {
+		return authDecision{}, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return authDecision{}, fmt.Errorf("token signature is malformed")
+	}
+	h := algorithm.hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	if !verifyJWTSignature(key, algorithm.kty, algorithm.hash, h.Sum(nil), signature) {
+		return authDecision{}, fmt.Errorf("token signature is invalid")
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return authDecision{}, err
+	}
+	if jwtIssuer != "" && claims.Issuer != jwtIssuer {
+		return authDecision{}, fmt.Errorf("token isn't from the expected issuer")
+	}
+	if jwtAudience != "" && !hasAudience(claims.Audience, jwtAudience) {
+		return authDecision{}, fmt.Errorf("token isn't for the expected audience")
+	}
+	if claims.ExpiresAt == nil || !checkTokenExpiry(tokenJWT, *claims.ExpiresAt, now) {
+		return authDecision{}, fmt.Errorf("token has expired")
+	}
+	if claims.NotBefore != nil && *claims.NotBefore > now.Add(clockSkew).Unix() {
+		return authDecision{}, fmt.Errorf("token isn't valid yet")
+	}
+	if err := validateSearchAttribute("subject", claims.Subject); err != nil {
+		return authDecision{}, fmt.Errorf("token %s", err.Error())
+	}
+	decision := authDecision{Method: bearerMethod, Subject: claims.Subject}
+	if err := mapClaims(parts[1], &decision); err != nil {
+		return authDecision{}, err
+	}
+	return decision, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("token is malformed")
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("token is malformed")
+	}
+	return nil
+}
+
+// aud is either one audience or a list of them
+func hasAudience(raw json.RawMessage, audience string) bool {
+	var one string
+	if json.Unmarshal(raw, &one) == nil {
+		return one == audience
+	}
+	var many []string
+	if json.Unmarshal(raw, &many) == nil {
+		for _, a := range many {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func verifyJWTSignature(key crypto.PublicKey, kty string, hash crypto.Hash, digest, signature []byte) bool {
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		return kty == "RSA" && rsa.VerifyPKCS1v15(pub, hash, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		// r and s, each as long as the curve's order
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if kty != "EC" || len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(pub, digest, r, s)
+	}
+	return false
+}
+
+// the signing key with an ID, fetching the JWKS again when the keys are
+// stale or, at most once a minute, when the ID isn't among them
+func jwksKey(kid string) (crypto.PublicKey, error) {
+	jwksCache.Lock()
+	key, ok := jwksCache.keys[kid]
+	fetched := jwksCache.fetched
+	jwksCache.Unlock()
+	stale := time.Since(fetched) > jwksRefresh
+	if ok && !stale {
+		return key, nil
+	}
+	if stale || time.Since(fetched) > jwksMinRefetch {
+		// requests arriving meanwhile wait on the same fetch, while those
+		// for keys already cached carry on
+		keys, err, _ := jwksFetches.Do(jwksURL, func() (interface{}, error) {
+			keys, err := fetchJWKS()
+			if err != nil {
+				return nil, err
+			}
+			jwksCache.Lock()
+			jwksCache.keys, jwksCache.fetched = keys, time.Now()
+			jwksCache.Unlock()
+			return keys, nil
+		})
+		if err != nil {
+			if ok {
+				// keep using what was fetched until the provider is back
+				return key, nil
+			}
+			return nil, errJWKSUnavailable
+		}
+		if key, ok = keys.(map[string]crypto.PublicKey)[kid]; ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("token key '%s' is unknown", kid)
+}
+
+// fetches the signing keys published at the JWKS url by ID
+func fetchJWKS() (map[string]crypto.PublicKey, error) {
+	resp, err := jwksClient.Get(jwksURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", jwksURL, resp.Status)
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(nil, resp.Body, maxJWKSBody)).Decode(&set); err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key, err := parseJWK(jwk); err == nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+func parseJWK(jwk jsonWebKey) (crypto.PublicKey, error) {
+	decode := func(s string) *big.Int {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil
+		}
+		return new(big.Int).SetBytes(b)
+	}
+	switch jwk.Kty {
+	case "RSA":
+		n, e := decode(jwk.N), decode(jwk.E)
+		if n == nil || e == nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve")
+		}
+		x, y := decode(jwk.X), decode(jwk.Y)
+		if x == nil || y == nil || !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("invalid EC key")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type")
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+var (
+	testRSAKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	testECKey, _  = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+)
+
+// serves a JWKS with the test RSA key as "rsa" and EC key as "ec", counting
+// fetches
+func serveJWKS(t *testing.T, fetches *int) *httptest.Server {
+	encode := func(i *big.Int) string {
+		return base64.RawURLEncoding.EncodeToString(i.Bytes())
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*fetches++
+		json.NewEncoder(w).Encode(map[string][]jsonWebKey{"keys": {
+			{Kid: "rsa", Kty: "RSA", Use: "sig", N: encode(testRSAKey.N), E: encode(big.NewInt(int64(testRSAKey.E)))},
+			{Kid: "ec", Kty: "EC", Crv: "P-256", X: encode(testECKey.X), Y: encode(testECKey.Y)},
+			{Kid: "enc", Kty: "RSA", Use: "enc", N: encode(testRSAKey.N), E: "AQAB"},
+		}})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// signs claims with the test key for the alg
+func signJWT(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(jwtHeader{Alg: alg, Kid: kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := jwtAlgorithms[alg].hash.New()
+	digest.Write([]byte(signed))
+	var signature []byte
+	if jwtAlgorithms[alg].kty == "RSA" {
+		signature, _ = rsa.SignPKCS1v15(rand.Reader, testRSAKey, jwtAlgorithms[alg].hash, digest.Sum(nil))
+	} else {
+		r, s, err := ecdsa.Sign(rand.Reader, testECKey, digest.Sum(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func resetJWT() {
+	jwksURL, jwtIssuer, jwtAudience = "", "", ""
+	jwksCache.Lock()
+	jwksCache.keys = map[string]crypto.PublicKey{}
+	jwksCache.fetched = time.Time{}
+	jwksCache.Unlock()
+}
+
+func TestValidateJWT(t *testing.T) {
+	defer resetJWT()
+	var fetches int
+	jwksURL = serveJWKS(t, &fetches).URL
+	jwtIssuer, jwtAudience = "https://idp.example.com/", "asset-uploader"
+	now := time.Now()
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss": jwtIssuer,
+			"aud": []string{"other", jwtAudience},
+			"sub": "auth0|user-1",
+			"exp": now.Add(time.Hour).Unix(),
+			"nbf": now.Add(-time.Minute).Unix(),
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	for _, alg := range []string{"RS256", "RS512", "ES256"} {
+		kid := "rsa"
+		if alg == "ES256" {
+			kid = "ec"
+		}
+		decision, err := validateJWT(signJWT(t, alg, kid, claims(nil)), now)
+		if err != nil || decision.Subject != "auth0|user-1" || decision.Method != bearerMethod {
+			t.Errorf("Valid %s token refused: %+v, %v", alg, decision, err)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("Incorrect JWKS fetches for known keys: %d", fetches)
+	}
+
+	for name, token := range map[string]string{
+		"malformed":       "abc.def",
+		"wrong issuer":    signJWT(t, "RS256", "rsa", claims(map[string]interface{}{"iss": "https://other.example.com/"})),
+		"wrong audience":  signJWT(t, "RS256", "rsa", claims(map[string]interface{}{"aud": "other"})),
+		"expired":         signJWT(t, "RS256", "rsa", claims(map[string]interface{}{"exp": now.Add(-time.Minute).Unix()})),
+		"no expiry":       signJWT(t, "RS256", "rsa", claims(map[string]interface{}{"exp": nil})),
+		"not yet valid":   signJWT(t, "RS256", "rsa", claims(map[string]interface{}{"nbf": now.Add(time.Minute).Unix()})),
+		"no subject":      signJWT(t, "RS256", "rsa", claims(map[string]interface{}{"sub": nil})),
+		"encryption key":  signJWT(t, "RS256", "enc", claims(nil)),
+		"wrong key type":  signJWT(t, "RS256", "ec", claims(nil)),
+		"unknown key":     signJWT(t, "RS256", "other", claims(nil)),
+		"unsigned":        "eyJhbGciOiJub25lIn0.e30.",
+		"tampered claims": tamperJWT(signJWT(t, "RS256", "rsa", claims(nil))),
+	} {
+		if _, err := validateJWT(token, now); err == nil {
+			t.Errorf("Got no error for %s token", name)
+		}
+	}
+	// unknown keys only prompt a fetch a minute after the last
+	if fetches != 1 {
+		t.Errorf("JWKS fetched again within a minute: %d fetches", fetches)
+	}
+	jwksCache.Lock()
+	jwksCache.fetched = now.Add(-2 * jwksMinRefetch)
+	jwksCache.Unlock()
+	validateJWT(signJWT(t, "RS256", "other", claims(nil)), now)
+	if fetches != 2 {
+		t.Errorf("JWKS not fetched again for an unknown key: %d fetches", fetches)
+	}
+}
+
+func TestJWKSFetchOutsideLock(t *testing.T) {
+	defer resetJWT()
+	var fetches int32
+	arrived, release := make(chan struct{}, 1), make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		select {
+		case arrived <- struct{}{}:
+		default:
+		}
+		<-release
+		json.NewEncoder(w).Encode(map[string][]jsonWebKey{"keys": {}})
+	}))
+	defer server.Close()
+	jwksURL = server.URL
+	jwksCache.Lock()
+	jwksCache.keys = map[string]crypto.PublicKey{"rsa": &testRSAKey.PublicKey}
+	jwksCache.fetched = time.Now().Add(-2 * jwksMinRefetch)
+	jwksCache.Unlock()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			jwksKey("other")
+		}()
+	}
+	<-arrived
+	// a known key is served while the fetch hangs
+	done := make(chan error, 1)
+	go func() {
+		_, err := jwksKey("rsa")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Known key refused during a fetch: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Known key held up by a JWKS fetch")
+	}
+	// give the others time to join the fetch
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("Concurrent unknown keys fetched the JWKS %d times", n)
+	}
+}
+
+// swaps the subject of a signed token for another
+func tamperJWT(token string) string {
+	parts := strings.Split(token, ".")
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	var claims map[string]interface{}
+	json.Unmarshal(payload, &claims)
+	claims["sub"] = "admin"
+	payload, _ = json.Marshal(claims)
+	return parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+}
+
+func TestWithAuthenticationBearer(t *testing.T) {
+	defer resetJWT()
+	defer resetAPIKeys()
+	var fetches int
+	jwksURL = serveJWKS(t, &fetches).URL
+	parseAPIKeys("web=abc")
+	var subject, name string
+	handler := withAuthentication(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subject, name = requestSubject(r), requestAPIKeyName(r)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	valid := signJWT(t, "ES256", "ec", map[string]interface{}{"sub": "user-1", "exp": time.Now().Add(time.Hour).Unix()})
+	for _, test := range []struct {
+		authorization, key, subject, name string
+		status                            int
+	}{
+		{"Bearer " + valid, "", "user-1", "", http.StatusNoContent},
+		{"bearer " + valid, "", "user-1", "", http.StatusNoContent},
+		{"", "abc", "", "web", http.StatusNoContent},
+		{"Bearer abc", "", "", "", http.StatusUnauthorized},
+		{"Basic abc", "", "", "", http.StatusUnauthorized},
+		{"", "", "", "", http.StatusUnauthorized},
+	} {
+		subject, name = "", ""
+		r := httptest.NewRequest(http.MethodGet, "/assets", nil)
+		if test.authorization != "" {
+			r.Header.Set("Authorization", test.authorization)
+		}
+		if test.key != "" {
+			r.Header.Set(apiKeyHeader, test.key)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Result().StatusCode != test.status || subject != test.subject || name != test.name {
+			t.Errorf("Incorrect response to %q with key %q: %d as %q/%q", test.authorization, test.key, w.Result().StatusCode, subject, name)
+		}
+	}
+}
+
+func TestOwnerFromSubject(t *testing.T) {
+	db := &mockDBPutRecordingClient{}
+	dbSvc, s3Svc = db, &mockS3Client{}
+	withSubject := func(r *http.Request) *http.Request {
+		return r.WithContext(context.WithValue(r.Context(), authContextKey{}, authDecision{Method: bearerMethod, Subject: "user-1"}))
+	}
+
+	for query, status := range map[string]int{
+		"":              http.StatusOK,
+		"?owner=user-1": http.StatusOK,
+		"?owner=other":  http.StatusForbidden,
+	} {
+		db.item = nil
+		w := httptest.NewRecorder()
+		initAsset(w, withSubject(httptest.NewRequest(http.MethodPost, "/asset"+query, nil)))
+		if w.Result().StatusCode != status {
+			t.Errorf("Incorrect status on init %q with a subject: %d", query, w.Result().StatusCode)
+		}
+		if status == http.StatusOK && stringAttribute(db.item, "owner") != "user-1" {
+			t.Errorf("Asset inited %q not owned by the subject: %v", query, db.item)
+		}
+	}
+
+	dbSvc = &mockDBClient{}
+	for body, status := range map[string]int{
+		`{"owner": "user-1"}`: http.StatusNoContent,
+		`{"owner": "other"}`:  http.StatusForbidden,
+		`{"owner": ""}`:       http.StatusForbidden,
+	} {
+		w := httptest.NewRecorder()
+		manageAsset(w, withSubject(httptest.NewRequest(http.MethodPatch, "/asset/someID", strings.NewReader(body))))
+		if w.Result().StatusCode != status {
+			t.Errorf("Incorrect status patching %s with a subject: %d", body, w.Result().StatusCode)
+		}
+	}
+}
+
+// an asset owned by someone else, whose updates check the owner condition
+type mockDBOwnedClient struct {
+	mockDBClient
+}
+
+func (m *mockDBOwnedClient) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	if strings.Contains(aws.StringValue(input.ConditionExpression), "owner = :currentSubject") &&
+		stringAttribute(input.ExpressionAttributeValues, ":currentSubject") != "other" {
+		item := map[string]*dynamodb.AttributeValue{"id": {S: aws.String("someID")}, "owner": {S: aws.String("other")}}
+		return nil, &dynamodb.ConditionalCheckFailedException{Message_: aws.String("The conditional request failed"), Item: item}
+	}
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+func (m *mockDBOwnedClient) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	return m.UpdateItem(input)
+}
+
+func TestPatchOwnerTakeover(t *testing.T) {
+	dbSvc, s3Svc = &mockDBOwnedClient{}, &mockS3Client{}
+	r := httptest.NewRequest(http.MethodPatch, "/asset/someID", strings.NewReader(`{"owner": "user-1"}`))
+	r = r.WithContext(context.WithValue(r.Context(), authContextKey{}, authDecision{Method: bearerMethod, Subject: "user-1"}))
+	w := httptest.NewRecorder()
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusForbidden {
+		t.Errorf("Didn't get 403 taking over someone else's asset: %d", w.Result().StatusCode)
+	}
+
+	// its owner can still set it
+	r = httptest.NewRequest(http.MethodPatch, "/asset/someID", strings.NewReader(`{"owner": "other"}`))
+	r = r.WithContext(context.WithValue(r.Context(), authContextKey{}, authDecision{Method: bearerMethod, Subject: "other"}))
+	w = httptest.NewRecorder()
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusNoContent {
+		t.Errorf("Owner couldn't patch their own asset: %d", w.Result().StatusCode)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// the DynamoDB index on key_prefix and id
+var keyPrefixIndexName string
+
+// checks a folder for an asset's object and returns the key prefix it
+// makes, such as invoices/2024/
+func normalizeKeyPrefix(value string) (string, error) {
+	if strings.Trim(value, "/") == "" {
+		return "", fmt.Errorf("folder can't be empty")
+	}
+	folder, err := normalizePath(value)
+	if err != nil {
+		return "", fmt.Errorf("%s", strings.Replace(err.Error(), "path", "folder", 1))
+	}
+	return strings.TrimPrefix(folder, "/") + "/", nil
+}
+
+// the key of an asset's object in the bucket, its ID under the folder it was
+// initialized in, if any
+func objectKey(assetID string, item map[string]*dynamodb.AttributeValue) string {
+	return stringAttribute(item, "key_prefix") + assetID
+}
+
+// fetches the record of an asset to find its object's key
+func lookupObjectKey(ctx context.Context, assetID string) (string, error) {
+	result, err := dbSvc.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		Key:                  assetKey(assetID),
+		TableName:            aws.String(tableName),
+		ConsistentRead:       aws.Bool(true),
+		ProjectionExpression: aws.String("key_prefix"),
+	})
+	if err != nil {
+		return "", err
+	}
+	return objectKey(assetID, result.Item), nil
+}
+
+// lists the assets initialized in a folder, in ID order, a page at a time
+func listAssetsInFolder(ctx context.Context, w http.ResponseWriter, prefix string, limit int, after assetsCursor) {
+	query := &dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		IndexName:              aws.String(keyPrefixIndexName),
+		KeyConditionExpression: aws.String("key_prefix = :prefix"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":prefix": {S: aws.String(prefix)},
+		},
+		Limit: aws.Int64(int64(limit)),
+	}
+	if after.ID != "" {
+		query.ExclusiveStartKey = assetKey(after.ID)
+		query.ExclusiveStartKey["key_prefix"] = &dynamodb.AttributeValue{S: aws.String(prefix)}
+	}
+	result, err := dbSvc.QueryWithContext(ctx, query)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	response := assetsResponse{Assets: []assetMeta{}}
+	for _, item := range result.Items {
+		if !isDeleted(item) {
+			response.Assets = append(response.Assets, describeAsset(item))
+		}
+	}
+	if last := stringAttribute(result.LastEvaluatedKey, "id"); last != "" {
+		response.Cursor = encodeAssetsCursor(assetsCursor{ID: last})
+	}
+	writeJSON(w, response)
+}
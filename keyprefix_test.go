@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// remembers the key of the last object presigned for upload
+type mockS3PresignKeyClient struct {
+	mockS3Client
+	key string
+}
+
+func (m *mockS3PresignKeyClient) PutObjectRequest(input *s3.PutObjectInput) (*request.Request, *s3.PutObjectOutput) {
+	m.key = aws.StringValue(input.Key)
+	return m.mockS3Client.PutObjectRequest(input)
+}
+
+// a folder holding one live and one deleted asset
+type mockDBFolderClient struct {
+	mockDBClient
+	query *dynamodb.QueryInput
+}
+
+func (m *mockDBFolderClient) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	m.query = input
+	return &dynamodb.QueryOutput{
+		Items: []map[string]*dynamodb.AttributeValue{
+			{
+				"id":         {S: aws.String("someID")},
+				"key_prefix": {S: aws.String("invoices/2024/")},
+				"status":     {S: aws.String(assetStatusUploaded)},
+			},
+			{
+				"id":         {S: aws.String("otherID")},
+				"key_prefix": {S: aws.String("invoices/2024/")},
+				"status":     {S: aws.String(assetStatusDeleted)},
+			},
+		},
+		LastEvaluatedKey: map[string]*dynamodb.AttributeValue{
+			"id":         {S: aws.String("otherID")},
+			"key_prefix": {S: aws.String("invoices/2024/")},
+		},
+	}, nil
+}
+func (m *mockDBFolderClient) QueryWithContext(ctx aws.Context, input *dynamodb.QueryInput, opts ...request.Option) (*dynamodb.QueryOutput, error) {
+	return m.Query(input)
+}
+
+func TestNormalizeKeyPrefix(t *testing.T) {
+	cases := map[string]string{
+		"invoices/2024":   "invoices/2024/",
+		"/invoices/2024/": "invoices/2024/",
+		"a//./b":          "a/b/",
+	}
+	for value, expected := range cases {
+		if actual, err := normalizeKeyPrefix(value); err != nil || actual != expected {
+			t.Errorf("Got %s, %v normalizing folder %s, expected %s", actual, err, value, expected)
+		}
+	}
+	for _, value := range []string{"", "/", "a/../b", "a\\b"} {
+		if _, err := normalizeKeyPrefix(value); err == nil {
+			t.Errorf("Got no error for folder %q", value)
+		}
+	}
+}
+
+func TestObjectKey(t *testing.T) {
+	if key := objectKey("someID", nil); key != "someID" {
+		t.Errorf("Incorrect key for an asset without a folder: %s", key)
+	}
+	item := map[string]*dynamodb.AttributeValue{"key_prefix": {S: aws.String("invoices/2024/")}}
+	if key := objectKey("someID", item); key != "invoices/2024/someID" {
+		t.Errorf("Incorrect key for an asset in a folder: %s", key)
+	}
+}
+
+func TestInitAssetFolder(t *testing.T) {
+	db := &mockDBPutRecordingClient{}
+	store := &mockS3PresignKeyClient{}
+	dbSvc, s3Svc = db, store
+	r := httptest.NewRequest(http.MethodPost, "/asset?folder=invoices/2024", nil)
+	w := httptest.NewRecorder()
+
+	initAsset(w, r)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Incorrect status on asset init with a folder: %d", w.Result().StatusCode)
+	}
+	if stringAttribute(db.item, "key_prefix") != "invoices/2024/" {
+		t.Errorf("Folder not recorded on asset: %v", db.item)
+	}
+	if expected := "invoices/2024/" + stringAttribute(db.item, "id"); store.key != expected {
+		t.Errorf("Upload presigned for key %s, expected %s", store.key, expected)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/asset?folder=a/../b", nil)
+	w = httptest.NewRecorder()
+	initAsset(w, r)
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("Didn't get 400 for a folder climbing out of the bucket: %d", w.Result().StatusCode)
+	}
+}
+
+func TestListAssetsInFolder(t *testing.T) {
+	db := &mockDBFolderClient{}
+	dbSvc = db
+	r := httptest.NewRequest(http.MethodGet, "/assets?folder=/invoices/2024", nil)
+	w := httptest.NewRecorder()
+
+	listAssets(w, r)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Incorrect status listing a folder: %d", resp.StatusCode)
+	}
+	if prefix := stringAttribute(db.query.ExpressionAttributeValues, ":prefix"); prefix != "invoices/2024/" {
+		t.Errorf("Queried folder %s, expected invoices/2024/", prefix)
+	}
+	jsonResp := assetsResponse{}
+	json.NewDecoder(resp.Body).Decode(&jsonResp)
+	if len(jsonResp.Assets) != 1 || jsonResp.Assets[0].KeyPrefix != "invoices/2024/" || jsonResp.Cursor == "" {
+		t.Fatalf("Incorrect folder listing: %+v", jsonResp)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/assets?folder=invoices&tag=red", nil)
+	w = httptest.NewRecorder()
+	listAssets(w, r)
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("Didn't get 400 listing by folder and tag: %d", w.Result().StatusCode)
+	}
+}
+
+// an asset initialized in a folder
+type mockDBFolderAssetClient struct {
+	mockDBClient
+}
+
+func (m *mockDBFolderAssetClient) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	output, _ := m.mockDBClient.GetItem(input)
+	output.Item["key_prefix"] = &dynamodb.AttributeValue{S: aws.String("invoices/2024/")}
+	return output, nil
+}
+func (m *mockDBFolderAssetClient) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return m.GetItem(input)
+}
+
+// holds looks at an object keyed by the bare asset ID until they're called
+// off, recording which were
+type mockS3SpeculativeHeadClient struct {
+	mockS3Client
+	mu       sync.Mutex
+	canceled []string
+	heads    []string
+}
+
+func (m *mockS3SpeculativeHeadClient) HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	key := aws.StringValue(input.Key)
+	m.mu.Lock()
+	m.heads = append(m.heads, key)
+	m.mu.Unlock()
+	if key == "someID" {
+		select {
+		case <-ctx.Done():
+			m.mu.Lock()
+			m.canceled = append(m.canceled, key)
+			m.mu.Unlock()
+			return nil, ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+	}
+	return m.HeadObject(input)
+}
+
+func TestResolveDownloadFolder(t *testing.T) {
+	defer func() { s3Svc = &mockS3Client{} }()
+	mock := &mockS3SpeculativeHeadClient{}
+	s3Svc = mock
+	dbSvc = &mockDBFolderAssetClient{}
+	w := httptest.NewRecorder()
+	manageAsset(w, httptest.NewRequest(http.MethodGet, "/asset/someID", nil))
+	if w.Code != http.StatusOK || len(mock.canceled) != 1 || mock.heads[len(mock.heads)-1] != "invoices/2024/someID" {
+		t.Errorf("Look at the bare ID not called off for a folder: %d %v %v", w.Code, mock.heads, mock.canceled)
+	}
+
+	// nor is it left running when there's no record
+	mock = &mockS3SpeculativeHeadClient{}
+	s3Svc = mock
+	dbSvc = &mockDBMissingKeyClient{}
+	w = httptest.NewRecorder()
+	manageAsset(w, httptest.NewRequest(http.MethodGet, "/asset/someID", nil))
+	if w.Code != http.StatusNotFound || len(mock.canceled) != 1 {
+		t.Errorf("Look not called off for a missing record: %d %v", w.Code, mock.canceled)
+	}
+}
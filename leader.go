@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// the item in the leader table that the instance running background sweeps
+// holds a lease on
+const leaderLockID = "background"
+
+// the DynamoDB table, keyed on id, holding the leader's lease; none to run
+// background sweeps on every instance
+var leaderTableName string
+
+// how long a leader's lease lasts unless renewed, which it is three times
+// as often; another instance takes over at most this long after a leader
+// stops renewing
+var leaderLease = 30 * time.Second
+
+// tells this instance apart from others holding the lease
+var instanceID = func() string {
+	host, _ := os.Hostname()
+	return host + "-" + secureToken(6)
+}()
+
+type leaderStats struct {
+	Enabled      bool   `json:"enabled"`
+	Instance     string `json:"instance"`
+	Leader       bool   `json:"leader"`
+	LeaseSeconds int64  `json:"lease_seconds"`
+	// the lease's term, counted up on every change of leader, as last seen
+	Term int64 `json:"term,omitempty"`
+	// times this instance became leader, and stopped being it, since start
+	Acquired     int64      `json:"acquired"`
+	Lost         int64      `json:"lost"`
+	LastChangeAt *time.Time `json:"last_change_at,omitempty"`
+}
+
+// how long before its lease runs out a leader that couldn't renew stops
+// leader work, leaving room for clock drift between instances and for
+// sweeps to wind down
+func leaderSafetyMargin() time.Duration {
+	return leaderLease / 6
+}
+
+var leadership struct {
+	sync.Mutex
+	leader bool
+	// when the lease held expires, as far as this instance knows
+	expires time.Time
+	// steps down a safety margin before expires unless renewed first
+	deadline *time.Timer
+	stats    leaderStats
+	// closed and replaced whenever leadership changes
+	changed chan struct{}
+}
+
+func init() {
+	leadership.changed = make(chan struct{})
+}
+
+// whether this instance leads, and a channel closed when that changes
+func leadershipState() (bool, <-chan struct{}) {
+	leadership.Lock()
+	defer leadership.Unlock()
+	return leadership.leader || leaderTableName == "", leadership.changed
+}
+
+func setLeader(leader bool, expires time.Time, term int64) {
+	leadership.Lock()
+	defer leadership.Unlock()
+	setLeaderLocked(leader, expires, term)
+}
+
+func setLeaderLocked(leader bool, expires time.Time, term int64) {
+	leadership.expires = expires
+	if leadership.deadline != nil {
+		leadership.deadline.Stop()
+		leadership.deadline = nil
+	}
+	if leader {
+		leadership.deadline = time.AfterFunc(time.Until(expires)-leaderSafetyMargin(), func() {
+			leadership.Lock()
+			defer leadership.Unlock()
+			// unless renewed meanwhile
+			if leadership.leader && leadership.expires.Equal(expires) {
+				log.Printf("instance %s couldn't renew its lease in time", instanceID)
+				setLeaderLocked(false, time.Time{}, 0)
+			}
+		})
+	}
+	if term > 0 {
+		leadership.stats.Term = term
+	}
+	if leader == leadership.leader {
+		return
+	}
+	leadership.leader = leader
+	now := time.Now().UTC()
+	leadership.stats.LastChangeAt = &now
+	if leader {
+		leadership.stats.Acquired++
+		log.Printf("instance %s became leader for term %d", instanceID, leadership.stats.Term)
+	} else {
+		leadership.stats.Lost++
+		log.Printf("instance %s is no longer leader", instanceID)
+	}
+	close(leadership.changed)
+	leadership.changed = make(chan struct{})
+}
+
+// adds a background sweep that, with a leader table, only runs on the
+// instance holding the lease
+func addLeaderLoop(name string, loop func(stop <-chan struct{})) {
+	if leaderTableName == "" {
+		addLoop(name, loop)
+		return
+	}
+	addLoop(name, func(stop <-chan struct{}) {
+		runWhileLeader(stop, loop)
+	})
+}
+
+// runs loop each time this instance becomes leader, stopping it when
+// leadership is lost, until stop is closed
+func runWhileLeader(stop <-chan struct{}, loop func(stop <-chan struct{})) {
+	for {
+		leader, changed := leadershipState()
+		if !leader {
+			select {
+			case <-stop:
+				return
+			case <-changed:
+				continue
+			}
+		}
+		loopStop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			loop(loopStop)
+		}()
+		select {
+		case <-stop:
+			close(loopStop)
+			<-done
+			return
+		case <-changed:
+			close(loopStop)
+			<-done
+		}
+	}
+}
+
+// takes or renews the lease until stopped, then gives it up so another
+// instance can take over without waiting for it to expire
+func watchLeadership(stop <-chan struct{}) {
+	for {
+		if err := campaign(); err != nil {
+			log.Printf("leader election: %s", err.Error())
+		}
+		if !pause(stop, leaderLease/3) {
+			resign()
+			return
+		}
+	}
+}
+
+// renews the lease if this instance holds it, or takes it if it's free or
+// expired, stepping down if it can't be sure of still holding it; the
+// attempt is given up after a third of the lease, so a hung call can't
+// outlast it
+func campaign() error {
+	ctx, cancel := context.WithTimeout(context.Background(), leaderLease/3)
+	defer cancel()
+	now := time.Now()
+	expires := now.Add(leaderLease)
+	values := map[string]*dynamodb.AttributeValue{
+		":me":      {S: aws.String(instanceID)},
+		":expires": {N: aws.String(strconv.FormatInt(expires.UnixNano()/int64(time.Millisecond), 10))},
+		":now":     {N: aws.String(strconv.FormatInt(now.UnixNano()/int64(time.Millisecond), 10))},
+	}
+	leader, _ := leadershipState()
+	update := "SET holder = :me, lease_expires = :expires"
+	condition := "holder = :me AND lease_expires >= :now"
+	if !leader {
+		values[":one"] = &dynamodb.AttributeValue{N: aws.String("1")}
+		update += " ADD term :one"
+		// including a lease this instance stepped down from without
+		// giving up
+		condition = "attribute_not_exists(holder) OR holder = :me OR lease_expires < :now"
+	}
+	result, err := dbSvc.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		Key:                       assetKey(leaderLockID),
+		TableName:                 aws.String(leaderTableName),
+		UpdateExpression:          aws.String(update),
+		ConditionExpression:       aws.String(condition),
+		ExpressionAttributeValues: values,
+		ReturnValues:              aws.String(dynamodb.ReturnValueAllNew),
+	})
+	if err != nil {
+		if isConditionFailed(err) {
+			// another instance holds the lease, or took it over
+			setLeader(false, time.Time{}, 0)
+			return nil
+		}
+		leadership.Lock()
+		expiring := time.Until(leadership.expires) < leaderLease/3+leaderSafetyMargin()
+		leadership.Unlock()
+		// the lease may run out, when another instance can take it over,
+		// before the next try could renew it
+		if leader && expiring {
+			setLeader(false, time.Time{}, 0)
+		}
+		return fmt.Errorf("renewing lease: %s", err.Error())
+	}
+	setLeader(true, expires, numberAttribute(result.Attributes, "term"))
+	return nil
+}
+
+// gives up the lease if this instance holds it
+func resign() {
+	if leader, _ := leadershipState(); !leader {
+		return
+	}
+	setLeader(false, time.Time{}, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), leaderLease/3)
+	defer cancel()
+	_, err := dbSvc.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		Key:                 assetKey(leaderLockID),
+		TableName:           aws.String(leaderTableName),
+		UpdateExpression:    aws.String("SET lease_expires = :zero"),
+		ConditionExpression: aws.String("holder = :me"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":me":   {S: aws.String(instanceID)},
+			":zero": {N: aws.String("0")},
+		},
+	})
+	if err != nil && !isConditionFailed(err) {
+		log.Printf("giving up lease: %s", err.Error())
+	}
+}
+
+// reports whether this instance leads background sweeps, with counts of
+// leadership changes since start
+func getLeaderStats(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	leader, _ := leadershipState()
+	leadership.Lock()
+	stats := leadership.stats
+	leadership.Unlock()
+	stats.Enabled = leaderTableName != ""
+	stats.Instance = instanceID
+	stats.Leader = leader
+	stats.LeaseSeconds = int64(leaderLease / time.Second)
+	writeJSON(w, stats)
+}
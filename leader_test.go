@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// a leader table holding one lease, whose conditions are checked as
+// DynamoDB would
+type mockDBLeaderClient struct {
+	mockDBClient
+	holder  string
+	expires int64
+	term    int64
+	err     error
+}
+
+func (m *mockDBLeaderClient) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	values := input.ExpressionAttributeValues
+	me := stringAttribute(values, ":me")
+	var ok bool
+	switch aws.StringValue(input.ConditionExpression) {
+	case "holder = :me AND lease_expires >= :now":
+		ok = m.holder == me && m.expires >= numberAttribute(values, ":now")
+	case "attribute_not_exists(holder) OR holder = :me OR lease_expires < :now":
+		ok = m.holder == "" || m.holder == me || m.expires < numberAttribute(values, ":now")
+	case "holder = :me":
+		ok = m.holder == me
+	}
+	if !ok {
+		return nil, &dynamodb.ConditionalCheckFailedException{Message_: aws.String("The conditional request failed")}
+	}
+	if _, resigning := values[":zero"]; resigning {
+		m.expires = 0
+		return &dynamodb.UpdateItemOutput{}, nil
+	}
+	m.holder, m.expires = me, numberAttribute(values, ":expires")
+	if _, ok := values[":one"]; ok {
+		m.term++
+	}
+	return &dynamodb.UpdateItemOutput{Attributes: map[string]*dynamodb.AttributeValue{
+		"term": {N: aws.String(strconv.FormatInt(m.term, 10))},
+	}}, nil
+}
+func (m *mockDBLeaderClient) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	return m.UpdateItem(input)
+}
+
+func resetLeadership() {
+	leaderTableName = ""
+	leadership.Lock()
+	setLeaderLocked(false, time.Time{}, 0)
+	leadership.stats = leaderStats{}
+	leadership.Unlock()
+}
+
+func TestCampaign(t *testing.T) {
+	leaderTableName = "leader"
+	defer resetLeadership()
+	db := &mockDBLeaderClient{}
+	dbSvc = db
+
+	if err := campaign(); err != nil {
+		t.Fatalf("Got error taking a free lease: %s", err)
+	}
+	if leader, _ := leadershipState(); !leader || db.holder != instanceID || db.term != 1 {
+		t.Fatalf("Lease not taken: %+v", db)
+	}
+	// renewing keeps the term
+	campaign()
+	if leader, _ := leadershipState(); !leader || db.term != 1 {
+		t.Errorf("Lease not renewed: %+v", db)
+	}
+
+	// another instance took over after the lease lapsed
+	db.holder, db.expires, db.term = "other", time.Now().Add(time.Minute).UnixNano()/int64(time.Millisecond), 2
+	campaign()
+	if leader, _ := leadershipState(); leader {
+		t.Errorf("Still leader after losing the lease")
+	}
+
+	// the other instance stopped renewing
+	db.expires = time.Now().Add(-time.Second).UnixNano() / int64(time.Millisecond)
+	campaign()
+	if leader, _ := leadershipState(); !leader || db.holder != instanceID || db.term != 3 {
+		t.Errorf("Expired lease not taken over: %+v", db)
+	}
+
+	// failing to renew steps down only once the lease might run out
+	db.err = errors.New("throttled")
+	if err := campaign(); err == nil {
+		t.Errorf("Got no error failing to renew")
+	}
+	if leader, _ := leadershipState(); !leader {
+		t.Errorf("Stepped down with the lease still held")
+	}
+	leadership.Lock()
+	leadership.expires = time.Now().Add(leaderLease / 4)
+	leadership.Unlock()
+	campaign()
+	if leader, _ := leadershipState(); leader {
+		t.Errorf("Still leader with the lease about to run out")
+	}
+
+	db.err = nil
+	campaign()
+	resign()
+	if leader, _ := leadershipState(); leader || db.expires != 0 {
+		t.Errorf("Lease not given up: %+v", db)
+	}
+
+	w := httptest.NewRecorder()
+	getLeaderStats(w, httptest.NewRequest(http.MethodGet, "/leader", nil))
+	var stats leaderStats
+	json.NewDecoder(w.Body).Decode(&stats)
+	if !stats.Enabled || stats.Leader || stats.Acquired != 3 || stats.Lost != 3 || stats.Term != 4 || stats.LastChangeAt == nil {
+		t.Errorf("Incorrect leader stats: %+v", stats)
+	}
+}
+
+func TestRunWhileLeader(t *testing.T) {
+	leaderTableName = "leader"
+	defer resetLeadership()
+	runs := make(chan bool)
+	loop := func(stop <-chan struct{}) {
+		runs <- true
+		<-stop
+		runs <- false
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runWhileLeader(stop, loop)
+	}()
+
+	setLeader(true, time.Now().Add(leaderLease), 1)
+	if !<-runs {
+		t.Fatalf("Loop not started on becoming leader")
+	}
+	setLeader(false, time.Time{}, 0)
+	if <-runs {
+		t.Fatalf("Loop not stopped on losing leadership")
+	}
+	setLeader(true, time.Now().Add(leaderLease), 2)
+	<-runs
+	close(stop)
+	if <-runs {
+		t.Fatalf("Loop not stopped on stop")
+	}
+	<-done
+}
+
+func TestLeaseDeadline(t *testing.T) {
+	leaderTableName = "leader"
+	defer resetLeadership()
+	// not renewed, the lease is given up a safety margin before it runs out
+	setLeader(true, time.Now().Add(leaderSafetyMargin()+50*time.Millisecond), 1)
+	leader, changed := leadershipState()
+	if !leader {
+		t.Fatal("Not leader with a lease held")
+	}
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Fatal("Still leader with the lease about to run out")
+	}
+	if leader, _ = leadershipState(); leader {
+		t.Error("Still leader past the safety margin")
+	}
+
+	// renewing puts the deadline off
+	setLeader(true, time.Now().Add(leaderSafetyMargin()+50*time.Millisecond), 2)
+	setLeader(true, time.Now().Add(leaderLease), 2)
+	time.Sleep(100 * time.Millisecond)
+	if leader, _ = leadershipState(); !leader {
+		t.Error("Stepped down though the lease was renewed")
+	}
+}
+
+// a leader table that doesn't answer until the call is given up
+type mockDBLeaderHangingClient struct {
+	mockDBClient
+}
+
+func (m *mockDBLeaderHangingClient) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	return m.UpdateItemWithContext(context.Background(), input)
+}
+func (m *mockDBLeaderHangingClient) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestCampaignTimeout(t *testing.T) {
+	leaderTableName = "leader"
+	defer func() { leaderLease = 30 * time.Second }()
+	defer resetLeadership()
+	leaderLease = 300 * time.Millisecond
+	dbSvc = &mockDBLeaderHangingClient{}
+	start := time.Now()
+	if err := campaign(); err == nil || time.Since(start) >= leaderLease {
+		t.Errorf("Renewal not given up within the lease: %v after %s", err, time.Since(start))
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// how long each subsystem gets to stop before shutdown moves on
+var shutdownTimeout = 15 * time.Second
+
+// a part of the service that runs from startup until shutdown
+type subsystem struct {
+	name  string
+	start func() error
+	stop  func(ctx context.Context) error
+}
+
+var subsystems []subsystem
+
+// told when a running subsystem fails, shutting the service down
+var subsystemFailed = make(chan error, 1)
+
+// adds a subsystem, started after and stopped before those added earlier
+func addSubsystem(name string, start func() error, stop func(ctx context.Context) error) {
+	subsystems = append(subsystems, subsystem{name: name, start: start, stop: stop})
+}
+
+// adds a background loop as a subsystem; the loop must return soon after
+// stop is closed
+func addLoop(name string, loop func(stop <-chan struct{})) {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	addSubsystem(name, func() error {
+		go func() {
+			defer close(done)
+			loop(stop)
+		}()
+		return nil
+	}, func(ctx context.Context) error {
+		close(stop)
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
+
+// adds an HTTP server as a subsystem, serving HTTPS if it has a TLS config,
+// draining its requests on stop
+func addServer(name string, server *http.Server) {
+	addSubsystem(name, func() error {
+		listener, err := net.Listen("tcp", server.Addr)
+		if err != nil {
+			return err
+		}
+		if server.TLSConfig != nil {
+			listener = tls.NewListener(listener, server.TLSConfig)
+		}
+		go func() {
+			if err := server.Serve(listener); err != http.ErrServerClosed {
+				reportSubsystemFailure(fmt.Errorf("%s: %s", name, err.Error()))
+			}
+		}()
+		return nil
+	}, server.Shutdown)
+}
+
+func reportSubsystemFailure(err error) {
+	select {
+	case subsystemFailed <- err:
+	default:
+		log.Println(err.Error())
+	}
+}
+
+// waits for d, returning false if stop was closed first
+func pause(stop <-chan struct{}, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-stop:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// starts every subsystem in turn, stopping those already started if one
+// can't start
+func startSubsystems() error {
+	for i, s := range subsystems {
+		if err := s.start(); err != nil {
+			stopSubsystems(subsystems[:i])
+			return fmt.Errorf("starting %s: %s", s.name, err.Error())
+		}
+	}
+	return nil
+}
+
+// stops subsystems in reverse order, each within the shutdown timeout
+func stopSubsystems(started []subsystem) {
+	for i := len(started) - 1; i >= 0; i-- {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		if err := started[i].stop(ctx); err != nil {
+			log.Printf("stopping %s: %s", started[i].name, err.Error())
+		}
+		cancel()
+	}
+}
+
+// runs every subsystem until SIGINT, SIGTERM or one of them failing, then
+// shuts them all down
+func runSubsystems() error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	if err := startSubsystems(); err != nil {
+		return err
+	}
+
+	var err error
+	select {
+	case sig := <-signals:
+		log.Printf("received %s, shutting down", sig)
+	case err = <-subsystemFailed:
+		log.Printf("shutting down: %s", err.Error())
+	}
+	stopSubsystems(subsystems)
+	return err
+}
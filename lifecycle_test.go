@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSubsystemOrder(t *testing.T) {
+	defer func() { subsystems = nil }()
+	var events []string
+	record := func(name string) {
+		addSubsystem(name, func() error {
+			events = append(events, "start "+name)
+			return nil
+		}, func(context.Context) error {
+			events = append(events, "stop "+name)
+			return nil
+		})
+	}
+	subsystems = nil
+	record("a")
+	record("b")
+	addSubsystem("broken", func() error { return errors.New("foo") }, nil)
+	record("c")
+
+	if err := startSubsystems(); err == nil {
+		t.Fatal("Failed start not reported")
+	}
+	expected := []string{"start a", "start b", "stop b", "stop a"}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("Incorrect order of hooks: %v", events)
+	}
+}
+func TestLoopStop(t *testing.T) {
+	defer func() { subsystems = nil }()
+	subsystems = nil
+	flushed := false
+	addLoop("test", func(stop <-chan struct{}) {
+		for pause(stop, time.Hour) {
+		}
+		flushed = true
+	})
+	hanging := make(chan struct{})
+	defer close(hanging)
+	addLoop("hanging", func(stop <-chan struct{}) {
+		<-hanging
+	})
+	if err := startSubsystems(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(timeout time.Duration) { shutdownTimeout = timeout }(shutdownTimeout)
+	shutdownTimeout = 50 * time.Millisecond
+	start := time.Now()
+	stopSubsystems(subsystems)
+	if !flushed {
+		t.Error("Loop didn't finish before being considered stopped")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Shutdown not bounded by its timeout: %s", elapsed)
+	}
+}
+func TestServerSubsystem(t *testing.T) {
+	defer func() { subsystems = nil }()
+	subsystems = nil
+	server := &http.Server{Addr: "127.0.0.1:0", Handler: http.NotFoundHandler()}
+	addServer("http server", server)
+	if err := startSubsystems(); err != nil {
+		t.Fatal(err)
+	}
+	stopSubsystems(subsystems)
+	select {
+	case err := <-subsystemFailed:
+		t.Errorf("Stopping the server was reported as a failure: %v", err)
+	default:
+	}
+}
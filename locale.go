@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// BCP 47 style tags: a language, then optional script, region or variant
+// subtags, e.g. en, pt-BR or zh-Hant-TW
+var localePattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// validates a locale tag and puts it in its conventional case, so that
+// filtering by it is exact
+func normalizeLocale(value string) (string, error) {
+	if !localePattern.MatchString(value) {
+		return "", errors.New("locale must be a language tag like en or pt-BR")
+	}
+	subtags := strings.Split(value, "-")
+	subtags[0] = strings.ToLower(subtags[0])
+	for i := 1; i < len(subtags); i++ {
+		switch {
+		case len(subtags[i]) == 4:
+			subtags[i] = strings.ToUpper(subtags[i][:1]) + strings.ToLower(subtags[i][1:])
+		case len(subtags[i]) == 2:
+			subtags[i] = strings.ToUpper(subtags[i])
+		default:
+			subtags[i] = strings.ToLower(subtags[i])
+		}
+	}
+	return strings.Join(subtags, "-"), nil
+}
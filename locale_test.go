@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestNormalizeLocale(t *testing.T) {
+	cases := map[string]string{
+		"en":         "en",
+		"PT-br":      "pt-BR",
+		"zh-hant-tw": "zh-Hant-TW",
+		"es-419":     "es-419",
+	}
+	for value, expected := range cases {
+		if actual, err := normalizeLocale(value); err != nil || actual != expected {
+			t.Errorf("Got %s, %v normalizing %s, expected %s", actual, err, value, expected)
+		}
+	}
+	for _, value := range []string{"", "e", "english-", "en_US", "en-US;x"} {
+		if _, err := normalizeLocale(value); err == nil {
+			t.Errorf("Got no error for locale %q", value)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	lockTokenHeader     = "X-Lock-Token"
+	defaultLockDuration = time.Second * 30
+	minLockDuration     = time.Second
+	maxLockDuration     = time.Minute * 10
+)
+
+// condition that passes when the asset is unlocked, the lease has
+// expired, or the caller holds the lock
+const lockCondition = "(attribute_not_exists(lock_token) OR lock_expires < :now OR lock_token = :token)"
+
+type lockResponse struct {
+	LockToken string    `json:"lock_token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// values referenced by lockCondition, using the token supplied by the caller
+func lockConditionValues(r *http.Request) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		":now":   {N: aws.String(strconv.FormatInt(time.Now().Unix(), 10))},
+		":token": {S: aws.String(r.Header.Get(lockTokenHeader))},
+	}
+}
+
+var errAssetLocked = errors.New("asset is locked")
+
+// whether anyone holds an unexpired lock on item
+func isLocked(item map[string]*dynamodb.AttributeValue) bool {
+	return stringAttribute(item, "lock_token") != "" && numberAttribute(item, "lock_expires") >= time.Now().Unix()
+}
+
+// whether someone other than the caller holds an unexpired lock on item,
+// for checking before work a conditional write would only refuse after
+func lockedByOther(r *http.Request, item map[string]*dynamodb.AttributeValue) bool {
+	token := stringAttribute(item, "lock_token")
+	return token != "" && token != r.Header.Get(lockTokenHeader) && numberAttribute(item, "lock_expires") >= time.Now().Unix()
+}
+
+// reports whether a failed conditional write hit an existing asset,
+// meaning the condition failed because someone else holds the lock
+func isLockedConflict(err error) bool {
+	cerr, ok := err.(*dynamodb.ConditionalCheckFailedException)
+	return ok && len(cerr.Item) > 0
+}
+
+// takes or renews an expiring exclusive lock on an asset
+func handleLockRequest(w http.ResponseWriter, r *http.Request, assetID string) {
+	duration, ok := parseDurationParam(w, r, "duration", defaultLockDuration, minLockDuration, maxLockDuration)
+	if !ok {
+		return
+	}
+
+	// renewing keeps the caller's token, otherwise a fresh one is issued
+	token := r.Header.Get(lockTokenHeader)
+	if token == "" {
+		token = secureToken(18)
+	}
+	expiresAt := time.Now().Add(duration)
+
+	values := lockConditionValues(r)
+	values[":newToken"] = &dynamodb.AttributeValue{S: aws.String(token)}
+	values[":expires"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(expiresAt.Unix(), 10))}
+	query := &dynamodb.UpdateItemInput{
+		Key:                                 assetKey(assetID),
+		TableName:                           aws.String(tableName),
+		UpdateExpression:                    aws.String("SET lock_token = :newToken, lock_expires = :expires"),
+		ConditionExpression:                 aws.String("attribute_exists(id) AND " + lockCondition),
+		ExpressionAttributeValues:           values,
+		ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValuesOnConditionCheckFailureAllOld),
+	}
+	_, err := dbSvc.UpdateItemWithContext(r.Context(), query)
+	if err != nil {
+		if isConditionFailed(err) {
+			if isLockedConflict(err) {
+				http.Error(w, fmt.Sprintf("Asset id '%s' is already locked.", assetID), http.StatusConflict)
+				return
+			}
+			writeError(w, notFound(assetID))
+			return
+		}
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, lockResponse{
+		LockToken: token,
+		ExpiresAt: expiresAt.UTC().Truncate(time.Second),
+	})
+}
+
+// releases a lock held by the caller
+func handleUnlockRequest(w http.ResponseWriter, r *http.Request, assetID string) {
+	token := r.Header.Get(lockTokenHeader)
+	if token == "" {
+		http.Error(w, fmt.Sprintf("Missing %s header.", lockTokenHeader), http.StatusBadRequest)
+		return
+	}
+
+	query := &dynamodb.UpdateItemInput{
+		Key:                 assetKey(assetID),
+		TableName:           aws.String(tableName),
+		UpdateExpression:    aws.String("REMOVE lock_token, lock_expires"),
+		ConditionExpression: aws.String("attribute_exists(id) AND lock_token = :token"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":token": {S: aws.String(token)},
+		},
+		ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValuesOnConditionCheckFailureAllOld),
+	}
+	_, err := dbSvc.UpdateItemWithContext(r.Context(), query)
+	if err != nil {
+		if isConditionFailed(err) {
+			if isLockedConflict(err) {
+				http.Error(w, fmt.Sprintf("Lock on asset id '%s' is not held by this token.", assetID), http.StatusConflict)
+				return
+			}
+			writeError(w, notFound(assetID))
+			return
+		}
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+type mockDBLockedClient struct {
+	dynamodbiface.DynamoDBAPI
+}
+
+func (m *mockDBLockedClient) UpdateItem(*dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	return nil, &dynamodb.ConditionalCheckFailedException{
+		Message_: aws.String("The conditional request failed"),
+		Item: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String("someID"),
+			},
+		},
+	}
+}
+func (m *mockDBLockedClient) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	return m.UpdateItem(input)
+}
+
+func (m *mockDBLockedClient) GetItem(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: map[string]*dynamodb.AttributeValue{"id": {S: aws.String("someID")}}}, nil
+}
+func (m *mockDBLockedClient) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return m.GetItem(input)
+}
+
+func TestLockOK(t *testing.T) {
+	dbSvc = &mockDBClient{}
+	r := httptest.NewRequest(http.MethodPost, "/asset/someID/lock?duration=60", nil)
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Incorrect status while locking asset: %d", resp.StatusCode)
+	}
+	jsonResp := lockResponse{}
+	json.NewDecoder(resp.Body).Decode(&jsonResp)
+	if jsonResp.LockToken == "" {
+		t.Error("Lock did not return a token")
+	}
+}
+func TestLockConflict(t *testing.T) {
+	dbSvc = &mockDBLockedClient{}
+	r := httptest.NewRequest(http.MethodPost, "/asset/someID/lock", nil)
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Didn't get 409 when locking a locked asset: %d", resp.StatusCode)
+	}
+}
+func TestLockNotFound(t *testing.T) {
+	dbSvc = &mockDBConditionalErrorClient{}
+	r := httptest.NewRequest(http.MethodPost, "/asset/nonexistant/lock", nil)
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Didn't get 404 when locking a missing asset: %d", resp.StatusCode)
+	}
+}
+func TestUnlockMissingToken(t *testing.T) {
+	dbSvc = &mockDBClient{}
+	r := httptest.NewRequest(http.MethodPost, "/asset/someID/unlock", nil)
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Didn't get 400 when unlocking without a token: %d", resp.StatusCode)
+	}
+}
+func TestMarkUploadedLocked(t *testing.T) {
+	dbSvc = &mockDBLockedClient{}
+	r := httptest.NewRequest(http.MethodPut, "/asset/someID", bytes.NewReader([]byte(`{"Status":"uploaded"}`)))
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusLocked {
+		t.Errorf("Didn't get 423 when marking a locked asset uploaded: %d", resp.StatusCode)
+	}
+}
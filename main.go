@@ -1,68 +1,132 @@
 package main
 
 import (
+	"context"
+	cryptorand "crypto/rand"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"math/rand"
+	"mime"
 	"net/http"
+	"net/url"
+	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"golang.org/x/sync/errgroup"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sqs"
 )
 
 const (
 	assetStatusUploaded    = "uploaded"
 	defaultDownloadTimeout = time.Minute
 	maxDownloadTimeout     = time.Hour * 24
-	uploadTimeout          = time.Hour * 24
+	// signed urls expire to the second
+	minURLTimeout = time.Second
 )
 
+// upload urls live this long unless the caller asks for less
+var maxUploadTimeout = time.Hour * 24
+
 type initAssetResponse struct {
-	UploadURL string `json:"upload_url"`
-	ID        string `json:"id"`
+	UploadURL     string            `json:"upload_url"`
+	UploadHeaders map[string]string `json:"upload_headers,omitempty"`
+	UploadFields  map[string]string `json:"upload_fields,omitempty"`
+	ID            string            `json:"id"`
+	// required to mark the asset uploaded, when completion tokens are
+	CompletionToken string `json:"completion_token,omitempty"`
 }
 
+// a download url along with what S3 reports about the object behind it
 type assetURLResponse struct {
-	DownloadURL string `json:"Download_url"`
+	DownloadURL  string     `json:"Download_url"`
+	Size         *int64     `json:"size,omitempty"`
+	ContentType  string     `json:"content_type,omitempty"`
+	ETag         string     `json:"etag,omitempty"`
+	LastModified *time.Time `json:"last_modified,omitempty"`
+	Version      string     `json:"version,omitempty"`
 }
 
 type markUploadedRequest struct {
 	Status string
+	MD5    string
+	SHA256 string
+}
+
+// returns n random bytes encoded as url-safe base64, for names that only
+// need to be unique
+func randomString(n int) string {
+	randBytes := make([]byte, n)
+	rand.Read(randBytes)
+	return base64.RawURLEncoding.EncodeToString(randBytes)
+}
+
+// returns n bytes from crypto/rand encoded as url-safe base64, for tokens
+// and ids that must not be guessable
+func secureToken(n int) string {
+	b := make([]byte, n)
+	if _, err := cryptorand.Read(b); err != nil {
+		// nothing secret can be made without it
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
 }
 
-// reserves a random ID for an asset in the database
-func reserveUniqueID() (string, error) {
+// reserves a random ID for an asset in the database, storing any extra
+// attributes on the new record
+func reserveUniqueID(ctx context.Context, attributes map[string]*dynamodb.AttributeValue) (string, error) {
 	var lastError error
 	// retry up to 10x in the event of collision
 	for i := 0; i <= 10; i++ {
-		randBytes := make([]byte, 12)
-		rand.Read(randBytes)
-		id := base64.RawURLEncoding.EncodeToString(randBytes)
+		id, unique, err := idGen.nextID(ctx)
+		if err != nil {
+			lastError = err
+			log.Println(err.Error())
+			continue
+		}
 
 		// now that we have a candidate ID, try to save it,
 		// on condition that it doesn't exist already
+		now := updatedAtValue()
 		query := &dynamodb.PutItemInput{
 			Item: map[string]*dynamodb.AttributeValue{
 				"id": {
 					S: aws.String(id),
 				},
+				"changes_shard": {
+					S: aws.String(changesShard(id)),
+				},
+				"created_at": now,
+				"updated_at": now,
 			},
-			TableName:           aws.String(tableName),
-			ConditionExpression: aws.String("attribute_not_exists(id)"),
+			TableName: aws.String(tableName),
 		}
-		_, err := dbSvc.PutItem(query)
+		for k, v := range attributes {
+			query.Item[k] = v
+		}
+		for k, v := range encryptionAttributes(id) {
+			query.Item[k] = v
+		}
+		if !unique {
+			query.ConditionExpression = aws.String("attribute_not_exists(id)")
+		}
+		_, err = dbSvc.PutItemWithContext(ctx, query)
 		if err != nil {
 			lastError = err
 			if aerr, ok := err.(awserr.Error); ok {
@@ -74,6 +138,7 @@ func reserveUniqueID() (string, error) {
 		}
 
 		// created record successfully, good to go
+		noteAssetExists(id)
 		return id, nil
 	}
 
@@ -93,45 +158,313 @@ func checkMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool
 	return false
 }
 
+// parses a duration from the named query parameter, given as integer
+// seconds or a Go duration string such as 1500ms, 90s or 2h, writing an
+// error and returning false if it is malformed or out of bounds
+func parseDurationParam(w http.ResponseWriter, r *http.Request, name string, def, min, max time.Duration) (time.Duration, bool) {
+	valueStr := r.URL.Query().Get(name)
+	if valueStr == "" {
+		return def, true
+	}
+	var value time.Duration
+	if valueSec, err := strconv.Atoi(valueStr); err == nil {
+		value = time.Duration(valueSec) * time.Second
+	} else if value, err = time.ParseDuration(valueStr); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid argument for %s, must be integer seconds or a duration such as 90s.", name), http.StatusBadRequest)
+		return 0, false
+	}
+	if value < min || value > max {
+		http.Error(w, fmt.Sprintf("Invalid argument for %s, must be from %s to %s.", name, min, max), http.StatusBadRequest)
+		return 0, false
+	}
+	return value, true
+}
+
 // return a signed URL with a unique key to be used for asset upload
 func initAsset(w http.ResponseWriter, r *http.Request) {
 	if !checkMethod(w, r, http.MethodPost) {
 		return
 	}
 
-	assetID, err := reserveUniqueID()
+	// user metadata is both signed into the upload and kept on the record
+	metadata, err := parseMetadataHeaders(r.Header)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid metadata: %s.", err.Error()), http.StatusBadRequest)
+		return
+	}
+	if response, ok := takeWarmUpload(r, metadata); ok {
+		recordAssetEvent(r, response.ID, assetEventCreated, nil)
+		recordAssetEvent(r, response.ID, assetEventURLIssued, map[string]string{"url": "upload"})
+		writeJSON(w, response)
+		return
+	}
+	attributes := map[string]*dynamodb.AttributeValue{}
+	if len(metadata) > 0 {
+		attributes["metadata"] = metadataAttribute(metadata)
+	}
+
+	// caching policy for the object, also replayed on download urls
+	cacheControl := defaultCacheControl
+	if value := r.URL.Query().Get("cache_control"); value != "" {
+		cacheControl = value
+	}
+	if err := validateCacheControl(cacheControl); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid argument for cache_control: %s.", err.Error()), http.StatusBadRequest)
+		return
+	}
+	if cacheControl != "" {
+		attributes["cache_control"] = &dynamodb.AttributeValue{S: aws.String(cacheControl)}
+	}
+
+	// declared content type, which the signature forces the upload to match
+	contentType := r.URL.Query().Get("content_type")
+	if err := validateContentType(contentType); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid argument for content_type: %s.", err.Error()), http.StatusBadRequest)
+		return
+	}
+	if contentType != "" {
+		attributes["content_type"] = &dynamodb.AttributeValue{S: aws.String(contentType)}
+	}
+
+	// original name downloads are saved under
+	filename := r.URL.Query().Get("filename")
+	if err := validateFilename(filename); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid argument for filename: %s.", err.Error()), http.StatusBadRequest)
+		return
+	}
+	if filename != "" {
+		attributes["filename"] = &dynamodb.AttributeValue{S: aws.String(filename)}
+	}
+
+	// free text and attributes searches can find the asset by
+	if description := r.URL.Query().Get("description"); description != "" {
+		if err := validateDescription(description); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid argument for description: %s.", err.Error()), http.StatusBadRequest)
+			return
+		}
+		attributes["description"] = &dynamodb.AttributeValue{S: aws.String(description)}
+	}
+	owner, err := requestOwner(r, r.URL.Query().Get("owner"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid argument for owner: %s.", err.Error()), http.StatusForbidden)
+		return
+	}
+	for name, value := range map[string]string{"owner": owner, "project": r.URL.Query().Get("project")} {
+		if value != "" {
+			if err := validateSearchAttribute(name, value); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid argument for %s: %s.", name, err.Error()), http.StatusBadRequest)
+				return
+			}
+			for k, v := range searchAttributes(name, value) {
+				attributes[k] = v
+			}
+		}
+	}
+	for k, v := range onBehalfOfAttributes(r) {
+		attributes[k] = v
+	}
+
+	// size in bytes the uploader says is coming, for browsing the registry
+	if value := r.URL.Query().Get("size"); value != "" {
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || size < 0 || size > maxDeclaredSize {
+			http.Error(w, "Invalid argument for size, must be integer bytes up to 5TB.", http.StatusBadRequest)
+			return
+		}
+		attributes["declared_size"] = &dynamodb.AttributeValue{N: aws.String(value)}
+	}
+
+	// language of the content, which listings can filter by
+	if value := r.URL.Query().Get("locale"); value != "" {
+		locale, err := normalizeLocale(value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid argument for locale: %s.", err.Error()), http.StatusBadRequest)
+			return
+		}
+		attributes["locale"] = &dynamodb.AttributeValue{S: aws.String(locale)}
+	}
+
+	// logical location in the folder tree, alongside the random key
+	if value := r.URL.Query().Get("path"); value != "" {
+		assetPath, err := normalizePath(value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid argument for path: %s.", err.Error()), http.StatusBadRequest)
+			return
+		}
+		if err := createFolders(r.Context(), assetPath); err != nil {
+			writeError(w, err)
+			return
+		}
+		for k, v := range pathAttributes(assetPath) {
+			attributes[k] = v
+		}
+	}
+
+	// a folder the object is stored under, keeping the bucket browsable
+	if value := r.URL.Query().Get("folder"); value != "" {
+		prefix, err := normalizeKeyPrefix(value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid argument for folder: %s.", err.Error()), http.StatusBadRequest)
+			return
+		}
+		attributes["key_prefix"] = &dynamodb.AttributeValue{S: aws.String(prefix)}
+	}
+
+	// embargoed assets can't be downloaded until their publication time
+	if value := r.URL.Query().Get("available_at"); value != "" {
+		availableAt, err := parseAvailableAt(value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid argument for available_at: %s.", err.Error()), http.StatusBadRequest)
+			return
+		}
+		for k, v := range embargoAttributes(availableAt) {
+			attributes[k] = v
+		}
+	}
+
+	// expiring assets are swept, along with their objects, once expired
+	if value := r.URL.Query().Get("expires_at"); value != "" {
+		expiresAt, err := parseExpiresAt(value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid argument for expires_at: %s.", err.Error()), http.StatusBadRequest)
+			return
+		}
+		for k, v := range expiryAttributes(expiresAt) {
+			attributes[k] = v
+		}
+	}
+
+	// world-readable assets get a stable download url
+	if r.URL.Query().Get("public") == "true" {
+		attributes["public"] = &dynamodb.AttributeValue{BOOL: aws.Bool(true)}
+	}
+
+	// uploads only redeemable from the client's networks go through the
+	// service, since S3 can't check where a presigned upload comes from
+	if value := r.URL.Query().Get("networks"); value != "" {
+		networks, err := parseUploadNetworks(value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid argument for networks: %s.", err.Error()), http.StatusBadRequest)
+			return
+		}
+		if r.URL.Query().Get("upload") == uploadMethodPost {
+			http.Error(w, "Uploads restricted to networks can't use upload=post.", http.StatusBadRequest)
+			return
+		}
+		networkAttributes, err := uploadNetworkAttributes(networks)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		for k, v := range networkAttributes {
+			attributes[k] = v
+		}
+	}
+
+	// browsers can upload with a form post instead of a put
+	uploadMethod := r.URL.Query().Get("upload")
+	var conditions postConditions
+	switch uploadMethod {
+	case "", uploadMethodPut:
+	case uploadMethodPost:
+		var ok bool
+		if conditions, ok = parsePostConditions(w, r); !ok {
+			return
+		}
+	default:
+		http.Error(w, "Invalid argument for upload, must be put or post.", http.StatusBadRequest)
+		return
+	}
+
+	// sensitive content can ask for shorter lived upload urls
+	timeout, ok := parseDurationParam(w, r, "timeout", maxUploadTimeout, minURLTimeout, maxUploadTimeout)
+	if !ok {
+		return
+	}
+	for k, v := range reservationAttributes(timeout) {
+		attributes[k] = v
+	}
+	completionToken, tokenAttributes := newCompletionToken(timeout)
+	for k, v := range tokenAttributes {
+		attributes[k] = v
+	}
+
+	assetID, err := reserveUniqueID(r.Context(), attributes)
 	if err != nil {
 		w.WriteHeader(http.StatusServiceUnavailable)
 		return
 	}
+	recordAssetEvent(r, assetID, assetEventCreated, nil)
+	response := initAssetResponse{ID: assetID, CompletionToken: completionToken}
 
-	// get a signed URL
-	req, _ := s3Svc.PutObjectRequest(&s3.PutObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(assetID),
-	})
-	url, err := req.Presign(uploadTimeout)
+	if len(uploadNetworks(attributes)) > 0 {
+		response.UploadURL = proxiedUploadURL(r, assetID, attributes)
+	} else if uploadMethod == uploadMethodPost {
+		// get signed form fields
+		fields := map[string]string{}
+		for k, v := range metadata {
+			fields["x-amz-meta-"+k] = v
+		}
+		if cacheControl != "" {
+			fields["Cache-Control"] = cacheControl
+		}
+		if contentType != "" {
+			fields["Content-Type"] = contentType
+		}
+		for k, v := range encryptionFields(assetID) {
+			fields[k] = v
+		}
+		response.UploadURL = bucketURL()
+		response.UploadFields, err = presignPost(objectKey(assetID, attributes), fields, conditions, timeout)
+	} else {
+		response.UploadURL, response.UploadHeaders, err = presignPut(assetID, objectKey(assetID, attributes), metadata, cacheControl, contentType, timeout)
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		log.Println(err.Error())
 		return
 	}
+	recordAssetEvent(r, assetID, assetEventURLIssued, map[string]string{"url": "upload"})
 
 	// output result as json
-	encoder := json.NewEncoder(w)
-	encoder.SetEscapeHTML(false)
-	err = encoder.Encode(initAssetResponse{
-		UploadURL: url,
-		ID:        assetID,
+	writeJSON(w, response)
+}
+
+// signs a url for uploading an asset's object to key with a put, returning
+// the headers the upload must send
+func presignPut(assetID, key string, metadata map[string]string, cacheControl, contentType string, timeout time.Duration) (string, map[string]string, error) {
+	req, _ := s3Svc.PutObjectRequest(&s3.PutObjectInput{
+		Bucket:                  aws.String(bucketName),
+		Key:                     aws.String(key),
+		Metadata:                aws.StringMap(metadata),
+		CacheControl:            optionalString(cacheControl),
+		ContentType:             optionalString(contentType),
+		ServerSideEncryption:    encryptionAlgorithm(),
+		SSEKMSKeyId:             optionalString(kmsKeyID),
+		SSEKMSEncryptionContext: encryptionContextHeader(assetID),
 	})
+	url, headers, err := req.PresignRequest(timeout)
+	return url, flattenHeaders(headers), err
+}
+
+// the time upload urls signed now for timeout expire, as a record attribute
+func uploadExpiresValue(timeout time.Duration) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(time.Now().Add(timeout).Unix(), 10))}
+}
+
+// fetches an asset record, writing an error and returning false if it
+// can't be found
+func fetchAsset(w http.ResponseWriter, r *http.Request, assetID string) (map[string]*dynamodb.AttributeValue, bool) {
+	item, err := getAsset(r.Context(), assetID)
 	if err != nil {
-		log.Println(err.Error())
+		writeError(w, err)
+		return nil, false
 	}
+	return item, true
 }
 
-// returned a signed url that can be used to download an asset
-func handleAssetURLRequest(w http.ResponseWriter, r *http.Request, assetID string) {
-	// fetch the asset record from db
+// fetches an asset record, failing with ErrNotFound if there is none
+func getAsset(ctx context.Context, assetID string) (map[string]*dynamodb.AttributeValue, error) {
 	query := &dynamodb.GetItemInput{
 		Key: map[string]*dynamodb.AttributeValue{
 			"id": {
@@ -141,67 +474,346 @@ func handleAssetURLRequest(w http.ResponseWriter, r *http.Request, assetID strin
 		TableName:      aws.String(tableName),
 		ConsistentRead: aws.Bool(true),
 	}
-	result, err := dbSvc.GetItem(query)
+	result, err := dbSvc.GetItemWithContext(ctx, query)
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			log.Println(aerr.Error())
-		} else {
-			log.Println(err.Error())
-		}
-		http.Error(w, "Unexpected internal error.", http.StatusInternalServerError)
-		return
+		return nil, storeError(err)
 	}
 
-	// error if not found
-	if _, ok := result.Item["id"]; !ok {
-		http.Error(w, fmt.Sprintf("Asset id '%s' not found.", assetID), http.StatusNotFound)
-		return
+	// error if not found, deleted assets being hidden until restored
+	if _, ok := result.Item["id"]; !ok || isDeleted(result.Item) {
+		return nil, notFound(assetID)
 	}
+	return result.Item, nil
+}
 
-	// error if found but not yet uploaded
-	if status, ok := result.Item["status"]; !ok || *status.S != assetStatusUploaded {
-		http.Error(w, fmt.Sprintf("Asset id '%s' found but upload is not complete.", assetID), http.StatusAccepted)
-		return
+// the primary key of an asset record
+func assetKey(assetID string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"id": {
+			S: aws.String(assetID),
+		},
 	}
+}
 
-	// parse and validate the timeout parameter
-	timeoutStr := r.URL.Query().Get("timeout")
-	timeout := defaultDownloadTimeout
-	if timeoutStr != "" {
-		timeoutSec, err := strconv.Atoi(timeoutStr)
-		if err != nil {
-			http.Error(w, "Invalid argument for timeout, must be integer.", http.StatusBadRequest)
-			return
-		}
-		timeout = time.Duration(timeoutSec) * time.Second
-		if timeout < time.Second || timeout > maxDownloadTimeout {
-			http.Error(w, "Please use a more reasonable timeout.", http.StatusBadRequest)
-			return
-		}
+// returns the string value of an attribute on a record, or empty if unset
+func stringAttribute(item map[string]*dynamodb.AttributeValue, name string) string {
+	if v, ok := item[name]; ok && v.S != nil {
+		return *v.S
 	}
+	return ""
+}
 
-	// sign and return a download url
-	req, _ := s3Svc.GetObjectRequest(&s3.GetObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(assetID),
-	})
-	url, err := req.Presign(timeout)
+// returns nil for empty strings so optional request fields are left out
+func optionalString(value string) *string {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+	return aws.String(value)
+}
+
+// returns the integer value of an attribute on a record, or zero if unset
+func numberAttribute(item map[string]*dynamodb.AttributeValue, name string) int64 {
+	if v, ok := item[name]; ok && v.N != nil {
+		n, _ := strconv.ParseInt(*v.N, 10, 64)
+		return n
+	}
+	return 0
+}
+
+// outputs a value as json, leaving signed urls unescaped
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(v)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
 		log.Println(err.Error())
+	}
+}
+
+// appends an assignment for each attribute to a SET update expression,
+// adding their values to the expression's values
+func setAttributes(update string, values, attributes map[string]*dynamodb.AttributeValue) string {
+	for name, value := range attributes {
+		update += fmt.Sprintf(", %s = :%s", name, name)
+		values[":"+name] = value
+	}
+	return update
+}
+
+// reports whether a conditional write was rejected by its condition
+func isConditionFailed(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+// the record a failed condition was checked against, empty if there was
+// none or it wasn't asked for
+func conditionFailedItem(err error) map[string]*dynamodb.AttributeValue {
+	if cerr, ok := err.(*dynamodb.ConditionalCheckFailedException); ok {
+		return cerr.Item
+	}
+	return nil
+}
+
+// returned a signed url that can be used to download an asset
+func handleAssetURLRequest(w http.ResponseWriter, r *http.Request, assetID string) {
+	response, ok := assetDownloadURL(w, r, assetID)
+	if !ok {
 		return
 	}
 	encoder := json.NewEncoder(w)
 	encoder.SetEscapeHTML(false)
-	err = encoder.Encode(assetURLResponse{
-		DownloadURL: url,
-	})
+	err := encoder.Encode(response)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// redirects to a signed url so the service url can go straight into
+// <img> and <a> tags
+func handleDownloadRedirect(w http.ResponseWriter, r *http.Request, assetID string) {
+	response, ok := assetDownloadURL(w, r, assetID)
+	if !ok {
+		return
+	}
+	http.Redirect(w, r, response.DownloadURL, http.StatusFound)
+}
+
+// an asset download worked out but not yet signed
+type downloadTarget struct {
+	response assetURLResponse
+	// nil for public assets, whose response already has their stable url
+	input   *s3.GetObjectInput
+	timeout time.Duration
+}
+
+// works out the url an asset can be downloaded from, writing an error and
+// returning false if it can't be
+func assetDownloadURL(w http.ResponseWriter, r *http.Request, assetID string) (assetURLResponse, bool) {
+	target, ok := resolveDownload(w, r, assetID)
+	if !ok || target.input == nil {
+		return target.response, ok
+	}
+	response := target.response
+
+	// limited-use links are served by the service so it can count them
+	downloadLimit, ok := parseDownloadLimit(w, r)
+	if !ok {
+		return response, false
+	}
+
+	// sign and return a download url, from the CDN when there is one
+	var err error
+	if downloadLimit > 0 {
+		response.DownloadURL, err = createDownloadToken(r, assetID, target.input, downloadLimit, target.timeout)
+	} else {
+		response.DownloadURL, err = cachedPresignDownload(r, target.input, target.timeout)
+	}
 	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
 		log.Println(err.Error())
+		return response, false
+	}
+	countDownload(assetID)
+	details := map[string]string{"url": "download"}
+	if downloadLimit > 0 {
+		details["download_limit"] = strconv.Itoa(downloadLimit)
+	}
+	recordAssetEvent(r, assetID, assetEventURLIssued, details)
+	return response, true
+}
+
+// stops a download's look at its object when its record can't be had,
+// the response saying why having been written
+var errRecordUnavailable = errors.New("asset record unavailable")
+
+// works out which object a download request is for and how it's served,
+// writing an error and returning false if it can't be downloaded
+func resolveDownload(w http.ResponseWriter, r *http.Request, assetID string) (downloadTarget, bool) {
+	var target downloadTarget
+	response := &target.response
+
+	// the latest object is described while the record is fetched, as it's
+	// usually the one the record points at; its key is the asset ID unless
+	// the record puts it in a folder, so the look is called off as soon as
+	// the record does, or can't be had
+	group, ctx := errgroup.WithContext(r.Context())
+	headCtx, cancelHead := context.WithCancel(ctx)
+	defer cancelHead()
+	var latestHead *s3.HeadObjectOutput
+	var headErr error
+	group.Go(func() error {
+		latestHead, headErr = s3Svc.HeadObjectWithContext(headCtx, &s3.HeadObjectInput{
+			Bucket: aws.String(bucketName),
+			Key:    aws.String(assetID),
+		})
+		// a failed look only means looking again once the key is known
+		return nil
+	})
+
+	// fetch the asset record from db, as of a given write if asked
+	var item map[string]*dynamodb.AttributeValue
+	ok := false
+	group.Go(func() error {
+		item, ok = fetchAssetAfter(w, r, assetID)
+		if !ok {
+			return errRecordUnavailable
+		}
+		if objectKey(assetID, item) != assetID {
+			cancelHead()
+		}
+		return nil
+	})
+	group.Wait()
+	if !ok {
+		return target, false
+	}
+
+	// error if found but not yet uploaded
+	if status, ok := item["status"]; !ok || *status.S != assetStatusUploaded {
+		if refreshExpiredUpload(w, r, assetID, item) {
+			return target, false
+		}
+		http.Error(w, fmt.Sprintf("Asset id '%s' found but upload is not complete.", assetID), http.StatusAccepted)
+		return target, false
+	}
+
+	if !checkExpiry(w, assetID, item) || !checkEmbargo(w, assetID, item) {
+		return target, false
+	}
+
+	// the latest version unless an older one is asked for
+	latest := item
+	item, ok = requestedVersion(w, r, assetID, item)
+	if !ok {
+		return target, false
+	}
+	response.Version = stringAttribute(item, "s3_version_id")
+
+	// describe the object so clients needn't fetch it to find out
+	// objects initialized in a folder aren't where the early look was
+	head := latestHead
+	if headErr != nil || objectKey(assetID, item) != assetID || (response.Version != "" && response.Version != aws.StringValue(head.VersionId)) {
+		var err error
+		head, err = objectHead(r.Context(), objectKey(assetID, item), response.Version)
+		if err != nil {
+			writeError(w, err)
+			return target, false
+		}
+	}
+	response.Size = head.ContentLength
+	response.ContentType = aws.StringValue(head.ContentType)
+	response.ETag = aws.StringValue(head.ETag)
+	response.LastModified = head.LastModified
+	if !checkArchived(w, assetID, head) {
+		return target, false
+	}
+	if r.URL.Query().Get("version") == "" {
+		shadowRead(assetID, item, head)
+	}
+
+	// public assets have a stable url that needs no signing
+	if isPublic(latest) && r.URL.Query().Get("version") == "" {
+		response.DownloadURL = publicURL(r, assetID, objectKey(assetID, latest), response.ContentType)
+		return target, true
 	}
+
+	// parse and validate the timeout parameter
+	target.timeout, ok = parseDurationParam(w, r, "timeout", defaultDownloadTimeout, minURLTimeout, maxDownloadTimeout)
+	if !ok {
+		return target, false
+	}
+
+	target.input, ok = downloadInput(w, r, assetID, item, head)
+	return target, ok
+}
+
+// works out how an asset's object, described by head, should be served,
+// writing an error and returning false if it shouldn't be
+func downloadInput(w http.ResponseWriter, r *http.Request, assetID string, item map[string]*dynamodb.AttributeValue, head *s3.HeadObjectOutput) (*s3.GetObjectInput, bool) {
+	// refuse objects that aren't encrypted the way the record says
+	if !encryptionMatches(item, head) {
+		log.Printf("asset %s is not encrypted with its recorded key %s", assetID, stringAttribute(item, "kms_key_id"))
+		http.Error(w, fmt.Sprintf("Asset id '%s' is not encrypted with its recorded key.", assetID), http.StatusConflict)
+		return nil, false
+	}
+
+	// callers may override the content type browsers are told, which is
+	// then held to the same rules as the stored one
+	contentType := aws.StringValue(head.ContentType)
+	var responseContentType *string
+	if value := r.URL.Query().Get("content_type"); value != "" {
+		if mediaType, _, err := mime.ParseMediaType(value); err != nil || !strings.Contains(mediaType, "/") {
+			http.Error(w, "Invalid argument for content_type, must be a media type.", http.StatusBadRequest)
+			return nil, false
+		}
+		contentType = value
+		responseContentType = aws.String(value)
+	}
+
+	// pick inline or attachment from the content type unless overridden
+	disposition := r.URL.Query().Get("disposition")
+	if disposition == "" {
+		disposition = dispositionFor(contentType)
+	} else if !validDisposition(disposition) {
+		http.Error(w, "Invalid argument for disposition, must be inline or attachment.", http.StatusBadRequest)
+		return nil, false
+	}
+
+	// never let browsers render content that can run script
+	if isActiveContent(contentType) {
+		if activeContentPolicy == activeContentBlock {
+			http.Error(w, fmt.Sprintf("Asset id '%s' has active content and can't be downloaded.", assetID), http.StatusForbidden)
+			return nil, false
+		}
+		disposition = dispositionAttachment
+		responseContentType = aws.String(safeContentType)
+	}
+
+	// save under the original name rather than the random key
+	filename := r.URL.Query().Get("filename")
+	if filename == "" {
+		filename = stringAttribute(item, "filename")
+	} else if err := validateFilename(filename); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid argument for filename: %s.", err.Error()), http.StatusBadRequest)
+		return nil, false
+	}
+
+	// replay the upload's caching policy unless told otherwise
+	cacheControl := r.URL.Query().Get("cache_control")
+	if cacheControl == "" {
+		cacheControl = stringAttribute(item, "cache_control")
+	} else if err := validateCacheControl(cacheControl); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid argument for cache_control: %s.", err.Error()), http.StatusBadRequest)
+		return nil, false
+	}
+
+	input := &s3.GetObjectInput{
+		Bucket:                     aws.String(bucketName),
+		Key:                        aws.String(objectKey(assetID, item)),
+		ResponseCacheControl:       optionalString(cacheControl),
+		ResponseContentDisposition: aws.String(dispositionHeader(disposition, filename)),
+		ResponseContentType:        responseContentType,
+		VersionId:                  optionalString(stringAttribute(item, "s3_version_id")),
+	}
+	return input, true
+}
+
+// signs a url for getting an object, from the CDN when there is one
+func presignDownload(input *s3.GetObjectInput, timeout time.Duration) (string, error) {
+	if cloudFrontSigner != nil {
+		return presignCloudFront(input, timeout)
+	}
+	req, _ := s3Svc.GetObjectRequest(input)
+	return req.Presign(timeout)
 }
 
 func handleMarkUploadedRequest(w http.ResponseWriter, r *http.Request, assetID string) {
+	completionToken, ok := requestCompletionToken(w, r)
+	if !ok {
+		return
+	}
+
 	// validate request body
 	var reqBody markUploadedRequest
 	err := json.NewDecoder(r.Body).Decode(&reqBody)
@@ -214,69 +826,583 @@ func handleMarkUploadedRequest(w http.ResponseWriter, r *http.Request, assetID s
 		return
 	}
 
-	// mark asset uploaded in DB and error if asset not found
-	query := &dynamodb.PutItemInput{
-		Item: map[string]*dynamodb.AttributeValue{
-			"id": {
-				S: aws.String(assetID),
-			},
-			"status": {
-				S: aws.String(assetStatusUploaded),
-			},
-		},
-		TableName:           aws.String(tableName),
-		ConditionExpression: aws.String("attribute_exists(id)"),
+	// make sure the object is intact before anyone downloads it
+	expected, err := parseChecksums(reqBody.MD5, reqBody.SHA256)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid checksum: %s.", err.Error()), http.StatusBadRequest)
+		return
 	}
-	_, err = dbSvc.PutItem(query)
+	key, err := lookupObjectKey(r.Context(), assetID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !expected.empty() {
+		ok, err := verifyChecksums(r.Context(), key, expected)
+		if err != nil {
+			if aerr, isAWS := err.(awserr.Error); isAWS && aerr.Code() == "NotFound" {
+				http.Error(w, fmt.Sprintf("Asset id '%s' has no uploaded content.", assetID), http.StatusConflict)
+				return
+			}
+			writeError(w, err)
+			return
+		}
+		if !ok {
+			http.Error(w, fmt.Sprintf("Asset id '%s' does not match the given checksum.", assetID), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	attributes := expected.attributes()
+	if !markUploaded(w, r, assetID, key, completionToken, attributes) {
+		return
+	}
+	writeJSON(w, markUploadedResponse{
+		DuplicateOf:      recordDuplicate(assetID, attributes),
+		ConsistencyToken: w.Header().Get(consistencyTokenHeader),
+	})
+}
+
+// flips an asset's status to uploaded, also setting any given attributes,
+// writing an error and returning false if the asset is not found, locked
+// by someone else or rejected by validation; key is where its object is,
+// and a completion token, if given, must match the one issued for it
+func markUploaded(w http.ResponseWriter, r *http.Request, assetID, key, completionToken string, attributes map[string]*dynamodb.AttributeValue) bool {
+	// whatever path the bytes came by
+	if requireCompletionToken && completionToken == "" {
+		http.Error(w, fmt.Sprintf("Missing %s header.", completionTokenHeader), http.StatusForbidden)
+		return false
+	}
+	// a rejected upload is recorded as such rather than made available
+	status := assetStatusUploaded
+	rejection, err := validateUpload(r.Context(), assetID)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "Upload validation is unavailable, try again later.", http.StatusBadGateway)
+		return false
+	}
+	if rejection != "" {
+		status = assetStatusRejected
+		attributes = map[string]*dynamodb.AttributeValue{
+			"rejection_reason": {S: aws.String(rejection)},
+		}
+	}
+
+	// in a versioned bucket the record points at the version just uploaded,
+	// which downloads are pinned to until a newer one is marked
+	versionID := ""
+	if rejection == "" {
+		versionID, err = latestVersionID(r.Context(), key)
+		if err != nil {
+			log.Println(err.Error())
+		}
+	}
+
+	// a request past its deadline has been answered 504, so nothing is marked
+	if r.Context().Err() != nil {
+		return false
+	}
+	values := lockConditionValues(r)
+	values[":status"] = &dynamodb.AttributeValue{S: aws.String(status)}
+	values[":deleted"] = &dynamodb.AttributeValue{S: aws.String(assetStatusDeleted)}
+	values[":updated"] = updatedAtValue()
+	update := setAttributes("SET #status = :status, updated_at = :updated", values, attributes)
+	if rejection == "" {
+		update += ", uploaded_at = :updated"
+	}
+	if versionID != "" {
+		values[":versionID"] = &dynamodb.AttributeValue{S: aws.String(versionID)}
+		values[":versions"] = &dynamodb.AttributeValue{SS: aws.StringSlice([]string{versionID})}
+		update += ", s3_version_id = :versionID ADD versions :versions"
+	}
+	// no longer a reservation to reap, and the completion token is spent
+	update += " REMOVE reservation_shard, completion_token, completion_token_expires"
+	condition := "attribute_exists(id) AND (attribute_not_exists(#status) OR #status <> :deleted) AND " + lockCondition
+	if completionToken != "" {
+		values[":completionToken"] = &dynamodb.AttributeValue{S: aws.String(completionToken)}
+		values[":tokenCutoff"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(tokenCutoff(time.Now()), 10))}
+		condition += " AND completion_token = :completionToken AND completion_token_expires > :tokenCutoff"
+	}
+	query := &dynamodb.UpdateItemInput{
+		Key:                                 assetKey(assetID),
+		TableName:                           aws.String(tableName),
+		UpdateExpression:                    aws.String(update),
+		ConditionExpression:                 aws.String(condition),
+		ExpressionAttributeNames:            map[string]*string{"#status": aws.String("status")},
+		ExpressionAttributeValues:           values,
+		ReturnValues:                        aws.String(dynamodb.ReturnValueAllNew),
+		ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValuesOnConditionCheckFailureAllOld),
+	}
+	result, err := dbSvc.UpdateItemWithContext(r.Context(), query)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			if aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
-				http.Error(w, fmt.Sprintf("Asset id '%s' not found.", assetID), http.StatusNotFound)
-				return
+				item := conditionFailedItem(err)
+				switch {
+				case len(item) == 0 || isDeleted(item):
+					writeError(w, notFound(assetID))
+				case isCompletionTokenRefused(item, completionToken):
+					http.Error(w, "Invalid or expired completion token.", http.StatusForbidden)
+				default:
+					http.Error(w, fmt.Sprintf("Asset id '%s' is locked.", assetID), http.StatusLocked)
+				}
+				return false
 			}
 			log.Println(aerr.Error())
 		} else {
 			log.Println(err.Error())
 		}
 		http.Error(w, "Unexpected internal error.", http.StatusInternalServerError)
-		return
+		return false
+	}
+	if rejection != "" {
+		http.Error(w, fmt.Sprintf("Asset id '%s' was rejected: %s", assetID, rejection), http.StatusUnprocessableEntity)
+		return false
 	}
+	if err := recordVersion(assetID, result.Attributes); err != nil {
+		writeError(w, err)
+		return false
+	}
+	if completionToken != "" {
+		noteTokenAccepted(tokenCompletion)
+	}
+	setConsistencyToken(w, assetID, result.Attributes)
+	processUpload(assetID)
+	publishEvent(eventUploaded, assetID, result.Attributes)
+	recordAssetEvent(r, assetID, assetEventUploaded, nil)
+	return true
+}
+
+// an operation on a sub-resource of an asset, e.g. /asset/{id}/lock
+type assetAction struct {
+	methods []string
+	handler func(w http.ResponseWriter, r *http.Request, assetID string)
+}
+
+var assetActions = map[string]assetAction{
+	"lock":          {[]string{http.MethodPost}, handleLockRequest},
+	"unlock":        {[]string{http.MethodPost}, handleUnlockRequest},
+	"multipart":     {[]string{http.MethodPost, http.MethodDelete}, handleMultipartRequest},
+	"part":          {[]string{http.MethodGet}, handlePartURLRequest},
+	"parts":         {[]string{http.MethodGet}, handlePartURLsRequest},
+	"complete":      {[]string{http.MethodPost}, handleCompleteMultipartRequest},
+	"content":       {[]string{http.MethodGet, http.MethodPost}, handleContentRequest},
+	"progress":      {[]string{http.MethodGet}, handleProgressRequest},
+	"public":        {[]string{http.MethodPost, http.MethodDelete}, handlePublicRequest},
+	"embargo":       {[]string{http.MethodPost, http.MethodDelete}, handleEmbargoRequest},
+	"download":      {[]string{http.MethodGet}, handleDownloadRedirect},
+	"alias":         {[]string{http.MethodPost, http.MethodDelete}, handleAliasRequest},
+	"pin":           {[]string{http.MethodPost}, handlePinRequest},
+	"unpin":         {[]string{http.MethodPost}, handleUnpinRequest},
+	"restore":       {[]string{http.MethodPost}, handleRestoreRequest},
+	"versions":      {[]string{http.MethodGet, http.MethodPost}, handleVersionsRequest},
+	"archive":       {[]string{http.MethodPost}, handleArchiveRequest},
+	"reupload":      {[]string{http.MethodPost}, handleReuploadRequest},
+	"download-plan": {[]string{http.MethodGet}, handleDownloadPlanRequest},
+	"meta":          {[]string{http.MethodGet}, handleMetaRequest},
+	"events":        {[]string{http.MethodGet}, handleEventsRequest},
+	"tags":          {[]string{http.MethodGet, http.MethodPost}, handleTagsRequest},
+	"prime":         {[]string{http.MethodPost}, handlePrimeRequest},
+	// restoring from an archive storage class, unlike restoring a deleted asset
+	"archive/restore": {[]string{http.MethodGet, http.MethodPost}, handleArchiveRestoreRequest},
 }
 
 func manageAsset(w http.ResponseWriter, r *http.Request) {
-	if !checkMethod(w, r, http.MethodGet, http.MethodPut) {
+	assetID := strings.TrimPrefix(r.URL.Path, "/asset/")
+
+	// dispatch sub-resource requests
+	if i := strings.Index(assetID, "/"); i >= 0 {
+		action, ok := assetActions[assetID[i+1:]]
+		if _, _, diff := versionDiffPath(assetID[i+1:]); !ok && diff {
+			action, ok = versionDiffAction, true
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if !checkMethod(w, r, action.methods...) {
+			return
+		}
+		w, ok := checkAssetExists(w, r, assetID[:i])
+		if !ok {
+			return
+		}
+		action.handler(w, r, assetID[:i])
+		return
+	}
+
+	if !checkMethod(w, r, http.MethodGet, http.MethodPut, http.MethodPatch, http.MethodDelete) {
+		return
+	}
+	w, ok := checkAssetExists(w, r, assetID)
+	if !ok {
 		return
 	}
-	assetID := strings.TrimPrefix(r.URL.Path, "/asset/")
 
 	if r.Method == http.MethodGet {
 		handleAssetURLRequest(w, r, assetID)
 	} else if r.Method == http.MethodPut {
 		handleMarkUploadedRequest(w, r, assetID)
+	} else if r.Method == http.MethodPatch {
+		handlePatchRequest(w, r, assetID)
+	} else if r.Method == http.MethodDelete {
+		handleDeleteRequest(w, r, assetID)
 	}
 }
 
 // settings
 var bucketName string
 var tableName string
+var changesIndexName string
+var idGen idGenerator = conditionalIDGenerator{}
 var dbSvc dynamodbiface.DynamoDBAPI
 var s3Svc s3iface.S3API
 
 func main() {
-	var port string
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if err := runReplay(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	var port, idStrategy, dispositions, allowedTypes, cloudFrontKeyID, cloudFrontKeyFile, pluginDir string
+	var deleteRate float64
+	var approvalTagList, basePathFlag, apiKeys, apiKeysFile, iamPrincipalList, redactNames, roleList, roleClaimList, auditLogFlag, onBehalfOfList string
+	var tlsCertFile, tlsKeyFile, clientCAFile, clientIdentityList string
+	var requireClientCert bool
 	flag.StringVar(&bucketName, "bucket", "1brown2green", "The name of the bucket to use.")
 	flag.StringVar(&tableName, "table", "assets", "The name of the DynamoDB table to use.")
+	flag.StringVar(&basePathFlag, "base-path", "", "Path prefix to serve every route under, e.g. /files, when mounted behind a shared ingress.")
+	flag.StringVar(&tenantsTableName, "tenants-table", "tenants", "The name of the DynamoDB table holding tenant configuration.")
+	flag.StringVar(&eventsTableName, "events-table", "", "The name of the DynamoDB table logging asset events, keyed on asset_id and sequence; none to not keep a log.")
+	flag.StringVar(&subscriptionsTableName, "subscriptions-table", "", "The name of the DynamoDB table holding event subscriptions, none to disable them.")
+	flag.StringVar(&changesIndexName, "changes-index", "changes-index", "The name of the DynamoDB index on changes_shard and updated_at.")
+	flag.DurationVar(&tombstoneTTL, "tombstone-ttl", tombstoneTTL, "How long assets deleted outright are still listed as deleted by /assets/changes.")
+	flag.StringVar(&treeIndexName, "tree-index", "tree-index", "The name of the DynamoDB index on folder and path.")
+	flag.StringVar(&tagIndexName, "tag-index", "tag-index", "The name of the DynamoDB index on tag and asset_id.")
+	flag.StringVar(&statusIndexName, "status-index", "status-index", "The name of the DynamoDB index on status and created_at.")
+	flag.StringVar(&keyPrefixIndexName, "key-prefix-index", "key-prefix-index", "The name of the DynamoDB index on key_prefix and id.")
+	flag.StringVar(&ownerIndexName, "owner-index", "owner-index", "The name of the DynamoDB index on owner and created_at.")
+	flag.StringVar(&projectIndexName, "project-index", "project-index", "The name of the DynamoDB index on project_shard and project.")
+	flag.StringVar(&checksumIndexName, "checksum-index", "checksum-index", "The name of the DynamoDB index on sha256, used to spot duplicate uploads.")
+	flag.StringVar(&idStrategy, "id-strategy", idStrategyConditional, "How asset IDs are reserved: conditional, pool or time.")
+	flag.StringVar(&idBlockTableName, "id-block-table", "", "The name of a DynamoDB table, keyed on id, where the pool id strategy reserves its blocks of IDs.")
+	flag.StringVar(&defaultCacheControl, "cache-control", "", "Cache-Control applied to uploads that don't set cache_control.")
+	flag.StringVar(&dispositions, "disposition", "image/*=inline,*=attachment", "Download disposition by content type, as comma separated pattern=inline|attachment rules.")
+	flag.StringVar(&activeContentPolicy, "active-content", activeContentForce, "How HTML/SVG/JS downloads are handled: force (as attachment) or block.")
+	flag.BoolVar(&requireDeleteConfirmation, "require-delete-confirmation", false, "Make DELETE /asset/{id} return a token that a second DELETE must pass as confirm.")
+	flag.BoolVar(&requireCompletionToken, "require-completion-token", false, "Make PUT /asset/{id} take the completion token issued with the asset's upload url in the '"+completionTokenHeader+"' header.")
+	flag.DurationVar(&gcWindow, "gc-window", gcWindow, "How long abandoned reservations and expired assets stay marked, and can be kept, before they're deleted; 0 deletes them outright.")
+	flag.StringVar(&gcIndexName, "gc-index", "gc-index", "The name of the DynamoDB index on gc_shard and gc_at.")
+	flag.DurationVar(&deleteRetention, "delete-retention", deleteRetention, "How long deleted assets can be restored before they're purged; 0 deletes them outright.")
+	flag.StringVar(&purgeIndexName, "purge-index", "purge-index", "The name of the DynamoDB index on purge_shard and purge_at.")
+	flag.Int64Var(&approvalSize, "approval-size", 0, "Objects at least this many bytes are only deleted once an operator approves; 0 for no size threshold.")
+	flag.StringVar(&approvalTagList, "approval-tags", "", "Comma separated tags whose assets are only deleted once an operator approves.")
+	flag.StringVar(&approvalIndexName, "approval-index", "approval-index", "The name of the DynamoDB index on approval_shard and deletion_requested_at.")
+	flag.StringVar(&approvalWebhook, "approval-webhook", "", "URL told about each deletion left waiting for approval.")
+	flag.Float64Var(&deleteRate, "delete-rate", 25, "Maximum background deletions per second.")
+	flag.StringVar(&rateLimitTableName, "rate-limit-table", "", "The name of a DynamoDB table, keyed on id, counting rate limited work such as background deletions across instances, so -delete-rate applies to all of them together; none to apply it to each instance.")
+	flag.DurationVar(&downloadStatsInterval, "download-stats-interval", downloadStatsInterval, "How often download counts are written to DynamoDB, on average; 0 disables them.")
+	flag.BoolVar(&mirrorMetadata, "mirror-metadata", false, "Copy metadata patched onto uploaded assets onto their objects too.")
+	flag.DurationVar(&existenceRebuildInterval, "existence-filter", 0, "How often the bloom filter of asset IDs that GETs are checked against is rebuilt; 0 disables it.")
+	flag.Float64Var(&existenceFalsePositiveRate, "existence-filter-rate", existenceFalsePositiveRate, "False positive rate the existence filter is sized for.")
+	flag.Float64Var(&urlCacheFraction, "url-cache-fraction", 0, "Fraction of a download url's lifetime it's reused for identical requests, e.g. 0.25; 0 signs every url afresh.")
+	flag.BoolVar(&proxyDownloads, "proxy-downloads", false, "Serve GET /asset/{id}/content by streaming objects through the service.")
+	flag.Int64Var(&maxProxyUploadSize, "max-proxy-upload", maxProxyUploadSize, "Largest body in bytes accepted by proxied uploads.")
+	flag.DurationVar(&maxUploadTimeout, "max-upload-timeout", maxUploadTimeout, "How long upload URLs last by default and at most.")
+	flag.IntVar(&warmPoolSize, "warm-pool", 0, "Number of uploads to keep reserved and signed ahead of inits without options.")
+	flag.StringVar(&validationWebhook, "validation-webhook", "", "URL called with each finished upload, which stays unavailable if it responds 4xx.")
+	flag.StringVar(&cloudFrontDomain, "cloudfront-domain", "", "CloudFront distribution domain to serve download URLs from instead of S3.")
+	flag.StringVar(&cloudFrontKeyID, "cloudfront-key-id", "", "ID of the CloudFront key pair or public key that signs download URLs.")
+	flag.StringVar(&cloudFrontKeyFile, "cloudfront-key-file", "", "PEM file holding the private key that signs CloudFront download URLs.")
+	flag.StringVar(&pluginDir, "plugin-dir", "", "Directory of Go plugins (*.so) exporting ValidateRequest and/or ProcessUpload hooks.")
+	flag.StringVar(&publicBaseURL, "public-url", "", "Base URL where objects are world-readable, used for public assets instead of redirecting through the service.")
+	flag.StringVar(&embargoIndexName, "embargo-index", "embargo-index", "The name of the DynamoDB index on embargo_shard and available_at.")
+	flag.StringVar(&expiryIndexName, "expiry-index", "expiry-index", "The name of the DynamoDB index on expiry_shard and expires_at.")
+	flag.StringVar(&deletionIndexName, "deletion-index", "deletion-index", "The name of the DynamoDB index on deletion_shard and delete_at.")
+	flag.StringVar(&deletionWebhook, "deletion-webhook", "", "URL told when assets are deleted as scheduled with delete_at.")
+	flag.DurationVar(&bundleRetention, "bundle-retention", bundleRetention, "How long bundle archives are kept after they're started before an hourly sweep deletes them, at least the hour their links last; 0 keeps them.")
+	flag.DurationVar(&multipartMaxAge, "multipart-max-age", multipartMaxAge, "How old unfinished multipart uploads get before an hourly sweep aborts them; 0 never aborts them.")
+	flag.DurationVar(&reapInterval, "reap-interval", reapInterval, "How often reservations never marked uploaded are deleted once their upload url has expired; 0 disables the reaper.")
+	flag.StringVar(&reservationIndexName, "reservation-index", "reservation-index", "The name of the DynamoDB index on reservation_shard and upload_expires.")
+	flag.DurationVar(&expirySweepInterval, "expiry-sweep", expirySweepInterval, "How often expired assets are deleted; 0 disables the sweep.")
+	flag.StringVar(&embargoWebhook, "embargo-webhook", "", "URL told when embargoed assets become publishable.")
+	flag.StringVar(&capturePrefix, "capture-prefix", "", "Bucket prefix to record anonymized request traces under for replaying, e.g. captures/; empty disables capture.")
+	flag.StringVar(&shadowTableName, "shadow-table", "", "Alternate DynamoDB table that sampled reads are compared against.")
+	flag.StringVar(&shadowBucketName, "shadow-bucket", "", "Alternate bucket that sampled reads are compared against.")
+	flag.Float64Var(&shadowPercent, "shadow-percent", 0, "Percentage of download requests repeated against -shadow-table/-shadow-bucket.")
+	flag.StringVar(&sloConfigFile, "slo-config", "", "JSON file of latency and error objectives by route, e.g. {\"/asset/\": {\"target\": 0.999, \"latency_ms\": 300}}.")
+	flag.StringVar(&sloWebhook, "slo-webhook", "", "URL told when a route burns its error budget too fast.")
+	flag.StringVar(&kmsKeyID, "kms-key", "", "ARN of a KMS key to encrypt uploads with, recording the key and encryption context on each asset.")
+	flag.StringVar(&allowedTypes, "allowed-types", "", "Comma separated content types uploads may declare, e.g. image/*,application/pdf; empty allows any.")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", shutdownTimeout, "How long each subsystem, such as the HTTP server or a background sweep, gets to stop on shutdown.")
+	flag.BoolVar(&trustForwardedFor, "trust-forwarded-for", false, "Take client addresses from the last X-Forwarded-For entry, as added by a load balancer, when checking upload networks.")
+	flag.DurationVar(&clockSkew, "clock-skew", 0, "How far clocks may drift apart, tolerated when checking when tokens expire or become valid.")
+	flag.DurationVar(&tokenExpiryGrace, "token-expiry-grace", 0, "How long past expiry, on top of -clock-skew, tokens the service checks are still accepted.")
+	flag.StringVar(&apiKeys, "api-keys", "", "Comma separated name=key pairs; requests must send one of the keys as X-API-Key.")
+	flag.StringVar(&apiKeysFile, "api-keys-file", "", "File of API keys, one \"name key\" pair per line.")
+	flag.StringVar(&apiKeysTableName, "api-keys-table", "", "The name of a DynamoDB table of API keys, by the hex SHA-256 of each key as id with a name; none to only use -api-keys and -api-keys-file.")
+	flag.StringVar(&jwksURL, "jwks-url", "", "URL of the JWKS of an identity provider whose RS256/384/512 or ES256/384 signed JWTs requests can send as bearer tokens, owning what they create as the token's subject; none to not accept bearer tokens.")
+	flag.StringVar(&jwtIssuer, "jwt-issuer", "", "The iss bearer tokens must have; empty to not check it.")
+	flag.StringVar(&jwtAudience, "jwt-audience", "", "An aud bearer tokens must have; empty to not check it.")
+	flag.StringVar(&oidcIssuer, "oidc-issuer", "", "The https issuer url of an OpenID Connect provider, whose discovery document sets the JWKS url and issuer bearer tokens are checked against, instead of -jwks-url and -jwt-issuer.")
+	flag.StringVar(&oidcRolesClaim, "oidc-roles-claim", "", "The claim, or dotted path to one such as realm_access.roles, listing a bearer token's roles; empty to not map roles.")
+	flag.StringVar(&oidcTenantClaim, "oidc-tenant-claim", "", "The claim, or dotted path to one, naming a bearer token's tenant; empty to not map tenants.")
+	flag.StringVar(&iamPrincipalList, "iam-principals", "", "Comma separated name=arn pairs of IAM roles and users whose callers can send an X-IAM-Token, a presigned STS GetCallerIdentity url, instead of an API key; none to not accept IAM tokens.")
+	flag.StringVar(&iamAudience, "iam-audience", iamAudience, "The X-Asset-Uploader-Audience header value IAM tokens must be signed with.")
+	flag.BoolVar(&rbacEnabled, "rbac", false, "Limit callers to what their role allows: reader to get download urls, uploader to also init and complete uploads, admin to do anything, including listing and deleting.")
+	flag.StringVar(&onBehalfOfList, "on-behalf-of-callers", "", "Comma separated names of API keys, IAM principals and client certificate identities that may act for an end user named in an X-On-Behalf-Of header.")
+	flag.StringVar(&roleList, "roles", "", "Comma separated name=role pairs giving API keys and IAM principals, by name, the role reader, uploader or admin.")
+	flag.StringVar(&roleClaimList, "role-claims", "", "Comma separated value=role pairs mapping bearer token roles, from -oidc-roles-claim, to reader, uploader or admin; empty to take roles named like those as they are.")
+	flag.BoolVar(&debugLogging, "debug", false, "Log every request and response with their headers and the start of response bodies; signatures, credentials and tokens are redacted from all logs regardless.")
+	flag.StringVar(&redactNames, "redact", "", "Comma separated query parameters, headers and JSON fields whose values are redacted from logs, on top of the built in ones.")
+	flag.StringVar(&auditLogFlag, "audit-log", "", "Where to record every request that changes state, with its caller, source IP and result: dynamodb:<table> keyed on day and sequence, cloudwatch:<log group> or file:<path>; none to not keep an audit log.")
+	flag.StringVar(&tlsCertFile, "tls-cert", "", "PEM file of the certificate, with any intermediates, to serve HTTPS with; none to serve plain HTTP.")
+	flag.StringVar(&tlsKeyFile, "tls-key", "", "PEM file of the private key of -tls-cert.")
+	flag.StringVar(&clientCAFile, "client-ca", "", "PEM bundle of the CAs whose client certificates authenticate callers, needing -tls-cert; none to not ask for client certificates.")
+	flag.BoolVar(&requireClientCert, "require-client-cert", false, "Refuse connections without a client certificate issued by a -client-ca.")
+	flag.StringVar(&clientIdentityList, "client-identities", "", "Semicolon separated name=subject pairs naming the identities of client certificates by RFC 2253 subject, e.g. ci=CN=ci,O=Example, or by a URI or DNS name they're issued for; empty to take each certificate's common name as its identity.")
+	flag.StringVar(&jobsTableName, "jobs-table", "", "The name of a DynamoDB table, keyed on id with TTL on expires, keeping the status of jobs so every instance can report and cancel them, also after a restart; none to keep them in memory.")
+	flag.StringVar(&leaderTableName, "leader-table", "", "The name of a DynamoDB table, keyed on id, where instances elect a leader that alone runs background sweeps; none to run them on every instance.")
+	flag.DurationVar(&leaderLease, "leader-lease", leaderLease, "How long the leader's lease lasts unless renewed; another instance takes over at most this long after the leader stops.")
 	flag.StringVar(&port, "port", "8080", "The port that the server should listen on.")
 	flag.Parse()
 
 	//init
 	rand.Seed(time.Now().UnixNano())
+	var err error
+	idGen, err = newIDGenerator(idStrategy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dispositionRules, err = parseDispositionRules(dispositions)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if activeContentPolicy != activeContentForce && activeContentPolicy != activeContentBlock {
+		log.Fatalf("unknown active content policy '%s'", activeContentPolicy)
+	}
+	if deleteRate <= 0 {
+		log.Fatal("delete-rate must be positive")
+	}
+	if shadowPercent < 0 || shadowPercent > 100 {
+		log.Fatal("shadow-percent must be from 0 to 100")
+	}
+	if shadowPercent > 0 && shadowTableName == "" && shadowBucketName == "" {
+		log.Fatal("shadow-percent needs a shadow-table or shadow-bucket to compare against")
+	}
+	if existenceFalsePositiveRate <= 0 || existenceFalsePositiveRate >= 1 {
+		log.Fatal("existence-filter-rate must be between 0 and 1")
+	}
+	if urlCacheFraction < 0 || urlCacheFraction >= 1 {
+		log.Fatal("url-cache-fraction must be at least 0 and less than 1")
+	}
+	if maxUploadTimeout < time.Second {
+		log.Fatal("max-upload-timeout must be at least a second")
+	}
+	if sloConfigFile != "" {
+		routeSLOs, err = loadSLOs(sloConfigFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	deleteThrottle = newThrottle(deleteRate)
+	if rateLimitTableName != "" {
+		deleteThrottle.shared = "delete"
+	}
+	approvalTags, err = parseApprovalTags(approvalTagList)
+	if err != nil {
+		log.Fatal(err)
+	}
+	basePath, err = parseBasePath(basePathFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := parseAPIKeys(apiKeys); err != nil {
+		log.Fatal(err)
+	}
+	if apiKeysFile != "" {
+		if err := loadAPIKeysFile(apiKeysFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if redactNames != "" {
+		setRedactedNames(strings.Split(redactNames, ","))
+	}
+	if err := parseIAMPrincipals(iamPrincipalList); err != nil {
+		log.Fatal(err)
+	}
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		log.Fatal("-tls-cert and -tls-key must be given together")
+	}
+	if clientCAFile != "" && tlsCertFile == "" {
+		log.Fatal("-client-ca needs -tls-cert, client certificates only being sent over TLS")
+	}
+	if (requireClientCert || clientIdentityList != "") && clientCAFile == "" {
+		log.Fatal("-require-client-cert and -client-identities need -client-ca")
+	}
+	var tlsConfig *tls.Config
+	if tlsCertFile != "" {
+		if tlsConfig, err = newTLSConfig(tlsCertFile, tlsKeyFile, clientCAFile, requireClientCert); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := parseClientIdentities(clientIdentityList); err != nil {
+		log.Fatal(err)
+	}
+	parseOnBehalfOfCallers(onBehalfOfList)
+	if err := parseRoles(roleList, namedRoles); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseRoles(roleClaimList, claimRoles); err != nil {
+		log.Fatal(err)
+	}
+	if leaderLease < 3*time.Second {
+		log.Fatal("-leader-lease must be at least 3s")
+	}
+	if bundleRetention > 0 && bundleRetention < bundleURLTimeout {
+		log.Fatal("-bundle-retention must be at least 1h, as long as bundle links last")
+	}
+	if oidcIssuer != "" {
+		if err := discoverOIDC(); err != nil {
+			log.Fatal(err)
+		}
+	} else if jwksURL != "" {
+		if u, err := url.Parse(jwksURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			log.Fatalf("invalid -jwks-url '%s'", jwksURL)
+		}
+	}
+	if rbacEnabled && !authenticationEnabled() {
+		log.Fatal("-rbac needs API keys, a JWKS url, IAM principals or a client CA to tell callers apart")
+	}
+	if !authenticationEnabled() {
+		log.Println("no API keys, JWKS url, IAM principals or client CA configured, serving requests without authentication")
+	}
+	allowedContentTypes = parseContentTypePatterns(allowedTypes)
+	if pluginDir != "" {
+		if err := loadPlugins(pluginDir); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if cloudFrontDomain != "" {
+		if err := initCloudFront(cloudFrontKeyID, cloudFrontKeyFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if warmPoolSize > 0 && len(allowedContentTypes) > 0 {
+		log.Fatal("warm-pool can't be used with allowed-types, which refuses inits without a content_type")
+	}
 	session := session.New()
 	dbSvc = dynamodb.New(session)
 	s3Svc = s3.New(session)
+	sqsSvc = sqs.New(session)
+	snsSvc = sns.New(session)
+	awsCredentials = session.Config.Credentials
+	awsRegion = aws.StringValue(session.Config.Region)
+	logsSvc = cloudwatchlogs.New(session)
+	if auditLogFlag != "" {
+		if auditLog, err = newAuditSink(auditLogFlag); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// anything after the flags is an admin subcommand, run instead of serving
+	if flag.NArg() > 0 {
+		if err := runAdminCommand(flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if warmPoolSize > 0 {
+		startWarmPool(warmPoolSize)
+	}
+	// started before and stopped after the sweeps only its leader runs
+	if leaderTableName != "" {
+		addLoop("leader election", watchLeadership)
+	}
+	if embargoWebhook != "" {
+		addLeaderLoop("embargo announcer", watchEmbargoes)
+	}
+	if downloadStatsInterval > 0 {
+		addLoop("download stats", watchDownloadStats)
+	}
+	if expirySweepInterval > 0 {
+		addLeaderLoop("expiry sweep", watchExpiries)
+	}
+	// also retries removals whose cleanup failed, retention or not
+	addLeaderLoop("purge sweep", watchPurges)
+	if gcWindow > 0 {
+		addLeaderLoop("gc sweep", watchCollections)
+	}
+	if reapInterval > 0 {
+		addLeaderLoop("reservation reaper", watchReservations)
+	}
+	addLeaderLoop("scheduled deletions", watchDeletions)
+	if existenceRebuildInterval > 0 {
+		addLoop("existence filter", watchExistence)
+	}
+	if multipartMaxAge > 0 {
+		addLeaderLoop("multipart sweep", watchMultipartUploads)
+	}
+	if bundleRetention > 0 {
+		addLeaderLoop("bundle sweep", watchBundles)
+	}
+	// stopped after the server, once no more jobs can start
+	addSubsystem("jobs", func() error { return nil }, drainJobs)
+	handler := withPlugins(withDeadlines(http.DefaultServeMux))
+	if capturePrefix != "" {
+		handler = withCapture(handler)
+		addLoop("traffic capture", watchCapture)
+	}
+	if len(routeSLOs) > 0 {
+		handler = withSLOs(http.DefaultServeMux, handler)
+		addLoop("slo alerts", watchSLOs)
+	}
+	if auditLog != nil {
+		addLoop("audit log", watchAudit)
+	}
+	// audited outside authentication, so refused requests are recorded too
+	handler = withDebugLogging(withBasePath(withAudit(withAuthentication(handler))))
 
 	http.HandleFunc("/asset", initAsset)
 	http.HandleFunc("/asset/", manageAsset)
+	http.HandleFunc("/asset/upload", uploadForm)
+	http.HandleFunc("/assets", listAssets)
+	http.HandleFunc("/assets/changes", listChanges)
+	http.HandleFunc("/assets/manifest", getManifest)
+	http.HandleFunc("/assets/search", searchAssets)
+	http.HandleFunc("/deletions", bulkDelete)
+	http.HandleFunc("/deletions/pending", listPendingDeletions)
+	http.HandleFunc("/deletions/pending/", managePendingDeletion)
+	http.HandleFunc("/bundle", createBundle)
+	http.HandleFunc("/tree", listTree)
+	http.HandleFunc("/tus", tusCreate)
+	http.HandleFunc("/tus/", tusManage)
+	http.HandleFunc("/jobs", listJobs)
+	http.HandleFunc("/jobs/", manageJob)
+	http.HandleFunc("/download/", serveDownload)
+	http.HandleFunc("/public/", servePublic)
+	http.HandleFunc("/a/", serveAlias)
+	http.HandleFunc("/shadow", getShadowStats)
+	http.HandleFunc("/existence", getExistenceStats)
+	http.HandleFunc("/slo", getSLOStatus)
+	http.HandleFunc("/tokens", getTokenStats)
+	http.HandleFunc("/auth", getAuth)
+	http.HandleFunc("/leader", getLeaderStats)
+	http.HandleFunc("/audit", getAuditLog)
+	http.HandleFunc("/audit/export", exportAuditLog)
+	http.HandleFunc("/gc", getGCStats)
+	http.HandleFunc("/gc/marked", listMarkedAssets)
+	http.HandleFunc("/gc/marked/", undoCollection)
+	http.HandleFunc("/tenants", manageTenants)
+	http.HandleFunc("/tenants/", manageTenant)
+	http.HandleFunc("/subscriptions", manageSubscriptions)
+	http.HandleFunc("/subscriptions/", manageSubscription)
+	// started last so it's stopped, draining requests, before the workers
+	// they feed
+	addServer("http server", &http.Server{Addr: ":" + port, Handler: handler, TLSConfig: tlsConfig})
 	log.Println("Asset uploader starting on port: " + port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	if err := runSubsystems(); err != nil {
+		log.Fatal(err)
+	}
 }
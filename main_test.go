@@ -2,11 +2,15 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
@@ -28,10 +32,106 @@ func (m *mockS3Client) GetObjectRequest(*s3.GetObjectInput) (*request.Request, *
 }
 
 func (m *mockS3Client) PutObjectRequest(*s3.PutObjectInput) (*request.Request, *s3.PutObjectOutput) {
+	r := request.New(aws.Config{}, metadata.ClientInfo{}, request.Handlers{}, nil, &request.Operation{}, nil, nil)
+	return r, &s3.PutObjectOutput{}
+}
+
+func (m *mockS3Client) HeadObject(*s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	return &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(12),
+		ContentType:   aws.String("image/png"),
+	}, nil
+}
+func (m *mockS3Client) HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	return m.HeadObject(input)
+}
+
+func (m *mockS3Client) UploadPartRequest(*s3.UploadPartInput) (*request.Request, *s3.UploadPartOutput) {
 	r := request.New(aws.Config{}, metadata.ClientInfo{}, request.Handlers{}, nil, &request.Operation{}, nil, nil)
 	return r, nil
 }
 
+func (m *mockS3Client) CreateMultipartUpload(*s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error) {
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String("someUploadID")}, nil
+}
+func (m *mockS3Client) CreateMultipartUploadWithContext(ctx aws.Context, input *s3.CreateMultipartUploadInput, opts ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+	return m.CreateMultipartUpload(input)
+}
+
+func (m *mockS3Client) CompleteMultipartUpload(*s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+func (m *mockS3Client) CompleteMultipartUploadWithContext(ctx aws.Context, input *s3.CompleteMultipartUploadInput, opts ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+	return m.CompleteMultipartUpload(input)
+}
+
+func (m *mockS3Client) AbortMultipartUpload(*s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+func (m *mockS3Client) AbortMultipartUploadWithContext(ctx aws.Context, input *s3.AbortMultipartUploadInput, opts ...request.Option) (*s3.AbortMultipartUploadOutput, error) {
+	return m.AbortMultipartUpload(input)
+}
+
+func (m *mockS3Client) ListPartsPages(input *s3.ListPartsInput, fn func(*s3.ListPartsOutput, bool) bool) error {
+	fn(&s3.ListPartsOutput{
+		Parts: []*s3.Part{{PartNumber: aws.Int64(1), ETag: aws.String(`"etag"`)}},
+	}, true)
+	return nil
+}
+func (m *mockS3Client) ListPartsPagesWithContext(ctx aws.Context, input *s3.ListPartsInput, fn func(*s3.ListPartsOutput, bool) bool, opts ...request.Option) error {
+	return m.ListPartsPages(input, fn)
+}
+
+func (m *mockS3Client) DeleteObject(*s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	return &s3.DeleteObjectOutput{}, nil
+}
+func (m *mockS3Client) DeleteObjectWithContext(ctx aws.Context, input *s3.DeleteObjectInput, opts ...request.Option) (*s3.DeleteObjectOutput, error) {
+	return m.DeleteObject(input)
+}
+
+func (m *mockS3Client) ListObjectVersionsPages(input *s3.ListObjectVersionsInput, fn func(*s3.ListObjectVersionsOutput, bool) bool) error {
+	fn(&s3.ListObjectVersionsOutput{
+		Versions: []*s3.ObjectVersion{{Key: input.Prefix, VersionId: aws.String("null")}},
+	}, true)
+	return nil
+}
+func (m *mockS3Client) ListObjectVersionsPagesWithContext(ctx aws.Context, input *s3.ListObjectVersionsInput, fn func(*s3.ListObjectVersionsOutput, bool) bool, opts ...request.Option) error {
+	return m.ListObjectVersionsPages(input, fn)
+}
+
+func (m *mockS3Client) DeleteObjects(*s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	return &s3.DeleteObjectsOutput{}, nil
+}
+func (m *mockS3Client) DeleteObjectsWithContext(ctx aws.Context, input *s3.DeleteObjectsInput, opts ...request.Option) (*s3.DeleteObjectsOutput, error) {
+	return m.DeleteObjects(input)
+}
+
+func (m *mockS3Client) UploadPart(*s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+	return &s3.UploadPartOutput{ETag: aws.String(`"etag"`)}, nil
+}
+func (m *mockS3Client) UploadPartWithContext(ctx aws.Context, input *s3.UploadPartInput, opts ...request.Option) (*s3.UploadPartOutput, error) {
+	return m.UploadPart(input)
+}
+
+func (m *mockS3Client) PutObject(*s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	return &s3.PutObjectOutput{}, nil
+}
+func (m *mockS3Client) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	return m.PutObject(input)
+}
+
+func (m *mockS3Client) GetObject(*s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	return &s3.GetObjectOutput{
+		Body:          ioutil.NopCloser(strings.NewReader("Hello world!")),
+		ContentLength: aws.Int64(12),
+		ContentType:   aws.String("image/png"),
+	}, nil
+}
+
+func (m *mockS3Client) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	return m.GetObject(input)
+}
+
 type mockDBClient struct {
 	dynamodbiface.DynamoDBAPI
 }
@@ -48,9 +148,54 @@ func (m *mockDBClient) GetItem(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput,
 		},
 	}, nil
 }
+func (m *mockDBClient) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return m.GetItem(input)
+}
 func (m *mockDBClient) PutItem(*dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
 	return &dynamodb.PutItemOutput{}, nil
 }
+func (m *mockDBClient) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	return m.PutItem(input)
+}
+func (m *mockDBClient) Query(*dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	return &dynamodb.QueryOutput{
+		Items: []map[string]*dynamodb.AttributeValue{
+			{
+				"id": {
+					S: aws.String("someID"),
+				},
+				"status": {
+					S: aws.String(assetStatusUploaded),
+				},
+				"updated_at": {
+					N: aws.String("1500000000000"),
+				},
+			},
+		},
+	}, nil
+}
+func (m *mockDBClient) QueryWithContext(ctx aws.Context, input *dynamodb.QueryInput, opts ...request.Option) (*dynamodb.QueryOutput, error) {
+	return m.Query(input)
+}
+func (m *mockDBClient) QueryPages(input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool) error {
+	fn(&dynamodb.QueryOutput{}, true)
+	return nil
+}
+func (m *mockDBClient) QueryPagesWithContext(ctx aws.Context, input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool, opts ...request.Option) error {
+	return m.QueryPages(input, fn)
+}
+func (m *mockDBClient) DeleteItem(*dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+func (m *mockDBClient) DeleteItemWithContext(ctx aws.Context, input *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	return m.DeleteItem(input)
+}
+func (m *mockDBClient) UpdateItem(*dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+func (m *mockDBClient) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	return m.UpdateItem(input)
+}
 
 type mockDBMissingKeyClient struct {
 	dynamodbiface.DynamoDBAPI
@@ -59,9 +204,26 @@ type mockDBMissingKeyClient struct {
 func (m *mockDBMissingKeyClient) GetItem(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
 	return &dynamodb.GetItemOutput{Item: map[string]*dynamodb.AttributeValue{}}, nil
 }
+func (m *mockDBMissingKeyClient) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return m.GetItem(input)
+}
+
+// remembers the last item put
+type mockDBPutRecordingClient struct {
+	mockDBClient
+	item map[string]*dynamodb.AttributeValue
+}
+
+func (m *mockDBPutRecordingClient) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	m.item = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+func (m *mockDBPutRecordingClient) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	return m.PutItem(input)
+}
 
 type mockDBNotUploadedClient struct {
-	dynamodbiface.DynamoDBAPI
+	mockDBClient
 }
 
 func (m *mockDBNotUploadedClient) GetItem(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
@@ -73,6 +235,9 @@ func (m *mockDBNotUploadedClient) GetItem(*dynamodb.GetItemInput) (*dynamodb.Get
 		},
 	}, nil
 }
+func (m *mockDBNotUploadedClient) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return m.GetItem(input)
+}
 
 type mockDBErrorClient struct {
 	dynamodbiface.DynamoDBAPI
@@ -81,10 +246,23 @@ type mockDBErrorClient struct {
 func (m *mockDBErrorClient) GetItem(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
 	return nil, errors.New("foo")
 }
+func (m *mockDBErrorClient) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return m.GetItem(input)
+}
 
 func (m *mockDBErrorClient) PutItem(*dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
 	return nil, errors.New("foo")
 }
+func (m *mockDBErrorClient) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	return m.PutItem(input)
+}
+
+func (m *mockDBErrorClient) UpdateItem(*dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	return nil, errors.New("foo")
+}
+func (m *mockDBErrorClient) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	return m.UpdateItem(input)
+}
 
 type mockDBConditionalErrorClient struct {
 	dynamodbiface.DynamoDBAPI
@@ -93,10 +271,27 @@ type mockDBConditionalErrorClient struct {
 func (m *mockDBConditionalErrorClient) PutItem(*dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
 	return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "", nil)
 }
+func (m *mockDBConditionalErrorClient) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	return m.PutItem(input)
+}
+
+func (m *mockDBConditionalErrorClient) UpdateItem(*dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "", nil)
+}
+func (m *mockDBConditionalErrorClient) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	return m.UpdateItem(input)
+}
+
+func (m *mockDBConditionalErrorClient) GetItem(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{}, nil
+}
+func (m *mockDBConditionalErrorClient) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return m.GetItem(input)
+}
 
 func TestReserveUniqueID(t *testing.T) {
 	dbSvc = &mockDBClient{}
-	id, err := reserveUniqueID()
+	id, err := reserveUniqueID(context.Background(), nil)
 	if id == "" {
 		t.Error("Should have gotten a valid ID but got empty")
 	}
@@ -105,7 +300,7 @@ func TestReserveUniqueID(t *testing.T) {
 	}
 
 	dbSvc = &mockDBErrorClient{}
-	id, err = reserveUniqueID()
+	id, err = reserveUniqueID(context.Background(), nil)
 	if id != "" {
 		t.Error("Got a nonempty id with a bad DB client")
 	}
@@ -146,6 +341,52 @@ func TestInitAsset(t *testing.T) {
 		t.Error("Failed to create a new ID for an asset")
 	}
 }
+func TestInitAssetTimeout(t *testing.T) {
+	db := &mockDBPutRecordingClient{}
+	dbSvc = db
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodPost, "/asset?timeout=60", nil)
+	w := httptest.NewRecorder()
+
+	initAsset(w, r)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Errorf("Incorrect status on asset init with a timeout: %d", w.Result().StatusCode)
+	}
+	expires := numberAttribute(db.item, "upload_expires")
+	if expected := time.Now().Add(time.Minute).Unix(); expires < expected-5 || expires > expected {
+		t.Errorf("Recorded upload expiry %d is not a minute out", expires)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/asset?timeout=999999", nil)
+	w = httptest.NewRecorder()
+	initAsset(w, r)
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("Didn't get 400 for a timeout over the maximum: %d", w.Result().StatusCode)
+	}
+}
+func TestParseDurationParam(t *testing.T) {
+	for value, expected := range map[string]time.Duration{
+		"":       time.Minute,
+		"90":     90 * time.Second,
+		"90s":    90 * time.Second,
+		"1500ms": 1500 * time.Millisecond,
+		"2h":     2 * time.Hour,
+		"500ms":  0,
+		"25h":    0,
+		"-5s":    0,
+		"soon":   0,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/asset/someID?timeout="+value, nil)
+		w := httptest.NewRecorder()
+		d, ok := parseDurationParam(w, r, "timeout", time.Minute, time.Second, 24*time.Hour)
+		if ok != (expected != 0) || d != expected {
+			t.Errorf("Parsed timeout %q as %s, %t", value, d, ok)
+		}
+		if !ok && w.Result().StatusCode != http.StatusBadRequest {
+			t.Errorf("Didn't get 400 for timeout %q: %d", value, w.Result().StatusCode)
+		}
+	}
+}
 func TestMarkUploadedOK(t *testing.T) {
 	dbSvc = &mockDBClient{}
 	s3Svc = &mockS3Client{}
@@ -209,6 +450,19 @@ func TestAssetURLRequestOK(t *testing.T) {
 		t.Errorf("Incorrect status while fetching asset url: %d", resp.StatusCode)
 	}
 }
+func TestAssetURLRequestObjectDetails(t *testing.T) {
+	dbSvc = &mockDBClient{}
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodGet, "/asset/someID", nil)
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	jsonResp := assetURLResponse{}
+	json.NewDecoder(w.Result().Body).Decode(&jsonResp)
+	if jsonResp.Size == nil || *jsonResp.Size != 12 || jsonResp.ContentType != "image/png" {
+		t.Errorf("Object details missing from download response: %+v", jsonResp)
+	}
+}
 func TestAssetURLRequest404(t *testing.T) {
 	dbSvc = &mockDBMissingKeyClient{}
 	s3Svc = &mockS3Client{}
@@ -233,6 +487,29 @@ func TestAssetURLRequestNotUploaded(t *testing.T) {
 		t.Errorf("Incorrect status while fetching asset url: %d", resp.StatusCode)
 	}
 }
+func TestDownloadRedirect(t *testing.T) {
+	dbSvc = &mockDBClient{}
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodGet, "/asset/someID/download", nil)
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("Incorrect status redirecting to asset download: %d", resp.StatusCode)
+	}
+}
+func TestDownloadRedirectNotUploaded(t *testing.T) {
+	dbSvc = &mockDBNotUploadedClient{}
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodGet, "/asset/someID/download", nil)
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusAccepted {
+		t.Errorf("Incorrect status redirecting to an unfinished upload: %d", w.Result().StatusCode)
+	}
+}
 func TestAssetURLRequestBadDB(t *testing.T) {
 	dbSvc = &mockDBErrorClient{}
 	s3Svc = &mockS3Client{}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	manifestFilename = "SHA256SUMS"
+	// assets left out of a manifest, comma separated
+	manifestSkippedHeader = "X-Manifest-Skipped"
+	// most assets BatchGetItem fetches at once
+	maxBatchGetAssets = 100
+)
+
+// answers a sha256sum manifest for ?ids= (comma separated) or every asset
+// carrying ?tag=, naming each asset as a bundle of them would, so
+// `sha256sum -c SHA256SUMS` checks the unzipped files; digests not recorded
+// when an asset was marked uploaded are worked out from its object
+func getManifest(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	ids, ok := manifestIDs(w, r)
+	if !ok {
+		return
+	}
+
+	var body strings.Builder
+	skipped := []string{}
+	names := map[string]bool{}
+	for start := 0; start < len(ids); start += maxBatchGetAssets {
+		end := start + maxBatchGetAssets
+		if end > len(ids) {
+			end = len(ids)
+		}
+		items, err := batchGetAssets(r.Context(), ids[start:end])
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		for _, assetID := range ids[start:end] {
+			item, ok := items[assetID]
+			if !ok || stringAttribute(item, "status") != assetStatusUploaded || isExpired(item) || isEmbargoed(item) {
+				skipped = append(skipped, assetID)
+				continue
+			}
+			name := bundleEntryName(assetID, item, names)
+			sum, err := assetSHA256(r.Context(), assetID, item)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			if sum == "" {
+				skipped = append(skipped, assetID)
+				continue
+			}
+			body.WriteString(manifestLine(sum, name))
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, manifestFilename))
+	if len(skipped) > 0 {
+		w.Header().Set(manifestSkippedHeader, strings.Join(skipped, ","))
+	}
+	io.WriteString(w, body.String())
+}
+
+// the assets a manifest request asks for, writing an error and returning
+// false if it doesn't ask for 1 to maxBundleIDs of them
+func manifestIDs(w http.ResponseWriter, r *http.Request) ([]string, bool) {
+	idsValue, tag := r.URL.Query().Get("ids"), r.URL.Query().Get("tag")
+	if (idsValue == "") == (tag == "") {
+		http.Error(w, "A manifest needs either ids or a tag.", http.StatusBadRequest)
+		return nil, false
+	}
+	var ids []string
+	if idsValue != "" {
+		seen := map[string]bool{}
+		for _, id := range strings.Split(idsValue, ",") {
+			if id = strings.TrimSpace(id); id != "" && !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	} else {
+		if !tagPattern.MatchString(tag) {
+			http.Error(w, "Invalid argument for tag.", http.StatusBadRequest)
+			return nil, false
+		}
+		err := dbSvc.QueryPagesWithContext(r.Context(), &dynamodb.QueryInput{
+			TableName:              aws.String(tableName),
+			IndexName:              aws.String(tagIndexName),
+			KeyConditionExpression: aws.String("tag = :tag"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":tag": {S: aws.String(tag)},
+			},
+		}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+			for _, item := range page.Items {
+				ids = append(ids, stringAttribute(item, "asset_id"))
+			}
+			return len(ids) <= maxBundleIDs
+		})
+		if err != nil {
+			writeError(w, err)
+			return nil, false
+		}
+	}
+	if len(ids) == 0 || len(ids) > maxBundleIDs {
+		http.Error(w, fmt.Sprintf("A manifest must cover 1 to %d assets.", maxBundleIDs), http.StatusBadRequest)
+		return nil, false
+	}
+	return ids, true
+}
+
+// a line of sha256sum output; like sha256sum, names holding a newline or
+// backslash have them escaped and the line marked with a leading backslash
+func manifestLine(sum, name string) string {
+	if strings.ContainsAny(name, "\\\n\r") {
+		name = strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`).Replace(name)
+		return `\` + sum + "  " + name + "\n"
+	}
+	return sum + "  " + name + "\n"
+}
+
+// an uploaded asset's SHA-256 in hex, as recorded, as S3 knows it or else
+// by hashing its object; empty if its object is archived
+func assetSHA256(ctx context.Context, assetID string, item map[string]*dynamodb.AttributeValue) (string, error) {
+	if sum := stringAttribute(item, "sha256"); sum != "" {
+		return sum, nil
+	}
+	key := objectKey(assetID, item)
+	versionID := optionalString(stringAttribute(item, "s3_version_id"))
+	head, err := s3Svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(bucketName),
+		Key:          aws.String(key),
+		VersionId:    versionID,
+		ChecksumMode: aws.String(s3.ChecksumModeEnabled),
+	})
+	if err != nil {
+		return "", err
+	}
+	// a checksum with a dash covers the parts, not the object
+	if head.ChecksumSHA256 != nil && !strings.Contains(*head.ChecksumSHA256, "-") {
+		if sum, err := base64.StdEncoding.DecodeString(*head.ChecksumSHA256); err == nil {
+			return hex.EncodeToString(sum), nil
+		}
+	}
+	object, err := s3Svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket:    aws.String(bucketName),
+		Key:       aws.String(key),
+		VersionId: versionID,
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidObjectState" {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer object.Body.Close()
+	d := newDigester()
+	if _, err := io.Copy(d, object.Body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(d.sums().sha256), nil
+}
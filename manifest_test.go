@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// two uploaded assets sharing a filename, one with its digest recorded
+type mockDBManifestClient struct {
+	mockDBClient
+}
+
+func (m *mockDBManifestClient) BatchGetItem(input *dynamodb.BatchGetItemInput) (*dynamodb.BatchGetItemOutput, error) {
+	return &dynamodb.BatchGetItemOutput{Responses: map[string][]map[string]*dynamodb.AttributeValue{
+		tableName: {
+			{
+				"id":       {S: aws.String("someID")},
+				"status":   {S: aws.String(assetStatusUploaded)},
+				"filename": {S: aws.String("report.pdf")},
+				"sha256":   {S: aws.String("0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")},
+			},
+			{
+				"id":       {S: aws.String("otherID")},
+				"status":   {S: aws.String(assetStatusUploaded)},
+				"filename": {S: aws.String("report.pdf")},
+			},
+		},
+	}}, nil
+}
+func (m *mockDBManifestClient) BatchGetItemWithContext(ctx aws.Context, input *dynamodb.BatchGetItemInput, opts ...request.Option) (*dynamodb.BatchGetItemOutput, error) {
+	return m.BatchGetItem(input)
+}
+
+func TestManifest(t *testing.T) {
+	dbSvc = &mockDBManifestClient{}
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodGet, "/assets/manifest?ids=someID,otherID,missingID", nil)
+	w := httptest.NewRecorder()
+
+	getManifest(w, r)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Incorrect status fetching a manifest: %d", resp.StatusCode)
+	}
+	sum := sha256.Sum256([]byte("Hello world!"))
+	expected := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef  report.pdf\n" +
+		hex.EncodeToString(sum[:]) + "  otherID-report.pdf\n"
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != expected {
+		t.Errorf("Incorrect manifest:\n%s\nexpected:\n%s", body, expected)
+	}
+	if skipped := resp.Header.Get(manifestSkippedHeader); skipped != "missingID" {
+		t.Errorf("Incorrect skipped assets: %s", skipped)
+	}
+
+	for _, query := range []string{"", "?ids=a&tag=b", "?tag=Bad!"} {
+		r = httptest.NewRequest(http.MethodGet, "/assets/manifest"+query, nil)
+		w = httptest.NewRecorder()
+		getManifest(w, r)
+		if w.Result().StatusCode != http.StatusBadRequest {
+			t.Errorf("Didn't get 400 for manifest query %q: %d", query, w.Result().StatusCode)
+		}
+	}
+}
+
+func TestManifestLine(t *testing.T) {
+	if line := manifestLine("ab", "a\\b\nc"); line != "\\ab  a\\\\b\\nc\n" {
+		t.Errorf("Incorrectly escaped manifest line: %q", line)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// largest object S3 stores, and so the largest size an init can declare
+const maxDeclaredSize = 5 << 40
+
+// an asset record as clients browsing the registry see it
+type assetMeta struct {
+	ID           string            `json:"id"`
+	Status       string            `json:"status,omitempty"`
+	ContentType  string            `json:"content_type,omitempty"`
+	CacheControl string            `json:"cache_control,omitempty"`
+	Filename     string            `json:"filename,omitempty"`
+	DeclaredSize *int64            `json:"declared_size,omitempty"`
+	Locale       string            `json:"locale,omitempty"`
+	Path         string            `json:"path,omitempty"`
+	KeyPrefix    string            `json:"key_prefix,omitempty"`
+	Description  string            `json:"description,omitempty"`
+	Owner        string            `json:"owner,omitempty"`
+	CreatedBy    string            `json:"created_by,omitempty"`
+	Project      string            `json:"project,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+	Tags         []string          `json:"tags,omitempty"`
+	Networks     []string          `json:"upload_networks,omitempty"`
+	Version      string            `json:"version,omitempty"`
+	Public       bool              `json:"public,omitempty"`
+	Pinned       bool              `json:"pinned,omitempty"`
+	CreatedAt    int64             `json:"created_at,omitempty"`
+	UploadedAt   int64             `json:"uploaded_at,omitempty"`
+	UpdatedAt    int64             `json:"updated_at"`
+}
+
+func describeAsset(item map[string]*dynamodb.AttributeValue) assetMeta {
+	meta := assetMeta{
+		ID:           stringAttribute(item, "id"),
+		Status:       stringAttribute(item, "status"),
+		ContentType:  stringAttribute(item, "content_type"),
+		CacheControl: stringAttribute(item, "cache_control"),
+		Filename:     stringAttribute(item, "filename"),
+		Locale:       stringAttribute(item, "locale"),
+		Path:         stringAttribute(item, "path"),
+		KeyPrefix:    stringAttribute(item, "key_prefix"),
+		Description:  stringAttribute(item, "description"),
+		Owner:        stringAttribute(item, "owner"),
+		CreatedBy:    stringAttribute(item, "created_by"),
+		Project:      stringAttribute(item, "project"),
+		Metadata:     recordedMetadata(item),
+		Tags:         recordedTags(item),
+		Networks:     uploadNetworks(item),
+		Version:      stringAttribute(item, "s3_version_id"),
+		Public:       isPublic(item),
+		Pinned:       isPinned(item),
+		CreatedAt:    numberAttribute(item, "created_at"),
+		UploadedAt:   numberAttribute(item, "uploaded_at"),
+		UpdatedAt:    numberAttribute(item, "updated_at"),
+	}
+	if _, ok := item["declared_size"]; ok {
+		meta.DeclaredSize = aws.Int64(numberAttribute(item, "declared_size"))
+	}
+	return meta
+}
+
+// describes an asset from its record alone, whether or not it's uploaded
+func handleMetaRequest(w http.ResponseWriter, r *http.Request, assetID string) {
+	item, ok := fetchAsset(w, r, assetID)
+	if !ok {
+		return
+	}
+	writeJSON(w, describeAsset(item))
+}
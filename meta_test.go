@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+type mockDBDescribedClient struct {
+	mockDBClient
+}
+
+func (m *mockDBDescribedClient) GetItem(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: map[string]*dynamodb.AttributeValue{
+		"id":            {S: aws.String("someID")},
+		"filename":      {S: aws.String("report.pdf")},
+		"content_type":  {S: aws.String("application/pdf")},
+		"declared_size": {N: aws.String("1024")},
+		"created_at":    {N: aws.String("1699999000000")},
+		"uploaded_at":   {N: aws.String("1700000000000")},
+		"updated_at":    {N: aws.String("1700000000000")},
+	}}, nil
+}
+func (m *mockDBDescribedClient) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return m.GetItem(input)
+}
+
+func TestInitAssetDeclaredSize(t *testing.T) {
+	db := &mockDBPutRecordingClient{}
+	dbSvc = db
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodPost, "/asset?size=1024&filename=report.pdf", nil)
+	w := httptest.NewRecorder()
+
+	initAsset(w, r)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Incorrect status declaring a size: %d", w.Result().StatusCode)
+	}
+	if aws.StringValue(db.item["declared_size"].N) != "1024" {
+		t.Errorf("Declared size not recorded: %v", db.item["declared_size"])
+	}
+
+	for _, size := range []string{"-1", "lots", "5497558138881"} {
+		r := httptest.NewRequest(http.MethodPost, "/asset?size="+size, nil)
+		w := httptest.NewRecorder()
+		initAsset(w, r)
+		if w.Result().StatusCode != http.StatusBadRequest {
+			t.Errorf("Incorrect status declaring size %s: %d", size, w.Result().StatusCode)
+		}
+	}
+}
+
+func TestMetaRequest(t *testing.T) {
+	dbSvc = &mockDBDescribedClient{}
+	r := httptest.NewRequest(http.MethodGet, "/asset/someID/meta", nil)
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Incorrect status describing asset: %d", w.Result().StatusCode)
+	}
+	var meta assetMeta
+	if err := json.NewDecoder(w.Body).Decode(&meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.ID != "someID" || meta.Filename != "report.pdf" || meta.ContentType != "application/pdf" ||
+		aws.Int64Value(meta.DeclaredSize) != 1024 || meta.Status != "" {
+		t.Errorf("Incorrect asset description: %+v", meta)
+	}
+	if meta.CreatedAt != 1699999000000 || meta.UploadedAt != 1700000000000 {
+		t.Errorf("Incorrect asset timestamps: %+v", meta)
+	}
+}
+
+func TestMarkUploadedTimestamp(t *testing.T) {
+	db := &mockDBUpdateRecordingClient{}
+	dbSvc = db
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodPut, "/asset/someID", bytes.NewReader([]byte(`{"Status":"uploaded"}`)))
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Incorrect status marking uploaded: %d", w.Result().StatusCode)
+	}
+	if !strings.Contains(aws.StringValue(db.update.UpdateExpression), "uploaded_at = :updated") {
+		t.Errorf("Upload time not recorded: %s", aws.StringValue(db.update.UpdateExpression))
+	}
+}
+
+func TestMetaRequestNotFound(t *testing.T) {
+	dbSvc = &mockDBMissingKeyClient{}
+	r := httptest.NewRequest(http.MethodGet, "/asset/someID/meta", nil)
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusNotFound {
+		t.Errorf("Incorrect status describing missing asset: %d", w.Result().StatusCode)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	metadataHeaderPrefix = "X-Amz-Meta-"
+	// S3 caps user-defined metadata at 2KB per object
+	maxMetadataSize = 2048
+	maxMetadataKeys = 32
+)
+
+// whether metadata patched onto an uploaded asset is also copied onto its
+// object, which S3 otherwise keeps as it was uploaded
+var mirrorMetadata bool
+
+// collects x-amz-meta-* request headers into S3 user metadata, keyed by
+// the lowercased name without the prefix
+func parseMetadataHeaders(header http.Header) (map[string]string, error) {
+	metadata := map[string]string{}
+	for name, values := range header {
+		if !strings.HasPrefix(name, metadataHeaderPrefix) || len(name) == len(metadataHeaderPrefix) {
+			continue
+		}
+		key := strings.ToLower(strings.TrimPrefix(name, metadataHeaderPrefix))
+		metadata[key] = strings.Join(values, ",")
+	}
+	if err := validateMetadata(metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// checks metadata fits on an S3 object and can be sent as headers
+func validateMetadata(metadata map[string]string) error {
+	if len(metadata) > maxMetadataKeys {
+		return fmt.Errorf("at most %d metadata keys are allowed", maxMetadataKeys)
+	}
+	size := 0
+	for key, value := range metadata {
+		if key == "" || strings.Trim(key, "abcdefghijklmnopqrstuvwxyz0123456789-") != "" {
+			return fmt.Errorf("metadata key '%s' must be lowercase letters, digits and dashes", key)
+		}
+		for _, c := range value {
+			if c < ' ' || c > '~' {
+				return fmt.Errorf("metadata value for '%s' must be printable ASCII", key)
+			}
+		}
+		size += len(key) + len(value)
+	}
+	if size > maxMetadataSize {
+		return errors.New("metadata exceeds the 2KB limit")
+	}
+	return nil
+}
+
+// converts metadata to a DynamoDB map attribute
+func metadataAttribute(metadata map[string]string) *dynamodb.AttributeValue {
+	m := map[string]*dynamodb.AttributeValue{}
+	for k, v := range metadata {
+		m[k] = &dynamodb.AttributeValue{S: aws.String(v)}
+	}
+	return &dynamodb.AttributeValue{M: m}
+}
+
+// reads the metadata recorded on an asset
+func recordedMetadata(item map[string]*dynamodb.AttributeValue) map[string]string {
+	metadata := map[string]string{}
+	if m, ok := item["metadata"]; ok {
+		for k, v := range m.M {
+			metadata[k] = aws.StringValue(v.S)
+		}
+	}
+	return metadata
+}
+
+// copies an uploaded asset's object onto itself with the metadata on its
+// record, keeping the rest of its headers, and records the new version in a
+// versioned bucket
+func mirrorObjectMetadata(ctx context.Context, assetID string, item map[string]*dynamodb.AttributeValue) error {
+	versionID := stringAttribute(item, "s3_version_id")
+	key := objectKey(assetID, item)
+	head, err := s3Svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket:    aws.String(bucketName),
+		Key:       aws.String(key),
+		VersionId: optionalString(versionID),
+	})
+	if err != nil {
+		return err
+	}
+	if aws.Int64Value(head.ContentLength) > maxArchiveSize {
+		return fmt.Errorf("asset %s is too large to copy its metadata onto", assetID)
+	}
+	source := bucketName + "/" + url.PathEscape(key)
+	if versionID != "" {
+		source += "?versionId=" + url.QueryEscape(versionID)
+	}
+	copied, err := s3Svc.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:                  aws.String(bucketName),
+		Key:                     aws.String(key),
+		CopySource:              aws.String(source),
+		MetadataDirective:       aws.String(s3.MetadataDirectiveReplace),
+		Metadata:                aws.StringMap(recordedMetadata(item)),
+		CacheControl:            head.CacheControl,
+		ContentType:             head.ContentType,
+		ContentDisposition:      head.ContentDisposition,
+		ContentEncoding:         head.ContentEncoding,
+		ContentLanguage:         head.ContentLanguage,
+		StorageClass:            head.StorageClass,
+		ServerSideEncryption:    encryptionAlgorithm(),
+		SSEKMSKeyId:             optionalString(kmsKeyID),
+		SSEKMSEncryptionContext: encryptionContextHeader(assetID),
+	})
+	if err != nil {
+		return err
+	}
+
+	newVersionID := aws.StringValue(copied.VersionId)
+	if versionID == "" || newVersionID == "" {
+		return nil
+	}
+	// the new version exists, so it's recorded even past the deadline
+	_, err = dbSvc.UpdateItemWithContext(context.WithoutCancel(ctx), &dynamodb.UpdateItemInput{
+		Key:                 assetKey(assetID),
+		TableName:           aws.String(tableName),
+		UpdateExpression:    aws.String("SET s3_version_id = :versionID, updated_at = :updated ADD versions :versions"),
+		ConditionExpression: aws.String("s3_version_id = :prevVersionID"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":versionID":     {S: aws.String(newVersionID)},
+			":prevVersionID": {S: aws.String(versionID)},
+			":versions":      {SS: aws.StringSlice([]string{newVersionID})},
+			":updated":       updatedAtValue(),
+		},
+	})
+	return err
+}
+
+// headers the client must send along with a presigned request,
+// flattened to one value each for the JSON response
+func flattenHeaders(header http.Header) map[string]string {
+	if len(header) == 0 {
+		return nil
+	}
+	flat := map[string]string{}
+	for name, values := range header {
+		flat[name] = strings.Join(values, ",")
+	}
+	return flat
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// an uploaded asset whose record is updated as patched
+type mockDBPatchedUploadClient struct {
+	mockDBClient
+	update *dynamodb.UpdateItemInput
+}
+
+func (m *mockDBPatchedUploadClient) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	m.update = input
+	return &dynamodb.UpdateItemOutput{Attributes: map[string]*dynamodb.AttributeValue{
+		"id":       {S: aws.String("someID")},
+		"status":   {S: aws.String(assetStatusUploaded)},
+		"metadata": input.ExpressionAttributeValues[":metadata"],
+	}}, nil
+}
+func (m *mockDBPatchedUploadClient) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	return m.UpdateItem(input)
+}
+
+// remembers the last copy
+type mockS3CopyingClient struct {
+	mockS3Client
+	copied *s3.CopyObjectInput
+}
+
+func (m *mockS3CopyingClient) CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	m.copied = input
+	return &s3.CopyObjectOutput{}, nil
+}
+func (m *mockS3CopyingClient) CopyObjectWithContext(ctx aws.Context, input *s3.CopyObjectInput, opts ...request.Option) (*s3.CopyObjectOutput, error) {
+	return m.CopyObject(input)
+}
+
+func TestParseMetadataHeaders(t *testing.T) {
+	header := http.Header{}
+	header.Set("X-Amz-Meta-Campaign", "spring")
+	header.Set("Content-Type", "text/plain")
+	metadata, err := parseMetadataHeaders(header)
+	if err != nil {
+		t.Errorf("Got error parsing valid metadata: %s", err)
+	}
+	if len(metadata) != 1 || metadata["campaign"] != "spring" {
+		t.Errorf("Unexpected metadata parsed: %v", metadata)
+	}
+
+	header.Set("X-Amz-Meta-Big", strings.Repeat("a", maxMetadataSize))
+	if _, err := parseMetadataHeaders(header); err == nil {
+		t.Error("Got no error for oversized metadata")
+	}
+}
+func TestInitAssetOversizedMetadata(t *testing.T) {
+	dbSvc = &mockDBClient{}
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodPost, "/asset", nil)
+	r.Header.Set("X-Amz-Meta-Big", strings.Repeat("a", maxMetadataSize+1))
+	w := httptest.NewRecorder()
+
+	initAsset(w, r)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Didn't get 400 for oversized metadata: %d", resp.StatusCode)
+	}
+}
+
+func TestValidateMetadata(t *testing.T) {
+	if err := validateMetadata(map[string]string{"correlation-id": "abc123", "label": "spring sale"}); err != nil {
+		t.Errorf("Got error for valid metadata: %s", err)
+	}
+	tooMany := map[string]string{}
+	for i := 0; i <= maxMetadataKeys; i++ {
+		tooMany[strings.Repeat("k", i+1)] = "v"
+	}
+	for _, metadata := range []map[string]string{
+		tooMany,
+		{"Label": "v"},
+		{"la bel": "v"},
+		{"label": "caf\u00e9"},
+		{"label": "line\nbreak"},
+	} {
+		if err := validateMetadata(metadata); err == nil {
+			t.Errorf("Got no error for invalid metadata: %v", metadata)
+		}
+	}
+}
+
+func TestPatchMetadata(t *testing.T) {
+	db := &mockDBPatchedUploadClient{}
+	dbSvc = db
+	objects := &mockS3CopyingClient{}
+	s3Svc = objects
+	for body, status := range map[string]int{
+		`{"metadata": {"correlation-id": "abc123"}}`: http.StatusNoContent,
+		`{"metadata": {}}`:                           http.StatusNoContent,
+		`{"metadata": {"Bad Key": "v"}}`:             http.StatusBadRequest,
+	} {
+		r := httptest.NewRequest(http.MethodPatch, "/asset/someID", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		manageAsset(w, r)
+		if w.Result().StatusCode != status {
+			t.Errorf("Incorrect status patching %s: %d", body, w.Result().StatusCode)
+		}
+	}
+	if objects.copied != nil {
+		t.Error("Metadata copied onto the object without -mirror-metadata")
+	}
+
+	mirrorMetadata = true
+	defer func() { mirrorMetadata = false }()
+	r := httptest.NewRequest(http.MethodPatch, "/asset/someID", strings.NewReader(`{"metadata": {"correlation-id": "abc123"}}`))
+	w := httptest.NewRecorder()
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusNoContent {
+		t.Fatalf("Incorrect status mirroring metadata: %d", w.Result().StatusCode)
+	}
+	if objects.copied == nil || aws.StringValue(objects.copied.MetadataDirective) != s3.MetadataDirectiveReplace ||
+		aws.StringValue(objects.copied.Metadata["correlation-id"]) != "abc123" {
+		t.Errorf("Metadata not copied onto the object: %+v", objects.copied)
+	}
+}
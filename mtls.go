@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// clients that authenticate with a certificate issued by a -client-ca
+const certificateMethod = "certificate"
+
+// CAs client certificates must be issued by, nil to not ask for them
+var clientCAs *x509.CertPool
+
+// identity names by certificate subject, URI or DNS name, from
+// -client-identities; when empty, a certificate's common name is its
+// identity
+var clientIdentities = map[string]string{}
+
+func clientCertificatesEnabled() bool {
+	return clientCAs != nil
+}
+
+// adds identities given as semicolon separated name=subject pairs; subjects
+// are distinguished names as RFC 2253 prints them, e.g. CN=ci,O=Example,
+// which have commas of their own, or a URI or DNS name the certificate is
+// issued for
+func parseClientIdentities(value string) error {
+	for _, pair := range strings.Split(value, ";") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return fmt.Errorf("client identity '%s' must be given as name=subject", pair)
+		}
+		if !apiKeyNamePattern.MatchString(parts[0]) {
+			return fmt.Errorf("invalid client identity name '%s'", parts[0])
+		}
+		clientIdentities[parts[1]] = parts[0]
+	}
+	return nil
+}
+
+// the TLS config the server listens with, serving the certificate and key
+// in certFile and keyFile; with caFile, client certificates are checked
+// against its PEM bundle of CAs if sent, or always with require
+func newTLSConfig(certFile, keyFile, caFile string, require bool) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if caFile == "" {
+		return config, nil
+	}
+	bundle, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	clientCAs = x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(bundle) {
+		clientCAs = nil
+		return nil, fmt.Errorf("no certificates in client CA bundle %s", caFile)
+	}
+	config.ClientCAs = clientCAs
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	if require {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// the certificate a request's connection was verified with, nil if none
+func clientCertificate(r *http.Request) *x509.Certificate {
+	if !clientCertificatesEnabled() || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// the identity a verified client certificate maps to, by its subject or else
+// any URI or DNS name it's issued for
+func validateClientCertificate(cert *x509.Certificate) (authDecision, error) {
+	subject := cert.Subject.String()
+	if len(clientIdentities) == 0 {
+		if cert.Subject.CommonName == "" {
+			return authDecision{}, fmt.Errorf("certificate '%s' has no common name", subject)
+		}
+		return authDecision{Method: certificateMethod, Key: cert.Subject.CommonName, Principal: subject}, nil
+	}
+	names := []string{subject}
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	names = append(names, cert.DNSNames...)
+	for _, name := range names {
+		if identity, ok := clientIdentities[name]; ok {
+			return authDecision{Method: certificateMethod, Key: identity, Principal: name}, nil
+		}
+	}
+	return authDecision{}, fmt.Errorf("certificate '%s' is not mapped to an identity", subject)
+}
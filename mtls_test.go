@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func resetClientCertificates() {
+	clientCAs = nil
+	clientIdentities = map[string]string{}
+}
+
+// issues a certificate from template, signed by parent or else self signed
+func issueCertificate(t *testing.T, template *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := template, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func writePEM(t *testing.T, path, kind string, der []byte) {
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientCertificates(t *testing.T) {
+	defer resetClientCertificates()
+	ca := issueCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	server := issueCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "asset-uploader"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &ca)
+	spiffe, _ := url.Parse("spiffe://example.org/deploy")
+	clientTemplate := func(name pkix.Name, uris ...*url.URL) *x509.Certificate {
+		return &x509.Certificate{Subject: name, URIs: uris, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}
+	}
+	ci := issueCertificate(t, clientTemplate(pkix.Name{CommonName: "ci", Organization: []string{"Example"}}), &ca)
+	deploy := issueCertificate(t, clientTemplate(pkix.Name{}, spiffe), &ca)
+	// issued by a CA the service doesn't trust
+	otherCA := issueCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "Other CA"}, IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}, nil)
+	other := issueCertificate(t, clientTemplate(pkix.Name{CommonName: "ci"}), &otherCA)
+
+	dir := t.TempDir()
+	writePEM(t, filepath.Join(dir, "server.pem"), "CERTIFICATE", server.Certificate[0])
+	keyDER, _ := x509.MarshalECPrivateKey(server.PrivateKey.(*ecdsa.PrivateKey))
+	writePEM(t, filepath.Join(dir, "server-key.pem"), "EC PRIVATE KEY", keyDER)
+	writePEM(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", ca.Certificate[0])
+	config, err := newTLSConfig(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"), filepath.Join(dir, "ca.pem"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewUnstartedServer(withAuthentication(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, requestAuth(r))
+	})))
+	ts.TLS = config
+	ts.StartTLS()
+	defer ts.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	get := func(certs ...tls.Certificate) (int, authDecision, error) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}}
+		resp, err := client.Get(ts.URL + "/auth")
+		if err != nil {
+			return 0, authDecision{}, err
+		}
+		defer resp.Body.Close()
+		var decision authDecision
+		json.NewDecoder(resp.Body).Decode(&decision)
+		return resp.StatusCode, decision, nil
+	}
+
+	// without identities, the common name is the identity
+	status, decision, err := get(ci)
+	if err != nil || status != http.StatusOK || decision.Method != certificateMethod || decision.Key != "ci" || decision.Principal != "CN=ci,O=Example" {
+		t.Errorf("Incorrect decision for a client certificate: %d %+v %v", status, decision, err)
+	}
+	if _, _, err := get(); err == nil {
+		t.Errorf("Connected without a client certificate")
+	}
+	if _, _, err := get(other); err == nil {
+		t.Errorf("Connected with a certificate from another CA")
+	}
+
+	if err := parseClientIdentities("deploy=spiffe://example.org/deploy;ci=CN=ci,O=Example"); err != nil {
+		t.Fatal(err)
+	}
+	if status, decision, _ = get(deploy); status != http.StatusOK || decision.Key != "deploy" || decision.Principal != spiffe.String() {
+		t.Errorf("Incorrect decision for a mapped URI: %d %+v", status, decision)
+	}
+	delete(clientIdentities, "CN=ci,O=Example")
+	if status, _, _ = get(ci); status != http.StatusUnauthorized {
+		t.Errorf("Didn't get 401 for an unmapped certificate: %d", status)
+	}
+}
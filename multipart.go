@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	maxPartNumber = 10000
+	// most part urls signed in one request
+	maxPartURLBatch        = 1000
+	multipartSweepInterval = time.Hour
+)
+
+// how old an unfinished multipart upload gets before it's aborted, zero to
+// never abort them
+var multipartMaxAge = 7 * 24 * time.Hour
+
+type multipartResponse struct {
+	ID       string `json:"id"`
+	UploadID string `json:"upload_id"`
+}
+
+type partURLResponse struct {
+	UploadURL  string `json:"upload_url"`
+	PartNumber int64  `json:"part_number"`
+}
+
+type partURLsResponse struct {
+	UploadID string            `json:"upload_id"`
+	Parts    []partURLResponse `json:"parts"`
+}
+
+type completeMultipartRequest struct {
+	Parts []completedPart
+}
+
+type completedPart struct {
+	PartNumber int64
+	ETag       string
+}
+
+// starts or aborts a multipart upload for an asset
+func handleMultipartRequest(w http.ResponseWriter, r *http.Request, assetID string) {
+	if r.Method == http.MethodDelete {
+		abortMultipartUpload(w, r, assetID)
+		return
+	}
+
+	key, err := lookupObjectKey(r.Context(), assetID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	// only one multipart upload per asset, and never over a finished one
+	created, err := s3Svc.CreateMultipartUploadWithContext(r.Context(), &s3.CreateMultipartUploadInput{
+		Bucket:                  aws.String(bucketName),
+		Key:                     aws.String(key),
+		ServerSideEncryption:    encryptionAlgorithm(),
+		SSEKMSKeyId:             optionalString(kmsKeyID),
+		SSEKMSEncryptionContext: encryptionContextHeader(assetID),
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	// the upload is started, so it's recorded or aborted even past the
+	// request's deadline
+	ctx := context.WithoutCancel(r.Context())
+	values := lockConditionValues(r)
+	values[":uploadID"] = &dynamodb.AttributeValue{S: created.UploadId}
+	values[":uploaded"] = &dynamodb.AttributeValue{S: aws.String(assetStatusUploaded)}
+	_, err = dbSvc.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		Key:                                 assetKey(assetID),
+		TableName:                           aws.String(tableName),
+		UpdateExpression:                    aws.String(setAttributes("SET upload_id = :uploadID", values, encryptionAttributes(assetID))),
+		ConditionExpression:                 aws.String("attribute_exists(id) AND attribute_not_exists(upload_id) AND (attribute_not_exists(#status) OR #status <> :uploaded) AND attribute_not_exists(upload_networks) AND " + lockCondition),
+		ExpressionAttributeNames:            map[string]*string{"#status": aws.String("status")},
+		ExpressionAttributeValues:           values,
+		ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValuesOnConditionCheckFailureAllOld),
+	})
+	if err != nil {
+		// don't leave the upload we just started dangling
+		s3Svc.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(bucketName),
+			Key:      aws.String(key),
+			UploadId: created.UploadId,
+		})
+		if isConditionFailed(err) {
+			if isLockedConflict(err) {
+				http.Error(w, fmt.Sprintf("Asset id '%s' is locked, already uploaded, restricted to networks or has a multipart upload in progress.", assetID), http.StatusConflict)
+				return
+			}
+			writeError(w, notFound(assetID))
+			return
+		}
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, multipartResponse{
+		ID:       assetID,
+		UploadID: *created.UploadId,
+	})
+}
+
+// fetches the in-progress multipart upload ID of an asset and the key it's
+// uploading to, writing an error and returning false if there is none
+func fetchUploadID(w http.ResponseWriter, r *http.Request, assetID string) (string, string, bool) {
+	item, ok := fetchAsset(w, r, assetID)
+	if !ok {
+		return "", "", false
+	}
+	uploadID := stringAttribute(item, "upload_id")
+	if uploadID == "" {
+		http.Error(w, fmt.Sprintf("Asset id '%s' has no multipart upload in progress.", assetID), http.StatusConflict)
+		return "", "", false
+	}
+	return uploadID, objectKey(assetID, item), true
+}
+
+// returns a signed url for uploading one part, recording it as issued
+func handlePartURLRequest(w http.ResponseWriter, r *http.Request, assetID string) {
+	partNumber, err := strconv.ParseInt(r.URL.Query().Get("number"), 10, 64)
+	if err != nil || partNumber < 1 || partNumber > maxPartNumber {
+		http.Error(w, fmt.Sprintf("Invalid argument for number, must be integer from 1 to %d.", maxPartNumber), http.StatusBadRequest)
+		return
+	}
+	uploadID, key, ok := fetchUploadID(w, r, assetID)
+	if !ok {
+		return
+	}
+	urls, ok := issuePartURLs(r.Context(), w, assetID, key, uploadID, partNumber, 1)
+	if !ok {
+		return
+	}
+	writeJSON(w, urls[0])
+}
+
+// returns signed urls for uploading count consecutive parts from start
+// (default 1), so clients can upload them in parallel
+func handlePartURLsRequest(w http.ResponseWriter, r *http.Request, assetID string) {
+	count, err := strconv.ParseInt(r.URL.Query().Get("count"), 10, 64)
+	if err != nil || count < 1 || count > maxPartURLBatch {
+		http.Error(w, fmt.Sprintf("Invalid argument for count, must be integer from 1 to %d.", maxPartURLBatch), http.StatusBadRequest)
+		return
+	}
+	start := int64(1)
+	if value := r.URL.Query().Get("start"); value != "" {
+		start, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || start < 1 {
+			http.Error(w, "Invalid argument for start, must be a positive integer.", http.StatusBadRequest)
+			return
+		}
+	}
+	if start+count-1 > maxPartNumber {
+		http.Error(w, fmt.Sprintf("Invalid arguments, parts can't be numbered past %d.", maxPartNumber), http.StatusBadRequest)
+		return
+	}
+	uploadID, key, ok := fetchUploadID(w, r, assetID)
+	if !ok {
+		return
+	}
+	urls, ok := issuePartURLs(r.Context(), w, assetID, key, uploadID, start, count)
+	if !ok {
+		return
+	}
+	writeJSON(w, partURLsResponse{
+		UploadID: uploadID,
+		Parts:    urls,
+	})
+}
+
+// records count consecutive parts from start as issued and signs an upload
+// url for each, writing an error and returning false on failure
+func issuePartURLs(ctx context.Context, w http.ResponseWriter, assetID, key, uploadID string, start, count int64) ([]partURLResponse, bool) {
+	var numbers []*string
+	for n := start; n < start+count; n++ {
+		numbers = append(numbers, aws.String(strconv.FormatInt(n, 10)))
+	}
+	_, err := dbSvc.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		Key:                 assetKey(assetID),
+		TableName:           aws.String(tableName),
+		UpdateExpression:    aws.String("ADD parts :parts"),
+		ConditionExpression: aws.String("upload_id = :uploadID"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":parts":    {NS: numbers},
+			":uploadID": {S: aws.String(uploadID)},
+		},
+	})
+	if err != nil {
+		if isConditionFailed(err) {
+			http.Error(w, fmt.Sprintf("Multipart upload for asset id '%s' is no longer in progress.", assetID), http.StatusConflict)
+			return nil, false
+		}
+		writeError(w, err)
+		return nil, false
+	}
+
+	urls := make([]partURLResponse, 0, count)
+	for n := start; n < start+count; n++ {
+		req, _ := s3Svc.UploadPartRequest(&s3.UploadPartInput{
+			Bucket:     aws.String(bucketName),
+			Key:        aws.String(key),
+			UploadId:   aws.String(uploadID),
+			PartNumber: aws.Int64(n),
+		})
+		url, err := req.Presign(maxUploadTimeout)
+		if err != nil {
+			writeError(w, err)
+			return nil, false
+		}
+		urls = append(urls, partURLResponse{
+			UploadURL:  url,
+			PartNumber: n,
+		})
+	}
+	return urls, true
+}
+
+// assembles the uploaded parts into the asset's object; parts may be listed
+// in the body, otherwise every part S3 has received is used
+func handleCompleteMultipartRequest(w http.ResponseWriter, r *http.Request, assetID string) {
+	var reqBody completeMultipartRequest
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&reqBody)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid JSON payload: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+	uploadID, key, ok := fetchUploadID(w, r, assetID)
+	if !ok {
+		return
+	}
+
+	var parts []*s3.CompletedPart
+	for _, part := range reqBody.Parts {
+		parts = append(parts, &s3.CompletedPart{
+			PartNumber: aws.Int64(part.PartNumber),
+			ETag:       aws.String(part.ETag),
+		})
+	}
+	if len(parts) == 0 {
+		var err error
+		parts, err = listUploadedParts(r.Context(), key, uploadID)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	if len(parts) == 0 {
+		http.Error(w, fmt.Sprintf("No parts have been uploaded for asset id '%s'.", assetID), http.StatusBadRequest)
+		return
+	}
+
+	_, err := s3Svc.CompleteMultipartUploadWithContext(r.Context(), &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucketName),
+		Key:             aws.String(key),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !clearUploadID(w, r, assetID, uploadID) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// every part S3 has received for a multipart upload to key, ready for
+// completion
+func listUploadedParts(ctx context.Context, key, uploadID string) ([]*s3.CompletedPart, error) {
+	var parts []*s3.CompletedPart
+	err := s3Svc.ListPartsPagesWithContext(ctx, &s3.ListPartsInput{
+		Bucket:   aws.String(bucketName),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	}, func(page *s3.ListPartsOutput, lastPage bool) bool {
+		for _, part := range page.Parts {
+			parts = append(parts, &s3.CompletedPart{PartNumber: part.PartNumber, ETag: part.ETag})
+		}
+		return true
+	})
+	return parts, err
+}
+
+// abandons an in-progress multipart upload, discarding its parts
+func abortMultipartUpload(w http.ResponseWriter, r *http.Request, assetID string) {
+	uploadID, key, ok := fetchUploadID(w, r, assetID)
+	if !ok {
+		return
+	}
+	_, err := s3Svc.AbortMultipartUploadWithContext(r.Context(), &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(bucketName),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !clearUploadID(w, r, assetID, uploadID) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removes multipart state from the record once the upload is finished
+func clearUploadID(w http.ResponseWriter, r *http.Request, assetID, uploadID string) bool {
+	if err := forgetUploadID(r.Context(), assetID, uploadID); err != nil {
+		writeError(w, err)
+		return false
+	}
+	return true
+}
+
+// removes multipart state from the record if it's still for uploadID
+func forgetUploadID(ctx context.Context, assetID, uploadID string) error {
+	_, err := dbSvc.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		Key:                 assetKey(assetID),
+		TableName:           aws.String(tableName),
+		UpdateExpression:    aws.String("REMOVE upload_id, parts, tus_parts, tus_tail"),
+		ConditionExpression: aws.String("upload_id = :uploadID"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":uploadID": {S: aws.String(uploadID)},
+		},
+	})
+	if isConditionFailed(err) {
+		return nil
+	}
+	return err
+}
+
+// aborts stale multipart uploads until stopped
+func watchMultipartUploads(stop <-chan struct{}) {
+	for {
+		if err := abortStaleMultipartUploads(); err != nil {
+			log.Println(err.Error())
+		}
+		if !pause(stop, multipartSweepInterval) {
+			return
+		}
+	}
+}
+
+// aborts every multipart upload in the bucket started over the maximum
+// age ago, whether or not an asset still refers to it, so its parts stop
+// being paid for
+func abortStaleMultipartUploads() error {
+	if multipartMaxAge <= 0 {
+		return nil
+	}
+	cutoff := time.Now().Add(-multipartMaxAge)
+	var stale []*s3.MultipartUpload
+	err := s3Svc.ListMultipartUploadsPages(&s3.ListMultipartUploadsInput{
+		Bucket: aws.String(bucketName),
+	}, func(page *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+		for _, upload := range page.Uploads {
+			if aws.TimeValue(upload.Initiated).Before(cutoff) {
+				stale = append(stale, upload)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	var failed error
+	for _, upload := range stale {
+		_, err := s3Svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(bucketName),
+			Key:      upload.Key,
+			UploadId: upload.UploadId,
+		})
+		if aerr, ok := err.(awserr.Error); err != nil && !(ok && aerr.Code() == s3.ErrCodeNoSuchUpload) {
+			failed = err
+			continue
+		}
+		log.Printf("aborted multipart upload of %s started %s", aws.StringValue(upload.Key), aws.TimeValue(upload.Initiated).Format(time.RFC3339))
+		// objects initialized in a folder are named by their ID under it
+		if assetID := path.Base(aws.StringValue(upload.Key)); isAssetKey(assetID) {
+			if err := forgetUploadID(context.Background(), assetID, aws.StringValue(upload.UploadId)); err != nil {
+				failed = err
+			}
+		}
+	}
+	return failed
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+type mockDBMultipartClient struct {
+	mockDBClient
+}
+
+func (m *mockDBMultipartClient) GetItem(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{
+		Item: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String("someID"),
+			},
+			"upload_id": {
+				S: aws.String("someUploadID"),
+			},
+		},
+	}, nil
+}
+func (m *mockDBMultipartClient) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return m.GetItem(input)
+}
+
+func TestStartMultipartUpload(t *testing.T) {
+	dbSvc = &mockDBClient{}
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodPost, "/asset/someID/multipart", nil)
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Incorrect status while starting multipart upload: %d", resp.StatusCode)
+	}
+	jsonResp := multipartResponse{}
+	json.NewDecoder(resp.Body).Decode(&jsonResp)
+	if jsonResp.UploadID != "someUploadID" {
+		t.Errorf("Unexpected upload id: %s", jsonResp.UploadID)
+	}
+}
+func TestStartMultipartUploadNotFound(t *testing.T) {
+	dbSvc = &mockDBConditionalErrorClient{}
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodPost, "/asset/nonexistant/multipart", nil)
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Didn't get 404 starting multipart upload for a missing asset: %d", resp.StatusCode)
+	}
+}
+func TestPartURL(t *testing.T) {
+	dbSvc = &mockDBMultipartClient{}
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodGet, "/asset/someID/part?number=3", nil)
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Incorrect status while fetching part url: %d", resp.StatusCode)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/asset/someID/part?number=0", nil)
+	w = httptest.NewRecorder()
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("Didn't get 400 for an invalid part number: %d", w.Result().StatusCode)
+	}
+}
+func TestPartURLs(t *testing.T) {
+	dbSvc = &mockDBMultipartClient{}
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodGet, "/asset/someID/parts?count=4&start=3", nil)
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Incorrect status while fetching part urls: %d", resp.StatusCode)
+	}
+	var urls partURLsResponse
+	json.NewDecoder(resp.Body).Decode(&urls)
+	if urls.UploadID == "" || len(urls.Parts) != 4 || urls.Parts[0].PartNumber != 3 || urls.Parts[3].PartNumber != 6 {
+		t.Errorf("Incorrect part urls: %+v", urls)
+	}
+
+	for _, query := range []string{"count=0", "count=1001", "count=2&start=10000", "count=2&start=x"} {
+		r = httptest.NewRequest(http.MethodGet, "/asset/someID/parts?"+query, nil)
+		w = httptest.NewRecorder()
+		manageAsset(w, r)
+		if w.Result().StatusCode != http.StatusBadRequest {
+			t.Errorf("Didn't get 400 for %s: %d", query, w.Result().StatusCode)
+		}
+	}
+}
+func TestPartURLNoUpload(t *testing.T) {
+	dbSvc = &mockDBClient{}
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodGet, "/asset/someID/part?number=1", nil)
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Didn't get 409 for a part url without a multipart upload: %d", resp.StatusCode)
+	}
+}
+func TestCompleteMultipartUpload(t *testing.T) {
+	dbSvc = &mockDBMultipartClient{}
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodPost, "/asset/someID/complete", nil)
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Incorrect status while completing multipart upload: %d", resp.StatusCode)
+	}
+
+	body := bytes.NewReader([]byte(`{"Parts":[{"PartNumber":1,"ETag":"\"etag\""}]}`))
+	r = httptest.NewRequest(http.MethodPost, "/asset/someID/complete", body)
+	w = httptest.NewRecorder()
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusNoContent {
+		t.Errorf("Incorrect status while completing multipart upload with parts: %d", w.Result().StatusCode)
+	}
+}
+func TestAbortMultipartUpload(t *testing.T) {
+	dbSvc = &mockDBMultipartClient{}
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodDelete, "/asset/someID/multipart", nil)
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Incorrect status while aborting multipart upload: %d", resp.StatusCode)
+	}
+}
+
+// a bucket with a multipart upload started a month ago and one just started
+type mockS3StaleUploadsClient struct {
+	mockS3Client
+	aborted []string
+}
+
+func (m *mockS3StaleUploadsClient) ListMultipartUploadsPages(input *s3.ListMultipartUploadsInput, fn func(*s3.ListMultipartUploadsOutput, bool) bool) error {
+	old := time.Now().Add(-30 * 24 * time.Hour)
+	recent := time.Now()
+	fn(&s3.ListMultipartUploadsOutput{Uploads: []*s3.MultipartUpload{
+		{Key: aws.String("staleID"), UploadId: aws.String("staleUpload"), Initiated: &old},
+		{Key: aws.String("someID"), UploadId: aws.String("someUpload"), Initiated: &recent},
+	}}, true)
+	return nil
+}
+func (m *mockS3StaleUploadsClient) ListMultipartUploadsPagesWithContext(ctx aws.Context, input *s3.ListMultipartUploadsInput, fn func(*s3.ListMultipartUploadsOutput, bool) bool, opts ...request.Option) error {
+	return m.ListMultipartUploadsPages(input, fn)
+}
+
+func (m *mockS3StaleUploadsClient) AbortMultipartUpload(input *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+	m.aborted = append(m.aborted, *input.UploadId)
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+func (m *mockS3StaleUploadsClient) AbortMultipartUploadWithContext(ctx aws.Context, input *s3.AbortMultipartUploadInput, opts ...request.Option) (*s3.AbortMultipartUploadOutput, error) {
+	return m.AbortMultipartUpload(input)
+}
+
+func TestAbortStaleMultipartUploads(t *testing.T) {
+	db := &mockDBUpdateRecordingClient{}
+	dbSvc = db
+	uploads := &mockS3StaleUploadsClient{}
+	s3Svc = uploads
+	if err := abortStaleMultipartUploads(); err != nil {
+		t.Fatal(err)
+	}
+	if len(uploads.aborted) != 1 || uploads.aborted[0] != "staleUpload" {
+		t.Errorf("Incorrect uploads aborted: %v", uploads.aborted)
+	}
+	if db.update == nil || *db.update.Key["id"].S != "staleID" {
+		t.Error("Aborted upload not cleared from its asset")
+	}
+}
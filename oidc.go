@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const oidcDiscoveryPath = "/.well-known/openid-configuration"
+
+// the issuer url of an OpenID Connect provider whose discovery document
+// sets the JWKS url and issuer bearer tokens are checked against
+var oidcIssuer string
+
+// dotted paths to the claims holding a token's roles, as a list or space
+// separated, and its tenant; empty to not map them
+var oidcRolesClaim, oidcTenantClaim string
+
+// the fields of a provider's discovery document the service uses
+type oidcConfiguration struct {
+	Issuer  string `json:"issuer"`
+	JWKSURI string `json:"jwks_uri"`
+}
+
+// fetches the discovery document of -oidc-issuer, taking the issuer and
+// JWKS url from it
+func discoverOIDC() error {
+	u, err := url.Parse(oidcIssuer)
+	if err != nil || u.Scheme != "https" || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("invalid -oidc-issuer '%s', must be an https url", oidcIssuer)
+	}
+	if jwksURL != "" || jwtIssuer != "" {
+		return fmt.Errorf("-oidc-issuer discovers the JWKS url and issuer, so -jwks-url and -jwt-issuer can't be given with it")
+	}
+	resp, err := jwksClient.Get(strings.TrimSuffix(oidcIssuer, "/") + oidcDiscoveryPath)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching OIDC discovery document of %s: %s", oidcIssuer, resp.Status)
+	}
+	var config oidcConfiguration
+	if err := json.NewDecoder(http.MaxBytesReader(nil, resp.Body, maxJWKSBody)).Decode(&config); err != nil {
+		return fmt.Errorf("decoding OIDC discovery document of %s: %s", oidcIssuer, err.Error())
+	}
+	// tokens name the issuer exactly as its discovery document does
+	if config.Issuer != oidcIssuer {
+		return fmt.Errorf("OIDC discovery document of %s is for issuer '%s'", oidcIssuer, config.Issuer)
+	}
+	if jwks, err := url.Parse(config.JWKSURI); err != nil || jwks.Scheme != "https" || jwks.Host == "" {
+		return fmt.Errorf("OIDC discovery document of %s has invalid jwks_uri '%s'", oidcIssuer, config.JWKSURI)
+	}
+	jwtIssuer, jwksURL = config.Issuer, config.JWKSURI
+	return nil
+}
+
+// the claim at a dotted path, such as realm_access.roles, if there is one
+func claimAt(claims map[string]interface{}, path string) (interface{}, bool) {
+	var value interface{} = claims
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[name]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// sets a decision's roles and tenant from the claims of a token's payload
+func mapClaims(payload string, decision *authDecision) error {
+	if oidcRolesClaim == "" && oidcTenantClaim == "" {
+		return nil
+	}
+	var claims map[string]interface{}
+	if err := decodeJWTPart(payload, &claims); err != nil {
+		return err
+	}
+	if value, ok := claimAt(claims, oidcRolesClaim); ok && oidcRolesClaim != "" {
+		switch roles := value.(type) {
+		case string:
+			decision.Roles = strings.Fields(roles)
+		case []interface{}:
+			for _, role := range roles {
+				name, ok := role.(string)
+				if !ok {
+					return fmt.Errorf("token %s claim must list strings", oidcRolesClaim)
+				}
+				decision.Roles = append(decision.Roles, name)
+			}
+		default:
+			return fmt.Errorf("token %s claim must be a string or list", oidcRolesClaim)
+		}
+	}
+	if value, ok := claimAt(claims, oidcTenantClaim); ok && oidcTenantClaim != "" {
+		tenant, _ := value.(string)
+		if !tenantIDPattern.MatchString(tenant) {
+			return fmt.Errorf("token %s claim isn't a tenant id", oidcTenantClaim)
+		}
+		decision.Tenant = tenant
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiscoverOIDC(t *testing.T) {
+	defer resetJWT()
+	var issuer string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != oidcDiscoveryPath {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(oidcConfiguration{Issuer: issuer, JWKSURI: "https://" + r.Host + "/keys"})
+	}))
+	defer server.Close()
+	client := jwksClient
+	jwksClient = server.Client()
+	defer func() { jwksClient = client }()
+
+	oidcIssuer, issuer = server.URL, server.URL
+	defer func() { oidcIssuer = "" }()
+	if err := discoverOIDC(); err != nil {
+		t.Fatalf("Got error discovering provider: %s", err)
+	}
+	if jwtIssuer != server.URL || jwksURL != server.URL+"/keys" {
+		t.Errorf("Incorrect issuer and JWKS url discovered: %s %s", jwtIssuer, jwksURL)
+	}
+	// discovery sets them, so they can't be given as well
+	if err := discoverOIDC(); err == nil {
+		t.Errorf("Got no error discovering with a JWKS url set")
+	}
+
+	resetJWT()
+	issuer = "https://other.example.com"
+	if err := discoverOIDC(); err == nil || jwksURL != "" {
+		t.Errorf("Got no error for a document of another issuer: %s", jwksURL)
+	}
+	oidcIssuer = "http://idp.example.com"
+	if err := discoverOIDC(); err == nil {
+		t.Errorf("Got no error for an http issuer")
+	}
+}
+
+func TestMapClaims(t *testing.T) {
+	defer resetJWT()
+	defer func() { oidcRolesClaim, oidcTenantClaim = "", "" }()
+	var fetches int
+	jwksURL = serveJWKS(t, &fetches).URL
+	oidcRolesClaim, oidcTenantClaim = "realm_access.roles", "tenant"
+	token := func(claims map[string]interface{}) string {
+		claims["sub"] = "user-1"
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+		return signJWT(t, "RS256", "rsa", claims)
+	}
+
+	decision, err := validateJWT(token(map[string]interface{}{
+		"realm_access": map[string]interface{}{"roles": []string{"uploader", "auditor"}},
+		"tenant":       "acme",
+	}), time.Now())
+	if err != nil || !reflect.DeepEqual(decision.Roles, []string{"uploader", "auditor"}) || decision.Tenant != "acme" {
+		t.Errorf("Incorrect claims mapped: %+v, %v", decision, err)
+	}
+	decision, err = validateJWT(token(map[string]interface{}{
+		"realm_access": map[string]interface{}{"roles": "uploader auditor"},
+	}), time.Now())
+	if err != nil || len(decision.Roles) != 2 || decision.Tenant != "" {
+		t.Errorf("Incorrect claims mapped from space separated roles: %+v, %v", decision, err)
+	}
+	for name, claims := range map[string]map[string]interface{}{
+		"numeric roles":  {"realm_access": map[string]interface{}{"roles": []int{1}}},
+		"roles object":   {"realm_access": map[string]interface{}{"roles": map[string]string{}}},
+		"invalid tenant": {"tenant": "Not A Tenant"},
+	} {
+		if _, err := validateJWT(token(claims), time.Now()); err == nil {
+			t.Errorf("Got no error for %s", name)
+		}
+	}
+
+	// handlers see the decision
+	handler := withAuthentication(http.HandlerFunc(getAuth))
+	r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+	r.Header.Set("Authorization", "Bearer "+token(map[string]interface{}{"tenant": "acme"}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	var served authDecision
+	json.NewDecoder(w.Body).Decode(&served)
+	if w.Result().StatusCode != http.StatusOK || served.Method != bearerMethod || served.Subject != "user-1" || served.Tenant != "acme" {
+		t.Errorf("Incorrect auth decision served: %d %+v", w.Result().StatusCode, served)
+	}
+}
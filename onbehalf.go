@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const onBehalfOfHeader = "X-On-Behalf-Of"
+
+// the API keys, IAM principals and client certificate identities, by name,
+// that may act for end users by naming them in X-On-Behalf-Of
+var onBehalfOfCallers = map[string]bool{}
+
+// parses -on-behalf-of-callers, a comma separated list of names
+func parseOnBehalfOfCallers(value string) {
+	onBehalfOfCallers = map[string]bool{}
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			onBehalfOfCallers[name] = true
+		}
+	}
+}
+
+// takes the end user a request acts for from its X-On-Behalf-Of into its
+// decision, answering 403 and returning false unless the caller may act for
+// others, or 400 if the user isn't a valid owner
+func applyOnBehalfOf(w http.ResponseWriter, r *http.Request, decision *authDecision) bool {
+	user := r.Header.Get(onBehalfOfHeader)
+	if user == "" {
+		return true
+	}
+	// bearer tokens are end users' own, so never act for anyone else
+	if decision.Key == "" || !onBehalfOfCallers[decision.Key] {
+		http.Error(w, "These credentials can't act on behalf of others.", http.StatusForbidden)
+		return false
+	}
+	if err := validateSearchAttribute("owner", user); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid %s header: %s.", onBehalfOfHeader, err.Error()), http.StatusBadRequest)
+		return false
+	}
+	decision.OnBehalfOf = user
+	return true
+}
+
+// record attributes naming the caller that created an asset for its owner,
+// none unless the request was made on someone's behalf
+func onBehalfOfAttributes(r *http.Request) map[string]*dynamodb.AttributeValue {
+	decision := requestAuth(r)
+	if decision.OnBehalfOf == "" {
+		return nil
+	}
+	return map[string]*dynamodb.AttributeValue{"created_by": {S: aws.String(decision.Key)}}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestOnBehalfOf(t *testing.T) {
+	defer resetAPIKeys()
+	defer parseOnBehalfOfCallers("")
+	defer func() { auditLog = nil }()
+	parseAPIKeys("svc=k1,web=k2")
+	parseOnBehalfOfCallers("svc")
+	auditLog = &fileAuditSink{path: filepath.Join(t.TempDir(), "audit.log")}
+	var subject string
+	handler := withAudit(withAuthentication(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subject = requestSubject(r)
+		w.WriteHeader(http.StatusNoContent)
+	})))
+	for _, test := range []struct {
+		key, onBehalfOf, subject string
+		status                   int
+	}{
+		{"k1", "user-1", "user-1", http.StatusNoContent},
+		{"k1", "", "", http.StatusNoContent},
+		{"k2", "user-1", "", http.StatusForbidden},
+		{"k1", "not a user", "", http.StatusBadRequest},
+	} {
+		subject = ""
+		r := httptest.NewRequest(http.MethodPut, "/asset/someID", nil)
+		r.Header.Set(apiKeyHeader, test.key)
+		if test.onBehalfOf != "" {
+			r.Header.Set(onBehalfOfHeader, test.onBehalfOf)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status || subject != test.subject {
+			t.Errorf("Incorrect response to key %s on behalf of %q: %d as %q", test.key, test.onBehalfOf, w.Code, subject)
+		}
+	}
+
+	// the caller and the user it acted for are audited apart
+	flushAudit()
+	if _, response := queryAudit(t, "?caller=user-1"); len(response.Entries) != 1 || response.Entries[0].Key != "svc" || response.Entries[0].Subject != "" || response.Entries[0].OnBehalfOf != "user-1" {
+		t.Errorf("Incorrect audit of a request on behalf of a user: %+v", response)
+	}
+}
+
+func TestInitOnBehalfOf(t *testing.T) {
+	db := &mockDBPutRecordingClient{}
+	dbSvc, s3Svc = db, &mockS3Client{}
+	r := httptest.NewRequest(http.MethodPost, "/asset", nil)
+	r = r.WithContext(context.WithValue(r.Context(), authContextKey{}, authDecision{Method: apiKeyMethod, Key: "svc", OnBehalfOf: "user-1"}))
+	w := httptest.NewRecorder()
+	initAsset(w, r)
+	if w.Code != http.StatusOK || stringAttribute(db.item, "owner") != "user-1" || stringAttribute(db.item, "created_by") != "svc" {
+		t.Errorf("Asset inited on behalf of a user not owned by them: %d %v", w.Code, db.item)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// condition that passes unless the asset is pinned
+const unpinnedCondition = "(attribute_not_exists(pinned) OR pinned = :false)"
+
+var errAssetPinned = errors.New("asset is pinned")
+
+func isPinned(item map[string]*dynamodb.AttributeValue) bool {
+	v, ok := item["pinned"]
+	return ok && aws.BoolValue(v.BOOL)
+}
+
+// exempts an asset from deletion and other cleanup until unpinned
+func handlePinRequest(w http.ResponseWriter, r *http.Request, assetID string) {
+	setPinned(w, r, assetID, true)
+}
+
+func handleUnpinRequest(w http.ResponseWriter, r *http.Request, assetID string) {
+	setPinned(w, r, assetID, false)
+}
+
+func setPinned(w http.ResponseWriter, r *http.Request, assetID string, pinned bool) {
+	values := lockConditionValues(r)
+	values[":pinned"] = &dynamodb.AttributeValue{BOOL: aws.Bool(pinned)}
+	values[":updated"] = updatedAtValue()
+	// DynamoDB TTL would remove pinned assets too, so they don't get one
+	update := "SET pinned = :pinned, updated_at = :updated"
+	if pinned {
+		update += " REMOVE expires"
+	}
+	_, err := dbSvc.UpdateItemWithContext(r.Context(), &dynamodb.UpdateItemInput{
+		Key:                                 assetKey(assetID),
+		TableName:                           aws.String(tableName),
+		UpdateExpression:                    aws.String(update),
+		ConditionExpression:                 aws.String("attribute_exists(id) AND " + lockCondition),
+		ExpressionAttributeValues:           values,
+		ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValuesOnConditionCheckFailureAllOld),
+	})
+	if err != nil {
+		if isConditionFailed(err) {
+			if isLockedConflict(err) {
+				http.Error(w, fmt.Sprintf("Asset id '%s' is locked.", assetID), http.StatusLocked)
+				return
+			}
+			writeError(w, notFound(assetID))
+			return
+		}
+		writeError(w, err)
+		return
+	}
+	if !pinned {
+		if err := setExpiryTTL(r.Context(), assetID); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
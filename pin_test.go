@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+type mockDBPinnedClient struct {
+	mockDBClient
+}
+
+func (m *mockDBPinnedClient) PutItem(*dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	return nil, &dynamodb.ConditionalCheckFailedException{
+		Message_: aws.String("The conditional request failed"),
+		Item:     map[string]*dynamodb.AttributeValue{"id": {S: aws.String("someID")}, "pinned": {BOOL: aws.Bool(true)}},
+	}
+}
+func (m *mockDBPinnedClient) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	return m.PutItem(input)
+}
+
+func (m *mockDBPinnedClient) UpdateItem(*dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	return nil, &dynamodb.ConditionalCheckFailedException{
+		Message_: aws.String("The conditional request failed"),
+		Item:     map[string]*dynamodb.AttributeValue{"id": {S: aws.String("someID")}, "pinned": {BOOL: aws.Bool(true)}},
+	}
+}
+func (m *mockDBPinnedClient) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	return m.UpdateItem(input)
+}
+
+func TestPinRequest(t *testing.T) {
+	dbSvc = &mockDBClient{}
+	for _, action := range []string{"pin", "unpin"} {
+		r := httptest.NewRequest(http.MethodPost, "/asset/someID/"+action, nil)
+		w := httptest.NewRecorder()
+		manageAsset(w, r)
+		if w.Result().StatusCode != http.StatusNoContent {
+			t.Errorf("Incorrect status for %s: %d", action, w.Result().StatusCode)
+		}
+	}
+
+	dbSvc = &mockDBLockedClient{}
+	r := httptest.NewRequest(http.MethodPost, "/asset/someID/pin", nil)
+	w := httptest.NewRecorder()
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusLocked {
+		t.Errorf("Didn't get 423 pinning a locked asset: %d", w.Result().StatusCode)
+	}
+}
+func TestDeletePinnedAsset(t *testing.T) {
+	dbSvc = &mockDBPinnedClient{}
+	s3Svc = &mockS3Client{}
+	if err := deleteAsset(context.Background(), "someID"); err != errAssetPinned {
+		t.Errorf("Deleting a pinned asset didn't fail with errAssetPinned: %v", err)
+	}
+	defer func() { deleteRetention = 7 * 24 * time.Hour }()
+	deleteRetention = 0
+	if err := deleteAsset(context.Background(), "someID"); err != errAssetPinned {
+		t.Errorf("Removing a pinned asset didn't fail with errAssetPinned: %v", err)
+	}
+}
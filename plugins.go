@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"plugin"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// symbols a plugin may export; a validator refuses a request by returning
+// an error, and a processor is handed each asset once it's uploaded
+const (
+	requestValidatorSymbol = "ValidateRequest"
+	uploadProcessorSymbol  = "ProcessUpload"
+)
+
+var requestValidators []func(r *http.Request) error
+var uploadProcessors []func(assetID string, metadata map[string]string) error
+
+// loads every Go plugin (*.so) in dir, registering the hooks it exports
+func loadPlugins(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.so"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		p, err := plugin.Open(path)
+		if err != nil {
+			return err
+		}
+		found := false
+		if sym, err := p.Lookup(requestValidatorSymbol); err == nil {
+			validator, ok := sym.(func(r *http.Request) error)
+			if !ok {
+				return fmt.Errorf("plugin %s: %s has the wrong signature", path, requestValidatorSymbol)
+			}
+			requestValidators = append(requestValidators, validator)
+			found = true
+		}
+		if sym, err := p.Lookup(uploadProcessorSymbol); err == nil {
+			processor, ok := sym.(func(assetID string, metadata map[string]string) error)
+			if !ok {
+				return fmt.Errorf("plugin %s: %s has the wrong signature", path, uploadProcessorSymbol)
+			}
+			uploadProcessors = append(uploadProcessors, processor)
+			found = true
+		}
+		if !found {
+			return fmt.Errorf("plugin %s exports neither %s nor %s", path, requestValidatorSymbol, uploadProcessorSymbol)
+		}
+		log.Println("Loaded plugin " + path)
+	}
+	return nil
+}
+
+// has every plugin validator vet a request before it's handled
+func withPlugins(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, validator := range requestValidators {
+			if err := validator(r); err != nil {
+				http.Error(w, fmt.Sprintf("Request refused: %s.", err.Error()), http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// hands a newly uploaded asset to every plugin processor in the background
+func processUpload(assetID string) {
+	if len(uploadProcessors) == 0 {
+		return
+	}
+	go func() {
+		result, err := dbSvc.GetItem(&dynamodb.GetItemInput{
+			Key:            assetKey(assetID),
+			TableName:      aws.String(tableName),
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		metadata := recordedMetadata(result.Item)
+		for _, processor := range uploadProcessors {
+			if err := processor(assetID, metadata); err != nil {
+				log.Printf("processing asset %s: %s", assetID, err.Error())
+			}
+		}
+	}()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWithPlugins(t *testing.T) {
+	defer func() { requestValidators = nil }()
+	requestValidators = append(requestValidators, func(r *http.Request) error {
+		if r.Header.Get("X-Site") == "" {
+			return errors.New("missing site")
+		}
+		return nil
+	})
+	handler := withPlugins(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/asset/someID", nil))
+	if w.Result().StatusCode != http.StatusForbidden {
+		t.Errorf("Didn't get 403 for a request a plugin refused: %d", w.Result().StatusCode)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/asset/someID", nil)
+	r.Header.Set("X-Site", "docs")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Result().StatusCode != http.StatusTeapot {
+		t.Errorf("Request a plugin accepted wasn't handled: %d", w.Result().StatusCode)
+	}
+}
+func TestProcessUpload(t *testing.T) {
+	defer func() { uploadProcessors = nil }()
+	processed := make(chan string, 1)
+	uploadProcessors = append(uploadProcessors, func(assetID string, metadata map[string]string) error {
+		processed <- assetID
+		return nil
+	})
+	dbSvc = &mockDBClient{}
+	processUpload("someID")
+
+	select {
+	case assetID := <-processed:
+		if assetID != "someID" {
+			t.Errorf("Processor got the wrong asset: %s", assetID)
+		}
+	case <-time.After(time.Second):
+		t.Error("Processor wasn't called")
+	}
+}
+func TestLoadPluginsBadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plugins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := loadPlugins(dir); err != nil {
+		t.Errorf("Got error loading an empty plugin dir: %s", err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "bad.so"), []byte("not a plugin"), 0644)
+	if err := loadPlugins(dir); err == nil {
+		t.Error("Got no error loading a file that isn't a plugin")
+	}
+}
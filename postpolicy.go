@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+const (
+	uploadMethodPut  = "put"
+	uploadMethodPost = "post"
+	// S3 rejects single request uploads over 5GB
+	maxPostSize = 5 << 30
+)
+
+// credentials and region used to sign POST policies, which the SDK can't do
+var awsCredentials *credentials.Credentials
+var awsRegion string
+
+// constraints enforced by S3 on a browser form upload
+type postConditions struct {
+	minSize           int64
+	maxSize           int64
+	contentTypePrefix string
+}
+
+type postPolicy struct {
+	Expiration string        `json:"expiration"`
+	Conditions []interface{} `json:"conditions"`
+}
+
+// parses the size range and content type prefix for a form upload,
+// writing an error and returning false if they are invalid
+func parsePostConditions(w http.ResponseWriter, r *http.Request) (postConditions, bool) {
+	conditions := postConditions{
+		maxSize:           maxPostSize,
+		contentTypePrefix: r.URL.Query().Get("content_type_prefix"),
+	}
+	for name, value := range map[string]*int64{"min_size": &conditions.minSize, "max_size": &conditions.maxSize} {
+		valueStr := r.URL.Query().Get(name)
+		if valueStr == "" {
+			continue
+		}
+		size, err := strconv.ParseInt(valueStr, 10, 64)
+		if err != nil || size < 0 || size > maxPostSize {
+			http.Error(w, fmt.Sprintf("Invalid argument for %s, must be integer from 0 to %d.", name, int64(maxPostSize)), http.StatusBadRequest)
+			return conditions, false
+		}
+		*value = size
+	}
+	if conditions.minSize > conditions.maxSize {
+		http.Error(w, "Invalid arguments, min_size is larger than max_size.", http.StatusBadRequest)
+		return conditions, false
+	}
+	return conditions, true
+}
+
+// the url browsers post upload forms to
+func bucketURL() string {
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/", bucketName, awsRegion)
+}
+
+// builds the signed form fields for uploading key via an HTML form POST;
+// fields are included verbatim in the form and pinned by the policy
+func presignPost(key string, fields map[string]string, conditions postConditions, expire time.Duration) (map[string]string, error) {
+	creds, err := awsCredentials.Get()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	date := now.Format("20060102")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, awsRegion)
+
+	form := map[string]string{
+		"key":              key,
+		"x-amz-algorithm":  "AWS4-HMAC-SHA256",
+		"x-amz-credential": creds.AccessKeyID + "/" + scope,
+		"x-amz-date":       now.Format("20060102T150405Z"),
+	}
+	if creds.SessionToken != "" {
+		form["x-amz-security-token"] = creds.SessionToken
+	}
+	for k, v := range fields {
+		form[k] = v
+	}
+
+	policy := postPolicy{
+		Expiration: now.Add(expire).Format("2006-01-02T15:04:05.000Z"),
+		Conditions: []interface{}{
+			map[string]string{"bucket": bucketName},
+			[]interface{}{"content-length-range", conditions.minSize, conditions.maxSize},
+		},
+	}
+	for k, v := range form {
+		policy.Conditions = append(policy.Conditions, map[string]string{k: v})
+	}
+	if conditions.contentTypePrefix != "" {
+		policy.Conditions = append(policy.Conditions, []string{"starts-with", "$Content-Type", conditions.contentTypePrefix})
+	}
+	policyJSON, err := json.Marshal(policy)
+	if err != nil {
+		return nil, err
+	}
+	form["policy"] = base64.StdEncoding.EncodeToString(policyJSON)
+
+	// sigv4 signing key derivation, applied to the encoded policy
+	signingKey := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	for _, part := range []string{awsRegion, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	form["x-amz-signature"] = hex.EncodeToString(hmacSHA256(signingKey, form["policy"]))
+	return form, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+func TestPresignPost(t *testing.T) {
+	awsCredentials = credentials.NewStaticCredentials("AKID", "SECRET", "")
+	awsRegion = "us-east-1"
+	conditions := postConditions{minSize: 1, maxSize: 1024, contentTypePrefix: "image/"}
+	fields, err := presignPost("someID", map[string]string{"Cache-Control": "no-cache"}, conditions, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to presign post: %s", err)
+	}
+	if fields["key"] != "someID" || fields["Cache-Control"] != "no-cache" || fields["x-amz-signature"] == "" {
+		t.Errorf("Missing form fields: %v", fields)
+	}
+	if !strings.HasPrefix(fields["x-amz-credential"], "AKID/") {
+		t.Errorf("Unexpected credential field: %s", fields["x-amz-credential"])
+	}
+
+	policyJSON, _ := base64.StdEncoding.DecodeString(fields["policy"])
+	policy := postPolicy{}
+	if err := json.Unmarshal(policyJSON, &policy); err != nil {
+		t.Fatalf("Failed to decode policy: %s", err)
+	}
+	for _, expected := range []string{`["content-length-range",1,1024]`, `["starts-with","$Content-Type","image/"]`, `{"key":"someID"}`} {
+		if !strings.Contains(string(policyJSON), expected) {
+			t.Errorf("Policy is missing condition %s: %s", expected, policyJSON)
+		}
+	}
+}
+func TestInitAssetPost(t *testing.T) {
+	awsCredentials = credentials.NewStaticCredentials("AKID", "SECRET", "")
+	awsRegion = "us-east-1"
+	dbSvc = &mockDBClient{}
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodPost, "/asset?upload=post&max_size=1048576", nil)
+	w := httptest.NewRecorder()
+
+	initAsset(w, r)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Incorrect status on asset init with post: %d", resp.StatusCode)
+	}
+	jsonResp := initAssetResponse{}
+	json.NewDecoder(resp.Body).Decode(&jsonResp)
+	if jsonResp.UploadFields["policy"] == "" || jsonResp.UploadFields["key"] != jsonResp.ID {
+		t.Errorf("Init with post did not return form fields: %v", jsonResp.UploadFields)
+	}
+}
+func TestInitAssetPostBadSize(t *testing.T) {
+	dbSvc = &mockDBClient{}
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodPost, "/asset?upload=post&min_size=10&max_size=5", nil)
+	w := httptest.NewRecorder()
+
+	initAsset(w, r)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Didn't get 400 for an inverted size range: %d", resp.StatusCode)
+	}
+}
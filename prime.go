@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// most edges one prime request can warm
+	maxPrimeEdges = 32
+	// how long priming an edge, fetching the whole object, can take
+	primeTimeout = 5 * time.Minute
+)
+
+var primeEdgePattern = regexp.MustCompile(`^[A-Za-z0-9.-]+$`)
+
+// the transport prime requests are sent with, dialing each edge directly
+var primeTransport = http.DefaultTransport.(*http.Transport)
+
+// what priming one edge found
+type primeResult struct {
+	// the address asked, "default" for wherever the CDN's DNS pointed
+	Edge string `json:"edge"`
+	// the edge location that answered and whether it already had the object,
+	// from CloudFront's X-Amz-Cf-Pop and X-Cache headers
+	Pop        string `json:"pop,omitempty"`
+	Cache      string `json:"cache,omitempty"`
+	Status     int    `json:"status,omitempty"`
+	Bytes      int64  `json:"bytes"`
+	DurationMS int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+type primeResponse struct {
+	ID      string        `json:"id"`
+	Results []primeResult `json:"results"`
+}
+
+// fetches an uploaded asset through the CDN, from each of the edges given as
+// edges or else from wherever its DNS points, so it's cached there ahead of
+// a launch; embargoed assets can be primed, their urls being signed
+func handlePrimeRequest(w http.ResponseWriter, r *http.Request, assetID string) {
+	if cloudFrontSigner == nil {
+		http.Error(w, "Priming needs downloads served through CloudFront, see -cloudfront-domain.", http.StatusConflict)
+		return
+	}
+	edges, err := parsePrimeEdges(r.URL.Query().Get("edges"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid argument for edges: %s.", err.Error()), http.StatusBadRequest)
+		return
+	}
+	item, ok := fetchAsset(w, r, assetID)
+	if !ok {
+		return
+	}
+	if stringAttribute(item, "status") != assetStatusUploaded {
+		writeError(w, notUploaded(assetID))
+		return
+	}
+
+	// the same response overrides as downloads, which CloudFront caches by
+	item, ok = requestedVersion(w, r, assetID, item)
+	if !ok {
+		return
+	}
+	head, err := objectHead(r.Context(), objectKey(assetID, item), stringAttribute(item, "s3_version_id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	input, ok := downloadInput(w, r, assetID, item, head)
+	if !ok {
+		return
+	}
+	signed, err := presignCloudFront(input, primeTimeout)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := primeResponse{ID: assetID, Results: make([]primeResult, len(edges))}
+	var wg sync.WaitGroup
+	for i, edge := range edges {
+		wg.Add(1)
+		go func(i int, edge string) {
+			defer wg.Done()
+			response.Results[i] = primeEdge(r.Context(), signed, edge)
+		}(i, edge)
+	}
+	wg.Wait()
+	failed := 0
+	for _, result := range response.Results {
+		if result.Error != "" {
+			failed++
+		}
+	}
+	if failed == len(edges) {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	writeJSON(w, response)
+}
+
+// edges given as comma separated hosts or IPs, with an optional port, to
+// connect to in place of the CDN's own address; just "default" if none
+func parsePrimeEdges(value string) ([]string, error) {
+	if value == "" {
+		return []string{"default"}, nil
+	}
+	var edges []string
+	for _, edge := range strings.Split(value, ",") {
+		if edge = strings.TrimSpace(edge); edge == "" {
+			continue
+		}
+		host := edge
+		if h, _, err := net.SplitHostPort(edge); err == nil {
+			host = h
+		} else {
+			edge = net.JoinHostPort(edge, "443")
+		}
+		if net.ParseIP(host) == nil && !primeEdgePattern.MatchString(host) {
+			return nil, fmt.Errorf("'%s' is not a host or IP", host)
+		}
+		edges = append(edges, edge)
+	}
+	if len(edges) == 0 || len(edges) > maxPrimeEdges {
+		return nil, fmt.Errorf("must list 1 to %d edges", maxPrimeEdges)
+	}
+	return edges, nil
+}
+
+// fetches the whole object at a signed url from one edge; the CDN's
+// certificate is checked whichever address answers
+func primeEdge(ctx context.Context, signed, edge string) primeResult {
+	result := primeResult{Edge: edge}
+	transport := primeTransport.Clone()
+	if edge != "default" {
+		dialer := &net.Dialer{Timeout: 10 * time.Second}
+		transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, edge)
+		}
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport, Timeout: primeTimeout}
+	start := time.Now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, signed, nil)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		// without the url, which is signed
+		if uerr, ok := err.(*url.Error); ok {
+			err = uerr.Err
+		}
+		result.Error = err.Error()
+		result.DurationMS = time.Since(start).Milliseconds()
+		return result
+	}
+	defer resp.Body.Close()
+	result.Status = resp.StatusCode
+	result.Pop = resp.Header.Get("X-Amz-Cf-Pop")
+	result.Cache = resp.Header.Get("X-Cache")
+	result.Bytes, err = io.Copy(ioutil.Discard, resp.Body)
+	if err != nil {
+		result.Error = err.Error()
+	} else if resp.StatusCode != http.StatusOK {
+		result.Error = resp.Status
+	}
+	result.DurationMS = time.Since(start).Milliseconds()
+	return result
+}
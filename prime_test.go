@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/cloudfront/sign"
+)
+
+func TestPrimeRequest(t *testing.T) {
+	var hits int64
+	status := http.StatusOK
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		if r.URL.Query().Get("Signature") == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("X-Amz-Cf-Pop", "FRA56-P1")
+		w.Header().Set("X-Cache", "Miss from cloudfront")
+		w.WriteHeader(status)
+		w.Write([]byte("Hello world!"))
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	transport := primeTransport
+	primeTransport = server.Client().Transport.(*http.Transport)
+	defer func() { primeTransport = transport }()
+	dbSvc = &mockDBClient{}
+	s3Svc = &mockS3Client{}
+
+	prime := func(query string) (int, primeResponse) {
+		w := httptest.NewRecorder()
+		manageAsset(w, httptest.NewRequest(http.MethodPost, "/asset/someID/prime"+query, nil))
+		var response primeResponse
+		json.NewDecoder(w.Body).Decode(&response)
+		return w.Code, response
+	}
+	if status, _ := prime(""); status != http.StatusConflict {
+		t.Errorf("Didn't get 409 without CloudFront: %d", status)
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cloudFrontDomain = u.Host
+	cloudFrontSigner = sign.NewURLSigner("someKeyID", key)
+	defer func() { cloudFrontDomain, cloudFrontSigner = "", nil }()
+
+	code, response := prime("")
+	if code != http.StatusOK || len(response.Results) != 1 {
+		t.Fatalf("Incorrect prime response: %d %+v", code, response)
+	}
+	if result := response.Results[0]; result.Edge != "default" || result.Pop != "FRA56-P1" || result.Bytes != 12 || result.Error != "" {
+		t.Errorf("Incorrect prime result: %+v", result)
+	}
+
+	// each edge is dialed directly, whatever the CDN's host resolves to
+	cloudFrontDomain = "cdn.example.com:" + u.Port()
+	atomic.StoreInt64(&hits, 0)
+	code, response = prime("?edges=" + u.Host + "," + u.Host)
+	if code != http.StatusOK || len(response.Results) != 2 || atomic.LoadInt64(&hits) != 2 {
+		t.Errorf("Edges not primed: %d %+v", code, response)
+	}
+
+	cloudFrontDomain = u.Host
+	status = http.StatusForbidden
+	if code, response = prime(""); code != http.StatusBadGateway || response.Results[0].Status != http.StatusForbidden {
+		t.Errorf("Didn't get 502 with every edge failing: %d %+v", code, response)
+	}
+	if code, _ = prime("?edges=not%20a%20host"); code != http.StatusBadRequest {
+		t.Errorf("Didn't get 400 for an invalid edge: %d", code)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	progressPending   = "pending"
+	progressUploading = "uploading"
+	progressUploaded  = "uploaded"
+	progressRejected  = "rejected"
+)
+
+// how far along an asset's upload is; single put uploads go straight from
+// pending to uploaded since S3 doesn't report their progress
+type progressResponse struct {
+	ID             string `json:"id"`
+	State          string `json:"state"`
+	BytesReceived  int64  `json:"bytes_received"`
+	BytesTotal     int64  `json:"bytes_total,omitempty"`
+	PartsCompleted int    `json:"parts_completed,omitempty"`
+	PartsIssued    int    `json:"parts_issued,omitempty"`
+}
+
+// reports the progress of an asset's upload
+func handleProgressRequest(w http.ResponseWriter, r *http.Request, assetID string) {
+	item, ok := fetchAsset(w, r, assetID)
+	if !ok {
+		return
+	}
+	progress := progressResponse{ID: assetID, State: progressPending}
+	uploadID := stringAttribute(item, "upload_id")
+
+	switch {
+	case stringAttribute(item, "status") == assetStatusRejected:
+		progress.State = progressRejected
+	case stringAttribute(item, "status") == assetStatusUploaded:
+		// the object is whole, so its size is the total
+		progress.State = progressUploaded
+		head, err := objectHead(r.Context(), objectKey(assetID, item), "")
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		progress.BytesTotal = aws.Int64Value(head.ContentLength)
+		progress.BytesReceived = progress.BytesTotal
+	case item["tus_length"] != nil:
+		// resumable uploads keep their offset on the record
+		progress.BytesReceived = numberAttribute(item, "tus_offset")
+		progress.BytesTotal = numberAttribute(item, "tus_length")
+		progress.PartsCompleted = int(numberAttribute(item, "tus_parts"))
+		if progress.BytesReceived > 0 {
+			progress.State = progressUploading
+		}
+	case uploadID != "":
+		// multipart uploads are as far along as the parts S3 holds
+		err := s3Svc.ListPartsPagesWithContext(r.Context(), &s3.ListPartsInput{
+			Bucket:   aws.String(bucketName),
+			Key:      aws.String(objectKey(assetID, item)),
+			UploadId: aws.String(uploadID),
+		}, func(page *s3.ListPartsOutput, lastPage bool) bool {
+			for _, part := range page.Parts {
+				progress.PartsCompleted++
+				progress.BytesReceived += aws.Int64Value(part.Size)
+			}
+			return true
+		})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if parts, ok := item["parts"]; ok {
+			progress.PartsIssued = len(parts.NS)
+		}
+		progress.State = progressUploading
+	}
+	writeJSON(w, progress)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+func fetchProgress(t *testing.T, db dynamodbiface.DynamoDBAPI) progressResponse {
+	dbSvc = db
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodGet, "/asset/someID/progress", nil)
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Incorrect status fetching progress: %d", w.Result().StatusCode)
+	}
+	var progress progressResponse
+	json.NewDecoder(w.Result().Body).Decode(&progress)
+	return progress
+}
+
+func TestProgress(t *testing.T) {
+	if p := fetchProgress(t, &mockDBNotUploadedClient{}); p.State != progressPending {
+		t.Errorf("Incorrect progress before upload: %+v", p)
+	}
+	if p := fetchProgress(t, &mockDBClient{}); p.State != progressUploaded || p.BytesReceived != 12 || p.BytesTotal != 12 {
+		t.Errorf("Incorrect progress of an uploaded asset: %+v", p)
+	}
+	if p := fetchProgress(t, &mockDBTusClient{}); p.State != progressUploading || p.BytesReceived != 12 || p.BytesTotal != 20 {
+		t.Errorf("Incorrect progress of a resumable upload: %+v", p)
+	}
+	if p := fetchProgress(t, &mockDBMultipartClient{}); p.State != progressUploading || p.PartsCompleted != 1 {
+		t.Errorf("Incorrect progress of a multipart upload: %+v", p)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// largest body accepted by proxied uploads
+var maxProxyUploadSize int64 = 5 << 30
+
+// whether downloads can be streamed through the service
+var proxyDownloads bool
+
+// proxies an asset's content in either direction
+func handleContentRequest(w http.ResponseWriter, r *http.Request, assetID string) {
+	if r.Method == http.MethodGet {
+		handleContentDownload(w, r, assetID)
+	} else {
+		handleContentUpload(w, r, assetID)
+	}
+}
+
+// streams an asset's object through the service, for clients that can't
+// reach S3 directly
+func handleContentDownload(w http.ResponseWriter, r *http.Request, assetID string) {
+	if !proxyDownloads {
+		http.Error(w, "Proxied downloads are disabled.", http.StatusNotFound)
+		return
+	}
+	item, ok := fetchAsset(w, r, assetID)
+	if !ok {
+		return
+	}
+	if stringAttribute(item, "status") != assetStatusUploaded {
+		http.Error(w, fmt.Sprintf("Asset id '%s' found but upload is not complete.", assetID), http.StatusAccepted)
+		return
+	}
+	if !checkExpiry(w, assetID, item) || !checkEmbargo(w, assetID, item) {
+		return
+	}
+	item, ok = requestedVersion(w, r, assetID, item)
+	if !ok {
+		return
+	}
+	head, err := objectHead(r.Context(), objectKey(assetID, item), stringAttribute(item, "s3_version_id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !checkArchived(w, assetID, head) {
+		return
+	}
+	input, ok := downloadInput(w, r, assetID, item, head)
+	if !ok {
+		return
+	}
+	countDownload(assetID)
+	recordAssetEvent(r, assetID, assetEventDownloaded, map[string]string{"via": "content"})
+	streamObject(w, r, input)
+}
+
+// streams the request body to S3 on the client's behalf and marks the
+// asset uploaded, for clients that can't reach S3 directly
+func handleContentUpload(w http.ResponseWriter, r *http.Request, assetID string) {
+	completionToken, ok := requestCompletionToken(w, r)
+	if !ok {
+		return
+	}
+	item, ok := fetchAsset(w, r, assetID)
+	if !ok || !checkUploadOrigin(w, r, assetID, item) {
+		return
+	}
+	if stringAttribute(item, "status") == assetStatusUploaded {
+		http.Error(w, fmt.Sprintf("Asset id '%s' is already uploaded.", assetID), http.StatusConflict)
+		return
+	}
+	contentType := stringAttribute(item, "content_type")
+	if contentType == "" {
+		contentType = r.Header.Get("Content-Type")
+		if err := validateContentType(contentType); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid Content-Type: %s.", err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+	if r.ContentLength > maxProxyUploadSize {
+		http.Error(w, "Request body is too large.", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// carry over what init recorded, as a presigned upload would have, and
+	// take checksums since the bytes pass through here
+	d := newDigester()
+	uploader := s3manager.NewUploaderWithClient(s3Svc)
+	_, err := uploader.UploadWithContext(r.Context(), &s3manager.UploadInput{
+		Bucket:                  aws.String(bucketName),
+		Key:                     aws.String(objectKey(assetID, item)),
+		Body:                    io.TeeReader(http.MaxBytesReader(w, r.Body, maxProxyUploadSize), d),
+		ContentType:             optionalString(contentType),
+		CacheControl:            optionalString(stringAttribute(item, "cache_control")),
+		Metadata:                aws.StringMap(recordedMetadata(item)),
+		ServerSideEncryption:    encryptionAlgorithm(),
+		SSEKMSKeyId:             optionalString(kmsKeyID),
+		SSEKMSEncryptionContext: encryptionContextHeader(assetID),
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	attributes := d.sums().attributes()
+	for k, v := range encryptionAttributes(assetID) {
+		attributes[k] = v
+	}
+	if !markUploaded(w, r, assetID, objectKey(assetID, item), completionToken, attributes) {
+		return
+	}
+	if duplicateOf := recordDuplicate(assetID, attributes); duplicateOf != "" {
+		writeJSON(w, markUploadedResponse{DuplicateOf: duplicateOf, ConsistencyToken: w.Header().Get(consistencyTokenHeader)})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestContentUpload(t *testing.T) {
+	dbSvc = &mockDBNotUploadedClient{}
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodPost, "/asset/someID/content", bytes.NewReader([]byte("Hello world!")))
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Incorrect status on proxied upload: %d", resp.StatusCode)
+	}
+}
+func TestContentUploadAlreadyUploaded(t *testing.T) {
+	dbSvc = &mockDBClient{}
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodPost, "/asset/someID/content", bytes.NewReader([]byte("Hello world!")))
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Didn't get 409 on proxied upload over an uploaded asset: %d", resp.StatusCode)
+	}
+}
+func TestContentUploadTooLarge(t *testing.T) {
+	defer func(size int64) { maxProxyUploadSize = size }(maxProxyUploadSize)
+	maxProxyUploadSize = 4
+	dbSvc = &mockDBNotUploadedClient{}
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodPost, "/asset/someID/content", bytes.NewReader([]byte("Hello world!")))
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Didn't get 413 on an oversized proxied upload: %d", resp.StatusCode)
+	}
+}
+func TestContentDownload(t *testing.T) {
+	defer func() { proxyDownloads = false }()
+	proxyDownloads = true
+	dbSvc = &mockDBClient{}
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodGet, "/asset/someID/content", nil)
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	resp := w.Result()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "Hello world!" {
+		t.Errorf("Incorrect proxied download: %d %q", resp.StatusCode, body)
+	}
+	if resp.Header.Get("Content-Length") != "12" || resp.Header.Get("Content-Type") != "image/png" {
+		t.Errorf("Incorrect headers on proxied download: %v", resp.Header)
+	}
+}
+func TestContentDownloadDisabled(t *testing.T) {
+	dbSvc = &mockDBClient{}
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodGet, "/asset/someID/content", nil)
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusNotFound {
+		t.Errorf("Didn't get 404 with proxied downloads disabled: %d", w.Result().StatusCode)
+	}
+}
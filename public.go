@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// base url where objects are world-readable, e.g. a public CDN or bucket
+// policy; without one public assets redirect through the service
+var publicBaseURL string
+
+func isPublic(item map[string]*dynamodb.AttributeValue) bool {
+	v, ok := item["public"]
+	return ok && aws.BoolValue(v.BOOL)
+}
+
+// download parameters only the service can apply, which the object's own
+// url at -public-url would ignore
+var publicOverrides = []string{"content_type", "disposition", "filename", "cache_control"}
+
+// the stable url of a public asset whose object is at key; the object is
+// linked directly only when served as stored is safe, active content and
+// overridden downloads go through /public/, which applies the same rules
+// as signed downloads
+func publicURL(r *http.Request, assetID, key, contentType string) string {
+	overrides := url.Values{}
+	for _, name := range publicOverrides {
+		if value := r.URL.Query().Get(name); value != "" {
+			overrides.Set(name, value)
+		}
+	}
+	if publicBaseURL != "" && len(overrides) == 0 && !isActiveContent(contentType) {
+		return strings.TrimSuffix(publicBaseURL, "/") + "/" + key
+	}
+	path := "/public/" + assetID
+	if len(overrides) > 0 {
+		path += "?" + overrides.Encode()
+	}
+	return serviceURL(r, path)
+}
+
+// makes an asset public (POST) or private again (DELETE)
+func handlePublicRequest(w http.ResponseWriter, r *http.Request, assetID string) {
+	values := lockConditionValues(r)
+	values[":public"] = &dynamodb.AttributeValue{BOOL: aws.Bool(r.Method == http.MethodPost)}
+	values[":updated"] = updatedAtValue()
+	_, err := dbSvc.UpdateItemWithContext(r.Context(), &dynamodb.UpdateItemInput{
+		Key:                                 assetKey(assetID),
+		TableName:                           aws.String(tableName),
+		UpdateExpression:                    aws.String("SET #public = :public, updated_at = :updated"),
+		ConditionExpression:                 aws.String("attribute_exists(id) AND " + lockCondition),
+		ExpressionAttributeNames:            map[string]*string{"#public": aws.String("public")},
+		ExpressionAttributeValues:           values,
+		ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValuesOnConditionCheckFailureAllOld),
+	})
+	if err != nil {
+		if isConditionFailed(err) {
+			if isLockedConflict(err) {
+				http.Error(w, fmt.Sprintf("Asset id '%s' is locked.", assetID), http.StatusLocked)
+				return
+			}
+			writeError(w, notFound(assetID))
+			return
+		}
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// redirects a public asset's stable url to a freshly signed one
+func servePublic(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet, http.MethodHead) {
+		return
+	}
+	assetID := strings.TrimPrefix(r.URL.Path, "/public/")
+	item, ok := fetchAsset(w, r, assetID)
+	if !ok {
+		return
+	}
+	// private assets look the same as missing ones here
+	if !isPublic(item) || stringAttribute(item, "status") != assetStatusUploaded {
+		writeError(w, notFound(assetID))
+		return
+	}
+	if !checkExpiry(w, assetID, item) || !checkEmbargo(w, assetID, item) {
+		return
+	}
+	head, err := objectHead(r.Context(), objectKey(assetID, item), stringAttribute(item, "s3_version_id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !checkArchived(w, assetID, head) {
+		return
+	}
+	input, ok := downloadInput(w, r, assetID, item, head)
+	if !ok {
+		return
+	}
+	signed, err := cachedPresignDownload(r, input, defaultDownloadTimeout)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	countDownload(assetID)
+	recordAssetEvent(r, assetID, assetEventDownloaded, map[string]string{"via": "public"})
+	http.Redirect(w, r, signed, http.StatusFound)
+}
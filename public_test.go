@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// an uploaded asset marked public
+type mockDBPublicClient struct {
+	mockDBClient
+}
+
+func (m *mockDBPublicClient) GetItem(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	output, _ := m.mockDBClient.GetItem(nil)
+	output.Item["public"] = &dynamodb.AttributeValue{BOOL: aws.Bool(true)}
+	return output, nil
+}
+func (m *mockDBPublicClient) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return m.GetItem(input)
+}
+
+func TestAssetURLRequestPublic(t *testing.T) {
+	dbSvc = &mockDBPublicClient{}
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodGet, "/asset/someID", nil)
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	var resp assetURLResponse
+	json.NewDecoder(w.Result().Body).Decode(&resp)
+	if resp.DownloadURL != "http://example.com/public/someID" {
+		t.Errorf("Public asset didn't get its stable URL: %s", resp.DownloadURL)
+	}
+
+	publicBaseURL = "https://cdn.example.com/assets/"
+	defer func() { publicBaseURL = "" }()
+	w = httptest.NewRecorder()
+	manageAsset(w, r)
+	json.NewDecoder(w.Result().Body).Decode(&resp)
+	if resp.DownloadURL != "https://cdn.example.com/assets/someID" {
+		t.Errorf("Public asset didn't use the public base URL: %s", resp.DownloadURL)
+	}
+
+	// only the service forces active content to download
+	s3Svc = &mockS3HTMLClient{}
+	w = httptest.NewRecorder()
+	manageAsset(w, r)
+	json.NewDecoder(w.Result().Body).Decode(&resp)
+	if resp.DownloadURL != "http://example.com/public/someID" {
+		t.Errorf("Active content linked from the public base URL: %s", resp.DownloadURL)
+	}
+	s3Svc = &mockS3Client{}
+	w = httptest.NewRecorder()
+	manageAsset(w, httptest.NewRequest(http.MethodGet, "/asset/someID?disposition=attachment", nil))
+	json.NewDecoder(w.Result().Body).Decode(&resp)
+	if resp.DownloadURL != "http://example.com/public/someID?disposition=attachment" {
+		t.Errorf("Overridden download linked from the public base URL: %s", resp.DownloadURL)
+	}
+}
+func TestServePublic(t *testing.T) {
+	s3Svc = &mockS3Client{}
+	dbSvc = &mockDBPublicClient{}
+	r := httptest.NewRequest(http.MethodGet, "/public/someID", nil)
+	w := httptest.NewRecorder()
+	servePublic(w, r)
+	if w.Result().StatusCode != http.StatusFound {
+		t.Errorf("Public asset wasn't redirected: %d", w.Result().StatusCode)
+	}
+
+	dbSvc = &mockDBClient{}
+	w = httptest.NewRecorder()
+	servePublic(w, r)
+	if w.Result().StatusCode != http.StatusNotFound {
+		t.Errorf("Private asset wasn't hidden: %d", w.Result().StatusCode)
+	}
+}
+func TestMakePublic(t *testing.T) {
+	dbSvc = &mockDBClient{}
+	r := httptest.NewRequest(http.MethodPost, "/asset/someID/public", nil)
+	w := httptest.NewRecorder()
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusNoContent {
+		t.Errorf("Incorrect status making an asset public: %d", w.Result().StatusCode)
+	}
+
+	dbSvc = &mockDBLockedClient{}
+	r = httptest.NewRequest(http.MethodDelete, "/asset/someID/public", nil)
+	w = httptest.NewRecorder()
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusLocked {
+		t.Errorf("Didn't get 423 for a locked asset: %d", w.Result().StatusCode)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	// how long throttles only space calls out locally after the rate limit
+	// table fails, before trying it again
+	rateLimitFallback = 30 * time.Second
+	// how long window counters are kept, by the table's TTL on expires
+	rateLimitRetention = time.Hour
+	// how long a claim waits on the table before it counts as unreachable
+	rateLimitClaimTimeout = 2 * time.Second
+)
+
+// the DynamoDB table, keyed on id, counting throttled calls across instances
+// per window; none to limit each instance on its own
+var rateLimitTableName string
+
+var rateLimitStore struct {
+	sync.Mutex
+	// when to try the table again after it failed
+	downUntil time.Time
+}
+
+// the window calls are counted in and how many it allows: a second, or
+// long enough for one call at rates under one a second
+func (t *throttle) sharedWindow() (time.Duration, int64) {
+	perSecond := float64(time.Second) / float64(t.interval)
+	window := time.Second
+	if perSecond < 1 {
+		window = time.Duration(math.Ceil(1/perSecond)) * time.Second
+	}
+	return window, int64(math.Max(1, math.Floor(perSecond*window.Seconds())))
+}
+
+// blocks until a call fits in the current window across instances,
+// returning false if canceled first; when the table can't be reached calls
+// are only spaced out locally for a while
+func (t *throttle) waitShared(cancel <-chan struct{}) bool {
+	window, limit := t.sharedWindow()
+	// claims are abandoned as soon as the wait is canceled
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go func() {
+		select {
+		case <-cancel:
+			stop()
+		case <-ctx.Done():
+		}
+	}()
+	for {
+		rateLimitStore.Lock()
+		down := time.Now().Before(rateLimitStore.downUntil)
+		rateLimitStore.Unlock()
+		if down {
+			return true
+		}
+		now := time.Now()
+		start := now.Truncate(window)
+		ok, err := claimRateLimitSlot(ctx, t.shared, start, window, limit)
+		if ctx.Err() != nil {
+			return false
+		}
+		if err != nil {
+			rateLimitStore.Lock()
+			rateLimitStore.downUntil = time.Now().Add(rateLimitFallback)
+			rateLimitStore.Unlock()
+			log.Printf("rate limit table unavailable, limiting %s on this instance only for %s: %s", t.shared, rateLimitFallback, err.Error())
+			return true
+		}
+		if ok {
+			return true
+		}
+		// the window is full across instances
+		timer := time.NewTimer(start.Add(window).Sub(now))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+	}
+}
+
+// counts a call against a limit's window starting at start, returning false
+// if the window already has limit calls
+func claimRateLimitSlot(ctx context.Context, name string, start time.Time, window time.Duration, limit int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, rateLimitClaimTimeout)
+	defer cancel()
+	_, err := dbSvc.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		Key:                 assetKey(fmt.Sprintf("%s:%d", name, start.Unix())),
+		TableName:           aws.String(rateLimitTableName),
+		UpdateExpression:    aws.String("SET expires = :expires ADD taken :one"),
+		ConditionExpression: aws.String("attribute_not_exists(taken) OR taken < :limit"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":one":     {N: aws.String("1")},
+			":limit":   {N: aws.String(strconv.FormatInt(limit, 10))},
+			":expires": {N: aws.String(strconv.FormatInt(start.Add(window+rateLimitRetention).Unix(), 10))},
+		},
+	})
+	if isConditionFailed(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// a rate limit table counting calls per window, full once limit is reached
+type mockDBRateLimitClient struct {
+	mockDBClient
+	taken map[string]int64
+	calls int
+	err   error
+}
+
+func (m *mockDBRateLimitClient) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	m.calls++
+	if m.err != nil {
+		return nil, m.err
+	}
+	id := stringAttribute(input.Key, "id")
+	if m.taken[id] >= numberAttribute(input.ExpressionAttributeValues, ":limit") {
+		return nil, &dynamodb.ConditionalCheckFailedException{Message_: aws.String("The conditional request failed")}
+	}
+	m.taken[id]++
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+func (m *mockDBRateLimitClient) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	return m.UpdateItem(input)
+}
+
+func TestSharedWindow(t *testing.T) {
+	for perSecond, want := range map[float64]struct {
+		window time.Duration
+		limit  int64
+	}{
+		25:   {time.Second, 25},
+		2.5:  {time.Second, 2},
+		0.5:  {2 * time.Second, 1},
+		0.3:  {4 * time.Second, 1},
+		1000: {time.Second, 1000},
+	} {
+		window, limit := newThrottle(perSecond).sharedWindow()
+		if window != want.window || limit != want.limit {
+			t.Errorf("Incorrect window for %v a second: %s, %d", perSecond, window, limit)
+		}
+	}
+}
+
+func TestSharedThrottle(t *testing.T) {
+	rateLimitTableName = "rate-limits"
+	defer func() { rateLimitTableName = "" }()
+	db := &mockDBRateLimitClient{taken: map[string]int64{}}
+	dbSvc = db
+	th := newThrottle(1000)
+	th.shared = "delete"
+
+	// another instance already filled this window, so waiting takes until
+	// the next one
+	start := time.Now().Truncate(time.Second)
+	db.taken[deleteWindowID(start)] = 1000
+	next := deleteWindowID(start.Add(time.Second))
+	if !th.wait(nil) {
+		t.Fatalf("Wait returned false without being canceled")
+	}
+	if time.Now().Before(start.Add(time.Second)) || db.taken[next] != 1 {
+		t.Errorf("Wait didn't hold off until the next window: %v", db.taken)
+	}
+
+	cancel := make(chan struct{})
+	close(cancel)
+	db.taken[next], db.taken[deleteWindowID(start.Add(2*time.Second))] = 1000, 1000
+	if th.waitShared(cancel) {
+		t.Errorf("Canceled wait on a full window returned true")
+	}
+
+	// an unavailable table falls back to limiting locally for a while
+	db.err = errors.New("throttled")
+	if !th.waitShared(nil) {
+		t.Errorf("Wait with the table unavailable returned false")
+	}
+	calls := db.calls
+	db.err = nil
+	th.waitShared(nil)
+	if db.calls != calls {
+		t.Errorf("Table used again during the fallback: %d calls", db.calls)
+	}
+	rateLimitStore.Lock()
+	rateLimitStore.downUntil = time.Time{}
+	rateLimitStore.Unlock()
+}
+
+// a rate limit table that never answers, until the call is given up on
+type mockDBHungRateLimitClient struct {
+	mockDBClient
+}
+
+func (m *mockDBHungRateLimitClient) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestSharedThrottleCancelClaim(t *testing.T) {
+	rateLimitTableName = "rate-limits"
+	defer func() { rateLimitTableName = "" }()
+	dbSvc = &mockDBHungRateLimitClient{}
+	th := newThrottle(1000)
+	th.shared = "delete"
+
+	cancel := make(chan struct{})
+	time.AfterFunc(50*time.Millisecond, func() { close(cancel) })
+	started := time.Now()
+	if th.waitShared(cancel) {
+		t.Errorf("Wait canceled during a claim returned true")
+	}
+	if elapsed := time.Since(started); elapsed >= rateLimitClaimTimeout {
+		t.Errorf("Claim not abandoned on cancel: took %s", elapsed)
+	}
+	rateLimitStore.Lock()
+	down := time.Now().Before(rateLimitStore.downUntil)
+	rateLimitStore.Unlock()
+	if down {
+		t.Errorf("Canceled claim counted as the table being unavailable")
+	}
+}
+
+// the id counting deletions in the window starting at start
+func deleteWindowID(start time.Time) string {
+	return "delete:" + strconv.FormatInt(start.Unix(), 10)
+}
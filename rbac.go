@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// roles callers can hold, each allowed everything the ones before it are
+const (
+	roleReader   = "reader"
+	roleUploader = "uploader"
+	roleAdmin    = "admin"
+)
+
+var roleRanks = map[string]int{roleReader: 1, roleUploader: 2, roleAdmin: 3}
+
+// whether requests are limited to what the caller's role allows
+var rbacEnabled bool
+
+// roles of API keys and IAM principals by name, from -roles
+var namedRoles = map[string]string{}
+
+// roles by the role claim values of bearer tokens, from -role-claims; when
+// empty, claim values naming a role grant it
+var claimRoles = map[string]string{}
+
+// the role each sub-resource of an asset needs, by method; ones not listed
+// need admin
+var assetActionRoles = map[string]map[string]string{
+	"download":        {http.MethodGet: roleReader},
+	"download-plan":   {http.MethodGet: roleReader},
+	"content":         {http.MethodGet: roleReader, http.MethodPost: roleUploader},
+	"lock":            {http.MethodPost: roleUploader},
+	"unlock":          {http.MethodPost: roleUploader},
+	"multipart":       {http.MethodPost: roleUploader, http.MethodDelete: roleUploader},
+	"part":            {http.MethodGet: roleUploader},
+	"parts":           {http.MethodGet: roleUploader},
+	"complete":        {http.MethodPost: roleUploader},
+	"progress":        {http.MethodGet: roleUploader},
+	"reupload":        {http.MethodPost: roleUploader},
+	"versions":        {http.MethodGet: roleUploader, http.MethodPost: roleUploader},
+	"meta":            {http.MethodGet: roleUploader},
+	"tags":            {http.MethodGet: roleUploader, http.MethodPost: roleUploader},
+	"archive/restore": {http.MethodGet: roleUploader},
+}
+
+// adds roles given as comma separated name=role pairs to roles
+func parseRoles(value string, roles map[string]string) error {
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("role '%s' must be given as name=role", pair)
+		}
+		if _, ok := roleRanks[parts[1]]; !ok {
+			return fmt.Errorf("invalid role '%s' for '%s', must be reader, uploader or admin", parts[1], parts[0])
+		}
+		roles[parts[0]] = parts[1]
+	}
+	return nil
+}
+
+// the highest role a decision grants, empty if none
+func grantedRole(decision authDecision) string {
+	var candidates []string
+	if decision.Key != "" {
+		candidates = append(candidates, namedRoles[decision.Key])
+	}
+	for _, claim := range decision.Roles {
+		if len(claimRoles) > 0 {
+			candidates = append(candidates, claimRoles[claim])
+		} else {
+			candidates = append(candidates, claim)
+		}
+	}
+	role := ""
+	for _, candidate := range candidates {
+		if roleRanks[candidate] > roleRanks[role] {
+			role = candidate
+		}
+	}
+	return role
+}
+
+// the role a request needs: reading downloads needs reader, creating and
+// completing uploads needs uploader, and listing, deleting and everything
+// else needs admin; empty for what any caller can do
+func requiredRole(r *http.Request) string {
+	method := r.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	path := r.URL.Path
+	switch {
+	case path == "/auth":
+		return ""
+	case path == "/asset", path == "/asset/upload", path == "/tus", strings.HasPrefix(path, "/tus/"):
+		return roleUploader
+	case strings.HasPrefix(path, "/asset/"):
+		assetID := strings.TrimPrefix(path, "/asset/")
+		i := strings.Index(assetID, "/")
+		if i < 0 {
+			switch method {
+			case http.MethodGet:
+				return roleReader
+			case http.MethodPut, http.MethodPatch:
+				return roleUploader
+			}
+			return roleAdmin
+		}
+		action := assetID[i+1:]
+		if _, _, diff := versionDiffPath(action); diff {
+			action = "versions"
+		}
+		if role, ok := assetActionRoles[action][method]; ok {
+			return role
+		}
+	}
+	return roleAdmin
+}
+
+// answers 403 and returns false if the decision's role doesn't allow the
+// request
+func checkRole(w http.ResponseWriter, r *http.Request, decision authDecision) bool {
+	required := requiredRole(r)
+	if roleRanks[decision.Role] >= roleRanks[required] {
+		return true
+	}
+	if decision.Role == "" {
+		http.Error(w, "These credentials have no role.", http.StatusForbidden)
+		return false
+	}
+	http.Error(w, fmt.Sprintf("Role '%s' can't %s %s, it needs %s.", decision.Role, r.Method, r.URL.Path, required), http.StatusForbidden)
+	return false
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func resetRoles() {
+	rbacEnabled = false
+	namedRoles = map[string]string{}
+	claimRoles = map[string]string{}
+}
+
+func TestRequiredRole(t *testing.T) {
+	for _, test := range []struct {
+		method, path, role string
+	}{
+		{http.MethodGet, "/auth", ""},
+		{http.MethodGet, "/asset/someID", roleReader},
+		{http.MethodHead, "/asset/someID", roleReader},
+		{http.MethodGet, "/asset/someID/download", roleReader},
+		{http.MethodGet, "/asset/someID/content", roleReader},
+		{http.MethodPost, "/asset", roleUploader},
+		{http.MethodPut, "/asset/someID", roleUploader},
+		{http.MethodPost, "/asset/someID/content", roleUploader},
+		{http.MethodPost, "/asset/someID/multipart", roleUploader},
+		{http.MethodPatch, "/tus/someID", roleUploader},
+		{http.MethodGet, "/asset/someID/versions/v1/diff/v2", roleUploader},
+		{http.MethodDelete, "/asset/someID", roleAdmin},
+		{http.MethodPost, "/asset/someID/pin", roleAdmin},
+		{http.MethodGet, "/asset/someID/events", roleAdmin},
+		{http.MethodGet, "/assets", roleAdmin},
+		{http.MethodPost, "/deletions", roleAdmin},
+		{http.MethodGet, "/leader", roleAdmin},
+	} {
+		if role := requiredRole(httptest.NewRequest(test.method, test.path, nil)); role != test.role {
+			t.Errorf("Incorrect role for %s %s: %q", test.method, test.path, role)
+		}
+	}
+}
+
+func TestRBAC(t *testing.T) {
+	defer resetAPIKeys()
+	defer resetRoles()
+	parseAPIKeys("viewer=k1,ci=k2,ops=k3,unassigned=k4")
+	if err := parseRoles("viewer=reader,ci=uploader,ops=admin", namedRoles); err != nil {
+		t.Fatalf("Got error parsing roles: %s", err)
+	}
+	if err := parseRoles("ci=owner", namedRoles); err == nil {
+		t.Errorf("Got no error for an unknown role")
+	}
+	rbacEnabled = true
+	handler := withAuthentication(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	for _, test := range []struct {
+		key, method, path string
+		status            int
+	}{
+		{"k1", http.MethodGet, "/asset/someID", http.StatusNoContent},
+		{"k1", http.MethodPost, "/asset", http.StatusForbidden},
+		{"k1", http.MethodGet, "/assets", http.StatusForbidden},
+		{"k2", http.MethodPost, "/asset", http.StatusNoContent},
+		{"k2", http.MethodPut, "/asset/someID", http.StatusNoContent},
+		{"k2", http.MethodGet, "/asset/someID", http.StatusNoContent},
+		{"k2", http.MethodDelete, "/asset/someID", http.StatusForbidden},
+		{"k3", http.MethodDelete, "/asset/someID", http.StatusNoContent},
+		{"k3", http.MethodGet, "/assets", http.StatusNoContent},
+		{"k4", http.MethodGet, "/asset/someID", http.StatusForbidden},
+		{"k4", http.MethodGet, "/auth", http.StatusNoContent},
+	} {
+		r := httptest.NewRequest(test.method, test.path, nil)
+		r.Header.Set(apiKeyHeader, test.key)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("Incorrect response to %s %s with %s: %d", test.method, test.path, test.key, w.Code)
+		}
+	}
+}
+
+func TestClaimRoles(t *testing.T) {
+	defer resetJWT()
+	defer resetRoles()
+	defer func() { oidcRolesClaim = "" }()
+	var fetches int
+	jwksURL = serveJWKS(t, &fetches).URL
+	oidcRolesClaim = "groups"
+	rbacEnabled = true
+	token := signJWT(t, "RS256", "rsa", map[string]interface{}{
+		"sub":    "user-1",
+		"exp":    time.Now().Add(time.Hour).Unix(),
+		"groups": []string{"staff", "asset-admins"},
+	})
+	handler := withAuthentication(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	deleteAsset := func() int {
+		r := httptest.NewRequest(http.MethodDelete, "/asset/someID", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+	// claim values are only taken as they are if they name a role
+	if status := deleteAsset(); status != http.StatusForbidden {
+		t.Errorf("Unmapped groups allowed to delete: %d", status)
+	}
+	parseRoles("asset-admins=admin,staff=reader", claimRoles)
+	if status := deleteAsset(); status != http.StatusNoContent {
+		t.Errorf("Mapped admin group not allowed to delete: %d", status)
+	}
+}
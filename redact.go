@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// what secrets in logs are replaced with
+const redacted = "REDACTED"
+
+// query parameters carrying signatures, credentials or tokens, whose
+// values never reach the logs
+var redactedParams = []string{
+	"X-Amz-Signature", "X-Amz-Credential", "X-Amz-Security-Token", "Signature", "Policy", "Key-Pair-Id",
+	"upload_token", "confirm", "consistency_token", "token", "access_token", "id_token",
+}
+
+// headers carrying credentials or tokens, whose values never reach the logs
+var redactedHeaders = []string{
+	apiKeyHeader, iamTokenHeader, lockTokenHeader, completionTokenHeader, consistencyTokenHeader,
+	"X-Amz-Security-Token", "Cookie", "Set-Cookie",
+}
+
+// JSON fields holding tokens, or the signed fields of browser upload forms,
+// whose values never reach the logs
+var redactedFields = []string{
+	"lock_token", "confirmation_token", "consistency_token", "completion_token", "upload_token",
+	"token", "access_token", "id_token",
+	"policy", "x-amz-signature", "x-amz-credential", "x-amz-security-token",
+}
+
+// whether each request and response, with their headers and the start of
+// response bodies, is logged, secrets redacted as always
+var debugLogging bool
+
+type redactionRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+var redaction struct {
+	sync.RWMutex
+	rules []redactionRule
+}
+
+func init() {
+	setRedactedNames(nil)
+	log.SetOutput(&redactingWriter{out: os.Stderr})
+}
+
+// builds the rules scrubbing logs, redacting the values of the given query
+// parameters, headers and JSON fields on top of the built in ones
+func setRedactedNames(extra []string) {
+	params, headers, fields := quoteNames(redactedParams, extra), quoteNames(redactedHeaders, extra), quoteNames(redactedFields, extra)
+	rules := []redactionRule{
+		// ?name=value and &name=value in urls, raw, escaped once or in JSON
+		{regexp.MustCompile(`(?i)((?:[?&]|%26|%3F|\\u0026)(?:` + params + `)(?:=|%3D))[^&\s"'\\]+`), "${1}" + redacted},
+		{regexp.MustCompile(`(?i)("(?:` + fields + `)"\s*:\s*")[^"]+`), "${1}" + redacted},
+		// name:[value ...] as headers print, every value of the list
+		{regexp.MustCompile(`(?i)(\b(?:` + headers + `):\[)[^\]\r\n]+`), "${1}" + redacted},
+		// name: value and name=value
+		{regexp.MustCompile(`(?i)(\b(?:` + headers + `)["']?\s*[:=]\s*\[?["']?)[^\s"'\],]+`), "${1}" + redacted},
+		// whatever follows Authorization, which has a scheme before its value
+		{regexp.MustCompile(`(?i)(\bAuthorization["']?\s*[:=]\s*\[?["']?)[^"'\]\r\n]+`), "${1}" + redacted},
+		{regexp.MustCompile(`(?i)\b(Bearer\s+)[A-Za-z0-9._~+/=-]+`), "${1}" + redacted},
+		// limited-use download links are credentials themselves
+		{regexp.MustCompile(`(/download/)[A-Za-z0-9_-]+`), "${1}" + redacted},
+		// JWTs wherever they turn up
+		{regexp.MustCompile(`\beyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`), redacted},
+	}
+	redaction.Lock()
+	redaction.rules = rules
+	redaction.Unlock()
+}
+
+// a regexp alternation of names
+func quoteNames(names ...[]string) string {
+	var quoted []string
+	for _, list := range names {
+		for _, name := range list {
+			if name = strings.TrimSpace(name); name != "" {
+				quoted = append(quoted, regexp.QuoteMeta(name))
+			}
+		}
+	}
+	return strings.Join(quoted, "|")
+}
+
+// replaces signatures, credentials and tokens in text
+func redactSecrets(text string) string {
+	redaction.RLock()
+	defer redaction.RUnlock()
+	for _, rule := range redaction.rules {
+		text = rule.pattern.ReplaceAllString(text, rule.replacement)
+	}
+	return text
+}
+
+// scrubs everything logged before writing it to out
+type redactingWriter struct {
+	out io.Writer
+}
+
+func (r *redactingWriter) Write(p []byte) (int, error) {
+	if _, err := r.out.Write([]byte(redactSecrets(string(p)))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// logs each request with its url and headers, and its response with its
+// status, headers and the start of its body
+func withDebugLogging(next http.Handler) http.Handler {
+	if !debugLogging {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("debug: request %s %s %v", r.Method, r.URL.String(), r.Header)
+		cw := &captureWriter{ResponseWriter: w, body: &bytes.Buffer{}}
+		next.ServeHTTP(cw, r)
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+		body := cw.body.Bytes()
+		if len(body) > maxCapturedBody {
+			body = body[:maxCapturedBody]
+		}
+		log.Printf("debug: response %s %s %d %v %s", r.Method, r.URL.Path, cw.status, w.Header(), body)
+	})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// how replayed requests compared with the captured ones
+type replaySummary struct {
+	Requests int
+	Matched  int
+	Failed   int
+}
+
+// the replay subcommand, which sends captured traffic to a service with
+// its original spacing
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	target := fs.String("target", "http://localhost:8080", "Base URL of the service to replay against.")
+	speed := fs.Float64("speed", 1, "How many times faster than captured to replay.")
+	fs.StringVar(&bucketName, "bucket", "1brown2green", "The name of the bucket holding the captures.")
+	fs.Usage = func() {
+		log.Println("usage: replay [flags] capture-key...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("no capture keys given")
+	}
+	if *speed <= 0 {
+		return errors.New("speed must be positive")
+	}
+
+	s3Svc = s3.New(session.New())
+	traces, err := loadTraces(fs.Args())
+	if err != nil {
+		return err
+	}
+	client := &http.Client{
+		Timeout: time.Minute,
+		// compare the service's own responses, not where they lead
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	summary := replayTraces(client, strings.TrimSuffix(*target, "/"), traces, *speed)
+	log.Printf("replayed %d requests: %d got the captured status, %d failed", summary.Requests, summary.Matched, summary.Failed)
+	return nil
+}
+
+// reads captured traces from S3, oldest first
+func loadTraces(keys []string) ([]requestTrace, error) {
+	var traces []requestTrace
+	for _, key := range keys {
+		object, err := s3Svc.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(bucketName),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(object.Body)
+		for scanner.Scan() {
+			var trace requestTrace
+			if err := json.Unmarshal(scanner.Bytes(), &trace); err != nil {
+				object.Body.Close()
+				return nil, err
+			}
+			traces = append(traces, trace)
+		}
+		object.Body.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(traces, func(i, j int) bool { return traces[i].At.Before(traces[j].At) })
+	return traces, nil
+}
+
+// sends each trace to target at its captured offset divided by speed,
+// standing in the ids created by replayed inits for the captured ones
+func replayTraces(client *http.Client, target string, traces []requestTrace, speed float64) replaySummary {
+	var summary replaySummary
+	if len(traces) == 0 {
+		return summary
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	ids := map[string]string{}
+	start := time.Now()
+	for _, trace := range traces {
+		offset := time.Duration(float64(trace.At.Sub(traces[0].At)) / speed)
+		time.Sleep(time.Until(start.Add(offset)))
+
+		mu.Lock()
+		path := replayPath(trace.Path, ids)
+		mu.Unlock()
+		wg.Add(1)
+		go func(trace requestTrace) {
+			defer wg.Done()
+			status, created, err := replayRequest(client, target, path, trace)
+			mu.Lock()
+			defer mu.Unlock()
+			summary.Requests++
+			if err != nil {
+				summary.Failed++
+				return
+			}
+			if status == trace.Status {
+				summary.Matched++
+			}
+			if trace.Created != "" && created != "" {
+				ids[trace.Created] = created
+			}
+		}(trace)
+	}
+	wg.Wait()
+	return summary
+}
+
+// maps an anonymized id in a captured path to the one created on replay
+func replayPath(path string, ids map[string]string) string {
+	segments := strings.Split(path, "/")
+	if len(segments) > 2 {
+		if id, ok := ids[segments[2]]; ok {
+			segments[2] = id
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// sends one request, returning its status and the id it created if it
+// was an init
+func replayRequest(client *http.Client, target, path string, trace requestTrace) (int, string, error) {
+	query := url.Values{}
+	for name, value := range trace.Params {
+		query.Set(name, value)
+	}
+	u := target + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(trace.Method, u, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	var created string
+	if trace.Created != "" {
+		var body initAssetResponse
+		json.NewDecoder(io.LimitReader(resp.Body, maxCapturedBody)).Decode(&body)
+		created = body.ID
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return resp.StatusCode, created, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// captures in the bucket by key, as JSON lines
+type mockS3CapturesClient struct {
+	mockS3Client
+	captures map[string]string
+}
+
+func (m *mockS3CapturesClient) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	body, ok := m.captures[aws.StringValue(input.Key)]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+}
+func (m *mockS3CapturesClient) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	return m.GetObject(input)
+}
+
+func TestLoadTraces(t *testing.T) {
+	s3Svc = &mockS3CapturesClient{captures: map[string]string{
+		"captures/b.jsonl": `{"at":"2026-10-16T12:00:01Z","method":"GET","path":"/asset/anon-1","status":200}
+{"at":"2026-10-16T12:00:03Z","method":"DELETE","path":"/asset/anon-1","status":204}
+`,
+		"captures/a.jsonl": `{"at":"2026-10-16T12:00:00Z","method":"POST","path":"/asset","status":200,"created":"anon-1"}
+{"at":"2026-10-16T12:00:01Z","method":"HEAD","path":"/asset/anon-1","status":200}
+`,
+		"captures/bad.jsonl": "{\"at\":\"2026-10-16T12:00:00Z\"}\nnot json\n",
+	}}
+	defer func() { s3Svc = &mockS3Client{} }()
+
+	// captures from several instances are replayed oldest first, keeping
+	// the order of those captured at the same time
+	traces, err := loadTraces([]string{"captures/b.jsonl", "captures/a.jsonl"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var methods []string
+	for _, trace := range traces {
+		methods = append(methods, trace.Method)
+	}
+	if strings.Join(methods, " ") != "POST GET HEAD DELETE" || traces[0].Created != "anon-1" {
+		t.Errorf("Traces not loaded in order: %v", methods)
+	}
+
+	if _, err := loadTraces([]string{"captures/a.jsonl", "captures/missing.jsonl"}); err == nil {
+		t.Error("Got no error for a missing capture")
+	}
+	if _, err := loadTraces([]string{"captures/bad.jsonl"}); err == nil {
+		t.Error("Got no error for a malformed capture")
+	}
+}
+
+func TestReplayTraces(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/asset":
+			writeJSON(w, initAssetResponse{ID: "replayedID"})
+		case "/asset/replayedID":
+			w.WriteHeader(http.StatusOK)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	at := time.Now()
+	traces := []requestTrace{
+		{At: at, Method: http.MethodPost, Path: "/asset", Status: http.StatusOK, Created: "anon-created"},
+		{At: at.Add(100 * time.Millisecond), Method: http.MethodGet, Path: "/asset/anon-created", Status: http.StatusOK},
+		{At: at.Add(100 * time.Millisecond), Method: http.MethodGet, Path: "/asset/anon-unknown", Status: http.StatusOK},
+	}
+	summary := replayTraces(server.Client(), server.URL, traces, 1)
+	if summary.Requests != 3 || summary.Matched != 2 || summary.Failed != 0 {
+		t.Errorf("Incorrect replay summary: %+v", summary)
+	}
+}
+
+func TestReplayTracesSpeed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	at := time.Now()
+	traces := []requestTrace{
+		{At: at, Method: http.MethodGet, Path: "/health", Status: http.StatusNoContent},
+		{At: at.Add(400 * time.Millisecond), Method: http.MethodGet, Path: "/health", Status: http.StatusNoContent},
+	}
+	start := time.Now()
+	summary := replayTraces(server.Client(), server.URL, traces, 4)
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed >= 400*time.Millisecond {
+		t.Errorf("Traces 400ms apart not replayed 100ms apart at speed 4: %s", elapsed)
+	}
+	if summary.Requests != 2 || summary.Matched != 2 {
+		t.Errorf("Incorrect replay summary: %+v", summary)
+	}
+	if summary = replayTraces(server.Client(), server.URL, nil, 1); summary != (replaySummary{}) {
+		t.Errorf("Replayed requests without traces: %+v", summary)
+	}
+}
+
+func TestReplayTracesTwice(t *testing.T) {
+	var mu sync.Mutex
+	var inits int
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path == "/asset" {
+			inits++
+			writeJSON(w, initAssetResponse{ID: "replayed" + strconv.Itoa(inits)})
+			return
+		}
+		paths = append(paths, r.URL.Path)
+	}))
+	defer server.Close()
+
+	at := time.Now()
+	traces := []requestTrace{
+		{At: at, Method: http.MethodPost, Path: "/asset", Status: http.StatusOK, Created: "anon-created"},
+		{At: at.Add(50 * time.Millisecond), Method: http.MethodPut, Path: "/asset/anon-created", Status: http.StatusOK},
+	}
+	// each replay stands in the ids it created itself
+	for i := 0; i < 2; i++ {
+		if summary := replayTraces(server.Client(), server.URL, traces, 1); summary.Matched != 2 {
+			t.Errorf("Incorrect summary replaying again: %+v", summary)
+		}
+	}
+	if strings.Join(paths, " ") != "/asset/replayed1 /asset/replayed2" {
+		t.Errorf("Replays didn't use their own ids: %v", paths)
+	}
+}
+
+func TestReplayErrors(t *testing.T) {
+	// nothing listening
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	traces := []requestTrace{
+		{At: time.Now(), Method: http.MethodGet, Path: "/asset/anon-1", Status: http.StatusOK},
+		{At: time.Now(), Method: "BAD METHOD", Path: "/asset/anon-1", Status: http.StatusOK},
+	}
+	summary := replayTraces(server.Client(), server.URL, traces, 1)
+	if summary.Requests != 2 || summary.Failed != 2 || summary.Matched != 0 {
+		t.Errorf("Failed requests not counted: %+v", summary)
+	}
+
+	defer func(bucket string) { bucketName = bucket }(bucketName)
+	if err := runReplay(nil); err == nil {
+		t.Error("Got no error replaying without capture keys")
+	}
+	if err := runReplay([]string{"-speed", "0", "captures/a.jsonl"}); err == nil {
+		t.Error("Got no error replaying at speed 0")
+	}
+}
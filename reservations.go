@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	// reservations are put in this partition of the sparse reservation
+	// index until they're marked uploaded
+	reservationShard = "all"
+	// uploads that finish just as their url expires still get this long to
+	// be marked
+	reservationGrace = time.Hour
+)
+
+// the DynamoDB index on reservation_shard and upload_expires
+var reservationIndexName string
+
+// how often abandoned reservations are reaped, zero to never reap
+var reapInterval = 10 * time.Minute
+
+// record attributes of an asset reserved for an upload taking at most
+// timeout, which is reaped if it's never marked uploaded
+func reservationAttributes(timeout time.Duration) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"upload_expires":    uploadExpiresValue(timeout),
+		"reservation_shard": {S: aws.String(reservationShard)},
+	}
+}
+
+// reaps abandoned reservations until stopped
+func watchReservations(stop <-chan struct{}) {
+	for {
+		if err := reapReservations(); err != nil {
+			log.Println(err.Error())
+		}
+		if !pause(stop, reapInterval) {
+			return
+		}
+	}
+}
+
+// collects every unpinned reservation whose upload expired without being
+// marked uploaded, with anything uploaded to it
+func reapReservations() error {
+	now := time.Now()
+	cutoff := strconv.FormatInt(now.Add(-reservationGrace).Unix(), 10)
+	var failed error
+	err := dbSvc.QueryPages(&dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		IndexName:              aws.String(reservationIndexName),
+		KeyConditionExpression: aws.String("reservation_shard = :shard AND upload_expires <= :cutoff"),
+		FilterExpression:       aws.String("attribute_not_exists(purge_at) AND attribute_not_exists(gc_at) AND attribute_not_exists(gc_kept) AND " + unpinnedCondition),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":shard":  {S: aws.String(reservationShard)},
+			":cutoff": {N: aws.String(cutoff)},
+			":false":  {BOOL: aws.Bool(false)},
+		},
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			// skip reservations uploaded, pinned or deleted since the query
+			err := collectAsset(stringAttribute(item, "id"), gcReasonAbandoned, now)
+			if err != nil && !isConditionFailed(err) {
+				failed = err
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return failed
+}
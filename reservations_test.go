@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// a reservation whose upload url expired long ago, reported by the
+// reservation index
+type mockDBAbandonedClient struct {
+	mockDBClient
+	query      *dynamodb.QueryInput
+	conditions []string
+}
+
+func (m *mockDBAbandonedClient) QueryPages(input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool) error {
+	m.query = input
+	fn(&dynamodb.QueryOutput{Items: []map[string]*dynamodb.AttributeValue{{
+		"id":             {S: aws.String("someID")},
+		"upload_expires": {N: aws.String("1500000000")},
+	}}}, true)
+	return nil
+}
+func (m *mockDBAbandonedClient) QueryPagesWithContext(ctx aws.Context, input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool, opts ...request.Option) error {
+	return m.QueryPages(input, fn)
+}
+
+func (m *mockDBAbandonedClient) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	if isRemoval(input) {
+		m.conditions = append(m.conditions, aws.StringValue(input.ConditionExpression))
+	}
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+func (m *mockDBAbandonedClient) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	return m.UpdateItem(input)
+}
+
+func TestReapReservations(t *testing.T) {
+	gcWindow = 0
+	defer func() { gcWindow = 24 * time.Hour }()
+	db := &mockDBAbandonedClient{}
+	dbSvc = db
+	s3Svc = &mockS3Client{}
+	if err := reapReservations(); err != nil {
+		t.Fatal(err)
+	}
+	if aws.StringValue(db.query.IndexName) != reservationIndexName {
+		t.Errorf("Reservations not queried from the reservation index: %s", aws.StringValue(db.query.IndexName))
+	}
+	if len(db.conditions) != 1 || !strings.Contains(db.conditions[0], "attribute_exists(reservation_shard)") {
+		t.Errorf("Abandoned reservation not deleted on condition it's still reserved: %v", db.conditions)
+	}
+}
+
+func TestReservationAttributes(t *testing.T) {
+	attributes := reservationAttributes(maxUploadTimeout)
+	if stringAttribute(attributes, "reservation_shard") != reservationShard {
+		t.Error("Reservation not put in the reservation index")
+	}
+	if numberAttribute(attributes, "upload_expires") == 0 {
+		t.Error("Reservation has no upload expiry")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// attributes describing an asset's uploaded content, dropped when it's
+// replaced
+var uploadedAttributes = []string{"rejection_reason", "md5", "sha256", "duplicate_of", "storage_class", "uploaded_at"}
+
+func isObjectMissing(err error) bool {
+	aerr, ok := err.(awserr.RequestFailure)
+	return ok && aerr.StatusCode() == http.StatusNotFound
+}
+
+// whether a request may renew an asset's upload: its owner's, or with no
+// owner recorded, one allowed to upload
+func canRenewUpload(r *http.Request, item map[string]*dynamodb.AttributeValue) bool {
+	if owner := stringAttribute(item, "owner"); owner != "" {
+		return requestSubject(r) == owner
+	}
+	return !rbacEnabled || roleRanks[requestAuth(r).Role] >= roleRanks[roleUploader]
+}
+
+// answers a download request for a pending asset whose upload url expired
+// without anything being uploaded with a 202 carrying a new upload url,
+// returning false if the upload may still be under way or can't be renewed
+// by this caller
+func refreshExpiredUpload(w http.ResponseWriter, r *http.Request, assetID string, item map[string]*dynamodb.AttributeValue) bool {
+	uploadExpires := numberAttribute(item, "upload_expires")
+	if _, ok := item["status"]; ok || uploadExpires == 0 || uploadExpires > time.Now().Unix() {
+		return false
+	}
+	if !canRenewUpload(r, item) {
+		return false
+	}
+	// multipart and resumable uploads sign each request, so never expire
+	if stringAttribute(item, "upload_id") != "" {
+		return false
+	}
+	_, err := s3Svc.HeadObjectWithContext(r.Context(), &s3.HeadObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(objectKey(assetID, item)),
+	})
+	if !isObjectMissing(err) {
+		if err != nil {
+			log.Println(err.Error())
+		}
+		return false
+	}
+
+	// only the first caller to notice renews it
+	values := lockConditionValues(r)
+	values[":prevExpires"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(uploadExpires, 10))}
+	values[":uploadExpires"] = uploadExpiresValue(maxUploadTimeout)
+	values[":updated"] = updatedAtValue()
+	completionToken, tokenAttributes := newCompletionToken(maxUploadTimeout)
+	_, err = dbSvc.UpdateItemWithContext(r.Context(), &dynamodb.UpdateItemInput{
+		Key:                       assetKey(assetID),
+		TableName:                 aws.String(tableName),
+		UpdateExpression:          aws.String(setAttributes("SET upload_expires = :uploadExpires, updated_at = :updated", values, tokenAttributes)),
+		ConditionExpression:       aws.String("attribute_not_exists(#status) AND upload_expires = :prevExpires AND " + lockCondition),
+		ExpressionAttributeNames:  map[string]*string{"#status": aws.String("status")},
+		ExpressionAttributeValues: values,
+	})
+	if err != nil {
+		if !isConditionFailed(err) {
+			log.Println(err.Error())
+		}
+		return false
+	}
+	response := initAssetResponse{ID: assetID, CompletionToken: completionToken}
+	response.UploadURL, response.UploadHeaders, err = reuploadURL(r, assetID, item, maxUploadTimeout)
+	if err != nil {
+		log.Println(err.Error())
+		return false
+	}
+	recordAssetEvent(r, assetID, assetEventURLIssued, map[string]string{"url": "upload"})
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, response)
+	return true
+}
+
+// signs a fresh upload for an existing asset, which goes back to pending,
+// unavailable for download, until it's marked uploaded again
+func handleReuploadRequest(w http.ResponseWriter, r *http.Request, assetID string) {
+	timeout, ok := parseDurationParam(w, r, "timeout", maxUploadTimeout, minURLTimeout, maxUploadTimeout)
+	if !ok {
+		return
+	}
+
+	values := lockConditionValues(r)
+	values[":deleted"] = &dynamodb.AttributeValue{S: aws.String(assetStatusDeleted)}
+	values[":uploadExpires"] = uploadExpiresValue(timeout)
+	values[":updated"] = updatedAtValue()
+	completionToken, tokenAttributes := newCompletionToken(timeout)
+	update := setAttributes("SET upload_expires = :uploadExpires, updated_at = :updated", values, tokenAttributes) + " REMOVE #status"
+	for _, name := range uploadedAttributes {
+		update += ", " + name
+	}
+	result, err := dbSvc.UpdateItemWithContext(r.Context(), &dynamodb.UpdateItemInput{
+		Key:              assetKey(assetID),
+		TableName:        aws.String(tableName),
+		UpdateExpression: aws.String(update),
+		// a multipart upload under way would complete over the new one
+		ConditionExpression: aws.String("attribute_exists(id) AND (attribute_not_exists(#status) OR #status <> :deleted) AND " +
+			"attribute_not_exists(upload_id) AND " + lockCondition),
+		ExpressionAttributeNames:            map[string]*string{"#status": aws.String("status")},
+		ExpressionAttributeValues:           values,
+		ReturnValues:                        aws.String(dynamodb.ReturnValueAllNew),
+		ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValuesOnConditionCheckFailureAllOld),
+	})
+	if err != nil {
+		if isConditionFailed(err) {
+			item := conditionFailedItem(err)
+			switch {
+			case len(item) == 0 || isDeleted(item):
+				writeError(w, notFound(assetID))
+			case stringAttribute(item, "upload_id") != "":
+				http.Error(w, fmt.Sprintf("Asset id '%s' has a multipart upload in progress, abort it first.", assetID), http.StatusConflict)
+			default:
+				http.Error(w, fmt.Sprintf("Asset id '%s' is locked.", assetID), http.StatusLocked)
+			}
+			return
+		}
+		writeError(w, err)
+		return
+	}
+
+	// the replacement is described like what it replaces
+	item := result.Attributes
+	response := initAssetResponse{ID: assetID, CompletionToken: completionToken}
+	response.UploadURL, response.UploadHeaders, err = reuploadURL(r, assetID, item, timeout)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	recordAssetEvent(r, assetID, assetEventURLIssued, map[string]string{"url": "upload"})
+	writeJSON(w, response)
+}
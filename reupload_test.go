@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// remembers the last update
+type mockDBUpdateRecordingClient struct {
+	mockDBClient
+	update *dynamodb.UpdateItemInput
+}
+
+func (m *mockDBUpdateRecordingClient) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	m.update = input
+	return &dynamodb.UpdateItemOutput{Attributes: map[string]*dynamodb.AttributeValue{
+		"id":           {S: aws.String("someID")},
+		"content_type": {S: aws.String("image/png")},
+	}}, nil
+}
+func (m *mockDBUpdateRecordingClient) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	return m.UpdateItem(input)
+}
+
+func TestReuploadRequest(t *testing.T) {
+	db := &mockDBUpdateRecordingClient{}
+	dbSvc = db
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodPost, "/asset/someID/reupload", nil)
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Incorrect status re-uploading: %d", w.Result().StatusCode)
+	}
+	var response initAssetResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil || response.ID != "someID" {
+		t.Errorf("Incorrect re-upload response: %+v", response)
+	}
+	if !strings.Contains(aws.StringValue(db.update.UpdateExpression), "REMOVE #status") {
+		t.Errorf("Asset not put back to pending: %s", aws.StringValue(db.update.UpdateExpression))
+	}
+}
+
+func TestReuploadRequestErrors(t *testing.T) {
+	s3Svc = &mockS3Client{}
+	for status, db := range map[int]dynamodbiface.DynamoDBAPI{
+		http.StatusNotFound: &mockDBConditionalErrorClient{},
+		http.StatusLocked:   &mockDBLockedClient{},
+	} {
+		dbSvc = db
+		r := httptest.NewRequest(http.MethodPost, "/asset/someID/reupload", nil)
+		w := httptest.NewRecorder()
+		manageAsset(w, r)
+		if w.Result().StatusCode != status {
+			t.Errorf("Expected %d re-uploading, got %d", status, w.Result().StatusCode)
+		}
+	}
+}
+
+// a pending asset whose upload url expired in 2017
+type mockDBExpiredUploadClient struct {
+	mockDBClient
+	owner string
+}
+
+func (m *mockDBExpiredUploadClient) GetItem(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	item := map[string]*dynamodb.AttributeValue{
+		"id":             {S: aws.String("someID")},
+		"upload_expires": {N: aws.String("1500000000")},
+	}
+	if m.owner != "" {
+		item["owner"] = &dynamodb.AttributeValue{S: aws.String(m.owner)}
+	}
+	return &dynamodb.GetItemOutput{Item: item}, nil
+}
+func (m *mockDBExpiredUploadClient) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return m.GetItem(input)
+}
+
+// a bucket without the asset's object
+type mockS3MissingObjectClient struct {
+	mockS3Client
+}
+
+func (m *mockS3MissingObjectClient) HeadObject(*s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	return nil, awserr.NewRequestFailure(awserr.New("NotFound", "Not Found", nil), http.StatusNotFound, "")
+}
+func (m *mockS3MissingObjectClient) HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	return m.HeadObject(input)
+}
+
+func TestAssetURLRequestExpiredUpload(t *testing.T) {
+	dbSvc = &mockDBExpiredUploadClient{}
+	s3Svc = &mockS3MissingObjectClient{}
+	r := httptest.NewRequest(http.MethodGet, "/asset/someID", nil)
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusAccepted {
+		t.Fatalf("Incorrect status for an expired upload: %d", w.Result().StatusCode)
+	}
+	var response initAssetResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil || response.ID != "someID" {
+		t.Errorf("No refreshed upload for an expired upload: %v", err)
+	}
+
+	// pending assets whose upload may still arrive get no new url
+	dbSvc = &mockDBNotUploadedClient{}
+	w = httptest.NewRecorder()
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusAccepted || strings.HasPrefix(w.Body.String(), "{") {
+		t.Errorf("Refreshed an upload that hasn't expired: %d %s", w.Result().StatusCode, w.Body.String())
+	}
+}
+
+func TestAssetURLRequestExpiredUploadCaller(t *testing.T) {
+	s3Svc = &mockS3MissingObjectClient{}
+	request := func(decision authDecision) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/asset/someID", nil)
+		return r.WithContext(context.WithValue(r.Context(), authContextKey{}, decision))
+	}
+	renewed := func(r *http.Request) bool {
+		w := httptest.NewRecorder()
+		manageAsset(w, r)
+		return w.Result().StatusCode == http.StatusAccepted && strings.HasPrefix(w.Body.String(), "{")
+	}
+
+	// only the owner renews an owned upload
+	dbSvc = &mockDBExpiredUploadClient{owner: "user-1"}
+	if renewed(request(authDecision{Method: bearerMethod, Subject: "user-2"})) {
+		t.Errorf("Renewed an upload for a caller other than its owner")
+	}
+	if !renewed(request(authDecision{Method: bearerMethod, Subject: "user-1"})) {
+		t.Errorf("Didn't renew an upload for its owner")
+	}
+
+	// and with roles, only uploaders renew one without an owner
+	defer func() { rbacEnabled = false }()
+	rbacEnabled = true
+	dbSvc = &mockDBExpiredUploadClient{}
+	if renewed(request(authDecision{Method: apiKeyMethod, Key: "web", Role: roleReader})) {
+		t.Errorf("Renewed an upload for a reader")
+	}
+	if !renewed(request(authDecision{Method: apiKeyMethod, Key: "web", Role: roleUploader})) {
+		t.Errorf("Didn't renew an upload for an uploader")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	// records scheduled for deletion are put in this partition of the
+	// sparse deletion index
+	deletionShard         = "all"
+	deletionCheckInterval = time.Minute
+	eventDeleted          = "asset.deleted"
+)
+
+// the DynamoDB index on deletion_shard and delete_at
+var deletionIndexName string
+
+// url told when scheduled deletions happen, none when empty
+var deletionWebhook string
+
+type deletionEvent struct {
+	Event    string    `json:"event"`
+	ID       string    `json:"id"`
+	DeleteAt time.Time `json:"delete_at"`
+}
+
+// parses an RFC 3339 deletion time, which must be in the future
+func parseDeleteAt(value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, fmt.Errorf("delete_at must be an RFC 3339 time")
+	}
+	if !t.After(time.Now()) {
+		return t, fmt.Errorf("delete_at must be in the future")
+	}
+	return t, nil
+}
+
+// record attributes scheduling an asset's deletion at the given time
+func deletionAttributes(deleteAt time.Time) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"delete_at":      {N: aws.String(strconv.FormatInt(deleteAt.Unix(), 10))},
+		"deletion_shard": {S: aws.String(deletionShard)},
+	}
+}
+
+// carries out scheduled deletions until stopped
+func watchDeletions(stop <-chan struct{}) {
+	for {
+		if err := runScheduledDeletions(); err != nil {
+			log.Println(err.Error())
+		}
+		if !pause(stop, deletionCheckInterval) {
+			return
+		}
+	}
+}
+
+// removes every unpinned asset due for deletion, with its objects, telling
+// the webhook about each; deletion doesn't wait for the retention window,
+// the schedule being the retention policy
+func runScheduledDeletions() error {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	var failed error
+	err := dbSvc.QueryPages(&dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		IndexName:              aws.String(deletionIndexName),
+		KeyConditionExpression: aws.String("deletion_shard = :shard AND delete_at <= :now"),
+		FilterExpression:       aws.String(unpinnedCondition),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":shard": {S: aws.String(deletionShard)},
+			":now":   {N: aws.String(now)},
+			":false": {BOOL: aws.Bool(false)},
+		},
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			// skip assets pinned or rescheduled since the query
+			assetID := stringAttribute(item, "id")
+			err := removeAsset(context.Background(), assetID, "delete_at <= :now AND "+unpinnedCondition, map[string]*dynamodb.AttributeValue{
+				":now":   {N: aws.String(now)},
+				":false": {BOOL: aws.Bool(false)},
+			})
+			if isConditionFailed(err) {
+				continue
+			}
+			if err != nil {
+				failed = err
+				continue
+			}
+			if err := announceDeletion(assetID, numberAttribute(item, "delete_at")); err != nil {
+				failed = err
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return failed
+}
+
+// the asset is already gone, so a failed announcement is only logged
+func announceDeletion(assetID string, deleteAt int64) error {
+	log.Printf("deleted asset %s as scheduled", assetID)
+	if deletionWebhook == "" {
+		return nil
+	}
+	body, err := json.Marshal(deletionEvent{
+		Event:    eventDeleted,
+		ID:       assetID,
+		DeleteAt: time.Unix(deleteAt, 0).UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := webhookClient.Post(deletionWebhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("deletion webhook returned %s for asset %s", resp.Status, assetID)
+	}
+	return nil
+}
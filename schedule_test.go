@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// an asset that was due for deletion in 2017, reported by the deletion index
+type mockDBScheduledClient struct {
+	mockDBClient
+	deleted []string
+}
+
+func (m *mockDBScheduledClient) QueryPages(input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool) error {
+	fn(&dynamodb.QueryOutput{Items: []map[string]*dynamodb.AttributeValue{{
+		"id":        {S: aws.String("someID")},
+		"delete_at": {N: aws.String("1500000000")},
+	}}}, true)
+	return nil
+}
+func (m *mockDBScheduledClient) QueryPagesWithContext(ctx aws.Context, input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool, opts ...request.Option) error {
+	return m.QueryPages(input, fn)
+}
+
+func (m *mockDBScheduledClient) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	m.deleted = append(m.deleted, *input.Item["id"].S)
+	return &dynamodb.PutItemOutput{}, nil
+}
+func (m *mockDBScheduledClient) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	return m.PutItem(input)
+}
+
+func TestRunScheduledDeletions(t *testing.T) {
+	events := make(chan deletionEvent, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event deletionEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		events <- event
+	}))
+	defer server.Close()
+	deletionWebhook = server.URL
+	defer func() { deletionWebhook = "" }()
+	db := &mockDBScheduledClient{}
+	dbSvc = db
+	s3Svc = &mockS3Client{}
+
+	if err := runScheduledDeletions(); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.deleted) != 1 || db.deleted[0] != "someID" {
+		t.Errorf("Scheduled deletion didn't happen: %v", db.deleted)
+	}
+	event := <-events
+	if event.Event != eventDeleted || event.ID != "someID" || event.DeleteAt.Unix() != 1500000000 {
+		t.Errorf("Incorrect deletion event: %+v", event)
+	}
+}
+
+func TestPatchDeleteAt(t *testing.T) {
+	db := &mockDBUpdateRecordingClient{}
+	dbSvc = db
+	for body, status := range map[string]int{
+		`{"delete_at": "2099-01-01T09:00:00Z"}`: http.StatusNoContent,
+		`{"delete_at": ""}`:                     http.StatusNoContent,
+		`{"delete_at": "2099-01-01T09:00:00Z", "expires_at": "2099-01-02T09:00:00Z"}`: http.StatusNoContent,
+		`{"delete_at": "2001-01-01T09:00:00Z"}`:                                       http.StatusBadRequest,
+		`{"delete_at": "soon"}`:                                                       http.StatusBadRequest,
+	} {
+		r := httptest.NewRequest(http.MethodPatch, "/asset/someID", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		manageAsset(w, r)
+		if w.Result().StatusCode != status {
+			t.Errorf("Incorrect status patching %s: %d", body, w.Result().StatusCode)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodPatch, "/asset/someID", strings.NewReader(`{"delete_at": ""}`))
+	manageAsset(httptest.NewRecorder(), r)
+	if !strings.Contains(aws.StringValue(db.update.UpdateExpression), "REMOVE delete_at, deletion_shard") {
+		t.Errorf("Scheduled deletion not cancelled: %s", aws.StringValue(db.update.UpdateExpression))
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	maxDescriptionLength = 1000
+	maxSearchTextLength  = 100
+	// records with a project are put in this partition of the sparse
+	// project index, so projects can be searched by prefix
+	projectShard = "all"
+)
+
+// owners and projects are short names, such as a team, an email, a token
+// subject or a path-like project, that searches match exactly or by prefix
+var searchAttributePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._@/|:+-]{0,127}$`)
+
+// the DynamoDB index on owner and created_at
+var ownerIndexName string
+
+// the DynamoDB index on project_shard and project
+var projectIndexName string
+
+// descriptions are free text of up to 1000 characters, on any number of
+// lines
+func validateDescription(description string) error {
+	if !utf8.ValidString(description) {
+		return fmt.Errorf("description must be UTF-8")
+	}
+	if utf8.RuneCountInString(description) > maxDescriptionLength {
+		return fmt.Errorf("description can be at most %d characters", maxDescriptionLength)
+	}
+	for _, c := range description {
+		if unicode.IsControl(c) && c != '\n' && c != '\t' {
+			return fmt.Errorf("description can't have control characters")
+		}
+	}
+	return nil
+}
+
+func validateSearchAttribute(name, value string) error {
+	if !searchAttributePattern.MatchString(value) {
+		return fmt.Errorf("%s must be 1 to 128 letters, digits or ._@/|:+- starting with a letter or digit", name)
+	}
+	return nil
+}
+
+// record attributes setting an asset's owner or project; a project also
+// puts the asset in the project index
+func searchAttributes(name, value string) map[string]*dynamodb.AttributeValue {
+	attributes := map[string]*dynamodb.AttributeValue{name: {S: aws.String(value)}}
+	if name == "project" {
+		attributes["project_shard"] = &dynamodb.AttributeValue{S: aws.String(projectShard)}
+	}
+	return attributes
+}
+
+// record attributes clearing an asset's owner or project
+func clearedSearchAttributes(name string) []string {
+	if name == "project" {
+		return []string{"project", "project_shard"}
+	}
+	return []string{name}
+}
+
+// finds assets by ?owner=, projects starting with ?project= and text in
+// their description or filename containing ?q=, a page of ?limit= at a time
+// resuming from ?cursor=; owners are looked up in the owner index, newest
+// last, projects in the project index and text alone by scanning
+func searchAssets(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	limit, after, ok := assetsPageParams(w, r)
+	if !ok {
+		return
+	}
+	owner, project, text := r.URL.Query().Get("owner"), r.URL.Query().Get("project"), r.URL.Query().Get("q")
+	if owner == "" && project == "" && text == "" {
+		http.Error(w, "A search needs an owner, a project or q.", http.StatusBadRequest)
+		return
+	}
+	if owner != "" {
+		if err := validateSearchAttribute("owner", owner); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid argument for owner: %s.", err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+	if project != "" {
+		if err := validateSearchAttribute("project", project); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid argument for project: %s.", err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+	if utf8.RuneCountInString(text) > maxSearchTextLength {
+		http.Error(w, fmt.Sprintf("Invalid argument for q, can be at most %d characters.", maxSearchTextLength), http.StatusBadRequest)
+		return
+	}
+
+	values := map[string]*dynamodb.AttributeValue{}
+	var filters []string
+	if text != "" {
+		values[":q"] = &dynamodb.AttributeValue{S: aws.String(text)}
+		filters = append(filters, "(contains(description, :q) OR contains(filename, :q))")
+	}
+	if project != "" {
+		values[":project"] = &dynamodb.AttributeValue{S: aws.String(project)}
+	}
+	var items []map[string]*dynamodb.AttributeValue
+	var last map[string]*dynamodb.AttributeValue
+	var err error
+	switch {
+	case owner != "":
+		values[":owner"] = &dynamodb.AttributeValue{S: aws.String(owner)}
+		if project != "" {
+			filters = append(filters, "begins_with(project, :project)")
+		}
+		query := &dynamodb.QueryInput{
+			TableName:                 aws.String(tableName),
+			IndexName:                 aws.String(ownerIndexName),
+			KeyConditionExpression:    aws.String("#owner = :owner"),
+			ExpressionAttributeNames:  map[string]*string{"#owner": aws.String("owner")},
+			ExpressionAttributeValues: values,
+			Limit:                     aws.Int64(int64(limit)),
+		}
+		if after.ID != "" {
+			query.ExclusiveStartKey = assetKey(after.ID)
+			query.ExclusiveStartKey["owner"] = values[":owner"]
+			query.ExclusiveStartKey["created_at"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(after.CreatedAt, 10))}
+		}
+		items, last, err = querySearch(r.Context(), query, filters)
+	case project != "":
+		values[":shard"] = &dynamodb.AttributeValue{S: aws.String(projectShard)}
+		query := &dynamodb.QueryInput{
+			TableName:                 aws.String(tableName),
+			IndexName:                 aws.String(projectIndexName),
+			KeyConditionExpression:    aws.String("project_shard = :shard AND begins_with(project, :project)"),
+			ExpressionAttributeValues: values,
+			Limit:                     aws.Int64(int64(limit)),
+		}
+		if after.ID != "" {
+			query.ExclusiveStartKey = assetKey(after.ID)
+			query.ExclusiveStartKey["project_shard"] = values[":shard"]
+			query.ExclusiveStartKey["project"] = &dynamodb.AttributeValue{S: aws.String(after.Project)}
+		}
+		items, last, err = querySearch(r.Context(), query, filters)
+	default:
+		scan := &dynamodb.ScanInput{
+			TableName:                 aws.String(tableName),
+			FilterExpression:          aws.String(strings.Join(filters, " AND ")),
+			ExpressionAttributeValues: values,
+			Limit:                     aws.Int64(int64(limit)),
+		}
+		if after.ID != "" {
+			scan.ExclusiveStartKey = assetKey(after.ID)
+		}
+		var result *dynamodb.ScanOutput
+		if result, err = dbSvc.ScanWithContext(r.Context(), scan); err == nil {
+			items, last = result.Items, result.LastEvaluatedKey
+		}
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := assetsResponse{Assets: []assetMeta{}}
+	for _, item := range items {
+		if isAssetKey(stringAttribute(item, "id")) && !isDeleted(item) {
+			response.Assets = append(response.Assets, describeAsset(item))
+		}
+	}
+	// a filtered page can end past its last match, or have none at all
+	if len(last) > 0 {
+		response.Cursor = encodeAssetsCursor(assetsCursor{
+			ID:        stringAttribute(last, "id"),
+			CreatedAt: numberAttribute(last, "created_at"),
+			Project:   stringAttribute(last, "project"),
+		})
+	}
+	writeJSON(w, response)
+}
+
+// queries a page of an index with the given filters, returning its items
+// and the key it ended at, if any
+func querySearch(ctx context.Context, query *dynamodb.QueryInput, filters []string) ([]map[string]*dynamodb.AttributeValue, map[string]*dynamodb.AttributeValue, error) {
+	if len(filters) > 0 {
+		query.FilterExpression = aws.String(strings.Join(filters, " AND "))
+	}
+	result, err := dbSvc.QueryWithContext(ctx, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	return result.Items, result.LastEvaluatedKey, nil
+}
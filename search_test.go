@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// an asset owned by someone in a project, plus a deleted one, recording the
+// last query and scan made
+type mockDBSearchClient struct {
+	mockDBClient
+	query *dynamodb.QueryInput
+	scan  *dynamodb.ScanInput
+}
+
+var searchItems = []map[string]*dynamodb.AttributeValue{
+	{
+		"id":          {S: aws.String("someID")},
+		"status":      {S: aws.String(assetStatusUploaded)},
+		"description": {S: aws.String("Quarterly report")},
+		"owner":       {S: aws.String("finance")},
+		"project":     {S: aws.String("reports/2024")},
+		"created_at":  {N: aws.String("1500000000000")},
+	},
+	{
+		"id":      {S: aws.String("otherID")},
+		"status":  {S: aws.String(assetStatusDeleted)},
+		"owner":   {S: aws.String("finance")},
+		"project": {S: aws.String("reports/2023")},
+	},
+}
+
+func (m *mockDBSearchClient) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	m.query = input
+	return &dynamodb.QueryOutput{
+		Items: searchItems,
+		LastEvaluatedKey: map[string]*dynamodb.AttributeValue{
+			"id":            {S: aws.String("otherID")},
+			"project_shard": {S: aws.String(projectShard)},
+			"project":       {S: aws.String("reports/2023")},
+		},
+	}, nil
+}
+func (m *mockDBSearchClient) QueryWithContext(ctx aws.Context, input *dynamodb.QueryInput, opts ...request.Option) (*dynamodb.QueryOutput, error) {
+	return m.Query(input)
+}
+
+func (m *mockDBSearchClient) Scan(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+	m.scan = input
+	return &dynamodb.ScanOutput{Items: searchItems}, nil
+}
+func (m *mockDBSearchClient) ScanWithContext(ctx aws.Context, input *dynamodb.ScanInput, opts ...request.Option) (*dynamodb.ScanOutput, error) {
+	return m.Scan(input)
+}
+
+func TestSearchAssets(t *testing.T) {
+	db := &mockDBSearchClient{}
+	dbSvc = db
+	r := httptest.NewRequest(http.MethodGet, "/assets/search?owner=finance&project=reports&q=report", nil)
+	w := httptest.NewRecorder()
+
+	searchAssets(w, r)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Incorrect status searching assets: %d", w.Result().StatusCode)
+	}
+	var response assetsResponse
+	json.NewDecoder(w.Body).Decode(&response)
+	if len(response.Assets) != 1 || response.Assets[0].ID != "someID" || response.Assets[0].Owner != "finance" ||
+		response.Assets[0].Description != "Quarterly report" {
+		t.Errorf("Incorrect assets found: %+v", response.Assets)
+	}
+	if aws.StringValue(db.query.IndexName) != ownerIndexName ||
+		!strings.Contains(aws.StringValue(db.query.FilterExpression), "begins_with(project, :project)") ||
+		!strings.Contains(aws.StringValue(db.query.FilterExpression), "contains(description, :q)") {
+		t.Errorf("Owner search didn't query the owner index filtered by project and text: %+v", db.query)
+	}
+
+	// resuming a search by project
+	after, _ := decodeAssetsCursor(response.Cursor)
+	r = httptest.NewRequest(http.MethodGet, "/assets/search?project=reports&cursor="+response.Cursor, nil)
+	w = httptest.NewRecorder()
+	searchAssets(w, r)
+	if aws.StringValue(db.query.IndexName) != projectIndexName || db.query.FilterExpression != nil ||
+		stringAttribute(db.query.ExclusiveStartKey, "project") != after.Project || after.Project != "reports/2023" {
+		t.Errorf("Project search didn't resume from the project index: %+v", db.query)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/assets/search?q=report", nil)
+	w = httptest.NewRecorder()
+	searchAssets(w, r)
+	if db.scan == nil || aws.StringValue(db.scan.FilterExpression) != "(contains(description, :q) OR contains(filename, :q))" {
+		t.Errorf("Text search didn't scan for the text: %+v", db.scan)
+	}
+	response = assetsResponse{}
+	json.NewDecoder(w.Body).Decode(&response)
+	if len(response.Assets) != 1 || response.Cursor != "" {
+		t.Errorf("Incorrect text search results: %+v", response)
+	}
+
+	for _, query := range []string{"", "?owner=", "?owner=-finance", "?project=a%20b", "?q=" + strings.Repeat("x", maxSearchTextLength+1)} {
+		r = httptest.NewRequest(http.MethodGet, "/assets/search"+query, nil)
+		w = httptest.NewRecorder()
+		searchAssets(w, r)
+		if w.Result().StatusCode != http.StatusBadRequest {
+			t.Errorf("Didn't get 400 for search %q: %d", query, w.Result().StatusCode)
+		}
+	}
+}
+
+func TestInitAssetSearchAttributes(t *testing.T) {
+	db := &mockDBPutRecordingClient{}
+	dbSvc, s3Svc = db, &mockS3Client{}
+	r := httptest.NewRequest(http.MethodPost, "/asset?owner=finance&project=reports/2024&description=Quarterly%20report", nil)
+	w := httptest.NewRecorder()
+
+	initAsset(w, r)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Incorrect status on asset init with search attributes: %d", w.Result().StatusCode)
+	}
+	if stringAttribute(db.item, "owner") != "finance" || stringAttribute(db.item, "project_shard") != projectShard ||
+		stringAttribute(db.item, "description") != "Quarterly report" {
+		t.Errorf("Search attributes not recorded on asset: %v", db.item)
+	}
+
+	for _, query := range []string{"?owner=a%20b", "?description=a%00b", "?description=" + strings.Repeat("x", maxDescriptionLength+1)} {
+		r = httptest.NewRequest(http.MethodPost, "/asset"+query, nil)
+		w = httptest.NewRecorder()
+		initAsset(w, r)
+		if w.Result().StatusCode != http.StatusBadRequest {
+			t.Errorf("Didn't get 400 for init %q: %d", query, w.Result().StatusCode)
+		}
+	}
+}
+
+func TestPatchSearchAttributes(t *testing.T) {
+	dbSvc = &mockDBClient{}
+	for body, status := range map[string]int{
+		`{"description": "Quarterly report\nfor the board"}`: http.StatusNoContent,
+		`{"owner": "finance", "project": "reports/2024"}`:    http.StatusNoContent,
+		`{"owner": "", "project": "", "description": ""}`:    http.StatusNoContent,
+		`{"project": "../reports"}`:                          http.StatusBadRequest,
+	} {
+		r := httptest.NewRequest(http.MethodPatch, "/asset/someID", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		manageAsset(w, r)
+		if w.Result().StatusCode != status {
+			t.Errorf("Incorrect status patching %s: %d", body, w.Result().StatusCode)
+		}
+	}
+}
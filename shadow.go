@@ -0,0 +1,103 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// an alternate table and/or bucket that a sample of reads is repeated
+// against, e.g. the target of a migration; empty means the primary one
+var shadowTableName, shadowBucketName string
+
+// percentage of download requests repeated against the shadow
+var shadowPercent float64
+
+// record attributes expected to match between primary and shadow
+var shadowComparedAttributes = []string{"status", "content_type", "cache_control", "filename", "md5", "sha256", "metadata"}
+
+// counts of shadow reads since startup
+type shadowStats struct {
+	Percent  float64 `json:"percent"`
+	Compared int64   `json:"compared"`
+	Diverged int64   `json:"diverged"`
+	Failed   int64   `json:"failed"`
+}
+
+var shadowCompared, shadowDiverged, shadowFailed int64
+
+// repeats a sample of asset reads against the shadow in the background,
+// logging any difference from what the primary returned
+func shadowRead(assetID string, item map[string]*dynamodb.AttributeValue, head *s3.HeadObjectOutput) {
+	if shadowPercent <= 0 || rand.Float64()*100 >= shadowPercent {
+		return
+	}
+	go func() {
+		diverged, err := compareShadow(assetID, item, head)
+		if err != nil {
+			atomic.AddInt64(&shadowFailed, 1)
+			log.Printf("shadow read of %s failed: %s", assetID, err.Error())
+			return
+		}
+		atomic.AddInt64(&shadowCompared, 1)
+		if len(diverged) > 0 {
+			atomic.AddInt64(&shadowDiverged, 1)
+			log.Printf("shadow read of %s diverged in %v", assetID, diverged)
+		}
+	}()
+}
+
+// reads an asset from the shadow, returning what differs from the primary
+func compareShadow(assetID string, item map[string]*dynamodb.AttributeValue, head *s3.HeadObjectOutput) ([]string, error) {
+	var diverged []string
+	if shadowTableName != "" {
+		result, err := dbSvc.GetItem(&dynamodb.GetItemInput{
+			Key:            assetKey(assetID),
+			TableName:      aws.String(shadowTableName),
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range shadowComparedAttributes {
+			if !reflect.DeepEqual(item[name], result.Item[name]) {
+				diverged = append(diverged, name)
+			}
+		}
+	}
+	if shadowBucketName != "" {
+		shadowHead, err := s3Svc.HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String(shadowBucketName),
+			Key:    aws.String(objectKey(assetID, item)),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if aws.Int64Value(head.ContentLength) != aws.Int64Value(shadowHead.ContentLength) {
+			diverged = append(diverged, "object size")
+		}
+		if aws.StringValue(head.ETag) != aws.StringValue(shadowHead.ETag) {
+			diverged = append(diverged, "object etag")
+		}
+	}
+	return diverged, nil
+}
+
+// reports how shadow reads have compared so far
+func getShadowStats(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, shadowStats{
+		Percent:  shadowPercent,
+		Compared: atomic.LoadInt64(&shadowCompared),
+		Diverged: atomic.LoadInt64(&shadowDiverged),
+		Failed:   atomic.LoadInt64(&shadowFailed),
+	})
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestCompareShadow(t *testing.T) {
+	defer func() { shadowTableName, shadowBucketName = "", "" }()
+	shadowTableName = "assets-next"
+	shadowBucketName = "assets-next"
+	dbSvc = &mockDBClient{}
+	s3Svc = &mockS3Client{}
+	item := map[string]*dynamodb.AttributeValue{
+		"id":     {S: aws.String("someID")},
+		"status": {S: aws.String(assetStatusUploaded)},
+	}
+
+	diverged, err := compareShadow("someID", item, &s3.HeadObjectOutput{ContentLength: aws.Int64(12)})
+	if err != nil || len(diverged) != 0 {
+		t.Errorf("Matching shadow read diverged: %v %v", diverged, err)
+	}
+
+	item["filename"] = &dynamodb.AttributeValue{S: aws.String("hello.txt")}
+	diverged, err = compareShadow("someID", item, &s3.HeadObjectOutput{ContentLength: aws.Int64(13)})
+	if err != nil || !reflect.DeepEqual(diverged, []string{"filename", "object size"}) {
+		t.Errorf("Incorrect shadow divergence: %v %v", diverged, err)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// requests are counted in minute buckets covering the long window
+	sloBucketLength = time.Minute
+	sloLongWindow   = 60
+	sloShortWindow  = 5
+	// spending the error budget this many times faster than it lasts, over
+	// both windows, raises an alert; 14.4 spends 2% of a 30 day budget in
+	// an hour
+	sloBurnThreshold = 14.4
+	eventSLOBurning  = "slo.burning"
+)
+
+// JSON file of objectives by route pattern, none when empty
+var sloConfigFile string
+
+// url told when a route burns its error budget too fast, none when empty
+var sloWebhook string
+
+// what fraction of a route's requests should succeed, and within how long;
+// without latency_ms only 5xx responses count against it
+type routeSLO struct {
+	Target    float64 `json:"target"`
+	LatencyMS int64   `json:"latency_ms,omitempty"`
+}
+
+var routeSLOs map[string]routeSLO
+
+// requests and failures per minute, indexed by unix minute modulo the
+// long window
+type sloWindow struct {
+	minutes [sloLongWindow]int64
+	total   [sloLongWindow]int64
+	bad     [sloLongWindow]int64
+	// whether an alert is out for the route
+	alerting bool
+}
+
+var sloMu sync.Mutex
+var sloWindows = map[string]*sloWindow{}
+
+// how a route is doing against its objective
+type sloStatus struct {
+	Route     string  `json:"route"`
+	Target    float64 `json:"target"`
+	LatencyMS int64   `json:"latency_ms,omitempty"`
+	Requests  int64   `json:"requests"`
+	ShortBurn float64 `json:"burn_rate_5m"`
+	LongBurn  float64 `json:"burn_rate_1h"`
+	Alerting  bool    `json:"alerting"`
+	Event     string  `json:"event,omitempty"`
+}
+
+// reads and checks the objectives in a config file
+func loadSLOs(file string) (map[string]routeSLO, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var slos map[string]routeSLO
+	if err := json.Unmarshal(b, &slos); err != nil {
+		return nil, fmt.Errorf("slo config: %s", err.Error())
+	}
+	for route, slo := range slos {
+		if slo.Target <= 0 || slo.Target >= 1 {
+			return nil, fmt.Errorf("slo config: target for %s must be between 0 and 1", route)
+		}
+		if slo.LatencyMS < 0 {
+			return nil, fmt.Errorf("slo config: latency_ms for %s must not be negative", route)
+		}
+	}
+	return slos, nil
+}
+
+// counts every request to a route with an objective against it, by the
+// pattern it's registered under in mux
+func withSLOs(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		slo, ok := routeSLOs[route]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &captureWriter{ResponseWriter: w}
+		start := time.Now()
+		next.ServeHTTP(cw, r)
+		elapsed := time.Since(start)
+		bad := cw.status >= 500 || (slo.LatencyMS > 0 && elapsed > time.Duration(slo.LatencyMS)*time.Millisecond)
+		recordSLO(route, start, bad)
+	})
+}
+
+func recordSLO(route string, at time.Time, bad bool) {
+	minute := at.Unix() / int64(sloBucketLength/time.Second)
+	i := minute % sloLongWindow
+	sloMu.Lock()
+	defer sloMu.Unlock()
+	window, ok := sloWindows[route]
+	if !ok {
+		window = &sloWindow{}
+		sloWindows[route] = window
+	}
+	if window.minutes[i] != minute {
+		window.minutes[i], window.total[i], window.bad[i] = minute, 0, 0
+	}
+	window.total[i]++
+	if bad {
+		window.bad[i]++
+	}
+}
+
+// how many times faster than sustainable the error budget was spent over
+// the last minutes, with the requests counted; callers hold sloMu
+func (window *sloWindow) burnRate(slo routeSLO, now time.Time, minutes int64) (float64, int64) {
+	current := now.Unix() / int64(sloBucketLength/time.Second)
+	var total, bad int64
+	for i := range window.minutes {
+		if window.minutes[i] > current-minutes && window.minutes[i] <= current {
+			total += window.total[i]
+			bad += window.bad[i]
+		}
+	}
+	if total == 0 {
+		return 0, 0
+	}
+	return float64(bad) / float64(total) / (1 - slo.Target), total
+}
+
+// every route's standing against its objective, sorted by route
+func sloStatuses(now time.Time) []sloStatus {
+	sloMu.Lock()
+	defer sloMu.Unlock()
+	statuses := []sloStatus{}
+	for route, slo := range routeSLOs {
+		status := sloStatus{Route: route, Target: slo.Target, LatencyMS: slo.LatencyMS}
+		if window, ok := sloWindows[route]; ok {
+			status.ShortBurn, _ = window.burnRate(slo, now, sloShortWindow)
+			status.LongBurn, status.Requests = window.burnRate(slo, now, sloLongWindow)
+			status.Alerting = window.alerting
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Route < statuses[j].Route })
+	return statuses
+}
+
+// checks burn rates every minute, until stopped
+func watchSLOs(stop <-chan struct{}) {
+	for pause(stop, sloBucketLength) {
+		for _, err := range checkSLOs(time.Now()) {
+			log.Println(err.Error())
+		}
+	}
+}
+
+// alerts once for each route newly burning its budget too fast over both
+// windows, clearing the alert when the short window recovers
+func checkSLOs(now time.Time) []error {
+	var burning []sloStatus
+	sloMu.Lock()
+	for route, slo := range routeSLOs {
+		window, ok := sloWindows[route]
+		if !ok {
+			continue
+		}
+		short, _ := window.burnRate(slo, now, sloShortWindow)
+		long, requests := window.burnRate(slo, now, sloLongWindow)
+		if short < sloBurnThreshold {
+			if window.alerting {
+				log.Printf("slo for %s recovered", route)
+			}
+			window.alerting = false
+			continue
+		}
+		if long >= sloBurnThreshold && !window.alerting {
+			window.alerting = true
+			burning = append(burning, sloStatus{
+				Route:     route,
+				Target:    slo.Target,
+				LatencyMS: slo.LatencyMS,
+				Requests:  requests,
+				ShortBurn: short,
+				LongBurn:  long,
+				Alerting:  true,
+				Event:     eventSLOBurning,
+			})
+		}
+	}
+	sloMu.Unlock()
+
+	var errs []error
+	for _, status := range burning {
+		log.Printf("slo for %s burning at %.1fx over 5m and %.1fx over 1h", status.Route, status.ShortBurn, status.LongBurn)
+		if sloWebhook == "" {
+			continue
+		}
+		if err := sendSLOAlert(status); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+func sendSLOAlert(status sloStatus) error {
+	body, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	resp, err := webhookClient.Post(sloWebhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("slo webhook returned %s for route %s", resp.Status, status.Route)
+	}
+	return nil
+}
+
+// reports every route's burn rates
+func getSLOStatus(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, sloStatuses(time.Now()))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadSLOs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "slo.json")
+	ioutil.WriteFile(file, []byte(`{"/asset/": {"target": 0.999, "latency_ms": 300}}`), 0644)
+	slos, err := loadSLOs(file)
+	if err != nil || slos["/asset/"].Target != 0.999 || slos["/asset/"].LatencyMS != 300 {
+		t.Errorf("Incorrect objectives loaded: %v %v", slos, err)
+	}
+	ioutil.WriteFile(file, []byte(`{"/asset/": {"target": 99.9}}`), 0644)
+	if _, err := loadSLOs(file); err == nil {
+		t.Error("Target above 1 wasn't refused")
+	}
+}
+func TestWithSLOs(t *testing.T) {
+	routeSLOs = map[string]routeSLO{"/asset/": {Target: 0.99}}
+	sloWindows = map[string]*sloWindow{}
+	defer func() { routeSLOs = nil }()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/asset/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/asset/broken" {
+			writeError(w, os.ErrClosed)
+		}
+	})
+	handler := withSLOs(mux, mux)
+	for _, path := range []string{"/asset/a", "/asset/b", "/asset/c", "/asset/broken"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	statuses := sloStatuses(time.Now())
+	if len(statuses) != 1 || statuses[0].Requests != 4 {
+		t.Fatalf("Incorrect requests counted: %+v", statuses)
+	}
+	// a quarter failing against a 1% budget
+	if statuses[0].ShortBurn < 24.9 || statuses[0].ShortBurn > 25.1 {
+		t.Errorf("Incorrect burn rate: %f", statuses[0].ShortBurn)
+	}
+}
+func TestCheckSLOs(t *testing.T) {
+	alerts := make(chan sloStatus, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var status sloStatus
+		json.NewDecoder(r.Body).Decode(&status)
+		alerts <- status
+	}))
+	defer server.Close()
+	sloWebhook = server.URL
+	routeSLOs = map[string]routeSLO{"/tus/": {Target: 0.999}}
+	sloWindows = map[string]*sloWindow{}
+	defer func() { sloWebhook, routeSLOs = "", nil }()
+
+	now := time.Now()
+	recordSLO("/tus/", now, false)
+	recordSLO("/tus/", now, true)
+	if errs := checkSLOs(now); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	if errs := checkSLOs(now); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	if len(alerts) != 1 {
+		t.Fatalf("Incorrect number of alerts sent: %d", len(alerts))
+	}
+	alert := <-alerts
+	if alert.Event != eventSLOBurning || alert.Route != "/tus/" || !alert.Alerting {
+		t.Errorf("Incorrect alert sent: %+v", alert)
+	}
+
+	// recovers once the short window is clean
+	later := now.Add(10 * time.Minute)
+	for i := 0; i < 10; i++ {
+		recordSLO("/tus/", later, false)
+	}
+	checkSLOs(later)
+	if sloWindows["/tus/"].alerting {
+		t.Error("Alert not cleared after recovering")
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+const (
+	eventUploaded = "asset.uploaded"
+
+	subscriptionWebhook = "webhook"
+	subscriptionSQS     = "sqs"
+	subscriptionSNS     = "sns"
+
+	// how long fan-out trusts its copy of the subscriptions before scanning
+	// the table again
+	subscriptionsRefresh = 30 * time.Second
+	maxLastErrorLength   = 500
+)
+
+// events a subscription can ask for
+var subscribableEvents = map[string]bool{
+	eventUploaded:        true,
+	eventDeleted:         true,
+	eventPublishable:     true,
+	eventDeletionPending: true,
+}
+
+var snsTopicPattern = regexp.MustCompile(`^arn:[a-z-]+:sns:[a-z0-9-]+:[0-9]{12}:[A-Za-z0-9_-]{1,256}(\.fifo)?$`)
+
+// the DynamoDB table holding event subscriptions, none to disable them
+var subscriptionsTableName string
+
+var sqsSvc sqsiface.SQSAPI
+var snsSvc snsiface.SNSAPI
+
+// interest in events on assets in a folder, or every asset, delivered to
+// a webhook, SQS queue or SNS topic; its ID is derived from what it asks
+// for, so registering the same interest twice finds the first
+type subscription struct {
+	ID     string   `json:"id"`
+	Folder string   `json:"folder,omitempty"`
+	Events []string `json:"events,omitempty"`
+	Type   string   `json:"type"`
+	Target string   `json:"target"`
+	// delivery state, kept up by fan-out
+	Delivered       int64  `json:"delivered"`
+	Failed          int64  `json:"failed"`
+	LastDeliveredAt int64  `json:"last_delivered_at,omitempty"`
+	LastFailedAt    int64  `json:"last_failed_at,omitempty"`
+	LastError       string `json:"last_error,omitempty"`
+	CreatedAt       int64  `json:"created_at"`
+}
+
+// what subscribers are sent, once per target however many of its
+// subscriptions match
+type subscriptionEvent struct {
+	Event         string    `json:"event"`
+	ID            string    `json:"id"`
+	Folder        string    `json:"folder,omitempty"`
+	Subscriptions []string  `json:"subscriptions"`
+	OccurredAt    time.Time `json:"occurred_at"`
+}
+
+var subscriptionsCache struct {
+	sync.Mutex
+	list   []subscription
+	loaded time.Time
+}
+
+// checks a subscription, normalizing its folder and events and deriving
+// its ID
+func validateSubscription(s *subscription) error {
+	switch s.Type {
+	case subscriptionWebhook, subscriptionSQS:
+		u, err := url.Parse(s.Target)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("%s target must be an https url", s.Type)
+		}
+	case subscriptionSNS:
+		if !snsTopicPattern.MatchString(s.Target) {
+			return fmt.Errorf("sns target must be a topic arn")
+		}
+	default:
+		return fmt.Errorf("type must be webhook, sqs or sns")
+	}
+	if s.Folder != "" {
+		prefix, err := normalizeKeyPrefix(s.Folder)
+		if err != nil {
+			return err
+		}
+		s.Folder = prefix
+	}
+	events := map[string]bool{}
+	for _, event := range s.Events {
+		if !subscribableEvents[event] {
+			return fmt.Errorf("unknown event '%s'", event)
+		}
+		events[event] = true
+	}
+	s.Events = sortedKeys(events)
+	if len(s.Events) == 0 {
+		s.Events = nil
+	}
+	sum := sha256.Sum256([]byte(strings.Join([]string{s.Type, s.Target, s.Folder, strings.Join(s.Events, ",")}, "\n")))
+	s.ID = hex.EncodeToString(sum[:16])
+	return nil
+}
+
+// whether a subscription wants an event on an asset in a folder
+func (s *subscription) matches(event, folder string) bool {
+	if !strings.HasPrefix(folder, s.Folder) {
+		return false
+	}
+	if len(s.Events) == 0 {
+		return true
+	}
+	for _, e := range s.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func subscriptionsEnabled(w http.ResponseWriter) bool {
+	if subscriptionsTableName == "" {
+		http.Error(w, "Subscriptions are disabled.", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// registers (POST) or lists (GET) subscriptions; registering one that
+// exists answers 200 with it rather than 201
+func manageSubscriptions(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet, http.MethodPost) || !subscriptionsEnabled(w) {
+		return
+	}
+	if r.Method == http.MethodGet {
+		list, err := scanSubscriptions()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, list)
+		return
+	}
+
+	var s subscription
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON payload: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	if err := validateSubscription(&s); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid subscription: %s.", err.Error()), http.StatusBadRequest)
+		return
+	}
+	s = subscription{ID: s.ID, Folder: s.Folder, Events: s.Events, Type: s.Type, Target: s.Target,
+		CreatedAt: time.Now().UnixNano() / int64(time.Millisecond)}
+	item, err := dynamodbattribute.MarshalMap(s)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	_, err = dbSvc.PutItemWithContext(r.Context(), &dynamodb.PutItemInput{
+		Item:                item,
+		TableName:           aws.String(subscriptionsTableName),
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	})
+	if isConditionFailed(err) {
+		existing, ok := fetchSubscription(r.Context(), w, s.ID)
+		if ok {
+			writeJSON(w, existing)
+		}
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	forgetSubscriptions()
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, s)
+}
+
+// shows a subscription with its delivery state, or removes it
+func manageSubscription(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet, http.MethodDelete) || !subscriptionsEnabled(w) {
+		return
+	}
+	subscriptionID := strings.TrimPrefix(r.URL.Path, "/subscriptions/")
+	if r.Method == http.MethodGet {
+		s, ok := fetchSubscription(r.Context(), w, subscriptionID)
+		if ok {
+			writeJSON(w, s)
+		}
+		return
+	}
+	_, err := dbSvc.DeleteItemWithContext(r.Context(), &dynamodb.DeleteItemInput{
+		Key:                 assetKey(subscriptionID),
+		TableName:           aws.String(subscriptionsTableName),
+		ConditionExpression: aws.String("attribute_exists(id)"),
+	})
+	if err != nil {
+		if isConditionFailed(err) {
+			http.Error(w, fmt.Sprintf("Subscription '%s' not found.", subscriptionID), http.StatusNotFound)
+			return
+		}
+		writeError(w, err)
+		return
+	}
+	forgetSubscriptions()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// fetches a subscription, writing an error and returning false if it
+// can't be found
+func fetchSubscription(ctx context.Context, w http.ResponseWriter, subscriptionID string) (*subscription, bool) {
+	result, err := dbSvc.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		Key:            assetKey(subscriptionID),
+		TableName:      aws.String(subscriptionsTableName),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		writeError(w, err)
+		return nil, false
+	}
+	if _, ok := result.Item["id"]; !ok {
+		http.Error(w, fmt.Sprintf("Subscription '%s' not found.", subscriptionID), http.StatusNotFound)
+		return nil, false
+	}
+	var s subscription
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &s); err != nil {
+		writeError(w, err)
+		return nil, false
+	}
+	return &s, true
+}
+
+// reads every subscription; there are few enough to scan
+func scanSubscriptions() ([]subscription, error) {
+	list := []subscription{}
+	var unmarshalErr error
+	err := dbSvc.ScanPages(&dynamodb.ScanInput{TableName: aws.String(subscriptionsTableName)}, func(page *dynamodb.ScanOutput, last bool) bool {
+		var subscriptions []subscription
+		if unmarshalErr = dynamodbattribute.UnmarshalListOfMaps(page.Items, &subscriptions); unmarshalErr != nil {
+			return false
+		}
+		list = append(list, subscriptions...)
+		return true
+	})
+	if err == nil {
+		err = unmarshalErr
+	}
+	return list, err
+}
+
+// the subscriptions as of at most subscriptionsRefresh ago; other instances'
+// changes take that long to be seen
+func cachedSubscriptions() ([]subscription, error) {
+	subscriptionsCache.Lock()
+	defer subscriptionsCache.Unlock()
+	if subscriptionsCache.list != nil && time.Since(subscriptionsCache.loaded) < subscriptionsRefresh {
+		return subscriptionsCache.list, nil
+	}
+	list, err := scanSubscriptions()
+	if err != nil {
+		return nil, err
+	}
+	subscriptionsCache.list, subscriptionsCache.loaded = list, time.Now()
+	return list, nil
+}
+
+func forgetSubscriptions() {
+	subscriptionsCache.Lock()
+	subscriptionsCache.list = nil
+	subscriptionsCache.Unlock()
+}
+
+// tells every subscription matching an event on an asset about it in the
+// background
+func publishEvent(event, assetID string, item map[string]*dynamodb.AttributeValue) {
+	if subscriptionsTableName == "" {
+		return
+	}
+	folder := stringAttribute(item, "key_prefix")
+	go func() {
+		if err := fanOut(event, assetID, folder); err != nil {
+			log.Printf("fanning out %s for asset %s: %s", event, assetID, err.Error())
+		}
+	}()
+}
+
+// delivers an event once to each target with a matching subscription,
+// recording the outcome on every one of them
+func fanOut(event, assetID, folder string) error {
+	list, err := cachedSubscriptions()
+	if err != nil {
+		return err
+	}
+	targets := map[string][]subscription{}
+	var order []string
+	for _, s := range list {
+		if !s.matches(event, folder) {
+			continue
+		}
+		target := s.Type + " " + s.Target
+		if _, ok := targets[target]; !ok {
+			order = append(order, target)
+		}
+		targets[target] = append(targets[target], s)
+	}
+	occurredAt := time.Now().UTC().Truncate(time.Second)
+	for _, target := range order {
+		matched := targets[target]
+		ids := make([]string, len(matched))
+		for i, s := range matched {
+			ids[i] = s.ID
+		}
+		sort.Strings(ids)
+		body, err := json.Marshal(subscriptionEvent{Event: event, ID: assetID, Folder: folder, Subscriptions: ids, OccurredAt: occurredAt})
+		if err != nil {
+			return err
+		}
+		deliveryErr := deliverEvent(matched[0].Type, matched[0].Target, body)
+		if deliveryErr != nil {
+			log.Printf("delivering %s for asset %s to %s: %s", event, assetID, matched[0].Target, deliveryErr.Error())
+		}
+		for _, id := range ids {
+			if err := recordDelivery(id, deliveryErr); err != nil {
+				log.Println(err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+func deliverEvent(kind, target string, body []byte) error {
+	switch kind {
+	case subscriptionSQS:
+		_, err := sqsSvc.SendMessage(&sqs.SendMessageInput{
+			QueueUrl:    aws.String(target),
+			MessageBody: aws.String(string(body)),
+		})
+		return err
+	case subscriptionSNS:
+		_, err := snsSvc.Publish(&sns.PublishInput{
+			TopicArn: aws.String(target),
+			Message:  aws.String(string(body)),
+		})
+		return err
+	}
+	resp, err := webhookClient.Post(target, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// counts a delivery to a subscription, keeping the last error of a failed
+// one; a subscription removed meanwhile is left removed
+func recordDelivery(subscriptionID string, deliveryErr error) error {
+	now := strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+	values := map[string]*dynamodb.AttributeValue{
+		":one": {N: aws.String("1")},
+		":now": {N: aws.String(now)},
+	}
+	update := "SET last_delivered_at = :now ADD delivered :one"
+	if deliveryErr != nil {
+		message := deliveryErr.Error()
+		if len(message) > maxLastErrorLength {
+			message = message[:maxLastErrorLength]
+		}
+		values[":error"] = &dynamodb.AttributeValue{S: aws.String(message)}
+		update = "SET last_failed_at = :now, last_error = :error ADD failed :one"
+	}
+	_, err := dbSvc.UpdateItem(&dynamodb.UpdateItemInput{
+		Key:                       assetKey(subscriptionID),
+		TableName:                 aws.String(subscriptionsTableName),
+		UpdateExpression:          aws.String(update),
+		ConditionExpression:       aws.String("attribute_exists(id)"),
+		ExpressionAttributeValues: values,
+	})
+	if isConditionFailed(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+// a subscriptions table holding two subscriptions sharing a webhook, one
+// for a folder, and a queue subscription for another folder, recording
+// the delivery updates made to them
+type mockDBSubscriptionsClient struct {
+	mockDBClient
+	hook    string
+	mu      sync.Mutex
+	updates map[string]string
+}
+
+func (m *mockDBSubscriptionsClient) ScanPages(input *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool) error {
+	fn(&dynamodb.ScanOutput{Items: []map[string]*dynamodb.AttributeValue{
+		{
+			"id":     {S: aws.String("all")},
+			"type":   {S: aws.String(subscriptionWebhook)},
+			"target": {S: aws.String(m.hook)},
+		},
+		{
+			"id":     {S: aws.String("invoices")},
+			"folder": {S: aws.String("invoices/")},
+			"events": {L: []*dynamodb.AttributeValue{{S: aws.String(eventUploaded)}}},
+			"type":   {S: aws.String(subscriptionWebhook)},
+			"target": {S: aws.String(m.hook)},
+		},
+		{
+			"id":     {S: aws.String("reports")},
+			"folder": {S: aws.String("reports/")},
+			"type":   {S: aws.String(subscriptionSQS)},
+			"target": {S: aws.String("https://sqs.us-east-1.amazonaws.com/123456789012/reports")},
+		},
+	}}, true)
+	return nil
+}
+func (m *mockDBSubscriptionsClient) ScanPagesWithContext(ctx aws.Context, input *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool, opts ...request.Option) error {
+	return m.ScanPages(input, fn)
+}
+
+func (m *mockDBSubscriptionsClient) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.updates[stringAttribute(input.Key, "id")] = aws.StringValue(input.UpdateExpression)
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+func (m *mockDBSubscriptionsClient) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	return m.UpdateItem(input)
+}
+
+type mockSQSClient struct {
+	sqsiface.SQSAPI
+	sent []string
+}
+
+func (m *mockSQSClient) SendMessage(input *sqs.SendMessageInput) (*sqs.SendMessageOutput, error) {
+	m.sent = append(m.sent, aws.StringValue(input.MessageBody))
+	return &sqs.SendMessageOutput{}, nil
+}
+
+func TestValidateSubscription(t *testing.T) {
+	a := subscription{Type: subscriptionWebhook, Target: "https://example.com/hook", Folder: "/invoices",
+		Events: []string{eventDeleted, eventUploaded, eventDeleted}}
+	b := subscription{Type: subscriptionWebhook, Target: "https://example.com/hook", Folder: "invoices/",
+		Events: []string{eventUploaded, eventDeleted}}
+	if err := validateSubscription(&a); err != nil {
+		t.Fatalf("Got error for a valid subscription: %s", err)
+	}
+	if err := validateSubscription(&b); err != nil {
+		t.Fatalf("Got error for a valid subscription: %s", err)
+	}
+	if a.ID == "" || a.ID != b.ID || a.Folder != "invoices/" || len(a.Events) != 2 {
+		t.Errorf("Equivalent subscriptions weren't normalized alike: %+v %+v", a, b)
+	}
+
+	invalid := []subscription{
+		{Type: "email", Target: "someone@example.com"},
+		{Type: subscriptionWebhook, Target: "http://example.com/hook"},
+		{Type: subscriptionSQS, Target: "reports"},
+		{Type: subscriptionSNS, Target: "https://example.com/topic"},
+		{Type: subscriptionWebhook, Target: "https://example.com/hook", Events: []string{"asset.renamed"}},
+		{Type: subscriptionWebhook, Target: "https://example.com/hook", Folder: "a/../b"},
+	}
+	for _, s := range invalid {
+		if err := validateSubscription(&s); err == nil {
+			t.Errorf("Got no error for invalid subscription %+v", s)
+		}
+	}
+	sns := subscription{Type: subscriptionSNS, Target: "arn:aws:sns:us-east-1:123456789012:assets"}
+	if err := validateSubscription(&sns); err != nil {
+		t.Errorf("Got error for a topic subscription: %s", err)
+	}
+}
+func TestCreateSubscription(t *testing.T) {
+	subscriptionsTableName = "subscriptions"
+	defer func() { subscriptionsTableName = "" }()
+	dbSvc = &mockDBClient{}
+	body := `{"type":"webhook","target":"https://example.com/hook","folder":"invoices"}`
+	r := httptest.NewRequest(http.MethodPost, "/subscriptions", bytes.NewReader([]byte(body)))
+	w := httptest.NewRecorder()
+
+	manageSubscriptions(w, r)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Incorrect status registering a subscription: %d", resp.StatusCode)
+	}
+	var created subscription
+	json.NewDecoder(resp.Body).Decode(&created)
+	if created.ID == "" || created.Folder != "invoices/" || created.CreatedAt == 0 {
+		t.Errorf("Incorrect subscription returned: %+v", created)
+	}
+
+	// registering it again finds the first
+	dbSvc = &mockDBPutConditionFailedClient{}
+	r = httptest.NewRequest(http.MethodPost, "/subscriptions", bytes.NewReader([]byte(body)))
+	w = httptest.NewRecorder()
+	manageSubscriptions(w, r)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Errorf("Didn't get 200 registering a subscription twice: %d", w.Result().StatusCode)
+	}
+
+	subscriptionsTableName = ""
+	r = httptest.NewRequest(http.MethodPost, "/subscriptions", bytes.NewReader([]byte(body)))
+	w = httptest.NewRecorder()
+	manageSubscriptions(w, r)
+	if w.Result().StatusCode != http.StatusNotFound {
+		t.Errorf("Didn't get 404 with subscriptions disabled: %d", w.Result().StatusCode)
+	}
+}
+func TestFanOut(t *testing.T) {
+	var mu sync.Mutex
+	var received []subscriptionEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event subscriptionEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		mu.Lock()
+		received = append(received, event)
+		mu.Unlock()
+	}))
+	defer server.Close()
+	subscriptionsTableName = "subscriptions"
+	defer func() { subscriptionsTableName = "" }()
+	forgetSubscriptions()
+	defer forgetSubscriptions()
+	db := &mockDBSubscriptionsClient{hook: server.URL, updates: map[string]string{}}
+	queue := &mockSQSClient{}
+	dbSvc, sqsSvc = db, queue
+
+	if err := fanOut(eventUploaded, "someID", "invoices/2024/"); err != nil {
+		t.Fatalf("Got error fanning out: %s", err)
+	}
+	if len(received) != 1 || strings.Join(received[0].Subscriptions, ",") != "all,invoices" || received[0].ID != "someID" {
+		t.Fatalf("Webhook shared by two subscriptions wasn't told once: %+v", received)
+	}
+	if len(queue.sent) != 0 {
+		t.Errorf("Queue of a subscription to another folder was sent: %v", queue.sent)
+	}
+	for _, id := range []string{"all", "invoices"} {
+		if !strings.Contains(db.updates[id], "ADD delivered") {
+			t.Errorf("Delivery to subscription %s not recorded: %v", id, db.updates)
+		}
+	}
+
+	if err := fanOut(eventDeleted, "otherID", "reports/"); err != nil {
+		t.Fatalf("Got error fanning out: %s", err)
+	}
+	if len(queue.sent) != 1 || !strings.Contains(queue.sent[0], eventDeleted) || len(received) != 2 {
+		t.Errorf("Event wasn't sent to the queue and the catch-all webhook: %v %+v", queue.sent, received)
+	}
+	server.Close()
+	if err := fanOut(eventDeleted, "otherID", ""); err != nil {
+		t.Fatalf("Got error fanning out: %s", err)
+	}
+	if !strings.Contains(db.updates["all"], "ADD failed") {
+		t.Errorf("Failed delivery not recorded: %v", db.updates)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	// each tag on an asset has a record of its own under this key prefix,
+	// which the tag index finds assets by
+	tagKeyPrefix    = "tag:"
+	maxTags         = 50
+	batchRetryPause = 50 * time.Millisecond
+)
+
+var tagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9:_-]{0,62}$`)
+
+// the DynamoDB index on tag and asset_id
+var tagIndexName string
+
+type tagsPatch struct {
+	Add    []string `json:"add"`
+	Remove []string `json:"remove"`
+}
+
+type tagsResponse struct {
+	Tags []string `json:"tags"`
+}
+
+// the record of a tag on an asset; asset IDs never contain a colon
+func tagKey(assetID, tag string) map[string]*dynamodb.AttributeValue {
+	return assetKey(tagKeyPrefix + assetID + ":" + tag)
+}
+
+// reads the tags recorded on an asset, in order
+func recordedTags(item map[string]*dynamodb.AttributeValue) []string {
+	var tags []string
+	if v, ok := item["tags"]; ok {
+		tags = aws.StringValueSlice(v.SS)
+		sort.Strings(tags)
+	}
+	return tags
+}
+
+// lists (GET) or changes (POST {"add": [...], "remove": [...]}) an asset's
+// tags
+func handleTagsRequest(w http.ResponseWriter, r *http.Request, assetID string) {
+	if r.Method == http.MethodGet {
+		item, ok := fetchAsset(w, r, assetID)
+		if !ok {
+			return
+		}
+		tags := recordedTags(item)
+		if tags == nil {
+			tags = []string{}
+		}
+		writeJSON(w, tagsResponse{Tags: tags})
+		return
+	}
+
+	var patch tagsPatch
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON payload: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	if len(patch.Add)+len(patch.Remove) == 0 {
+		http.Error(w, "Nothing to update.", http.StatusBadRequest)
+		return
+	}
+	if len(patch.Add)+len(patch.Remove) > maxTags {
+		http.Error(w, fmt.Sprintf("At most %d tags can be added or removed at once.", maxTags), http.StatusBadRequest)
+		return
+	}
+	if err := validateTags(append(append([]string{}, patch.Add...), patch.Remove...)); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid tag %s.", err.Error()), http.StatusBadRequest)
+		return
+	}
+	item, ok := fetchAsset(w, r, assetID)
+	if !ok {
+		return
+	}
+	added, removed, count := diffTags(recordedTags(item), patch.Add, patch.Remove)
+	if count > maxTags {
+		http.Error(w, fmt.Sprintf("Asset id '%s' can have at most %d tags.", assetID, maxTags), http.StatusBadRequest)
+		return
+	}
+	if len(added)+len(removed) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// the asset update comes first so its failure can be told apart
+	values := lockConditionValues(r)
+	values[":updated"] = updatedAtValue()
+	clause, records := tagWrites(assetID, added, removed, values)
+	items := append([]*dynamodb.TransactWriteItem{{Update: &dynamodb.Update{
+		Key:                       assetKey(assetID),
+		TableName:                 aws.String(tableName),
+		UpdateExpression:          aws.String("SET updated_at = :updated" + clause),
+		ConditionExpression:       aws.String("attribute_exists(id) AND " + lockCondition),
+		ExpressionAttributeValues: values,
+	}}}, records...)
+
+	_, err := dbSvc.TransactWriteItemsWithContext(r.Context(), &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	if err != nil {
+		if isFirstConditionFailed(err) {
+			http.Error(w, fmt.Sprintf("Asset id '%s' is locked.", assetID), http.StatusLocked)
+			return
+		}
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checks every tag is well formed, returning an error naming the first
+// that isn't
+func validateTags(tags []string) error {
+	for _, tag := range tags {
+		if !tagPattern.MatchString(tag) {
+			return fmt.Errorf("'%s', must be 1 to 63 lowercase letters, digits, dashes, underscores or colons", tag)
+		}
+	}
+	return nil
+}
+
+// works out which tags adding and removing some really adds to and removes
+// from an asset's current ones, and how many it's left with; removing wins
+func diffTags(current, add, remove []string) (added, removed map[string]bool, count int) {
+	tags := map[string]bool{}
+	for _, tag := range current {
+		tags[tag] = true
+	}
+	added, removed = map[string]bool{}, map[string]bool{}
+	for _, tag := range remove {
+		if tags[tag] {
+			removed[tag] = true
+			delete(tags, tag)
+		}
+	}
+	for _, tag := range add {
+		if !tags[tag] && !removed[tag] {
+			added[tag] = true
+			tags[tag] = true
+		}
+	}
+	return added, removed, len(tags)
+}
+
+// the clauses adding and removing tags to append to an asset's update
+// expression, and the writes of their tag records to transact with it
+func tagWrites(assetID string, added, removed map[string]bool, values map[string]*dynamodb.AttributeValue) (string, []*dynamodb.TransactWriteItem) {
+	var clause string
+	if len(added) > 0 {
+		values[":added"] = &dynamodb.AttributeValue{SS: aws.StringSlice(sortedKeys(added))}
+		clause += " ADD tags :added"
+	}
+	if len(removed) > 0 {
+		values[":removed"] = &dynamodb.AttributeValue{SS: aws.StringSlice(sortedKeys(removed))}
+		clause += " DELETE tags :removed"
+	}
+	var items []*dynamodb.TransactWriteItem
+	for tag := range added {
+		record := tagKey(assetID, tag)
+		record["tag"] = &dynamodb.AttributeValue{S: aws.String(tag)}
+		record["asset_id"] = &dynamodb.AttributeValue{S: aws.String(assetID)}
+		items = append(items, &dynamodb.TransactWriteItem{Put: &dynamodb.Put{
+			Item:      record,
+			TableName: aws.String(tableName),
+		}})
+	}
+	for tag := range removed {
+		items = append(items, &dynamodb.TransactWriteItem{Delete: &dynamodb.Delete{
+			Key:       tagKey(assetID, tag),
+			TableName: aws.String(tableName),
+		}})
+	}
+	return clause, items
+}
+
+// whether a transaction was canceled by the condition on its first item
+func isFirstConditionFailed(err error) bool {
+	cerr, ok := err.(*dynamodb.TransactionCanceledException)
+	return ok && len(cerr.CancellationReasons) > 0 &&
+		aws.StringValue(cerr.CancellationReasons[0].Code) == "ConditionalCheckFailed"
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// deletes the tag records of an asset being removed
+func deleteTagRecords(ctx context.Context, assetID string, item map[string]*dynamodb.AttributeValue) error {
+	for _, tag := range recordedTags(item) {
+		_, err := dbSvc.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+			Key:       tagKey(assetID, tag),
+			TableName: aws.String(tableName),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lists the assets carrying a tag, in ID order, a page at a time
+func listTaggedAssets(ctx context.Context, w http.ResponseWriter, tag string, limit int, after assetsCursor) {
+	query := &dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		IndexName:              aws.String(tagIndexName),
+		KeyConditionExpression: aws.String("tag = :tag"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":tag": {S: aws.String(tag)},
+		},
+		Limit: aws.Int64(int64(limit)),
+	}
+	if after.ID != "" {
+		query.ExclusiveStartKey = tagKey(after.ID, tag)
+		query.ExclusiveStartKey["tag"] = &dynamodb.AttributeValue{S: aws.String(tag)}
+		query.ExclusiveStartKey["asset_id"] = &dynamodb.AttributeValue{S: aws.String(after.ID)}
+	}
+	result, err := dbSvc.QueryWithContext(ctx, query)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var assetIDs []string
+	for _, item := range result.Items {
+		assetIDs = append(assetIDs, stringAttribute(item, "asset_id"))
+	}
+	items, err := batchGetAssets(ctx, assetIDs)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// deleted assets keep their tags until restored or purged
+	response := assetsResponse{Assets: []assetMeta{}}
+	for _, assetID := range assetIDs {
+		if item, ok := items[assetID]; ok && !isDeleted(item) {
+			response.Assets = append(response.Assets, describeAsset(item))
+		}
+	}
+	if last := stringAttribute(result.LastEvaluatedKey, "asset_id"); last != "" {
+		response.Cursor = encodeAssetsCursor(assetsCursor{ID: last})
+	}
+	writeJSON(w, response)
+}
+
+// fetches up to 100 asset records by ID, retrying any DynamoDB leaves
+// unprocessed
+func batchGetAssets(ctx context.Context, assetIDs []string) (map[string]map[string]*dynamodb.AttributeValue, error) {
+	items := map[string]map[string]*dynamodb.AttributeValue{}
+	if len(assetIDs) == 0 {
+		return items, nil
+	}
+	keys := &dynamodb.KeysAndAttributes{ConsistentRead: aws.Bool(true)}
+	for _, assetID := range assetIDs {
+		keys.Keys = append(keys.Keys, assetKey(assetID))
+	}
+	request := map[string]*dynamodb.KeysAndAttributes{tableName: keys}
+	for len(request) > 0 {
+		result, err := dbSvc.BatchGetItemWithContext(ctx, &dynamodb.BatchGetItemInput{RequestItems: request})
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range result.Responses[tableName] {
+			items[stringAttribute(item, "id")] = item
+		}
+		request = result.UnprocessedKeys
+		if len(request) > 0 {
+			time.Sleep(batchRetryPause)
+		}
+	}
+	return items, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// an uploaded asset tagged spring, found along with a deleted one by the
+// tag index
+type mockDBTaggedClient struct {
+	mockDBClient
+	transaction []*dynamodb.TransactWriteItem
+}
+
+func (m *mockDBTaggedClient) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	output, _ := m.mockDBClient.GetItem(input)
+	output.Item["tags"] = &dynamodb.AttributeValue{SS: aws.StringSlice([]string{"spring"})}
+	return output, nil
+}
+func (m *mockDBTaggedClient) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return m.GetItem(input)
+}
+
+func (m *mockDBTaggedClient) TransactWriteItems(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+	m.transaction = input.TransactItems
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
+func (m *mockDBTaggedClient) TransactWriteItemsWithContext(ctx aws.Context, input *dynamodb.TransactWriteItemsInput, opts ...request.Option) (*dynamodb.TransactWriteItemsOutput, error) {
+	return m.TransactWriteItems(input)
+}
+
+func (m *mockDBTaggedClient) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	return &dynamodb.QueryOutput{
+		Items: []map[string]*dynamodb.AttributeValue{
+			{"asset_id": {S: aws.String("someID")}},
+			{"asset_id": {S: aws.String("deletedID")}},
+		},
+		LastEvaluatedKey: map[string]*dynamodb.AttributeValue{"asset_id": {S: aws.String("deletedID")}},
+	}, nil
+}
+func (m *mockDBTaggedClient) QueryWithContext(ctx aws.Context, input *dynamodb.QueryInput, opts ...request.Option) (*dynamodb.QueryOutput, error) {
+	return m.Query(input)
+}
+
+func (m *mockDBTaggedClient) BatchGetItem(input *dynamodb.BatchGetItemInput) (*dynamodb.BatchGetItemOutput, error) {
+	return &dynamodb.BatchGetItemOutput{Responses: map[string][]map[string]*dynamodb.AttributeValue{
+		tableName: {
+			{"id": {S: aws.String("someID")}, "tags": {SS: aws.StringSlice([]string{"spring"})}},
+			{"id": {S: aws.String("deletedID")}, "status": {S: aws.String(assetStatusDeleted)}},
+		},
+	}}, nil
+}
+func (m *mockDBTaggedClient) BatchGetItemWithContext(ctx aws.Context, input *dynamodb.BatchGetItemInput, opts ...request.Option) (*dynamodb.BatchGetItemOutput, error) {
+	return m.BatchGetItem(input)
+}
+
+func TestTagsRequest(t *testing.T) {
+	db := &mockDBTaggedClient{}
+	dbSvc = db
+	r := httptest.NewRequest(http.MethodPost, "/asset/someID/tags", strings.NewReader(`{"add": ["env:prod", "spring"], "remove": ["spring", "summer"]}`))
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusNoContent {
+		t.Fatalf("Incorrect status tagging: %d", w.Result().StatusCode)
+	}
+	// updates the asset, records the new tag and drops the removed one
+	if len(db.transaction) != 3 || *db.transaction[1].Put.Item["id"].S != "tag:someID:env:prod" || *db.transaction[2].Delete.Key["id"].S != "tag:someID:spring" {
+		t.Errorf("Incorrect tag transaction: %v", db.transaction)
+	}
+
+	for _, body := range []string{`{}`, `{"add": ["Not A Tag"]}`, `{"add": [` + strings.Repeat(`"a",`, maxTags) + `"b"]}`} {
+		r := httptest.NewRequest(http.MethodPost, "/asset/someID/tags", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		manageAsset(w, r)
+		if w.Result().StatusCode != http.StatusBadRequest {
+			t.Errorf("Incorrect status tagging with %s: %d", body, w.Result().StatusCode)
+		}
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/asset/someID/tags", nil)
+	w = httptest.NewRecorder()
+	manageAsset(w, r)
+	var response tagsResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil || len(response.Tags) != 1 || response.Tags[0] != "spring" {
+		t.Errorf("Incorrect tags listed: %+v", response)
+	}
+}
+
+func TestListAssetsByTag(t *testing.T) {
+	dbSvc = &mockDBTaggedClient{}
+	r := httptest.NewRequest(http.MethodGet, "/assets?tag=spring", nil)
+	w := httptest.NewRecorder()
+
+	listAssets(w, r)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Incorrect status listing by tag: %d", w.Result().StatusCode)
+	}
+	var response assetsResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Assets) != 1 || response.Assets[0].ID != "someID" || response.Cursor == "" {
+		t.Errorf("Incorrect assets listed: %+v", response)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/assets?tag=spring&cursor="+response.Cursor, nil)
+	w = httptest.NewRecorder()
+	listAssets(w, r)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Errorf("Incorrect status listing the next page: %d", w.Result().StatusCode)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/assets?tag=Not+A+Tag", nil)
+	w = httptest.NewRecorder()
+	listAssets(w, r)
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("Incorrect status listing by an invalid tag: %d", w.Result().StatusCode)
+	}
+}
+
+func TestPatchTagsAndFilename(t *testing.T) {
+	db := &mockDBTaggedClient{}
+	dbSvc = db
+	r := httptest.NewRequest(http.MethodPatch, "/asset/someID", strings.NewReader(`{"filename": "report.pdf", "tags": ["summer"]}`))
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusNoContent {
+		t.Fatalf("Incorrect status patching tags: %d", w.Result().StatusCode)
+	}
+	// replaces spring with summer alongside the filename
+	if len(db.transaction) != 3 || *db.transaction[1].Put.Item["id"].S != "tag:someID:summer" || *db.transaction[2].Delete.Key["id"].S != "tag:someID:spring" ||
+		!strings.Contains(*db.transaction[0].Update.UpdateExpression, "filename") {
+		t.Errorf("Incorrect patch transaction: %v", db.transaction)
+	}
+
+	for _, body := range []string{`{"id": "otherID"}`, `{"created_at": 0}`, `{"tags": ["Not A Tag"]}`, `{"filename": "a/b"}`} {
+		r := httptest.NewRequest(http.MethodPatch, "/asset/someID", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		manageAsset(w, r)
+		if w.Result().StatusCode != http.StatusBadRequest {
+			t.Errorf("Incorrect status patching with %s: %d", body, w.Result().StatusCode)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// the DynamoDB table holding tenant configuration
+var tenantsTableName string
+
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// how a customer's assets are stored and limited; assets live either under
+// a prefix of the shared bucket or in a dedicated bucket
+type tenant struct {
+	ID           string      `json:"id"`
+	Bucket       string      `json:"bucket,omitempty"`
+	Prefix       string      `json:"prefix,omitempty"`
+	KMSKeyID     string      `json:"kms_key_id,omitempty"`
+	Quota        tenantQuota `json:"quota"`
+	AllowedTypes []string    `json:"allowed_types,omitempty"`
+	Webhooks     []string    `json:"webhooks,omitempty"`
+	UpdatedAt    int64       `json:"updated_at"`
+}
+
+// zero means unlimited; crossing the warning percentage of either limit
+// is a soft threshold to be warned about before the limit is enforced
+type tenantQuota struct {
+	MaxAssets      int64 `json:"max_assets,omitempty"`
+	MaxBytes       int64 `json:"max_bytes,omitempty"`
+	WarningPercent int   `json:"warning_percent,omitempty"`
+}
+
+// checks a tenant configuration, normalizing its allowed types
+func validateTenant(t *tenant) error {
+	if !tenantIDPattern.MatchString(t.ID) {
+		return fmt.Errorf("id must be 1 to 63 lowercase letters, digits or dashes")
+	}
+	if (t.Bucket == "") == (t.Prefix == "") {
+		return fmt.Errorf("exactly one of bucket or prefix must be set")
+	}
+	if strings.HasPrefix(t.Prefix, "/") {
+		return fmt.Errorf("prefix must not start with a slash")
+	}
+	if t.Quota.MaxAssets < 0 || t.Quota.MaxBytes < 0 {
+		return fmt.Errorf("quotas must not be negative")
+	}
+	if t.Quota.WarningPercent < 0 || t.Quota.WarningPercent > 99 {
+		return fmt.Errorf("quota warning_percent must be from 1 to 99")
+	}
+	t.AllowedTypes = parseContentTypePatterns(strings.Join(t.AllowedTypes, ","))
+	for _, pattern := range t.AllowedTypes {
+		if pattern != "*" && strings.Count(pattern, "/") != 1 {
+			return fmt.Errorf("allowed type '%s' must look like type/subtype", pattern)
+		}
+	}
+	for _, hook := range t.Webhooks {
+		u, err := url.Parse(hook)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("webhook '%s' must be an https url", hook)
+		}
+	}
+	return nil
+}
+
+// creates or lists tenants
+func manageTenants(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+	if r.Method == http.MethodGet {
+		listTenants(r.Context(), w)
+		return
+	}
+	t, ok := decodeTenant(w, r, "")
+	if !ok {
+		return
+	}
+	if !saveTenant(r.Context(), w, t, "attribute_not_exists(id)") {
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, t)
+}
+
+// shows, replaces or removes a tenant's configuration
+func manageTenant(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet, http.MethodPut, http.MethodDelete) {
+		return
+	}
+	tenantID := strings.TrimPrefix(r.URL.Path, "/tenants/")
+	switch r.Method {
+	case http.MethodGet:
+		t, ok := fetchTenant(r.Context(), w, tenantID)
+		if !ok {
+			return
+		}
+		writeJSON(w, t)
+	case http.MethodPut:
+		t, ok := decodeTenant(w, r, tenantID)
+		if !ok {
+			return
+		}
+		if !saveTenant(r.Context(), w, t, "attribute_exists(id)") {
+			return
+		}
+		writeJSON(w, t)
+	case http.MethodDelete:
+		_, err := dbSvc.DeleteItemWithContext(r.Context(), &dynamodb.DeleteItemInput{
+			Key:                 assetKey(tenantID),
+			TableName:           aws.String(tenantsTableName),
+			ConditionExpression: aws.String("attribute_exists(id)"),
+		})
+		if err != nil {
+			if isConditionFailed(err) {
+				http.Error(w, fmt.Sprintf("Tenant '%s' not found.", tenantID), http.StatusNotFound)
+				return
+			}
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// reads and validates a tenant from the request body, taking the id from
+// the path when given one
+func decodeTenant(w http.ResponseWriter, r *http.Request, tenantID string) (*tenant, bool) {
+	var t tenant
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON payload: %s", err.Error()), http.StatusBadRequest)
+		return nil, false
+	}
+	if tenantID != "" {
+		t.ID = tenantID
+	}
+	if err := validateTenant(&t); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid tenant: %s.", err.Error()), http.StatusBadRequest)
+		return nil, false
+	}
+	t.UpdatedAt = time.Now().UnixNano() / int64(time.Millisecond)
+	return &t, true
+}
+
+// writes a tenant's configuration on the given condition, writing an error
+// and returning false if it fails
+func saveTenant(ctx context.Context, w http.ResponseWriter, t *tenant, condition string) bool {
+	item, err := dynamodbattribute.MarshalMap(t)
+	if err != nil {
+		writeError(w, err)
+		return false
+	}
+	_, err = dbSvc.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		Item:                item,
+		TableName:           aws.String(tenantsTableName),
+		ConditionExpression: aws.String(condition),
+	})
+	if err != nil {
+		if isConditionFailed(err) {
+			if condition == "attribute_not_exists(id)" {
+				http.Error(w, fmt.Sprintf("Tenant '%s' already exists.", t.ID), http.StatusConflict)
+			} else {
+				http.Error(w, fmt.Sprintf("Tenant '%s' not found.", t.ID), http.StatusNotFound)
+			}
+			return false
+		}
+		writeError(w, err)
+		return false
+	}
+	return true
+}
+
+// fetches a tenant's configuration, writing an error and returning false if
+// it can't be found
+func fetchTenant(ctx context.Context, w http.ResponseWriter, tenantID string) (*tenant, bool) {
+	result, err := dbSvc.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		Key:            assetKey(tenantID),
+		TableName:      aws.String(tenantsTableName),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		writeError(w, err)
+		return nil, false
+	}
+	if _, ok := result.Item["id"]; !ok {
+		http.Error(w, fmt.Sprintf("Tenant '%s' not found.", tenantID), http.StatusNotFound)
+		return nil, false
+	}
+	var t tenant
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &t); err != nil {
+		writeError(w, err)
+		return nil, false
+	}
+	return &t, true
+}
+
+// lists every tenant; there are few enough to scan
+func listTenants(ctx context.Context, w http.ResponseWriter) {
+	list := []tenant{}
+	var unmarshalErr error
+	err := dbSvc.ScanPagesWithContext(ctx, &dynamodb.ScanInput{TableName: aws.String(tenantsTableName)}, func(page *dynamodb.ScanOutput, last bool) bool {
+		var tenants []tenant
+		if unmarshalErr = dynamodbattribute.UnmarshalListOfMaps(page.Items, &tenants); unmarshalErr != nil {
+			return false
+		}
+		list = append(list, tenants...)
+		return true
+	})
+	if err == nil {
+		err = unmarshalErr
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, list)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// a tenants table holding a single tenant
+type mockDBTenantsClient struct {
+	mockDBClient
+}
+
+func (m *mockDBTenantsClient) ScanPages(input *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool) error {
+	fn(&dynamodb.ScanOutput{Items: []map[string]*dynamodb.AttributeValue{{
+		"id":     {S: aws.String("acme")},
+		"prefix": {S: aws.String("acme/")},
+	}}}, true)
+	return nil
+}
+func (m *mockDBTenantsClient) ScanPagesWithContext(ctx aws.Context, input *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool, opts ...request.Option) error {
+	return m.ScanPages(input, fn)
+}
+
+// rejects every conditional put
+type mockDBPutConditionFailedClient struct {
+	mockDBClient
+}
+
+func (m *mockDBPutConditionFailedClient) PutItem(*dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "condition failed", nil)
+}
+func (m *mockDBPutConditionFailedClient) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	return m.PutItem(input)
+}
+
+func TestValidateTenant(t *testing.T) {
+	valid := tenant{ID: "acme", Prefix: "acme/", AllowedTypes: []string{" Image/* ", "application/pdf"}}
+	if err := validateTenant(&valid); err != nil {
+		t.Errorf("Got error for a valid tenant: %s", err)
+	}
+	if valid.AllowedTypes[0] != "image/*" {
+		t.Errorf("Allowed types weren't normalized: %v", valid.AllowedTypes)
+	}
+
+	invalid := []tenant{
+		{ID: "Acme!", Prefix: "acme/"},
+		{ID: "acme"},
+		{ID: "acme", Prefix: "acme/", Bucket: "acme-assets"},
+		{ID: "acme", Prefix: "/acme"},
+		{ID: "acme", Bucket: "acme-assets", Quota: tenantQuota{MaxBytes: -1}},
+		{ID: "acme", Bucket: "acme-assets", Quota: tenantQuota{MaxBytes: 1000, WarningPercent: 100}},
+		{ID: "acme", Bucket: "acme-assets", AllowedTypes: []string{"image"}},
+		{ID: "acme", Bucket: "acme-assets", Webhooks: []string{"http://example.com/hook"}},
+	}
+	for _, tn := range invalid {
+		if err := validateTenant(&tn); err == nil {
+			t.Errorf("Got no error for invalid tenant %+v", tn)
+		}
+	}
+}
+func TestCreateTenant(t *testing.T) {
+	dbSvc = &mockDBClient{}
+	body := `{"id":"acme","bucket":"acme-assets","quota":{"max_bytes":1000},"webhooks":["https://example.com/hook"]}`
+	r := httptest.NewRequest(http.MethodPost, "/tenants", bytes.NewReader([]byte(body)))
+	w := httptest.NewRecorder()
+
+	manageTenants(w, r)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Incorrect status creating a tenant: %d", resp.StatusCode)
+	}
+	var created tenant
+	json.NewDecoder(resp.Body).Decode(&created)
+	if created.ID != "acme" || created.Quota.MaxBytes != 1000 || created.UpdatedAt == 0 {
+		t.Errorf("Incorrect tenant returned: %+v", created)
+	}
+
+	dbSvc = &mockDBPutConditionFailedClient{}
+	r = httptest.NewRequest(http.MethodPost, "/tenants", bytes.NewReader([]byte(body)))
+	w = httptest.NewRecorder()
+	manageTenants(w, r)
+	if w.Result().StatusCode != http.StatusConflict {
+		t.Errorf("Didn't get 409 creating an existing tenant: %d", w.Result().StatusCode)
+	}
+}
+func TestManageTenant(t *testing.T) {
+	dbSvc = &mockDBMissingKeyClient{}
+	r := httptest.NewRequest(http.MethodGet, "/tenants/acme", nil)
+	w := httptest.NewRecorder()
+	manageTenant(w, r)
+	if w.Result().StatusCode != http.StatusNotFound {
+		t.Errorf("Didn't get 404 for a missing tenant: %d", w.Result().StatusCode)
+	}
+
+	dbSvc = &mockDBPutConditionFailedClient{}
+	r = httptest.NewRequest(http.MethodPut, "/tenants/acme", bytes.NewReader([]byte(`{"prefix":"acme/"}`)))
+	w = httptest.NewRecorder()
+	manageTenant(w, r)
+	if w.Result().StatusCode != http.StatusNotFound {
+		t.Errorf("Didn't get 404 updating a missing tenant: %d", w.Result().StatusCode)
+	}
+}
+func TestListTenants(t *testing.T) {
+	dbSvc = &mockDBTenantsClient{}
+	r := httptest.NewRequest(http.MethodGet, "/tenants", nil)
+	w := httptest.NewRecorder()
+
+	manageTenants(w, r)
+	var list []tenant
+	json.NewDecoder(w.Result().Body).Decode(&list)
+	if len(list) != 1 || list[0].ID != "acme" || list[0].Prefix != "acme/" {
+		t.Errorf("Incorrect tenant list: %+v", list)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// kinds of token the service issues and checks
+const (
+	tokenDownload           = "download"
+	tokenUpload             = "upload"
+	tokenDeleteConfirmation = "delete_confirmation"
+	// tokens used within this long of expiring count as near expiry
+	nearExpiryWindow = time.Minute
+)
+
+// how far apart clocks may be, tolerated on every expiry and, for tokens
+// that carry one, on the time they become valid
+var clockSkew time.Duration
+
+// how long past its expiry, and the clock skew, a token is still accepted
+var tokenExpiryGrace time.Duration
+
+// counts since start for one kind of token
+type tokenCounts struct {
+	Accepted int64 `json:"accepted"`
+	// accepted with less than nearExpiryWindow left
+	NearExpiry int64 `json:"near_expiry"`
+	// accepted after expiring, within the clock skew and expiry grace
+	InGrace int64 `json:"in_grace"`
+	Expired int64 `json:"expired"`
+}
+
+type tokenStats struct {
+	ClockSkewSeconds   int64                   `json:"clock_skew_seconds"`
+	ExpiryGraceSeconds int64                   `json:"expiry_grace_seconds"`
+	Tokens             map[string]*tokenCounts `json:"tokens"`
+}
+
+var tokenUsage = map[string]*tokenCounts{
+	tokenDownload:           {},
+	tokenUpload:             {},
+	tokenDeleteConfirmation: {},
+	tokenJWT:                {},
+	tokenCompletion:         {},
+	tokenIAM:                {},
+}
+
+// the leeway given to a token past its expiry
+func tokenLeeway() time.Duration {
+	return clockSkew + tokenExpiryGrace
+}
+
+// tokens used at now are accepted if they expire, in unix seconds, after
+// this
+func tokenCutoff(now time.Time) int64 {
+	return now.Add(-tokenLeeway()).Unix()
+}
+
+// whether a token expiring at expiresAt, in unix seconds, can be used at
+// now, counting the use
+func checkTokenExpiry(kind string, expiresAt int64, now time.Time) bool {
+	if expiresAt <= tokenCutoff(now) {
+		noteTokenExpired(kind)
+		return false
+	}
+	noteTokenUse(kind, expiresAt, now)
+	return true
+}
+
+// counts an accepted token that expires, in unix seconds, at expiresAt
+func noteTokenUse(kind string, expiresAt int64, now time.Time) {
+	counts := tokenUsage[kind]
+	noteTokenAccepted(kind)
+	switch left := time.Unix(expiresAt, 0).Sub(now); {
+	case left <= 0:
+		atomic.AddInt64(&counts.InGrace, 1)
+	case left < nearExpiryWindow:
+		atomic.AddInt64(&counts.NearExpiry, 1)
+	}
+}
+
+// counts an accepted token whose expiry was checked by a conditional write,
+// and so isn't known
+func noteTokenAccepted(kind string) {
+	atomic.AddInt64(&tokenUsage[kind].Accepted, 1)
+}
+
+func noteTokenExpired(kind string) {
+	atomic.AddInt64(&tokenUsage[kind].Expired, 1)
+}
+
+// reports the clock skew and expiry grace with counts of tokens accepted,
+// near expiry or within grace, and refused for expiring
+func getTokenStats(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	stats := tokenStats{
+		ClockSkewSeconds:   int64(clockSkew / time.Second),
+		ExpiryGraceSeconds: int64(tokenExpiryGrace / time.Second),
+		Tokens:             map[string]*tokenCounts{},
+	}
+	for kind, counts := range tokenUsage {
+		stats.Tokens[kind] = &tokenCounts{
+			Accepted:   atomic.LoadInt64(&counts.Accepted),
+			NearExpiry: atomic.LoadInt64(&counts.NearExpiry),
+			InGrace:    atomic.LoadInt64(&counts.InGrace),
+			Expired:    atomic.LoadInt64(&counts.Expired),
+		}
+	}
+	writeJSON(w, stats)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// a download token that expired ten seconds ago, whose condition is checked
+// against the cutoff it's given as DynamoDB would
+type mockDBExpiredTokenClient struct {
+	mockDBClient
+}
+
+func (m *mockDBExpiredTokenClient) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	item := map[string]*dynamodb.AttributeValue{
+		"id":        {S: aws.String(downloadTokenKeyPrefix + "someToken")},
+		"asset_id":  {S: aws.String("someID")},
+		"remaining": {N: aws.String("1")},
+		"expires":   {N: aws.String(strconv.FormatInt(time.Now().Add(-10*time.Second).Unix(), 10))},
+	}
+	cutoff, _ := strconv.ParseInt(aws.StringValue(input.ExpressionAttributeValues[":cutoff"].N), 10, 64)
+	if numberAttribute(item, "expires") <= cutoff {
+		return nil, &dynamodb.ConditionalCheckFailedException{Message_: aws.String("The conditional request failed"), Item: item}
+	}
+	return &dynamodb.UpdateItemOutput{Attributes: item}, nil
+}
+func (m *mockDBExpiredTokenClient) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	return m.UpdateItem(input)
+}
+
+func TestCheckTokenExpiry(t *testing.T) {
+	defer func() { clockSkew, tokenExpiryGrace = 0, 0 }()
+	clockSkew, tokenExpiryGrace = 30*time.Second, 30*time.Second
+	now := time.Now()
+	before := *tokenUsage[tokenUpload]
+	for _, test := range []struct {
+		expiresIn time.Duration
+		ok        bool
+	}{
+		{time.Hour, true},
+		{30 * time.Second, true},
+		{-45 * time.Second, true},
+		{-2 * time.Minute, false},
+	} {
+		if ok := checkTokenExpiry(tokenUpload, now.Add(test.expiresIn).Unix(), now); ok != test.ok {
+			t.Errorf("Token expiring in %s accepted: %t", test.expiresIn, ok)
+		}
+	}
+	after := tokenUsage[tokenUpload]
+	if after.Accepted-before.Accepted != 3 || after.NearExpiry-before.NearExpiry != 1 ||
+		after.InGrace-before.InGrace != 1 || after.Expired-before.Expired != 1 {
+		t.Errorf("Incorrect token counts: %+v then %+v", before, *after)
+	}
+}
+
+func TestServeDownloadGrace(t *testing.T) {
+	defer func() { tokenExpiryGrace = 0 }()
+	dbSvc = &mockDBExpiredTokenClient{}
+	s3Svc = &mockS3Client{}
+	w := httptest.NewRecorder()
+	serveDownload(w, httptest.NewRequest(http.MethodGet, "/download/someToken", nil))
+	if w.Result().StatusCode != http.StatusGone {
+		t.Errorf("Didn't get 410 for an expired download token: %d", w.Result().StatusCode)
+	}
+
+	tokenExpiryGrace = time.Minute
+	w = httptest.NewRecorder()
+	serveDownload(w, httptest.NewRequest(http.MethodGet, "/download/someToken", nil))
+	if w.Result().StatusCode != http.StatusOK {
+		t.Errorf("Download token within its grace refused: %d", w.Result().StatusCode)
+	}
+
+	w = httptest.NewRecorder()
+	getTokenStats(w, httptest.NewRequest(http.MethodGet, "/tokens", nil))
+	var stats tokenStats
+	json.NewDecoder(w.Body).Decode(&stats)
+	if stats.ExpiryGraceSeconds != 60 || stats.Tokens[tokenDownload].InGrace == 0 || stats.Tokens[tokenDownload].Expired == 0 {
+		t.Errorf("Incorrect token stats: %+v %+v", stats, stats.Tokens[tokenDownload])
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	assetStatusDeleted = "deleted"
+	// deleted records are put in this partition of the sparse purge index
+	// until they're purged
+	purgeShard    = "all"
+	purgeInterval = time.Minute
+)
+
+// how long deleted assets can be restored for, zero to delete outright
+var deleteRetention = 7 * 24 * time.Hour
+
+// the DynamoDB index on purge_shard and purge_at
+var purgeIndexName string
+
+// marks an asset deleted if condition holds, keeping its object until it's
+// purged after the retention window; a failed condition comes back as the
+// DynamoDB error, carrying the record when there is one
+func trashAsset(ctx context.Context, assetID, condition string, values map[string]*dynamodb.AttributeValue) error {
+	values[":deleted"] = &dynamodb.AttributeValue{S: aws.String(assetStatusDeleted)}
+	values[":noStatus"] = &dynamodb.AttributeValue{S: aws.String("")}
+	values[":purgeAt"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(time.Now().Add(deleteRetention).Unix(), 10))}
+	values[":purgeShard"] = &dynamodb.AttributeValue{S: aws.String(purgeShard)}
+	values[":updated"] = updatedAtValue()
+	result, err := dbSvc.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		Key:       assetKey(assetID),
+		TableName: aws.String(tableName),
+		// the status is kept to restore, uploads that never finished having none
+		UpdateExpression: aws.String("SET deleted_status = if_not_exists(#status, :noStatus), #status = :deleted, " +
+			"purge_at = :purgeAt, purge_shard = :purgeShard, updated_at = :updated " +
+			"REMOVE delete_token, delete_token_expires, deletion_requested_at, approval_shard, deletion_reason"),
+		ConditionExpression:                 aws.String("attribute_exists(id) AND (attribute_not_exists(#status) OR #status <> :deleted) AND " + condition),
+		ExpressionAttributeNames:            map[string]*string{"#status": aws.String("status")},
+		ExpressionAttributeValues:           values,
+		ReturnValues:                        aws.String(dynamodb.ReturnValueAllNew),
+		ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValuesOnConditionCheckFailureAllOld),
+	})
+	if err != nil {
+		return err
+	}
+	publishEvent(eventDeleted, assetID, result.Attributes)
+	recordAssetEvent(nil, assetID, assetEventDeleted, nil)
+	return nil
+}
+
+func isDeleted(item map[string]*dynamodb.AttributeValue) bool {
+	return stringAttribute(item, "status") == assetStatusDeleted
+}
+
+// brings back a deleted asset that hasn't been purged yet
+func handleRestoreRequest(w http.ResponseWriter, r *http.Request, assetID string) {
+	values := lockConditionValues(r)
+	values[":deleted"] = &dynamodb.AttributeValue{S: aws.String(assetStatusDeleted)}
+	values[":updated"] = updatedAtValue()
+	_, err := dbSvc.UpdateItemWithContext(r.Context(), &dynamodb.UpdateItemInput{
+		Key:                                 assetKey(assetID),
+		TableName:                           aws.String(tableName),
+		UpdateExpression:                    aws.String("SET #status = deleted_status, updated_at = :updated REMOVE deleted_status, purge_at, purge_shard"),
+		ConditionExpression:                 aws.String("attribute_exists(id) AND #status = :deleted AND purge_at > :now AND " + lockCondition),
+		ExpressionAttributeNames:            map[string]*string{"#status": aws.String("status")},
+		ExpressionAttributeValues:           values,
+		ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValuesOnConditionCheckFailureAllOld),
+	})
+	if err != nil {
+		if isConditionFailed(err) {
+			item := conditionFailedItem(err)
+			switch {
+			case len(item) == 0 || isTombstone(item):
+				writeError(w, notFound(assetID))
+			case !isDeleted(item):
+				http.Error(w, fmt.Sprintf("Asset id '%s' isn't deleted.", assetID), http.StatusConflict)
+			case numberAttribute(item, "purge_at") <= time.Now().Unix():
+				http.Error(w, fmt.Sprintf("Asset id '%s' is being purged.", assetID), http.StatusGone)
+			default:
+				http.Error(w, fmt.Sprintf("Asset id '%s' is locked.", assetID), http.StatusLocked)
+			}
+			return
+		}
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// purges deleted assets until stopped
+func watchPurges(stop <-chan struct{}) {
+	for {
+		if err := purgeDeleted(); err != nil {
+			log.Println(err.Error())
+		}
+		if !pause(stop, purgeInterval) {
+			return
+		}
+	}
+}
+
+// removes every unpinned deleted asset past its retention window, with its
+// objects
+func purgeDeleted() error {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	var failed error
+	err := dbSvc.QueryPages(&dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		IndexName:              aws.String(purgeIndexName),
+		KeyConditionExpression: aws.String("purge_shard = :shard AND purge_at <= :now"),
+		FilterExpression:       aws.String(unpinnedCondition),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":shard": {S: aws.String(purgeShard)},
+			":now":   {N: aws.String(now)},
+			":false": {BOOL: aws.Bool(false)},
+		},
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			// skip assets restored or pinned since the query
+			err := removeAsset(context.Background(), stringAttribute(item, "id"), "purge_at <= :now AND "+unpinnedCondition, map[string]*dynamodb.AttributeValue{
+				":now":   {N: aws.String(now)},
+				":false": {BOOL: aws.Bool(false)},
+			})
+			if err != nil && !isConditionFailed(err) {
+				failed = err
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return failed
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// a deleted asset still within its retention window, which the purge index
+// reports as past it
+type mockDBDeletedClient struct {
+	mockDBClient
+	updates []string
+	purged  []string
+}
+
+func (m *mockDBDeletedClient) GetItem(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	output, _ := m.mockDBClient.GetItem(nil)
+	output.Item["status"] = &dynamodb.AttributeValue{S: aws.String(assetStatusDeleted)}
+	return output, nil
+}
+func (m *mockDBDeletedClient) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return m.GetItem(input)
+}
+
+func (m *mockDBDeletedClient) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	m.updates = append(m.updates, *input.UpdateExpression)
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+func (m *mockDBDeletedClient) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	return m.UpdateItem(input)
+}
+
+func (m *mockDBDeletedClient) QueryPages(input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool) error {
+	fn(&dynamodb.QueryOutput{Items: []map[string]*dynamodb.AttributeValue{{
+		"id":       {S: aws.String("someID")},
+		"purge_at": {N: aws.String("1500000000")},
+	}}}, true)
+	return nil
+}
+func (m *mockDBDeletedClient) QueryPagesWithContext(ctx aws.Context, input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool, opts ...request.Option) error {
+	return m.QueryPages(input, fn)
+}
+
+func (m *mockDBDeletedClient) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	m.purged = append(m.purged, *input.Item["id"].S)
+	return &dynamodb.PutItemOutput{}, nil
+}
+func (m *mockDBDeletedClient) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	return m.PutItem(input)
+}
+
+func TestSoftDeleteRequest(t *testing.T) {
+	db := &mockDBDeletedClient{}
+	dbSvc = db
+	s3 := &mockS3VersionsClient{}
+	s3Svc = s3
+	r := httptest.NewRequest(http.MethodDelete, "/asset/someID", nil)
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusNoContent {
+		t.Fatalf("Incorrect status deleting an asset: %d", w.Result().StatusCode)
+	}
+	if len(db.updates) != 1 || !strings.Contains(db.updates[0], "#status = :deleted") {
+		t.Errorf("Asset wasn't marked deleted: %v", db.updates)
+	}
+	if len(db.purged) > 0 || len(s3.deleted) > 0 {
+		t.Errorf("Asset removed before its retention ended: %v %v", db.purged, s3.deleted)
+	}
+}
+func TestDeletedAssetHidden(t *testing.T) {
+	dbSvc = &mockDBDeletedClient{}
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodGet, "/asset/someID", nil)
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusNotFound {
+		t.Errorf("Didn't get 404 for a deleted asset: %d", w.Result().StatusCode)
+	}
+}
+func TestRestoreRequest(t *testing.T) {
+	dbSvc = &mockDBClient{}
+	r := httptest.NewRequest(http.MethodPost, "/asset/someID/restore", nil)
+	w := httptest.NewRecorder()
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusNoContent {
+		t.Errorf("Incorrect status restoring an asset: %d", w.Result().StatusCode)
+	}
+
+	purgeAt := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+	cases := []struct {
+		item   map[string]*dynamodb.AttributeValue
+		status int
+	}{
+		{nil, http.StatusNotFound},
+		{map[string]*dynamodb.AttributeValue{"id": {S: aws.String("someID")}, "status": {S: aws.String(assetStatusUploaded)}}, http.StatusConflict},
+		{map[string]*dynamodb.AttributeValue{"id": {S: aws.String("someID")}, "status": {S: aws.String(assetStatusDeleted)}, "purge_at": {N: aws.String(purgeAt)}}, http.StatusGone},
+	}
+	for _, c := range cases {
+		dbSvc = &mockDBDeleteConflictClient{item: c.item}
+		r := httptest.NewRequest(http.MethodPost, "/asset/someID/restore", nil)
+		w := httptest.NewRecorder()
+		manageAsset(w, r)
+		if w.Result().StatusCode != c.status {
+			t.Errorf("Expected %d restoring %v, got %d", c.status, c.item, w.Result().StatusCode)
+		}
+	}
+}
+func TestPurgeDeleted(t *testing.T) {
+	db := &mockDBDeletedClient{}
+	dbSvc = db
+	s3Svc = &mockS3Client{}
+	if err := purgeDeleted(); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.purged) != 1 || db.purged[0] != "someID" {
+		t.Errorf("Deleted asset wasn't purged: %v", db.purged)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	// folders share the assets table under this key prefix
+	folderKeyPrefix = "folder:"
+	maxPathLength   = 1024
+	maxPathDepth    = 32
+	defaultTreePage = 100
+	maxTreePage     = 1000
+	treeEntryFolder = "folder"
+	treeEntryAsset  = "asset"
+)
+
+// the DynamoDB index on folder and path
+var treeIndexName string
+
+type treeEntry struct {
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	Type   string `json:"type"`
+	ID     string `json:"id,omitempty"`
+	Status string `json:"status,omitempty"`
+}
+
+type treeResponse struct {
+	Path    string      `json:"path"`
+	Entries []treeEntry `json:"entries"`
+	Cursor  string      `json:"cursor,omitempty"`
+}
+
+// position in a folder listing, handed to clients as an opaque cursor
+type treeCursor struct {
+	ID   string `json:"i"`
+	Path string `json:"p"`
+}
+
+// checks a slash separated logical path and returns it in canonical form,
+// with a leading slash and no empty, . or .. segments
+func normalizePath(value string) (string, error) {
+	if len(value) > maxPathLength {
+		return "", fmt.Errorf("path is too long")
+	}
+	segments := []string{}
+	for _, segment := range strings.Split(value, "/") {
+		switch segment {
+		case "", ".":
+			continue
+		case "..":
+			return "", fmt.Errorf("path can't contain .. segments")
+		}
+		for _, c := range segment {
+			if c < ' ' || c == 0x7f || c == '\\' {
+				return "", fmt.Errorf("path contains control characters or backslashes")
+			}
+		}
+		segments = append(segments, segment)
+	}
+	if len(segments) == 0 {
+		return "", fmt.Errorf("path must name a file")
+	}
+	if len(segments) > maxPathDepth {
+		return "", fmt.Errorf("path is nested too deeply")
+	}
+	return "/" + strings.Join(segments, "/"), nil
+}
+
+// record attributes placing an asset at a path in the tree
+func pathAttributes(assetPath string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"path":   {S: aws.String(assetPath)},
+		"folder": {S: aws.String(path.Dir(assetPath))},
+	}
+}
+
+// records every folder above a path so each shows up in its parent
+func createFolders(ctx context.Context, assetPath string) error {
+	for dir := path.Dir(assetPath); dir != "/"; dir = path.Dir(dir) {
+		item := pathAttributes(dir)
+		item["id"] = &dynamodb.AttributeValue{S: aws.String(folderKeyPrefix + dir)}
+		_, err := dbSvc.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+			Item:      item,
+			TableName: aws.String(tableName),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lists the folders and assets directly inside a folder, in path order
+func listTree(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	folder := "/"
+	if value := r.URL.Query().Get("path"); value != "" && value != "/" {
+		var err error
+		folder, err = normalizePath(value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid argument for path: %s.", err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+	limit := defaultTreePage
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > maxTreePage {
+			http.Error(w, "Invalid argument for limit.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	query := &dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		IndexName:              aws.String(treeIndexName),
+		KeyConditionExpression: aws.String("folder = :folder"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":folder": {S: aws.String(folder)},
+		},
+		Limit: aws.Int64(int64(limit)),
+	}
+	if value := r.URL.Query().Get("cursor"); value != "" {
+		var cursor treeCursor
+		b, err := base64.RawURLEncoding.DecodeString(value)
+		if err == nil {
+			err = json.Unmarshal(b, &cursor)
+		}
+		if err != nil {
+			http.Error(w, "Invalid argument for cursor.", http.StatusBadRequest)
+			return
+		}
+		query.ExclusiveStartKey = map[string]*dynamodb.AttributeValue{
+			"id":     {S: aws.String(cursor.ID)},
+			"folder": {S: aws.String(folder)},
+			"path":   {S: aws.String(cursor.Path)},
+		}
+	}
+
+	result, err := dbSvc.QueryWithContext(r.Context(), query)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	resp := treeResponse{Path: folder, Entries: []treeEntry{}}
+	for _, item := range result.Items {
+		entry := treeEntry{
+			Path: stringAttribute(item, "path"),
+			Type: treeEntryAsset,
+		}
+		entry.Name = path.Base(entry.Path)
+		if id := stringAttribute(item, "id"); strings.HasPrefix(id, folderKeyPrefix) {
+			entry.Type = treeEntryFolder
+		} else {
+			entry.ID = id
+			entry.Status = stringAttribute(item, "status")
+		}
+		resp.Entries = append(resp.Entries, entry)
+	}
+	if last := result.LastEvaluatedKey; last != nil {
+		b, _ := json.Marshal(treeCursor{ID: stringAttribute(last, "id"), Path: stringAttribute(last, "path")})
+		resp.Cursor = base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	writeJSON(w, resp)
+}
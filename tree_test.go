@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// a folder holding one subfolder and one asset
+type mockDBTreeClient struct {
+	mockDBClient
+}
+
+func (m *mockDBTreeClient) Query(*dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	return &dynamodb.QueryOutput{
+		Items: []map[string]*dynamodb.AttributeValue{
+			{
+				"id":     {S: aws.String("folder:/projects/42/specs")},
+				"path":   {S: aws.String("/projects/42/specs")},
+				"folder": {S: aws.String("/projects/42")},
+			},
+			{
+				"id":     {S: aws.String("someID")},
+				"path":   {S: aws.String("/projects/42/design.pdf")},
+				"folder": {S: aws.String("/projects/42")},
+				"status": {S: aws.String(assetStatusUploaded)},
+			},
+		},
+		LastEvaluatedKey: map[string]*dynamodb.AttributeValue{
+			"id":     {S: aws.String("someID")},
+			"path":   {S: aws.String("/projects/42/design.pdf")},
+			"folder": {S: aws.String("/projects/42")},
+		},
+	}, nil
+}
+func (m *mockDBTreeClient) QueryWithContext(ctx aws.Context, input *dynamodb.QueryInput, opts ...request.Option) (*dynamodb.QueryOutput, error) {
+	return m.Query(input)
+}
+
+func TestNormalizePath(t *testing.T) {
+	cases := map[string]string{
+		"projects/42/specs/design.pdf": "/projects/42/specs/design.pdf",
+		"/a//b/./c.txt":                "/a/b/c.txt",
+		"x":                            "/x",
+	}
+	for value, expected := range cases {
+		if actual, err := normalizePath(value); err != nil || actual != expected {
+			t.Errorf("Got %s, %v normalizing %s, expected %s", actual, err, value, expected)
+		}
+	}
+	for _, value := range []string{"", "/", "a/../b", "a\\b", "a/\x00"} {
+		if _, err := normalizePath(value); err == nil {
+			t.Errorf("Got no error for path %q", value)
+		}
+	}
+}
+func TestInitAssetPath(t *testing.T) {
+	db := &mockDBPutRecordingClient{}
+	dbSvc = db
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodPost, "/asset?path=projects/42/design.pdf", nil)
+	w := httptest.NewRecorder()
+
+	initAsset(w, r)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Incorrect status on asset init with a path: %d", w.Result().StatusCode)
+	}
+	if stringAttribute(db.item, "path") != "/projects/42/design.pdf" || stringAttribute(db.item, "folder") != "/projects/42" {
+		t.Errorf("Path not recorded on asset: %v", db.item)
+	}
+}
+func TestListTree(t *testing.T) {
+	dbSvc = &mockDBTreeClient{}
+	r := httptest.NewRequest(http.MethodGet, "/tree?path=projects/42", nil)
+	w := httptest.NewRecorder()
+
+	listTree(w, r)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Incorrect status listing tree: %d", resp.StatusCode)
+	}
+	jsonResp := treeResponse{}
+	json.NewDecoder(resp.Body).Decode(&jsonResp)
+	if jsonResp.Path != "/projects/42" || len(jsonResp.Entries) != 2 || jsonResp.Cursor == "" {
+		t.Fatalf("Incorrect tree listing: %+v", jsonResp)
+	}
+	if e := jsonResp.Entries[0]; e.Type != treeEntryFolder || e.Name != "specs" || e.ID != "" {
+		t.Errorf("Incorrect folder entry: %+v", e)
+	}
+	if e := jsonResp.Entries[1]; e.Type != treeEntryAsset || e.Name != "design.pdf" || e.ID != "someID" {
+		t.Errorf("Incorrect asset entry: %+v", e)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/tree?cursor="+jsonResp.Cursor, nil)
+	w = httptest.NewRecorder()
+	listTree(w, r)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Errorf("Incorrect status listing tree from a cursor: %d", w.Result().StatusCode)
+	}
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// resumable uploads following the tus.io 1.0 protocol, with the creation
+// and termination extensions; bytes are streamed into an S3 multipart
+// upload, holding back anything short of a full part as a tail object
+const (
+	tusVersion     = "1.0.0"
+	tusExtensions  = "creation,termination"
+	tusContentType = "application/offset+octet-stream"
+	// S3 requires every part but the last to be at least 5MB
+	tusPartSize = 5 << 20
+	// S3's maximum object size
+	tusMaxSize = 5 << 40
+)
+
+// progress of a tus upload as stored on the asset record
+type tusState struct {
+	// where the asset's object goes
+	key      string
+	uploadID string
+	offset   int64
+	length   int64
+	parts    int64
+	tail     int64
+}
+
+func tusTailKey(key string) string {
+	return key + ".tus-tail"
+}
+
+// parses a tus Upload-Metadata header of comma separated "key base64value" pairs
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	size := 0
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.Fields(pair)
+		if len(parts) == 0 {
+			continue
+		}
+		value := []byte{}
+		if len(parts) > 1 {
+			var err error
+			value, err = base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for %s", parts[0])
+			}
+		}
+		key := strings.ToLower(parts[0])
+		metadata[key] = string(value)
+		size += len(key) + len(value)
+	}
+	if size > maxMetadataSize {
+		return nil, fmt.Errorf("metadata exceeds the 2KB limit")
+	}
+	return metadata, nil
+}
+
+// checks the protocol version and advertises the server's, writing an
+// error and returning false for unsupported clients
+func checkTusResumable(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Method != http.MethodOptions && r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version.", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// creates a resumable upload, or describes the server's tus support
+func tusCreate(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodPost, http.MethodOptions) || !checkTusResumable(w, r) {
+		return
+	}
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(tusMaxSize, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Invalid Upload-Length header.", http.StatusBadRequest)
+		return
+	}
+	if length > tusMaxSize {
+		http.Error(w, "Upload-Length exceeds the maximum size.", http.StatusRequestEntityTooLarge)
+		return
+	}
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid Upload-Metadata header: %s.", err.Error()), http.StatusBadRequest)
+		return
+	}
+	// resumable uploads are reaped like any other if never finished
+	attributes := reservationAttributes(maxUploadTimeout)
+	if len(metadata) > 0 {
+		attributes["metadata"] = metadataAttribute(metadata)
+	}
+	// tus clients conventionally send the file's name as metadata
+	if filename := metadata["filename"]; filename != "" && validateFilename(filename) == nil {
+		attributes["filename"] = &dynamodb.AttributeValue{S: aws.String(filename)}
+	}
+	if locale, err := normalizeLocale(metadata["locale"]); err == nil {
+		attributes["locale"] = &dynamodb.AttributeValue{S: aws.String(locale)}
+	}
+	// every PATCH must carry it back
+	completionToken, tokenAttributes := newCompletionToken(maxUploadTimeout)
+	for k, v := range tokenAttributes {
+		attributes[k] = v
+	}
+
+	assetID, err := reserveUniqueID(r.Context(), attributes)
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	recordAssetEvent(r, assetID, assetEventCreated, nil)
+	// the asset is reserved, so its upload is set up even past the deadline
+	ctx := context.WithoutCancel(r.Context())
+	created, err := s3Svc.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:                  aws.String(bucketName),
+		Key:                     aws.String(objectKey(assetID, attributes)),
+		Metadata:                aws.StringMap(metadata),
+		ServerSideEncryption:    encryptionAlgorithm(),
+		SSEKMSKeyId:             optionalString(kmsKeyID),
+		SSEKMSEncryptionContext: encryptionContextHeader(assetID),
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	_, err = dbSvc.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		Key:              assetKey(assetID),
+		TableName:        aws.String(tableName),
+		UpdateExpression: aws.String("SET upload_id = :uploadID, tus_offset = :zero, tus_length = :length, tus_parts = :zero, tus_tail = :zero"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":uploadID": {S: created.UploadId},
+			":zero":     {N: aws.String("0")},
+			":length":   {N: aws.String(strconv.FormatInt(length, 10))},
+		},
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", basePath+"/tus/"+assetID)
+	if completionToken != "" {
+		w.Header().Set(completionTokenHeader, completionToken)
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// reports, appends to, or terminates a resumable upload
+func tusManage(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodHead, http.MethodPatch, http.MethodDelete, http.MethodOptions) || !checkTusResumable(w, r) {
+		return
+	}
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	assetID := strings.TrimPrefix(r.URL.Path, "/tus/")
+	state, ok := fetchTusState(w, r, assetID)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		w.Header().Set("Upload-Offset", strconv.FormatInt(state.offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(state.length, 10))
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPatch:
+		if _, ok := requestCompletionToken(w, r); ok {
+			tusAppend(w, r, assetID, state)
+		}
+	case http.MethodDelete:
+		tusTerminate(w, r, assetID, state)
+	}
+}
+
+// loads the state of a resumable upload, writing an error and returning
+// false if the asset has none in progress, or is locked by someone else
+// when the request would change it
+func fetchTusState(w http.ResponseWriter, r *http.Request, assetID string) (tusState, bool) {
+	query := &dynamodb.GetItemInput{
+		Key:            assetKey(assetID),
+		TableName:      aws.String(tableName),
+		ConsistentRead: aws.Bool(true),
+	}
+	result, err := dbSvc.GetItemWithContext(r.Context(), query)
+	if err != nil {
+		writeError(w, err)
+		return tusState{}, false
+	}
+	state := tusState{
+		key:      objectKey(assetID, result.Item),
+		uploadID: stringAttribute(result.Item, "upload_id"),
+		offset:   numberAttribute(result.Item, "tus_offset"),
+		length:   numberAttribute(result.Item, "tus_length"),
+		parts:    numberAttribute(result.Item, "tus_parts"),
+		tail:     numberAttribute(result.Item, "tus_tail"),
+	}
+	if _, ok := result.Item["tus_length"]; !ok || state.uploadID == "" {
+		http.Error(w, fmt.Sprintf("Resumable upload '%s' not found.", assetID), http.StatusNotFound)
+		return tusState{}, false
+	}
+	if r.Method != http.MethodHead && lockedByOther(r, result.Item) {
+		http.Error(w, fmt.Sprintf("Asset id '%s' is locked.", assetID), http.StatusLocked)
+		return tusState{}, false
+	}
+	// refused before any bytes are taken; finishing checks it again
+	if r.Method == http.MethodPatch && requireCompletionToken && r.Header.Get(completionTokenHeader) != stringAttribute(result.Item, "completion_token") {
+		http.Error(w, "Invalid or expired completion token.", http.StatusForbidden)
+		return tusState{}, false
+	}
+	return state, true
+}
+
+// streams the request body into the upload starting at the client's offset
+func tusAppend(w http.ResponseWriter, r *http.Request, assetID string, state tusState) {
+	if r.Header.Get("Content-Type") != tusContentType {
+		http.Error(w, fmt.Sprintf("Content-Type must be %s.", tusContentType), http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid Upload-Offset header.", http.StatusBadRequest)
+		return
+	}
+	if offset != state.offset {
+		http.Error(w, fmt.Sprintf("Upload-Offset does not match the current offset %d.", state.offset), http.StatusConflict)
+		return
+	}
+
+	// pick up the bytes held back from the previous request, only as many
+	// as were recorded in case a request that failed to record its own
+	// overwrote the tail
+	buf := &bytes.Buffer{}
+	if state.tail > 0 {
+		tail, err := s3Svc.GetObjectWithContext(r.Context(), &s3.GetObjectInput{
+			Bucket: aws.String(bucketName),
+			Key:    aws.String(tusTailKey(state.key)),
+		})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		_, err = io.CopyN(buf, tail.Body, state.tail)
+		tail.Body.Close()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	body := io.LimitReader(r.Body, state.length-state.offset)
+	next := state
+	// progress is saved for whatever made it to S3, even past the deadline,
+	// so the offset never falls behind the tail and parts stored
+	saved := context.WithoutCancel(r.Context())
+	for {
+		n, readErr := io.CopyN(buf, body, int64(tusPartSize-buf.Len()))
+		next.offset += n
+		finished := next.offset == state.length
+		if buf.Len() < tusPartSize && !finished {
+			// hold back a partial part until more data arrives
+			if readErr == nil {
+				continue
+			}
+			if buf.Len() > 0 {
+				_, err = s3Svc.PutObjectWithContext(r.Context(), &s3.PutObjectInput{
+					Bucket:                  aws.String(bucketName),
+					Key:                     aws.String(tusTailKey(state.key)),
+					Body:                    bytes.NewReader(buf.Bytes()),
+					ServerSideEncryption:    encryptionAlgorithm(),
+					SSEKMSKeyId:             optionalString(kmsKeyID),
+					SSEKMSEncryptionContext: encryptionContextHeader(assetID),
+				})
+				if err != nil {
+					writeError(w, err)
+					return
+				}
+			}
+			next.tail = int64(buf.Len())
+			if err = saveTusProgress(saved, r, assetID, state.offset, next); err != nil {
+				writeError(w, err)
+				return
+			}
+			if readErr != io.EOF {
+				log.Println(readErr.Error())
+			}
+			break
+		}
+
+		next.parts++
+		_, err = s3Svc.UploadPartWithContext(r.Context(), &s3.UploadPartInput{
+			Bucket:     aws.String(bucketName),
+			Key:        aws.String(state.key),
+			UploadId:   aws.String(state.uploadID),
+			PartNumber: aws.Int64(next.parts),
+			Body:       bytes.NewReader(buf.Bytes()),
+		})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		buf.Reset()
+		next.tail = 0
+		if finished {
+			if !finishTusUpload(w, r.WithContext(saved), assetID, state.offset, next) {
+				return
+			}
+			break
+		}
+		if err = saveTusProgress(saved, r, assetID, state.offset, next); err != nil {
+			writeError(w, err)
+			return
+		}
+		state.offset = next.offset
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(next.offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// records upload progress, on condition no other request moved it first
+// and the asset isn't locked by someone else
+func saveTusProgress(ctx context.Context, r *http.Request, assetID string, prevOffset int64, state tusState) error {
+	values := lockConditionValues(r)
+	values[":offset"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(state.offset, 10))}
+	values[":parts"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(state.parts, 10))}
+	values[":tail"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(state.tail, 10))}
+	values[":prevOffset"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(prevOffset, 10))}
+	_, err := dbSvc.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		Key:                       assetKey(assetID),
+		TableName:                 aws.String(tableName),
+		UpdateExpression:          aws.String("SET tus_offset = :offset, tus_parts = :parts, tus_tail = :tail"),
+		ConditionExpression:       aws.String("tus_offset = :prevOffset AND " + lockCondition),
+		ExpressionAttributeValues: values,
+	})
+	return err
+}
+
+// assembles the object once every byte has arrived, ends the resumable
+// upload and marks the asset uploaded like any other, writing an error and
+// returning false if that fails or validation rejects it
+func finishTusUpload(w http.ResponseWriter, r *http.Request, assetID string, prevOffset int64, state tusState) bool {
+	parts, err := listUploadedParts(r.Context(), state.key, state.uploadID)
+	if err != nil {
+		writeError(w, err)
+		return false
+	}
+	_, err = s3Svc.CompleteMultipartUploadWithContext(r.Context(), &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucketName),
+		Key:             aws.String(state.key),
+		UploadId:        aws.String(state.uploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		writeError(w, err)
+		return false
+	}
+	s3Svc.DeleteObjectWithContext(r.Context(), &s3.DeleteObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(tusTailKey(state.key)),
+	})
+
+	// the upload is no longer resumable, even if marking it fails and it
+	// has to be marked uploaded by id
+	values := lockConditionValues(r)
+	values[":offset"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(state.offset, 10))}
+	values[":prevOffset"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(prevOffset, 10))}
+	_, err = dbSvc.UpdateItemWithContext(r.Context(), &dynamodb.UpdateItemInput{
+		Key:                       assetKey(assetID),
+		TableName:                 aws.String(tableName),
+		UpdateExpression:          aws.String("SET tus_offset = :offset REMOVE upload_id, tus_parts, tus_tail"),
+		ConditionExpression:       aws.String("tus_offset = :prevOffset AND " + lockCondition),
+		ExpressionAttributeValues: values,
+	})
+	if err != nil {
+		writeError(w, err)
+		return false
+	}
+	return markUploaded(w, r, assetID, state.key, r.Header.Get(completionTokenHeader), nil)
+}
+
+// discards a resumable upload along with its asset
+func tusTerminate(w http.ResponseWriter, r *http.Request, assetID string, state tusState) {
+	_, err := s3Svc.AbortMultipartUploadWithContext(r.Context(), &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(bucketName),
+		Key:      aws.String(state.key),
+		UploadId: aws.String(state.uploadID),
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	// the upload is gone, so the asset goes too even past the deadline
+	ctx := context.WithoutCancel(r.Context())
+	s3Svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(tusTailKey(state.key)),
+	})
+	err = deleteAsset(ctx, assetID)
+	if err == errAssetPinned {
+		http.Error(w, fmt.Sprintf("Asset id '%s' is pinned.", assetID), http.StatusConflict)
+		return
+	}
+	if err == errAssetLocked {
+		http.Error(w, fmt.Sprintf("Asset id '%s' is locked.", assetID), http.StatusLocked)
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// a resumable upload of 20 bytes with 12 already received and held back
+type mockDBTusClient struct {
+	mockDBClient
+}
+
+func (m *mockDBTusClient) GetItem(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{
+		Item: map[string]*dynamodb.AttributeValue{
+			"id":         {S: aws.String("someID")},
+			"upload_id":  {S: aws.String("someUploadID")},
+			"tus_offset": {N: aws.String("12")},
+			"tus_length": {N: aws.String("20")},
+			"tus_parts":  {N: aws.String("0")},
+			"tus_tail":   {N: aws.String("12")},
+		},
+	}, nil
+}
+func (m *mockDBTusClient) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return m.GetItem(input)
+}
+
+func TestParseTusMetadata(t *testing.T) {
+	metadata, err := parseTusMetadata("filename d29ybGRfZG9taW5hdGlvbl9wbGFuLnBkZg==,is_confidential")
+	if err != nil {
+		t.Fatalf("Got error parsing valid metadata: %s", err)
+	}
+	if metadata["filename"] != "world_domination_plan.pdf" || metadata["is_confidential"] != "" {
+		t.Errorf("Unexpected metadata parsed: %v", metadata)
+	}
+	if _, err := parseTusMetadata("filename !!!"); err == nil {
+		t.Error("Got no error for metadata that isn't base64")
+	}
+}
+func TestTusOptions(t *testing.T) {
+	r := httptest.NewRequest(http.MethodOptions, "/tus", nil)
+	w := httptest.NewRecorder()
+
+	tusCreate(w, r)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Tus-Version") != tusVersion {
+		t.Errorf("Unexpected tus discovery response: %d %v", resp.StatusCode, resp.Header)
+	}
+}
+func TestTusCreate(t *testing.T) {
+	dbSvc = &mockDBClient{}
+	s3Svc = &mockS3Client{}
+	r := httptest.NewRequest(http.MethodPost, "/tus", nil)
+	r.Header.Set("Tus-Resumable", tusVersion)
+	r.Header.Set("Upload-Length", "20")
+	w := httptest.NewRecorder()
+
+	tusCreate(w, r)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Location") == "" {
+		t.Errorf("Failed to create resumable upload: %d", resp.StatusCode)
+	}
+
+	r.Header.Set("Tus-Resumable", "0.2.2")
+	w = httptest.NewRecorder()
+	tusCreate(w, r)
+	if w.Result().StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("Didn't get 412 for an unsupported tus version: %d", w.Result().StatusCode)
+	}
+}
+func TestTusHead(t *testing.T) {
+	dbSvc = &mockDBTusClient{}
+	r := httptest.NewRequest(http.MethodHead, "/tus/someID", nil)
+	r.Header.Set("Tus-Resumable", tusVersion)
+	w := httptest.NewRecorder()
+
+	tusManage(w, r)
+	resp := w.Result()
+	if resp.Header.Get("Upload-Offset") != "12" || resp.Header.Get("Upload-Length") != "20" {
+		t.Errorf("Unexpected tus offset headers: %v", resp.Header)
+	}
+}
+func TestTusPatch(t *testing.T) {
+	dbSvc = &mockDBTusClient{}
+	s3Svc = &mockS3Client{}
+	patch := func(offset int, body string) *http.Response {
+		r := httptest.NewRequest(http.MethodPatch, "/tus/someID", bytes.NewReader([]byte(body)))
+		r.Header.Set("Tus-Resumable", tusVersion)
+		r.Header.Set("Content-Type", tusContentType)
+		r.Header.Set("Upload-Offset", strconv.Itoa(offset))
+		w := httptest.NewRecorder()
+		tusManage(w, r)
+		return w.Result()
+	}
+
+	resp := patch(12, "1234")
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Upload-Offset") != "16" {
+		t.Errorf("Unexpected response to partial patch: %d offset %s", resp.StatusCode, resp.Header.Get("Upload-Offset"))
+	}
+	resp = patch(12, "12345678")
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Upload-Offset") != "20" {
+		t.Errorf("Unexpected response to final patch: %d offset %s", resp.StatusCode, resp.Header.Get("Upload-Offset"))
+	}
+	resp = patch(4, "1234")
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Didn't get 409 for a mismatched offset: %d", resp.StatusCode)
+	}
+}
+func TestTusNotFound(t *testing.T) {
+	dbSvc = &mockDBClient{}
+	r := httptest.NewRequest(http.MethodHead, "/tus/someID", nil)
+	r.Header.Set("Tus-Resumable", tusVersion)
+	w := httptest.NewRecorder()
+
+	tusManage(w, r)
+	if w.Result().StatusCode != http.StatusNotFound {
+		t.Errorf("Didn't get 404 for an asset without a resumable upload: %d", w.Result().StatusCode)
+	}
+}
+
+// the same upload of an asset initialized in a folder, and locked when
+// lockedBy is set; records the updates made
+type mockDBTusFolderClient struct {
+	mockDBTusClient
+	lockedBy string
+	updates  []*dynamodb.UpdateItemInput
+}
+
+func (m *mockDBTusFolderClient) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	output, _ := m.mockDBTusClient.GetItem(input)
+	output.Item["key_prefix"] = &dynamodb.AttributeValue{S: aws.String("folder/")}
+	if m.lockedBy != "" {
+		output.Item["lock_token"] = &dynamodb.AttributeValue{S: aws.String(m.lockedBy)}
+		output.Item["lock_expires"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10))}
+	}
+	return output, nil
+}
+func (m *mockDBTusFolderClient) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return m.GetItem(input)
+}
+func (m *mockDBTusFolderClient) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	m.updates = append(m.updates, input)
+	return m.mockDBTusClient.UpdateItem(input)
+}
+func (m *mockDBTusFolderClient) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	return m.UpdateItem(input)
+}
+
+// records the key a multipart upload is completed at
+type mockS3TusClient struct {
+	mockS3Client
+	completed string
+}
+
+func (m *mockS3TusClient) CompleteMultipartUpload(input *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+	m.completed = aws.StringValue(input.Key)
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+func (m *mockS3TusClient) CompleteMultipartUploadWithContext(ctx aws.Context, input *s3.CompleteMultipartUploadInput, opts ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+	return m.CompleteMultipartUpload(input)
+}
+
+func TestTusPatchFinish(t *testing.T) {
+	db := &mockDBTusFolderClient{}
+	mock := &mockS3TusClient{}
+	dbSvc, s3Svc = db, mock
+	r := httptest.NewRequest(http.MethodPatch, "/tus/someID", bytes.NewReader([]byte("12345678")))
+	r.Header.Set("Tus-Resumable", tusVersion)
+	r.Header.Set("Content-Type", tusContentType)
+	r.Header.Set("Upload-Offset", "12")
+	w := httptest.NewRecorder()
+	tusManage(w, r)
+	if w.Code != http.StatusNoContent || w.Header().Get(consistencyTokenHeader) == "" {
+		t.Fatalf("Incorrect answer to the final patch: %d %v", w.Code, w.Header())
+	}
+	if mock.completed != "folder/someID" {
+		t.Errorf("Upload completed at the wrong key: %s", mock.completed)
+	}
+	// the upload is ended, then marked uploaded as any other is
+	if len(db.updates) != 2 || !strings.Contains(aws.StringValue(db.updates[0].UpdateExpression), "REMOVE upload_id") ||
+		aws.StringValue(db.updates[1].ExpressionAttributeValues[":status"].S) != assetStatusUploaded ||
+		!strings.Contains(aws.StringValue(db.updates[1].ConditionExpression), lockCondition) {
+		t.Errorf("Incorrect updates finishing the upload: %v", db.updates)
+	}
+
+	db = &mockDBTusFolderClient{lockedBy: "someone-else"}
+	dbSvc = db
+	for _, method := range []string{http.MethodPatch, http.MethodDelete} {
+		r = httptest.NewRequest(method, "/tus/someID", bytes.NewReader([]byte("1234")))
+		r.Header.Set("Tus-Resumable", tusVersion)
+		r.Header.Set("Content-Type", tusContentType)
+		r.Header.Set("Upload-Offset", "12")
+		w = httptest.NewRecorder()
+		tusManage(w, r)
+		if w.Code != http.StatusLocked || len(db.updates) != 0 {
+			t.Errorf("Didn't get 423 for %s of a locked upload: %d", method, w.Code)
+		}
+	}
+}
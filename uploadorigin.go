@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const maxUploadNetworks = 10
+
+// whether the client address is taken from the last X-Forwarded-For entry,
+// as added by a load balancer in front of the service
+var trustForwardedFor bool
+
+// parses comma separated CIDR ranges or addresses uploads must come from
+func parseUploadNetworks(value string) ([]string, error) {
+	var networks []string
+	seen := map[string]bool{}
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			ip := net.ParseIP(part)
+			if ip == nil {
+				return nil, fmt.Errorf("'%s' isn't an address or CIDR range", part)
+			}
+			if ip.To4() != nil {
+				part += "/32"
+			} else {
+				part += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' isn't an address or CIDR range", part)
+		}
+		if !seen[network.String()] {
+			seen[network.String()] = true
+			networks = append(networks, network.String())
+		}
+	}
+	if len(networks) == 0 || len(networks) > maxUploadNetworks {
+		return nil, fmt.Errorf("must be 1 to %d addresses or CIDR ranges", maxUploadNetworks)
+	}
+	return networks, nil
+}
+
+// record attributes restricting uploads to networks, through the service
+// with a token since S3 can't check where a presigned upload comes from
+func uploadNetworkAttributes(networks []string) (map[string]*dynamodb.AttributeValue, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return map[string]*dynamodb.AttributeValue{
+		"upload_networks": {SS: aws.StringSlice(networks)},
+		"upload_token":    {S: aws.String(base64.RawURLEncoding.EncodeToString(b))},
+	}, nil
+}
+
+// the networks uploads of an asset are restricted to, if any
+func uploadNetworks(item map[string]*dynamodb.AttributeValue) []string {
+	if value, ok := item["upload_networks"]; ok && value != nil {
+		return aws.StringValueSlice(value.SS)
+	}
+	return nil
+}
+
+// the service url a network restricted asset's object is uploaded to
+func proxiedUploadURL(r *http.Request, assetID string, item map[string]*dynamodb.AttributeValue) string {
+	return serviceURL(r, "/asset/"+assetID+"/content?upload_token="+stringAttribute(item, "upload_token"))
+}
+
+// the url an existing asset's object is uploaded to again, along with the
+// headers it must send, signed for S3 unless restricted to networks
+func reuploadURL(r *http.Request, assetID string, item map[string]*dynamodb.AttributeValue, timeout time.Duration) (string, map[string]string, error) {
+	if len(uploadNetworks(item)) > 0 {
+		return proxiedUploadURL(r, assetID, item), nil, nil
+	}
+	return presignPut(assetID, objectKey(assetID, item), recordedMetadata(item),
+		stringAttribute(item, "cache_control"), stringAttribute(item, "content_type"), timeout)
+}
+
+// the address a request came from
+func clientIP(r *http.Request) net.IP {
+	if trustForwardedFor {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			parts := strings.Split(forwarded, ",")
+			return net.ParseIP(strings.TrimSpace(parts[len(parts)-1]))
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// refuses proxied uploads of an asset restricted to networks without its
+// token, after its upload url expired or from elsewhere, writing an error
+// and returning false if refused
+func checkUploadOrigin(w http.ResponseWriter, r *http.Request, assetID string, item map[string]*dynamodb.AttributeValue) bool {
+	networks := uploadNetworks(item)
+	if len(networks) == 0 {
+		return true
+	}
+	token := r.URL.Query().Get("upload_token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(stringAttribute(item, "upload_token"))) != 1 {
+		http.Error(w, "Upload token is missing or invalid.", http.StatusForbidden)
+		return false
+	}
+	if !checkTokenExpiry(tokenUpload, numberAttribute(item, "upload_expires"), time.Now()) {
+		http.Error(w, fmt.Sprintf("Upload url for asset id '%s' has expired.", assetID), http.StatusForbidden)
+		return false
+	}
+	ip := clientIP(r)
+	for _, value := range networks {
+		if _, network, err := net.ParseCIDR(value); err == nil && ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	http.Error(w, fmt.Sprintf("Uploads of asset id '%s' aren't allowed from %s.", assetID, ip), http.StatusForbidden)
+	return false
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// a pending asset whose uploads are restricted to a corporate network
+type mockDBRestrictedClient struct {
+	mockDBClient
+	uploadExpires time.Time
+}
+
+func (m *mockDBRestrictedClient) GetItem(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: map[string]*dynamodb.AttributeValue{
+		"id":              {S: aws.String("someID")},
+		"upload_networks": {SS: aws.StringSlice([]string{"203.0.113.0/24", "2001:db8::/32"})},
+		"upload_token":    {S: aws.String("secret")},
+		"upload_expires":  {N: aws.String(strconv.FormatInt(m.uploadExpires.Unix(), 10))},
+	}}, nil
+}
+func (m *mockDBRestrictedClient) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return m.GetItem(input)
+}
+
+func TestParseUploadNetworks(t *testing.T) {
+	networks, err := parseUploadNetworks("203.0.113.7/24, 198.51.100.1,203.0.113.0/24,2001:db8::1")
+	if err != nil {
+		t.Fatalf("Got error for valid networks: %s", err)
+	}
+	if strings.Join(networks, ",") != "203.0.113.0/24,198.51.100.1/32,2001:db8::1/128" {
+		t.Errorf("Incorrectly normalized networks: %v", networks)
+	}
+	for _, value := range []string{"", ",", "example.com", "10.0.0.0/33", "10.0.0.1,10.0.0.2,10.0.0.3,10.0.0.4,10.0.0.5,10.0.0.6,10.0.0.7,10.0.0.8,10.0.0.9,10.0.0.10,10.0.0.11"} {
+		if _, err := parseUploadNetworks(value); err == nil {
+			t.Errorf("Got no error for networks %q", value)
+		}
+	}
+}
+
+func TestInitAssetNetworks(t *testing.T) {
+	db := &mockDBPutRecordingClient{}
+	dbSvc, s3Svc = db, &mockS3Client{}
+	r := httptest.NewRequest(http.MethodPost, "/asset?networks=203.0.113.0/24", nil)
+	w := httptest.NewRecorder()
+
+	initAsset(w, r)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Incorrect status on asset init with networks: %d", w.Result().StatusCode)
+	}
+	var response initAssetResponse
+	json.NewDecoder(w.Body).Decode(&response)
+	token := stringAttribute(db.item, "upload_token")
+	expected := "http://example.com/asset/" + response.ID + "/content?upload_token=" + token
+	if token == "" || response.UploadURL != expected || len(response.UploadHeaders) != 0 {
+		t.Errorf("Restricted upload not proxied: %+v, expected %s", response, expected)
+	}
+
+	for _, query := range []string{"?networks=nowhere", "?networks=203.0.113.0/24&upload=post"} {
+		r = httptest.NewRequest(http.MethodPost, "/asset"+query, nil)
+		w = httptest.NewRecorder()
+		initAsset(w, r)
+		if w.Result().StatusCode != http.StatusBadRequest {
+			t.Errorf("Didn't get 400 for init %q: %d", query, w.Result().StatusCode)
+		}
+	}
+}
+
+func TestContentUploadOrigin(t *testing.T) {
+	defer func() { trustForwardedFor = false }()
+	s3Svc = &mockS3Client{}
+	for _, test := range []struct {
+		path, remoteAddr, forwardedFor string
+		trustForwardedFor              bool
+		uploadExpires                  time.Time
+		status                         int
+	}{
+		{"/asset/someID/content?upload_token=secret", "203.0.113.9:5000", "", false, time.Now().Add(time.Hour), http.StatusNoContent},
+		{"/asset/someID/content?upload_token=secret", "[2001:db8::5]:5000", "", false, time.Now().Add(time.Hour), http.StatusNoContent},
+		{"/asset/someID/content?upload_token=secret", "10.0.0.1:5000", "203.0.113.9", true, time.Now().Add(time.Hour), http.StatusNoContent},
+		{"/asset/someID/content?upload_token=secret", "10.0.0.1:5000", "203.0.113.9", false, time.Now().Add(time.Hour), http.StatusForbidden},
+		{"/asset/someID/content?upload_token=secret", "198.51.100.1:5000", "", false, time.Now().Add(time.Hour), http.StatusForbidden},
+		{"/asset/someID/content?upload_token=guess", "203.0.113.9:5000", "", false, time.Now().Add(time.Hour), http.StatusForbidden},
+		{"/asset/someID/content", "203.0.113.9:5000", "", false, time.Now().Add(time.Hour), http.StatusForbidden},
+		{"/asset/someID/content?upload_token=secret", "203.0.113.9:5000", "", false, time.Now().Add(-time.Hour), http.StatusForbidden},
+	} {
+		dbSvc = &mockDBRestrictedClient{uploadExpires: test.uploadExpires}
+		trustForwardedFor = test.trustForwardedFor
+		r := httptest.NewRequest(http.MethodPost, test.path, bytes.NewReader([]byte("Hello world!")))
+		r.RemoteAddr = test.remoteAddr
+		if test.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", test.forwardedFor)
+		}
+		w := httptest.NewRecorder()
+		manageAsset(w, r)
+		if w.Result().StatusCode != test.status {
+			t.Errorf("Incorrect status on proxied upload %+v: %d", test, w.Result().StatusCode)
+		}
+	}
+}
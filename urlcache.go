@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// most download urls kept for reuse at once
+const maxCachedURLs = 10000
+
+// fraction of a download url's lifetime it's handed out again for, zero
+// to sign every url afresh
+var urlCacheFraction float64
+
+type cachedURL struct {
+	url   string
+	until time.Time
+}
+
+var urlCacheMu sync.Mutex
+var urlCache = map[string]cachedURL{}
+
+// identical requests are for the same object, served the same way, for
+// the same length of time
+func urlCacheKey(input *s3.GetObjectInput, timeout time.Duration) string {
+	return strings.Join([]string{
+		aws.StringValue(input.Key),
+		aws.StringValue(input.VersionId),
+		aws.StringValue(input.ResponseCacheControl),
+		aws.StringValue(input.ResponseContentDisposition),
+		aws.StringValue(input.ResponseContentType),
+		timeout.String(),
+	}, "\x00")
+}
+
+// signs a download url, or hands out the one signed for an identical
+// request while it has most of its lifetime left; ?fresh=true always signs
+// a new one
+func cachedPresignDownload(r *http.Request, input *s3.GetObjectInput, timeout time.Duration) (string, error) {
+	if urlCacheFraction <= 0 {
+		return presignDownload(input, timeout)
+	}
+	key := urlCacheKey(input, timeout)
+	now := time.Now()
+	if r.URL.Query().Get("fresh") != "true" {
+		urlCacheMu.Lock()
+		cached, ok := urlCache[key]
+		urlCacheMu.Unlock()
+		if ok && now.Before(cached.until) {
+			return cached.url, nil
+		}
+	}
+
+	url, err := presignDownload(input, timeout)
+	if err != nil {
+		return url, err
+	}
+	until := now.Add(time.Duration(float64(timeout) * urlCacheFraction))
+	urlCacheMu.Lock()
+	defer urlCacheMu.Unlock()
+	if len(urlCache) >= maxCachedURLs {
+		for k, cached := range urlCache {
+			if !now.Before(cached.until) {
+				delete(urlCache, k)
+			}
+		}
+		// still full of live urls, start over rather than grow
+		if len(urlCache) >= maxCachedURLs {
+			urlCache = map[string]cachedURL{}
+		}
+	}
+	urlCache[key] = cachedURL{url: url, until: until}
+	return url, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// counts the urls signed
+type mockS3SigningClient struct {
+	mockS3Client
+	signed int
+}
+
+func (m *mockS3SigningClient) GetObjectRequest(input *s3.GetObjectInput) (*request.Request, *s3.GetObjectOutput) {
+	m.signed++
+	return m.mockS3Client.GetObjectRequest(input)
+}
+
+func TestCachedPresignDownload(t *testing.T) {
+	defer func() { urlCacheFraction = 0 }()
+	urlCacheFraction = 0.25
+	urlCache = map[string]cachedURL{}
+	signer := &mockS3SigningClient{}
+	s3Svc = signer
+	input := &s3.GetObjectInput{Bucket: aws.String(bucketName), Key: aws.String("someID")}
+	sign := func(target string, timeout time.Duration) {
+		if _, err := cachedPresignDownload(httptest.NewRequest(http.MethodGet, target, nil), input, timeout); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sign("/asset/someID", time.Minute)
+	sign("/asset/someID", time.Minute)
+	if signer.signed != 1 {
+		t.Errorf("Identical request signed again: %d", signer.signed)
+	}
+	sign("/asset/someID?timeout=120", 2*time.Minute)
+	if signer.signed != 2 {
+		t.Errorf("Request for a different timeout reused a url: %d", signer.signed)
+	}
+	sign("/asset/someID?fresh=true", time.Minute)
+	if signer.signed != 3 {
+		t.Errorf("Fresh url not signed: %d", signer.signed)
+	}
+
+	// reused only for part of its lifetime
+	urlCache[urlCacheKey(input, time.Minute)] = cachedURL{url: "old", until: time.Now().Add(-time.Second)}
+	sign("/asset/someID", time.Minute)
+	if signer.signed != 4 {
+		t.Errorf("Url reused past its share of its lifetime: %d", signer.signed)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	assetStatusRejected = "rejected"
+	// how long the webhook's read url lasts
+	validationURLTimeout = 15 * time.Minute
+	maxRejectionLength   = 256
+)
+
+// url called to approve each upload before it becomes available, none
+// when empty
+var validationWebhook string
+
+// shared by every outgoing webhook call
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// what the validation webhook is told about an upload
+type validationRequest struct {
+	ID          string            `json:"id"`
+	Metadata    map[string]string `json:"metadata"`
+	ContentType string            `json:"content_type,omitempty"`
+	Filename    string            `json:"filename,omitempty"`
+	DownloadURL string            `json:"download_url"`
+}
+
+// a webhook rejects an upload by responding 4xx, optionally with a reason
+type validationResponse struct {
+	Reason string `json:"reason"`
+}
+
+// asks the validation webhook whether an uploaded asset may become
+// available, returning the reason if it was rejected; errors mean the
+// webhook couldn't decide
+func validateUpload(ctx context.Context, assetID string) (string, error) {
+	if validationWebhook == "" {
+		return "", nil
+	}
+	result, err := dbSvc.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		Key:            assetKey(assetID),
+		TableName:      aws.String(tableName),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return "", err
+	}
+	presign, _ := s3Svc.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(objectKey(assetID, result.Item)),
+	})
+	url, err := presign.Presign(validationURLTimeout)
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(validationRequest{
+		ID:          assetID,
+		Metadata:    recordedMetadata(result.Item),
+		ContentType: stringAttribute(result.Item, "content_type"),
+		Filename:    stringAttribute(result.Item, "filename"),
+		DownloadURL: url,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, validationWebhook, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode / 100 {
+	case 2:
+		recordAssetEvent(nil, assetID, assetEventScanned, map[string]string{"result": "accepted"})
+		return "", nil
+	case 4:
+		var v validationResponse
+		json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&v)
+		if v.Reason == "" {
+			v.Reason = "rejected by validation webhook"
+		}
+		if len(v.Reason) > maxRejectionLength {
+			v.Reason = v.Reason[:maxRejectionLength]
+		}
+		recordAssetEvent(nil, assetID, assetEventScanned, map[string]string{"result": "rejected", "reason": v.Reason})
+		return v.Reason, nil
+	default:
+		return "", fmt.Errorf("validation webhook returned %s", resp.Status)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// points the validation webhook at a server answering with status and body
+func serveValidation(t *testing.T, status int, body string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req validationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID != "foo" {
+			t.Errorf("Webhook got an incomplete request: %+v %v", req, err)
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	validationWebhook = server.URL
+	return server
+}
+
+func TestMarkUploadedValidation(t *testing.T) {
+	defer func() { validationWebhook = "" }()
+	cases := []struct {
+		status   int
+		body     string
+		expected int
+	}{
+		{http.StatusNoContent, "", http.StatusOK},
+		{http.StatusUnprocessableEntity, `{"reason":"too blurry"}`, http.StatusUnprocessableEntity},
+		{http.StatusForbidden, "", http.StatusUnprocessableEntity},
+		{http.StatusInternalServerError, "", http.StatusBadGateway},
+	}
+	for _, c := range cases {
+		server := serveValidation(t, c.status, c.body)
+		dbSvc = &mockDBClient{}
+		s3Svc = &mockS3Client{}
+		r := httptest.NewRequest(http.MethodPut, "/asset/foo", bytes.NewReader([]byte(`{"Status":"uploaded"}`)))
+		w := httptest.NewRecorder()
+
+		manageAsset(w, r)
+		if w.Result().StatusCode != c.expected {
+			t.Errorf("Got %d marking uploaded when the webhook responds %d, expected %d", w.Result().StatusCode, c.status, c.expected)
+		}
+		server.Close()
+	}
+}
+func TestValidateUploadReason(t *testing.T) {
+	defer func() { validationWebhook = "" }()
+	server := serveValidation(t, http.StatusUnprocessableEntity, `{"reason":"too blurry"}`)
+	defer server.Close()
+	dbSvc = &mockDBClient{}
+	s3Svc = &mockS3Client{}
+
+	if reason, err := validateUpload(context.Background(), "foo"); reason != "too blurry" || err != nil {
+		t.Errorf("Incorrect rejection: %q %v", reason, err)
+	}
+}
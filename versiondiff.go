@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// largest version diffed line by line
+	maxDiffSize = 256 << 10
+	// most lines compared between the common head and tail of two versions
+	maxDiffCells = 4 << 20
+	diffContext  = 3
+
+	diffOmittedBinary      = "binary"
+	diffOmittedTooLarge    = "too_large"
+	diffOmittedTooComplex  = "too_many_changes"
+	diffOmittedSameContent = "same_content"
+)
+
+// GET /asset/{id}/versions/{a}/diff/{b}
+var versionDiffAction = assetAction{[]string{http.MethodGet}, handleVersionDiffRequest}
+
+// one side of a version comparison
+type versionSummary struct {
+	Version     string `json:"version"`
+	Size        int64  `json:"size"`
+	ETag        string `json:"etag,omitempty"`
+	MD5         string `json:"md5,omitempty"`
+	SHA256      string `json:"sha256,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+type versionDiff struct {
+	From      versionSummary `json:"from"`
+	To        versionSummary `json:"to"`
+	SizeDelta int64          `json:"size_delta"`
+	// fields of the summaries that differ
+	Changed     []string `json:"changed"`
+	SameContent bool     `json:"same_content"`
+	// a unified diff for text versions, or why there's none
+	Diff        string `json:"diff,omitempty"`
+	DiffOmitted string `json:"diff_omitted,omitempty"`
+}
+
+// splits versions/{a}/diff/{b} into its two version IDs
+func versionDiffPath(subpath string) (from, to string, ok bool) {
+	parts := strings.Split(subpath, "/")
+	if len(parts) != 4 || parts[0] != "versions" || parts[2] != "diff" || parts[1] == "" || parts[3] == "" {
+		return "", "", false
+	}
+	return parts[1], parts[3], true
+}
+
+// compares two uploaded versions of an asset
+func handleVersionDiffRequest(w http.ResponseWriter, r *http.Request, assetID string) {
+	subpath := strings.TrimPrefix(r.URL.Path, "/asset/"+assetID+"/")
+	from, to, _ := versionDiffPath(subpath)
+	item, ok := fetchAsset(w, r, assetID)
+	if !ok {
+		return
+	}
+	if stringAttribute(item, "s3_version_id") == "" {
+		http.Error(w, fmt.Sprintf("Asset id '%s' isn't versioned, enable versioning on the bucket first.", assetID), http.StatusConflict)
+		return
+	}
+	fromRecord, ok := fetchVersion(r.Context(), w, assetID, from, item)
+	if !ok {
+		return
+	}
+	toRecord, ok := fetchVersion(r.Context(), w, assetID, to, item)
+	if !ok {
+		return
+	}
+	fromSummary, err := summarizeVersion(r.Context(), assetID, from, fromRecord)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	toSummary, err := summarizeVersion(r.Context(), assetID, to, toRecord)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	diff := versionDiff{From: fromSummary, To: toSummary, SizeDelta: toSummary.Size - fromSummary.Size, Changed: []string{}}
+	for _, field := range []struct {
+		name     string
+		from, to string
+	}{
+		{"size", fmt.Sprint(fromSummary.Size), fmt.Sprint(toSummary.Size)},
+		{"etag", fromSummary.ETag, toSummary.ETag},
+		{"md5", fromSummary.MD5, toSummary.MD5},
+		{"sha256", fromSummary.SHA256, toSummary.SHA256},
+		{"content_type", fromSummary.ContentType, toSummary.ContentType},
+	} {
+		if field.from != field.to {
+			diff.Changed = append(diff.Changed, field.name)
+		}
+	}
+	// multipart ETags differ for the same bytes, so checksums win when known
+	if fromSummary.SHA256 != "" && toSummary.SHA256 != "" {
+		diff.SameContent = fromSummary.SHA256 == toSummary.SHA256
+	} else {
+		diff.SameContent = fromSummary.Size == toSummary.Size && fromSummary.ETag == toSummary.ETag
+	}
+
+	switch {
+	case diff.SameContent:
+		diff.DiffOmitted = diffOmittedSameContent
+	case !isTextContentType(fromSummary.ContentType) || !isTextContentType(toSummary.ContentType):
+		diff.DiffOmitted = diffOmittedBinary
+	case fromSummary.Size > maxDiffSize || toSummary.Size > maxDiffSize:
+		diff.DiffOmitted = diffOmittedTooLarge
+	default:
+		fromText, err := readVersion(r.Context(), objectKey(assetID, item), from)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		toText, err := readVersion(r.Context(), objectKey(assetID, item), to)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if !utf8.ValidString(fromText) || !utf8.ValidString(toText) {
+			diff.DiffOmitted = diffOmittedBinary
+			break
+		}
+		var ok bool
+		diff.Diff, ok = unifiedDiff(assetID+"@"+from, assetID+"@"+to, fromText, toText)
+		if !ok {
+			diff.DiffOmitted = diffOmittedTooComplex
+		}
+	}
+	writeJSON(w, diff)
+}
+
+// describes a version from its record and its object
+func summarizeVersion(ctx context.Context, assetID, versionID string, record map[string]*dynamodb.AttributeValue) (versionSummary, error) {
+	head, err := s3Svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket:    aws.String(bucketName),
+		Key:       aws.String(objectKey(assetID, record)),
+		VersionId: aws.String(versionID),
+	})
+	if err != nil {
+		return versionSummary{}, err
+	}
+	contentType := stringAttribute(record, "content_type")
+	if contentType == "" {
+		contentType = aws.StringValue(head.ContentType)
+	}
+	return versionSummary{
+		Version:     versionID,
+		Size:        aws.Int64Value(head.ContentLength),
+		ETag:        aws.StringValue(head.ETag),
+		MD5:         stringAttribute(record, "md5"),
+		SHA256:      stringAttribute(record, "sha256"),
+		ContentType: contentType,
+	}, nil
+}
+
+func readVersion(ctx context.Context, key, versionID string) (string, error) {
+	object, err := s3Svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket:    aws.String(bucketName),
+		Key:       aws.String(key),
+		VersionId: aws.String(versionID),
+	})
+	if err != nil {
+		return "", err
+	}
+	defer object.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(object.Body, maxDiffSize))
+	return string(b), err
+}
+
+// text/*, JSON and XML, ignoring parameters such as charset
+func isTextContentType(contentType string) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	return strings.HasPrefix(mediaType, "text/") ||
+		mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") ||
+		mediaType == "application/xml" || strings.HasSuffix(mediaType, "+xml") ||
+		mediaType == "application/javascript" || mediaType == "application/x-yaml"
+}
+
+// a line of an edit script: ' ' kept, '-' removed or '+' added
+type diffLine struct {
+	op   byte
+	text string
+}
+
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// the shortest edit script turning a into b, from the longest common
+// subsequence of the lines between their common head and tail; false when
+// that middle is too big to compare
+func diffLines(a, b []string) ([]diffLine, bool) {
+	head := 0
+	for head < len(a) && head < len(b) && a[head] == b[head] {
+		head++
+	}
+	tail := 0
+	for tail < len(a)-head && tail < len(b)-head && a[len(a)-1-tail] == b[len(b)-1-tail] {
+		tail++
+	}
+	midA, midB := a[head:len(a)-tail], b[head:len(b)-tail]
+	n, m := len(midA), len(midB)
+	if (n+1)*(m+1) > maxDiffCells {
+		return nil, false
+	}
+
+	// lcs[i*(m+1)+j] is the LCS length of midA[i:] and midB[j:]
+	lcs := make([]int32, (n+1)*(m+1))
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if midA[i] == midB[j] {
+				lcs[i*(m+1)+j] = lcs[(i+1)*(m+1)+j+1] + 1
+			} else if lcs[(i+1)*(m+1)+j] >= lcs[i*(m+1)+j+1] {
+				lcs[i*(m+1)+j] = lcs[(i+1)*(m+1)+j]
+			} else {
+				lcs[i*(m+1)+j] = lcs[i*(m+1)+j+1]
+			}
+		}
+	}
+
+	var lines []diffLine
+	for _, line := range a[:head] {
+		lines = append(lines, diffLine{' ', line})
+	}
+	i, j := 0, 0
+	for i < n && j < m {
+		switch {
+		case midA[i] == midB[j]:
+			lines = append(lines, diffLine{' ', midA[i]})
+			i++
+			j++
+		case lcs[(i+1)*(m+1)+j] >= lcs[i*(m+1)+j+1]:
+			lines = append(lines, diffLine{'-', midA[i]})
+			i++
+		default:
+			lines = append(lines, diffLine{'+', midB[j]})
+			j++
+		}
+	}
+	for ; i < n; i++ {
+		lines = append(lines, diffLine{'-', midA[i]})
+	}
+	for ; j < m; j++ {
+		lines = append(lines, diffLine{'+', midB[j]})
+	}
+	for _, line := range a[len(a)-tail:] {
+		lines = append(lines, diffLine{' ', line})
+	}
+	return lines, true
+}
+
+// a unified diff of two texts with 3 lines of context, false when they're
+// too different to compare
+func unifiedDiff(fromName, toName, from, to string) (string, bool) {
+	lines, ok := diffLines(splitLines(from), splitLines(to))
+	if !ok {
+		return "", false
+	}
+	// line numbers in each text where each edit script line falls
+	fromLine, toLine := make([]int, len(lines)+1), make([]int, len(lines)+1)
+	for k, line := range lines {
+		fromLine[k+1], toLine[k+1] = fromLine[k], toLine[k]
+		if line.op != '+' {
+			fromLine[k+1]++
+		}
+		if line.op != '-' {
+			toLine[k+1]++
+		}
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+	for k := 0; k < len(lines); {
+		if lines[k].op == ' ' {
+			k++
+			continue
+		}
+		start := k - diffContext
+		if start < 0 {
+			start = 0
+		}
+		// changes separated by up to twice the context share a hunk
+		end := k
+		for end < len(lines) {
+			if lines[end].op != ' ' {
+				end++
+				continue
+			}
+			run := end
+			for run < len(lines) && lines[run].op == ' ' {
+				run++
+			}
+			if run == len(lines) || run-end > 2*diffContext {
+				end += diffContext
+				if end > len(lines) {
+					end = len(lines)
+				}
+				break
+			}
+			end = run
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(fromLine[start], fromLine[end]), hunkRange(toLine[start], toLine[end]))
+		for _, line := range lines[start:end] {
+			out.WriteByte(line.op)
+			out.WriteString(line.text)
+			if !strings.HasSuffix(line.text, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		k = end
+	}
+	return out.String(), true
+}
+
+// a hunk's first line and count, where an empty hunk names the line before
+func hunkRange(start, end int) string {
+	if end == start {
+		return fmt.Sprintf("%d,0", start)
+	}
+	return fmt.Sprintf("%d,%d", start+1, end-start)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// text versions v1 and v2 of an asset
+type mockS3TextVersionsClient struct {
+	mockS3Client
+}
+
+var textVersions = map[string]string{
+	"v1": "one\ntwo\nthree\n",
+	"v2": "one\n2\nthree\nfour\n",
+}
+
+func (m *mockS3TextVersionsClient) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	text := textVersions[aws.StringValue(input.VersionId)]
+	return &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(text))),
+		ContentType:   aws.String("text/plain"),
+		ETag:          aws.String(`"` + aws.StringValue(input.VersionId) + `"`),
+		VersionId:     input.VersionId,
+	}, nil
+}
+func (m *mockS3TextVersionsClient) HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	return m.HeadObject(input)
+}
+
+func (m *mockS3TextVersionsClient) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(strings.NewReader(textVersions[aws.StringValue(input.VersionId)]))}, nil
+}
+func (m *mockS3TextVersionsClient) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	return m.GetObject(input)
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	diff, ok := unifiedDiff("a", "b", "one\ntwo\nthree\n", "one\n2\nthree\nfour")
+	expected := "--- a\n+++ b\n@@ -1,3 +1,4 @@\n one\n-two\n+2\n three\n+four\n\\ No newline at end of file\n"
+	if !ok || diff != expected {
+		t.Errorf("Incorrect diff:\n%s", diff)
+	}
+
+	// far apart changes get hunks of their own
+	var from, to []string
+	for i := 0; i < 20; i++ {
+		from = append(from, fmt.Sprintf("line %d\n", i))
+		to = append(to, fmt.Sprintf("line %d\n", i))
+	}
+	to[2], to[17] = "changed\n", "changed\n"
+	diff, _ = unifiedDiff("a", "b", strings.Join(from, ""), strings.Join(to, ""))
+	if strings.Count(diff, "@@ -") != 2 || !strings.Contains(diff, "@@ -1,6 +1,6 @@") || !strings.Contains(diff, "@@ -15,6 +15,6 @@") {
+		t.Errorf("Incorrect hunks:\n%s", diff)
+	}
+
+	if diff, _ := unifiedDiff("a", "b", "", "new\n"); !strings.Contains(diff, "@@ -0,0 +1,1 @@\n+new\n") {
+		t.Errorf("Incorrect diff from empty:\n%s", diff)
+	}
+}
+
+func TestVersionDiffRequest(t *testing.T) {
+	dbSvc = &mockDBVersionedClient{}
+	s3Svc = &mockS3TextVersionsClient{}
+	r := httptest.NewRequest(http.MethodGet, "/asset/someID/versions/v1/diff/v2", nil)
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Incorrect status diffing versions: %d", w.Result().StatusCode)
+	}
+	var diff versionDiff
+	if err := json.NewDecoder(w.Body).Decode(&diff); err != nil {
+		t.Fatal(err)
+	}
+	if diff.SizeDelta != 3 || diff.SameContent || strings.Join(diff.Changed, ",") != "size,etag" || !strings.Contains(diff.Diff, "-two\n+2\n") {
+		t.Errorf("Incorrect version diff: %+v", diff)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/asset/someID/versions/v1/diff/v9", nil)
+	w = httptest.NewRecorder()
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusNotFound {
+		t.Errorf("Incorrect status diffing a missing version: %d", w.Result().StatusCode)
+	}
+}
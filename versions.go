@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const versionKeyPrefix = "version:"
+
+// record attributes describing how a version is served, copied onto its
+// version record when it's marked uploaded
+var versionedAttributes = []string{"content_type", "cache_control", "filename", "md5", "sha256", "metadata", "kms_key_id", "encryption_context", "key_prefix"}
+
+// an uploaded version of an asset, newest first in listings
+type assetVersion struct {
+	Version      string     `json:"version"`
+	Size         *int64     `json:"size,omitempty"`
+	LastModified *time.Time `json:"last_modified,omitempty"`
+	Latest       bool       `json:"latest"`
+}
+
+// version records share the assets table, under a prefix no asset id has
+func versionKey(assetID, versionID string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"id": {S: aws.String(versionKeyPrefix + assetID + ":" + versionID)},
+	}
+}
+
+// the S3 version of the newest object at key, empty when the bucket isn't
+// versioned
+func latestVersionID(ctx context.Context, key string) (string, error) {
+	head, err := s3Svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", err
+	}
+	// buckets with versioning suspended report the null version
+	if versionID := aws.StringValue(head.VersionId); versionID != "null" {
+		return versionID, nil
+	}
+	return "", nil
+}
+
+// keeps a copy of how the version an asset record points at is served, so
+// it can still be fetched once newer ones are uploaded
+func recordVersion(assetID string, item map[string]*dynamodb.AttributeValue) error {
+	versionID := stringAttribute(item, "s3_version_id")
+	if versionID == "" {
+		return nil
+	}
+	record := versionKey(assetID, versionID)
+	record["asset_id"] = &dynamodb.AttributeValue{S: aws.String(assetID)}
+	record["s3_version_id"] = item["s3_version_id"]
+	record["uploaded_at"] = item["updated_at"]
+	for _, name := range versionedAttributes {
+		if v, ok := item[name]; ok {
+			record[name] = v
+		}
+	}
+	_, err := dbSvc.PutItem(&dynamodb.PutItemInput{
+		Item:      record,
+		TableName: aws.String(tableName),
+	})
+	return err
+}
+
+// the record to serve for a request, the asset's own unless ?version= asks
+// for an older one, writing an error and returning false if there's no
+// such version
+func requestedVersion(w http.ResponseWriter, r *http.Request, assetID string, item map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, bool) {
+	versionID := r.URL.Query().Get("version")
+	if versionID == "" {
+		return item, true
+	}
+	return fetchVersion(r.Context(), w, assetID, versionID, item)
+}
+
+// the record of one version of an asset, given the asset's own record,
+// writing an error and returning false if there's no such version
+func fetchVersion(ctx context.Context, w http.ResponseWriter, assetID, versionID string, item map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, bool) {
+	if versionID == stringAttribute(item, "s3_version_id") {
+		return item, true
+	}
+	result, err := dbSvc.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		Key:            versionKey(assetID, versionID),
+		TableName:      aws.String(tableName),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		writeError(w, err)
+		return nil, false
+	}
+	if len(result.Item) == 0 {
+		http.Error(w, fmt.Sprintf("Asset id '%s' has no version '%s'.", assetID, versionID), http.StatusNotFound)
+		return nil, false
+	}
+	return result.Item, true
+}
+
+// re-initializes (POST) an uploaded asset for a new version, or lists its
+// versions (GET)
+func handleVersionsRequest(w http.ResponseWriter, r *http.Request, assetID string) {
+	if r.Method == http.MethodGet {
+		listVersions(w, r, assetID)
+		return
+	}
+	timeout, ok := parseDurationParam(w, r, "timeout", maxUploadTimeout, minURLTimeout, maxUploadTimeout)
+	if !ok {
+		return
+	}
+
+	// only versioned assets can be re-uploaded without losing what's there
+	values := lockConditionValues(r)
+	values[":uploaded"] = &dynamodb.AttributeValue{S: aws.String(assetStatusUploaded)}
+	values[":uploadExpires"] = uploadExpiresValue(timeout)
+	values[":updated"] = updatedAtValue()
+	completionToken, tokenAttributes := newCompletionToken(timeout)
+	result, err := dbSvc.UpdateItemWithContext(r.Context(), &dynamodb.UpdateItemInput{
+		Key:                                 assetKey(assetID),
+		TableName:                           aws.String(tableName),
+		UpdateExpression:                    aws.String(setAttributes("SET upload_expires = :uploadExpires, updated_at = :updated", values, tokenAttributes)),
+		ConditionExpression:                 aws.String("attribute_exists(id) AND #status = :uploaded AND attribute_exists(s3_version_id) AND attribute_not_exists(upload_networks) AND " + lockCondition),
+		ExpressionAttributeNames:            map[string]*string{"#status": aws.String("status")},
+		ExpressionAttributeValues:           values,
+		ReturnValues:                        aws.String(dynamodb.ReturnValueAllNew),
+		ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValuesOnConditionCheckFailureAllOld),
+	})
+	if err != nil {
+		if isConditionFailed(err) {
+			item := conditionFailedItem(err)
+			switch {
+			case len(item) == 0 || isDeleted(item):
+				writeError(w, notFound(assetID))
+			case stringAttribute(item, "status") != assetStatusUploaded:
+				writeError(w, notUploaded(assetID))
+			case stringAttribute(item, "s3_version_id") == "":
+				http.Error(w, fmt.Sprintf("Asset id '%s' isn't versioned, enable versioning on the bucket first.", assetID), http.StatusConflict)
+			case len(uploadNetworks(item)) > 0:
+				http.Error(w, fmt.Sprintf("Asset id '%s' only takes uploads from its networks, which can't add versions.", assetID), http.StatusConflict)
+			default:
+				http.Error(w, fmt.Sprintf("Asset id '%s' is locked.", assetID), http.StatusLocked)
+			}
+			return
+		}
+		writeError(w, err)
+		return
+	}
+
+	// the new version is described like the current one
+	item := result.Attributes
+	response := initAssetResponse{ID: assetID, CompletionToken: completionToken}
+	response.UploadURL, response.UploadHeaders, err = presignPut(assetID, objectKey(assetID, item), recordedMetadata(item),
+		stringAttribute(item, "cache_control"), stringAttribute(item, "content_type"), timeout)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	recordAssetEvent(r, assetID, assetEventURLIssued, map[string]string{"url": "upload", "version": "new"})
+	writeJSON(w, response)
+}
+
+// lists the versions of an asset that were marked uploaded, newest first
+func listVersions(w http.ResponseWriter, r *http.Request, assetID string) {
+	item, ok := fetchAsset(w, r, assetID)
+	if !ok {
+		return
+	}
+	known := map[string]bool{}
+	if v, ok := item["versions"]; ok {
+		for _, versionID := range v.SS {
+			known[aws.StringValue(versionID)] = true
+		}
+	}
+	latest := stringAttribute(item, "s3_version_id")
+	key := objectKey(assetID, item)
+	versions := []assetVersion{}
+	err := s3Svc.ListObjectVersionsPagesWithContext(r.Context(), &s3.ListObjectVersionsInput{
+		Bucket: aws.String(bucketName),
+		Prefix: aws.String(key),
+	}, func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
+		for _, v := range page.Versions {
+			versionID := aws.StringValue(v.VersionId)
+			if aws.StringValue(v.Key) != key || !known[versionID] {
+				continue
+			}
+			versions = append(versions, assetVersion{
+				Version:      versionID,
+				Size:         v.Size,
+				LastModified: v.LastModified,
+				Latest:       versionID == latest,
+			})
+		}
+		return true
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		return aws.TimeValue(versions[i].LastModified).After(aws.TimeValue(versions[j].LastModified))
+	})
+	writeJSON(w, versions)
+}
+
+// removes the version records of an asset being deleted
+func deleteVersionRecords(ctx context.Context, assetID string, item map[string]*dynamodb.AttributeValue) error {
+	v, ok := item["versions"]
+	if !ok {
+		return nil
+	}
+	for _, versionID := range v.SS {
+		_, err := dbSvc.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+			Key:       versionKey(assetID, aws.StringValue(versionID)),
+			TableName: aws.String(tableName),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
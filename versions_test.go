@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// a versioned bucket whose newest object is v2, remembering what's fetched
+type mockS3VersionedClient struct {
+	mockS3Client
+	got *s3.GetObjectInput
+}
+
+func (m *mockS3VersionedClient) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	output, _ := m.mockS3Client.HeadObject(input)
+	output.VersionId = aws.String("v2")
+	return output, nil
+}
+func (m *mockS3VersionedClient) HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	return m.HeadObject(input)
+}
+
+func (m *mockS3VersionedClient) GetObjectRequest(input *s3.GetObjectInput) (*request.Request, *s3.GetObjectOutput) {
+	m.got = input
+	return m.mockS3Client.GetObjectRequest(input)
+}
+
+func (m *mockS3VersionedClient) ListObjectVersionsPages(input *s3.ListObjectVersionsInput, fn func(*s3.ListObjectVersionsOutput, bool) bool) error {
+	fn(&s3.ListObjectVersionsOutput{Versions: []*s3.ObjectVersion{
+		{Key: aws.String("someID"), VersionId: aws.String("v3"), Size: aws.Int64(3), LastModified: aws.Time(time.Unix(1500000300, 0))},
+		{Key: aws.String("someID"), VersionId: aws.String("v2"), Size: aws.Int64(2), LastModified: aws.Time(time.Unix(1500000200, 0))},
+		{Key: aws.String("someID"), VersionId: aws.String("v1"), Size: aws.Int64(1), LastModified: aws.Time(time.Unix(1500000100, 0))},
+	}}, true)
+	return nil
+}
+func (m *mockS3VersionedClient) ListObjectVersionsPagesWithContext(ctx aws.Context, input *s3.ListObjectVersionsInput, fn func(*s3.ListObjectVersionsOutput, bool) bool, opts ...request.Option) error {
+	return m.ListObjectVersionsPages(input, fn)
+}
+
+// an asset at version v2 of a versioned bucket, with a record of v1
+type mockDBVersionedClient struct {
+	mockDBClient
+	update string
+	put    map[string]*dynamodb.AttributeValue
+}
+
+func (m *mockDBVersionedClient) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	switch *input.Key["id"].S {
+	case "someID":
+		output, _ := m.mockDBClient.GetItem(input)
+		output.Item["s3_version_id"] = &dynamodb.AttributeValue{S: aws.String("v2")}
+		output.Item["versions"] = &dynamodb.AttributeValue{SS: aws.StringSlice([]string{"v1", "v2"})}
+		return output, nil
+	case versionKeyPrefix + "someID:v1":
+		return &dynamodb.GetItemOutput{Item: map[string]*dynamodb.AttributeValue{
+			"id":            input.Key["id"],
+			"s3_version_id": {S: aws.String("v1")},
+			"filename":      {S: aws.String("old.txt")},
+		}}, nil
+	}
+	return &dynamodb.GetItemOutput{}, nil
+}
+func (m *mockDBVersionedClient) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return m.GetItem(input)
+}
+
+func (m *mockDBVersionedClient) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	m.update = *input.UpdateExpression
+	return &dynamodb.UpdateItemOutput{Attributes: map[string]*dynamodb.AttributeValue{
+		"id":            {S: aws.String("someID")},
+		"status":        {S: aws.String(assetStatusUploaded)},
+		"s3_version_id": input.ExpressionAttributeValues[":versionID"],
+		"content_type":  {S: aws.String("text/plain")},
+	}}, nil
+}
+func (m *mockDBVersionedClient) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	return m.UpdateItem(input)
+}
+
+func (m *mockDBVersionedClient) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	m.put = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+func (m *mockDBVersionedClient) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	return m.PutItem(input)
+}
+
+func TestMarkUploadedVersion(t *testing.T) {
+	db := &mockDBVersionedClient{}
+	dbSvc = db
+	s3Svc = &mockS3VersionedClient{}
+	r := httptest.NewRequest(http.MethodPut, "/asset/someID", strings.NewReader(`{"Status": "uploaded"}`))
+	w := httptest.NewRecorder()
+
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Incorrect status marking uploaded: %d", w.Result().StatusCode)
+	}
+	if !strings.Contains(db.update, "s3_version_id = :versionID ADD versions :versions") {
+		t.Errorf("Version not recorded on the asset: %s", db.update)
+	}
+	if aws.StringValue(db.put["id"].S) != versionKeyPrefix+"someID:v2" || aws.StringValue(db.put["content_type"].S) != "text/plain" {
+		t.Errorf("Incorrect version record: %v", db.put)
+	}
+}
+func TestAssetURLRequestVersion(t *testing.T) {
+	dbSvc = &mockDBVersionedClient{}
+	s3 := &mockS3VersionedClient{}
+	s3Svc = s3
+	for version, expected := range map[string]string{"": "v2", "v1": "v1"} {
+		r := httptest.NewRequest(http.MethodGet, "/asset/someID?version="+version, nil)
+		w := httptest.NewRecorder()
+		manageAsset(w, r)
+		response := assetURLResponse{}
+		json.NewDecoder(w.Result().Body).Decode(&response)
+		if w.Result().StatusCode != http.StatusOK || response.Version != expected || aws.StringValue(s3.got.VersionId) != expected {
+			t.Errorf("Didn't get version %s: %d %+v", expected, w.Result().StatusCode, response)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/asset/someID?version=v0", nil)
+	w := httptest.NewRecorder()
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusNotFound {
+		t.Errorf("Didn't get 404 for a missing version: %d", w.Result().StatusCode)
+	}
+}
+func TestReinitVersion(t *testing.T) {
+	dbSvc = &mockDBVersionedClient{}
+	s3Svc = &mockS3VersionedClient{}
+	r := httptest.NewRequest(http.MethodPost, "/asset/someID/versions", nil)
+	w := httptest.NewRecorder()
+	manageAsset(w, r)
+	response := initAssetResponse{}
+	json.NewDecoder(w.Result().Body).Decode(&response)
+	if w.Result().StatusCode != http.StatusOK || response.ID != "someID" {
+		t.Errorf("Incorrect response re-initializing: %d %+v", w.Result().StatusCode, response)
+	}
+
+	dbSvc = &mockDBDeleteConflictClient{item: map[string]*dynamodb.AttributeValue{
+		"id":     {S: aws.String("someID")},
+		"status": {S: aws.String(assetStatusUploaded)},
+	}}
+	r = httptest.NewRequest(http.MethodPost, "/asset/someID/versions", nil)
+	w = httptest.NewRecorder()
+	manageAsset(w, r)
+	if w.Result().StatusCode != http.StatusConflict {
+		t.Errorf("Didn't get 409 re-initializing an unversioned asset: %d", w.Result().StatusCode)
+	}
+}
+func TestListVersions(t *testing.T) {
+	dbSvc = &mockDBVersionedClient{}
+	s3Svc = &mockS3VersionedClient{}
+	r := httptest.NewRequest(http.MethodGet, "/asset/someID/versions", nil)
+	w := httptest.NewRecorder()
+	manageAsset(w, r)
+
+	var versions []assetVersion
+	json.NewDecoder(w.Result().Body).Decode(&versions)
+	// v3 was uploaded but never marked
+	if len(versions) != 2 || versions[0].Version != "v2" || !versions[0].Latest || versions[1].Version != "v1" || versions[1].Latest {
+		t.Errorf("Incorrect versions listed: %+v", versions)
+	}
+}
+
+// counts the objects described
+type mockS3CountingHeadsClient struct {
+	mockS3VersionedClient
+	heads []string
+}
+
+func (m *mockS3CountingHeadsClient) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	m.heads = append(m.heads, aws.StringValue(input.VersionId))
+	return m.mockS3VersionedClient.HeadObject(input)
+}
+func (m *mockS3CountingHeadsClient) HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	return m.HeadObject(input)
+}
+
+func TestAssetURLRequestHeadsLatestOnce(t *testing.T) {
+	dbSvc = &mockDBVersionedClient{}
+	for target, heads := range map[string]int{
+		"/asset/someID":            1,
+		"/asset/someID?version=v1": 2,
+	} {
+		counting := &mockS3CountingHeadsClient{}
+		s3Svc = counting
+		w := httptest.NewRecorder()
+		manageAsset(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Result().StatusCode != http.StatusOK {
+			t.Fatalf("Incorrect status for %s: %d", target, w.Result().StatusCode)
+		}
+		if len(counting.heads) != heads {
+			t.Errorf("Described %d objects for %s instead of %d: %v", len(counting.heads), target, heads, counting.heads)
+		}
+	}
+}
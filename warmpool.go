@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// number of uploads kept ready for plain init requests, zero disables
+var warmPoolSize int
+
+var warmPool chan warmUpload
+
+// an asset reserved and signed ahead of the init request it will answer
+type warmUpload struct {
+	response initAssetResponse
+	prepared time.Time
+}
+
+// keeps size uploads ready in the background
+func startWarmPool(size int) {
+	warmPool = make(chan warmUpload, size)
+	addLoop("warm pool", fillWarmPool)
+}
+
+// tops up the warm pool as uploads are taken, until stopped
+func fillWarmPool(stop <-chan struct{}) {
+	for {
+		upload, err := prepareWarmUpload()
+		if err != nil {
+			log.Println(err.Error())
+			if !pause(stop, time.Second) {
+				return
+			}
+			continue
+		}
+		select {
+		case warmPool <- upload:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// reserves and signs an upload the way a plain init would
+func prepareWarmUpload() (warmUpload, error) {
+	attributes := reservationAttributes(maxUploadTimeout)
+	if defaultCacheControl != "" {
+		attributes["cache_control"] = &dynamodb.AttributeValue{S: aws.String(defaultCacheControl)}
+	}
+	completionToken, tokenAttributes := newCompletionToken(maxUploadTimeout)
+	for k, v := range tokenAttributes {
+		attributes[k] = v
+	}
+	prepared := time.Now()
+	assetID, err := reserveUniqueID(context.Background(), attributes)
+	if err != nil {
+		return warmUpload{}, err
+	}
+	response := initAssetResponse{ID: assetID, CompletionToken: completionToken}
+	response.UploadURL, response.UploadHeaders, err = presignPut(assetID, assetID, nil, defaultCacheControl, "", maxUploadTimeout)
+	return warmUpload{response: response, prepared: prepared}, err
+}
+
+// takes a ready upload for an init request without options, skipping any
+// that have used up half their url's lifetime waiting; requests with a
+// bearer token own what they init, so they can't take one
+func takeWarmUpload(r *http.Request, metadata map[string]string) (initAssetResponse, bool) {
+	if warmPool == nil || r.URL.RawQuery != "" || len(metadata) > 0 || requestSubject(r) != "" {
+		return initAssetResponse{}, false
+	}
+	for {
+		select {
+		case upload := <-warmPool:
+			if time.Since(upload.prepared) < maxUploadTimeout/2 {
+				return upload.response, true
+			}
+		default:
+			return initAssetResponse{}, false
+		}
+	}
+}
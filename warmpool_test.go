@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWarmPool(t *testing.T) {
+	defer func() { warmPool = nil }()
+	dbSvc = &mockDBClient{}
+	s3Svc = &mockS3Client{}
+	warmPool = make(chan warmUpload, 2)
+	warmPool <- warmUpload{response: initAssetResponse{ID: "staleID"}, prepared: time.Now().Add(-maxUploadTimeout)}
+	warmPool <- warmUpload{response: initAssetResponse{ID: "warmID"}, prepared: time.Now()}
+
+	// options need a freshly signed upload
+	r := httptest.NewRequest(http.MethodPost, "/asset?content_type=image/png", nil)
+	w := httptest.NewRecorder()
+	initAsset(w, r)
+	var resp initAssetResponse
+	json.NewDecoder(w.Result().Body).Decode(&resp)
+	if resp.ID == "warmID" || len(warmPool) != 2 {
+		t.Error("Init with options was served from the warm pool")
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/asset", nil)
+	w = httptest.NewRecorder()
+	initAsset(w, r)
+	json.NewDecoder(w.Result().Body).Decode(&resp)
+	if resp.ID != "warmID" {
+		t.Errorf("Plain init wasn't served the fresh warm upload: %s", resp.ID)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/asset", nil)
+	w = httptest.NewRecorder()
+	initAsset(w, r)
+	json.NewDecoder(w.Result().Body).Decode(&resp)
+	if w.Result().StatusCode != http.StatusOK || resp.ID == "" || resp.ID == "warmID" {
+		t.Errorf("Init with an empty pool didn't reserve a new ID: %d %s", w.Result().StatusCode, resp.ID)
+	}
+}